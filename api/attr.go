@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	// ErrNoAttr ... Nothing has been stored for the key, the mount defaults are used
+	ErrNoAttr = errors.New("No attributes stored")
+	// ErrNoXattr ... The extended attribute doesn't exist
+	ErrNoXattr = errors.New("No such extended attribute")
+)
+
+// Attributes ... Permission bits and owner of a key
+type Attributes struct {
+	Mode os.FileMode `json:"mode"`
+	Uid  uint32      `json:"uid"`
+	Gid  uint32      `json:"gid"`
+}
+
+// AttrStore ... Optional capability for devices that can store permissions per key.
+// GetAttr returns ErrNoAttr for keys that have never been set.
+type AttrStore interface {
+	GetAttr(path string) (Attributes, error)
+	SetAttr(path string, attr Attributes) error
+}
+
+// XattrStore ... Optional capability for devices that can store extended attributes per key.
+// GetXattr and RemoveXattr return ErrNoXattr when the name doesn't exist.
+type XattrStore interface {
+	GetXattr(path, name string) ([]byte, error)
+	SetXattr(path, name string, value []byte) error
+	ListXattr(path string) ([]string, error)
+	RemoveXattr(path, name string) error
+}
+
+// AsAttrStore ... Walk a middleware chain to find out if the device really stores attributes
+func AsAttrStore(d SimpleDevice) (AttrStore, bool) {
+	as, ok := d.(AttrStore)
+	if !ok {
+		return nil, false
+	}
+	if u, ok := d.(Unwrapper); ok {
+		if _, inner := AsAttrStore(u.Unwrap()); !inner {
+			return nil, false
+		}
+	}
+	return as, true
+}
+
+// AsXattrStore ... Walk a middleware chain to find out if the device really stores extended attributes
+func AsXattrStore(d SimpleDevice) (XattrStore, bool) {
+	xs, ok := d.(XattrStore)
+	if !ok {
+		return nil, false
+	}
+	if u, ok := d.(Unwrapper); ok {
+		if _, inner := AsXattrStore(u.Unwrap()); !inner {
+			return nil, false
+		}
+	}
+	return xs, true
+}
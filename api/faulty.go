@@ -0,0 +1,497 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// WrapperFaulty ... Name of the fault injection middleware
+	WrapperFaulty = "faulty"
+	// DeviceFaulty ... Name of the device type that mounts another type with the fault injection middleware
+	DeviceFaulty = "FAULTY"
+
+	// FaultOpen ... Opening a file or stream
+	FaultOpen = "open"
+	// FaultRead ... Reading a file or stream
+	FaultRead = "read"
+	// FaultWrite ... Writing a file or stream
+	FaultWrite = "write"
+	// FaultList ... Listing a path
+	FaultList = "list"
+	// FaultRemove ... Removing a path
+	FaultRemove = "remove"
+	// FaultCreate ... Creating a file, only native file systems create files on their own
+	FaultCreate = "create"
+	// FaultMkdir ... Making a directory on a native file system
+	FaultMkdir = "mkdir"
+	// FaultRename ... Renaming a path on a native file system
+	FaultRename = "rename"
+	// FaultSetattr ... Changing the size or mode of a path on a native file system
+	FaultSetattr = "setattr"
+)
+
+// faultErrors ... Errors a rule can inject, buse hands them to the kernel as is
+var faultErrors = map[string]syscall.Errno{
+	"EIO":       syscall.EIO,
+	"ENOENT":    syscall.ENOENT,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+}
+
+// faultyProperties ... Config shared by the wrapper and the device
+const faultyProperties = `"name": {"type": "string", "minLength": 1, "description": "Name used to toggle the faults over http at /faults/{name}"},
+	"enabled": {"type": "boolean", "description": "Start with the faults turned on, defaults to true"},
+	"seed": {"type": "integer", "description": "Seed for the percentage rolls so runs can be repeated"},
+	"rules": {
+		"type": "array",
+		"items": {
+			"type": "object",
+			"additionalProperties": false,
+			"properties": {
+				"path": {"type": "string", "description": "Only paths with this prefix, every path when empty"},
+				"ops": {"type": "array", "items": {"type": "string", "enum": ["open", "read", "write", "list", "remove", "create", "mkdir", "rename", "setattr"]}, "description": "Only these operations, every operation when empty. Native file systems are the only ones that create, mkdir, rename and setattr"},
+				"percent": {"type": "number", "minimum": 0, "maximum": 100, "description": "Chance the rule fires, every call when missing"},
+				"error": {"type": "string", "enum": ["EIO", "ENOENT", "ETIMEDOUT"], "description": "Error returned instead of calling the device"},
+				"latency_ms": {"type": "integer", "minimum": 0, "description": "Delay added before the call"},
+				"partial": {"type": "boolean", "description": "Reads only return the first half of the data"},
+				"drop": {"type": "boolean", "description": "Writes report success without reaching the device"},
+				"hang": {"type": "boolean", "description": "Block until the faults are changed, disabled or the device is unmounted"}
+			}
+		}
+	}`
+
+func init() {
+	RegisterWrapperType(Registered{
+		FSType:      WrapperFaulty,
+		Description: "Injects errors, latency, partial reads, dropped writes and hangs for chaos testing",
+		Schema:      []byte(`{"type": "object", "additionalProperties": false, "properties": {` + faultyProperties + `}}`),
+	}, NewFaulty)
+	RegisterSimpleDeviceType(Registered{
+		FSType:      DeviceFaulty,
+		Description: "Mounts another registered simple device with faults injected into it for chaos testing",
+		Schema: []byte(`{"type": "object", "additionalProperties": false, "required": ["type"], "properties": {
+	"type": {"type": "string", "minLength": 1, "description": "Registered simple device type the faults are injected into"},
+	"config": {"description": "Config of the inner device"},
+	` + faultyProperties + `}}`),
+	}, newFaultyDevice)
+	RegisterNativeWrapper(WrapperFaulty, func(config []byte) (NativeMiddleware, error) {
+		d, err := NewFaulty(nil, config)
+		if err != nil {
+			return nil, err
+		}
+		return d.(*Faulty), nil
+	})
+}
+
+// FaultRule ... When and how to break a call. The first rule that matches and fires wins
+type FaultRule struct {
+	Path      string   `json:"path,omitempty"`
+	Ops       []string `json:"ops,omitempty"`
+	Percent   *float64 `json:"percent,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	LatencyMS int      `json:"latency_ms,omitempty"`
+	Partial   bool     `json:"partial,omitempty"`
+	Drop      bool     `json:"drop,omitempty"`
+	Hang      bool     `json:"hang,omitempty"`
+}
+
+// matches ... Path and operation filters, the percentage is rolled separately
+func (fr *FaultRule) matches(op, path string) bool {
+	if !strings.HasPrefix(path, fr.Path) {
+		return false
+	}
+	if len(fr.Ops) == 0 {
+		return true
+	}
+	for _, o := range fr.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultState ... What a faulty device is currently doing
+type FaultState struct {
+	Name    string      `json:"name"`
+	Enabled bool        `json:"enabled"`
+	Rules   []FaultRule `json:"rules"`
+}
+
+type faultConfig struct {
+	Name    string      `json:"name"`
+	Enabled *bool       `json:"enabled"`
+	Seed    int64       `json:"seed"`
+	Rules   []FaultRule `json:"rules"`
+}
+
+// validateRules ... Catch unknown errors when rules come from somewhere other than the schema
+func validateRules(rules []FaultRule) error {
+	for _, r := range rules {
+		if _, known := faultErrors[r.Error]; r.Error != "" && !known {
+			return fmt.Errorf("Unknown fault error %s", r.Error)
+		}
+	}
+	return nil
+}
+
+var (
+	faulties      = make(map[string]*Faulty)
+	faultiesCount int
+	faultiesMutex sync.RWMutex
+)
+
+// LookupFaulty ... Find a mounted faulty device by name
+func LookupFaulty(name string) (*Faulty, bool) {
+	faultiesMutex.RLock()
+	defer faultiesMutex.RUnlock()
+	f, exists := faulties[name]
+	return f, exists
+}
+
+// FaultyDevices ... State of every mounted faulty device sorted by name
+func FaultyDevices() []FaultState {
+	faultiesMutex.RLock()
+	states := make([]FaultState, 0, len(faulties))
+	for _, f := range faulties {
+		states = append(states, f.State())
+	}
+	faultiesMutex.RUnlock()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// Faulty ... Middleware that breaks calls to the inner device according to rules
+type Faulty struct {
+	Wrapper
+	Name    string
+	mutex   sync.Mutex
+	enabled bool
+	rules   []FaultRule
+	rand    *rand.Rand
+	// release ... Closed to wake up hung calls whenever the faults change
+	release chan struct{}
+}
+
+// NewFaulty ... Wrap a device so it fails the way the rules say. Devices without a name
+// in the config are called faulty-1, faulty-2 and so on
+func NewFaulty(inner SimpleDevice, config []byte) (SimpleDevice, error) {
+	conf := &faultConfig{}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, conf); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateRules(conf.Rules); err != nil {
+		return nil, err
+	}
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	f := &Faulty{
+		Wrapper: Wrapper{Inner: inner},
+		Name:    conf.Name,
+		enabled: conf.Enabled == nil || *conf.Enabled,
+		rules:   conf.Rules,
+		rand:    rand.New(rand.NewSource(seed)),
+		release: make(chan struct{}),
+	}
+	faultiesMutex.Lock()
+	defer faultiesMutex.Unlock()
+	faultiesCount++
+	if f.Name == "" {
+		f.Name = fmt.Sprintf("%s-%d", WrapperFaulty, faultiesCount)
+	}
+	if _, exists := faulties[f.Name]; exists {
+		return nil, fmt.Errorf("Faulty device %s is already mounted", f.Name)
+	}
+	faulties[f.Name] = f
+	return f, nil
+}
+
+// faultyDevice ... Faulty middleware registered as a device so it can be mounted on its own
+type faultyDevice struct {
+	*Faulty
+}
+
+// newFaultyDevice ... Mount the inner device then wrap it, the rest of the config is the faulty config
+func newFaultyDevice(mountPoint string, config []byte) (SimpleDevice, error) {
+	conf := struct {
+		Type   string          `json:"type"`
+		Config json.RawMessage `json:"config"`
+	}{}
+	if err := json.Unmarshal(config, &conf); err != nil {
+		return nil, err
+	}
+	if conf.Type == DeviceFaulty {
+		return nil, fmt.Errorf("Faulty device can't wrap another %s", DeviceFaulty)
+	}
+	inner, err := MountSimpleDevice(conf.Type, mountPoint, conf.Config)
+	if err != nil {
+		return nil, err
+	}
+	f, err := NewFaulty(inner, config)
+	if err != nil {
+		inner.Unmount()
+		return nil, err
+	}
+	return &faultyDevice{f.(*Faulty)}, nil
+}
+
+// Mount ... Noop since the inner device is mounted when the faulty device is built
+func (fd *faultyDevice) Mount(config []byte) error {
+	return nil
+}
+
+// State ... Current switch and rules
+func (f *Faulty) State() FaultState {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return FaultState{Name: f.Name, Enabled: f.enabled, Rules: append([]FaultRule{}, f.rules...)}
+}
+
+// SetEnabled ... Turn the faults on or off, hung calls carry on either way
+func (f *Faulty) SetEnabled(enabled bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.enabled = enabled
+	f.wake()
+}
+
+// SetRules ... Replace the rules, hung calls carry on
+func (f *Faulty) SetRules(rules []FaultRule) error {
+	if err := validateRules(rules); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rules = rules
+	f.wake()
+	return nil
+}
+
+// wake ... Release hung calls, must hold the mutex
+func (f *Faulty) wake() {
+	close(f.release)
+	f.release = make(chan struct{})
+}
+
+// inject ... Pick the rule that fires for a call and apply its latency, hang and error.
+// The rule is returned so reads and writes can apply partial and drop
+func (f *Faulty) inject(op, path string) (*FaultRule, error) {
+	f.mutex.Lock()
+	if !f.enabled {
+		f.mutex.Unlock()
+		return nil, nil
+	}
+	var rule *FaultRule
+	for i := range f.rules {
+		r := f.rules[i]
+		if !r.matches(op, path) {
+			continue
+		}
+		if r.Percent != nil && f.rand.Float64()*100 >= *r.Percent {
+			continue
+		}
+		rule = &r
+		break
+	}
+	release := f.release
+	f.mutex.Unlock()
+	if rule == nil {
+		return nil, nil
+	}
+	if rule.LatencyMS > 0 {
+		time.Sleep(time.Duration(rule.LatencyMS) * time.Millisecond)
+	}
+	if rule.Hang {
+		<-release
+	}
+	if rule.Error != "" {
+		return rule, faultErrors[rule.Error]
+	}
+	return rule, nil
+}
+
+// Unmount ... Releases hung calls and stops the device from being toggled
+func (f *Faulty) Unmount() error {
+	f.Close()
+	return f.Inner.Unmount()
+}
+
+// Close ... Releases hung calls and stops the faults from being toggled, called for native file
+// systems once they are unmounted
+func (f *Faulty) Close() error {
+	faultiesMutex.Lock()
+	if faulties[f.Name] == f {
+		delete(faulties, f.Name)
+	}
+	faultiesMutex.Unlock()
+	f.mutex.Lock()
+	f.enabled = false
+	f.wake()
+	f.mutex.Unlock()
+	return nil
+}
+
+// Intercept ... Injects faults into requests to a native file system. Partial reads return half of
+// what the file system read and dropped writes never reach it
+func (f *Faulty) Intercept(op *NativeOp, next func() error) error {
+	rule, err := f.inject(op.Op, op.Path)
+	if err != nil {
+		return err
+	}
+	if rule != nil && rule.Drop && op.Op == NativeWrite {
+		return nil
+	}
+	if err := next(); err != nil {
+		return err
+	}
+	if rule != nil && rule.Partial && op.Op == NativeRead {
+		op.Data = op.Data[:len(op.Data)/2]
+		op.Size = len(op.Data)
+	}
+	return nil
+}
+
+// List ... Injects faults then forwards
+func (f *Faulty) List(path string) ([]string, error) {
+	if _, err := f.inject(FaultList, path); err != nil {
+		return nil, err
+	}
+	return f.Inner.List(path)
+}
+
+// Remove ... Injects faults then forwards
+func (f *Faulty) Remove(path string) error {
+	if _, err := f.inject(FaultRemove, path); err != nil {
+		return err
+	}
+	return f.Inner.Remove(path)
+}
+
+// Open ... Injects faults then forwards, reads and writes of the file get faults as well
+func (f *Faulty) Open(path string) (SimpleFile, error) {
+	if _, err := f.inject(FaultOpen, path); err != nil {
+		return nil, err
+	}
+	sf, err := f.Inner.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{SimpleFile: sf, faulty: f, path: path}, nil
+}
+
+// OpenStream ... Injects faults then forwards, stream reads and writes get faults as well
+func (f *Faulty) OpenStream(path string) (StreamFile, error) {
+	if _, err := f.inject(FaultOpen, path); err != nil {
+		return nil, err
+	}
+	sf, err := f.Wrapper.OpenStream(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyStream{StreamFile: sf, faulty: f, path: path}, nil
+}
+
+type faultyFile struct {
+	SimpleFile
+	faulty *Faulty
+	path   string
+}
+
+func (ff *faultyFile) Read() ([]byte, error) {
+	rule, err := ff.faulty.inject(FaultRead, ff.path)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ff.SimpleFile.Read()
+	if err == nil && rule != nil && rule.Partial {
+		body = body[:len(body)/2]
+	}
+	return body, err
+}
+
+func (ff *faultyFile) Write(body []byte) error {
+	rule, err := ff.faulty.inject(FaultWrite, ff.path)
+	if err != nil {
+		return err
+	}
+	if rule != nil && rule.Drop {
+		return nil
+	}
+	return ff.SimpleFile.Write(body)
+}
+
+type faultyStream struct {
+	StreamFile
+	faulty *Faulty
+	path   string
+}
+
+func (fst *faultyStream) Reader() (io.ReadCloser, error) {
+	r, err := fst.StreamFile.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return &faultyReader{ReadCloser: r, faulty: fst.faulty, path: fst.path}, nil
+}
+
+func (fst *faultyStream) Writer() (io.WriteCloser, error) {
+	w, err := fst.StreamFile.Writer()
+	if err != nil {
+		return nil, err
+	}
+	return &faultyWriter{WriteCloser: w, faulty: fst.faulty, path: fst.path}, nil
+}
+
+// faultyReader ... A partial read cuts the stream short after half of a chunk
+type faultyReader struct {
+	io.ReadCloser
+	faulty    *Faulty
+	path      string
+	truncated bool
+}
+
+func (fr *faultyReader) Read(p []byte) (int, error) {
+	if fr.truncated {
+		return 0, io.EOF
+	}
+	rule, err := fr.faulty.inject(FaultRead, fr.path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fr.ReadCloser.Read(p)
+	if rule != nil && rule.Partial {
+		fr.truncated = true
+		return n / 2, io.EOF
+	}
+	return n, err
+}
+
+type faultyWriter struct {
+	io.WriteCloser
+	faulty *Faulty
+	path   string
+}
+
+func (fw *faultyWriter) Write(p []byte) (int, error) {
+	rule, err := fw.faulty.inject(FaultWrite, fw.path)
+	if err != nil {
+		return 0, err
+	}
+	if rule != nil && rule.Drop {
+		return len(p), nil
+	}
+	return fw.WriteCloser.Write(p)
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newFaultyTest(t *testing.T, config string) (SimpleDevice, *Faulty) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	wrapped, err := Wrap(d, []WrapperConfig{{Type: WrapperFaulty, Config: []byte(config)}})
+	if err != nil {
+		t.Fatalf("Failed to wrap device %s", err)
+	}
+	return d, wrapped.(*Faulty)
+}
+
+func TestFaultyErrors(t *testing.T) {
+	_, f := newFaultyTest(t, `{"name": "test_errors", "rules": [
+		{"path": "/mnt/test/missing", "error": "ENOENT"},
+		{"path": "/mnt/test/slow", "ops": ["write"], "error": "ETIMEDOUT"},
+		{"ops": ["remove"], "error": "EIO"}
+	]}`)
+	defer f.Unmount()
+	if _, err := f.Open("/mnt/test/missing"); err != syscall.ENOENT {
+		t.Errorf("Expected ENOENT opening missing however got %v", err)
+	}
+	sf, err := f.Open("/mnt/test/slow")
+	if err != nil {
+		t.Fatalf("Expected open to work however got %s", err)
+	}
+	if err := sf.Write([]byte("data")); err != syscall.ETIMEDOUT {
+		t.Errorf("Expected ETIMEDOUT writing however got %v", err)
+	}
+	if _, err := sf.Read(); err != nil {
+		t.Errorf("Expected reads to be left alone however got %s", err)
+	}
+	if err := f.Remove("/mnt/test/slow"); err != syscall.EIO {
+		t.Errorf("Expected EIO removing however got %v", err)
+	}
+	if _, err := f.List("/mnt/test"); err != nil {
+		t.Errorf("Expected list to be left alone however got %s", err)
+	}
+
+	f.SetEnabled(false)
+	if _, err := f.Open("/mnt/test/missing"); err != nil {
+		t.Errorf("Expected no faults once disabled however got %s", err)
+	}
+}
+
+func TestFaultyPercent(t *testing.T) {
+	_, f := newFaultyTest(t, `{"name": "test_percent", "seed": 1, "rules": [
+		{"path": "/mnt/test/never", "percent": 0, "error": "EIO"},
+		{"path": "/mnt/test/some", "percent": 50, "error": "EIO"}
+	]}`)
+	defer f.Unmount()
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if _, err := f.List("/mnt/test/never"); err != nil {
+			t.Fatalf("Expected 0 percent to never fail however got %s", err)
+		}
+		if _, err := f.List("/mnt/test/some"); err != nil {
+			failed++
+		}
+	}
+	if failed < 50 || failed > 150 {
+		t.Errorf("Expected about half of 200 lists to fail however %d did", failed)
+	}
+}
+
+func TestFaultyPartialAndDrop(t *testing.T) {
+	d, f := newFaultyTest(t, `{"name": "test_partial", "rules": [
+		{"path": "/mnt/test/partial", "ops": ["read"], "partial": true},
+		{"path": "/mnt/test/drop", "ops": ["write"], "drop": true}
+	]}`)
+	defer f.Unmount()
+	inner, _ := d.Open("/mnt/test/partial")
+	inner.Write([]byte("12345678"))
+	pf, _ := f.Open("/mnt/test/partial")
+	body, err := pf.Read()
+	if err != nil || string(body) != "1234" {
+		t.Errorf("Expected partial read of 1234 however got %s error %v", string(body), err)
+	}
+
+	df, _ := f.Open("/mnt/test/drop")
+	if err := df.Write([]byte("lost")); err != nil {
+		t.Errorf("Expected dropped write to look like it worked however got %s", err)
+	}
+	inner, _ = d.Open("/mnt/test/drop")
+	body, _ = inner.Read()
+	if len(body) != 0 {
+		t.Errorf("Expected dropped write to never reach the device however got %s", string(body))
+	}
+}
+
+func TestFaultyLatencyAndHang(t *testing.T) {
+	_, f := newFaultyTest(t, `{"name": "test_hang", "rules": [
+		{"path": "/mnt/test/slow", "latency_ms": 50},
+		{"path": "/mnt/test/hang", "hang": true}
+	]}`)
+	defer f.Unmount()
+	start := time.Now()
+	f.List("/mnt/test/slow")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected at least 50ms of latency however took %s", time.Since(start))
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := f.List("/mnt/test/hang")
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Expected list to hang")
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.SetEnabled(false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected released list to work however got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected disabling faults to release the hung list")
+	}
+}
+
+func TestFaultyRest(t *testing.T) {
+	_, f := newFaultyTest(t, `{"name": "test_rest", "enabled": false, "rules": [{"error": "EIO"}]}`)
+	defer f.Unmount()
+
+	w := httptest.NewRecorder()
+	HandleFaults(w, httptest.NewRequest(http.MethodGet, "/faults", nil))
+	states := make([]FaultState, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &states); err != nil {
+		t.Fatalf("Failed to decode faults %s", err)
+	}
+	found := false
+	for _, s := range states {
+		found = found || s.Name == "test_rest"
+	}
+	if !found {
+		t.Fatalf("Expected test_rest in %v", states)
+	}
+
+	w = httptest.NewRecorder()
+	HandleFaults(w, httptest.NewRequest(http.MethodPut, "/faults/test_rest", bytes.NewBufferString(`{"enabled": true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected toggle to work however got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := f.List("/mnt/test"); err != syscall.EIO {
+		t.Errorf("Expected EIO once enabled over http however got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	HandleFaults(w, httptest.NewRequest(http.MethodPut, "/faults/test_rest", bytes.NewBufferString(`{"rules": [{"error": "EBADF"}]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown error to be rejected however got %d", w.Code)
+	}
+
+	f.Unmount()
+	w = httptest.NewRecorder()
+	HandleFaults(w, httptest.NewRequest(http.MethodGet, "/faults/test_rest", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected unmounted device to be gone however got %d", w.Code)
+	}
+}
+
+func TestFaultyNative(t *testing.T) {
+	mws, err := WrapNative([]WrapperConfig{{Type: WrapperFaulty, Config: []byte(`{"name": "test_native", "rules": [
+		{"path": "/mnt/native/missing", "error": "ENOENT"},
+		{"path": "/mnt/native/partial", "ops": ["read"], "partial": true},
+		{"path": "/mnt/native/drop", "ops": ["write"], "drop": true},
+		{"ops": ["mkdir"], "error": "EIO"}
+	]}`)}})
+	if err != nil {
+		t.Fatalf("Failed to build native faulty middleware %s", err)
+	}
+	f := mws[0].(*Faulty)
+	calls := 0
+	next := func(op *NativeOp) func() error {
+		return func() error {
+			calls++
+			if op.Op == NativeRead {
+				op.Data = []byte("12345678")
+				op.Size = len(op.Data)
+			}
+			return nil
+		}
+	}
+	op := &NativeOp{Op: NativeOpen, Path: "/mnt/native/missing"}
+	if err := f.Intercept(op, next(op)); err != syscall.ENOENT || calls != 0 {
+		t.Errorf("Expected ENOENT without reaching the file system however got %v after %d calls", err, calls)
+	}
+	op = &NativeOp{Op: NativeRead, Path: "/mnt/native/partial"}
+	if err := f.Intercept(op, next(op)); err != nil || string(op.Data) != "1234" || op.Size != 4 {
+		t.Errorf("Expected partial read of 1234 however got %s of %d error %v", string(op.Data), op.Size, err)
+	}
+	calls = 0
+	op = &NativeOp{Op: NativeWrite, Path: "/mnt/native/drop", Data: []byte("lost")}
+	if err := f.Intercept(op, next(op)); err != nil || calls != 0 {
+		t.Errorf("Expected dropped write to look like it worked without reaching the file system however got %v after %d calls", err, calls)
+	}
+	op = &NativeOp{Op: NativeMkdir, Path: "/mnt/native/dir"}
+	if err := f.Intercept(op, next(op)); err != syscall.EIO {
+		t.Errorf("Expected EIO making a directory however got %v", err)
+	}
+	if _, exists := LookupFaulty("test_native"); !exists {
+		t.Fatalf("Expected native faulty middleware to be toggled like any other")
+	}
+	CloseNative(mws)
+	if _, exists := LookupFaulty("test_native"); exists {
+		t.Errorf("Expected closed middleware to be gone")
+	}
+}
+
+func TestFaultyWrapFailureReleasesName(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	chain := []WrapperConfig{
+		{Type: WrapperReadOnly, Config: []byte(`{"extra": true}`)},
+		{Type: WrapperFaulty, Config: []byte(`{"name": "test_wrap_failure"}`)},
+	}
+	if _, err := Wrap(d, chain); err == nil {
+		t.Fatalf("Expected the invalid readonly config to fail the chain")
+	}
+	if _, exists := LookupFaulty("test_wrap_failure"); exists {
+		t.Errorf("Expected the faulty wrapper built before the failure to be gone")
+	}
+	wrapped, err := Wrap(d, chain[1:])
+	if err != nil {
+		t.Fatalf("Expected the name to be free again however got %s", err)
+	}
+	wrapped.Unmount()
+}
+
+func TestFaultyDevice(t *testing.T) {
+	RegisterSimpleDevice("TEST_FAULTY_INNER", newTestDevice)
+	defer unregister("TEST_FAULTY_INNER")
+	config := []byte(`{"type": "TEST_FAULTY_INNER", "name": "test_device", "rules": [{"ops": ["remove"], "error": "EIO"}]}`)
+	d, err := MountSimpleDevice(DeviceFaulty, "/mnt/test", config)
+	if err != nil {
+		t.Fatalf("Failed to mount the faulty device %s", err)
+	}
+	if err := d.Remove("/mnt/test/a"); err != syscall.EIO {
+		t.Errorf("Expected EIO removing however got %v", err)
+	}
+	if _, err := d.Open("/mnt/test/a"); err != nil {
+		t.Errorf("Expected open to reach the inner device however got %s", err)
+	}
+	if _, exists := LookupFaulty("test_device"); !exists {
+		t.Errorf("Expected the faulty device to be toggled like the wrapper")
+	}
+	d.Unmount()
+	if _, exists := LookupFaulty("test_device"); exists {
+		t.Errorf("Expected unmount to drop the faulty device")
+	}
+	if _, err := MountSimpleDevice(DeviceFaulty, "/mnt/test", []byte(`{"type": "TEST_DOES_NOT_EXIST", "name": "test_device"}`)); err == nil {
+		t.Errorf("Expected an unknown inner type to fail")
+	}
+	d, err = MountSimpleDevice(DeviceFaulty, "/mnt/test", config)
+	if err != nil {
+		t.Fatalf("Expected a remount with the same name to work however got %s", err)
+	}
+	d.Unmount()
+}
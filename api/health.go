@@ -0,0 +1,23 @@
+package api
+
+import (
+	"context"
+)
+
+// HealthChecker ... Devices and file systems backed by a server report whether they can reach it
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+// Health ... Forward to the inner device when it checks its backend
+func (w *Wrapper) Health(ctx context.Context) error {
+	return CheckHealth(ctx, w.Inner)
+}
+
+// CheckHealth ... Anything without a backend to reach is healthy
+func CheckHealth(ctx context.Context, d interface{}) error {
+	if hc, ok := d.(HealthChecker); ok {
+		return hc.Health(ctx)
+	}
+	return nil
+}
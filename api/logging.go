@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lateefj/shylock/logger"
+)
+
+const (
+	// WrapperLogging ... Name of the logging middleware
+	WrapperLogging = "logging"
+)
+
+func init() {
+	RegisterWrapperType(Registered{
+		FSType:      WrapperLogging,
+		Description: "Logs every operation with the path, latency and error",
+		Schema: []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"prefix": {"type": "string", "description": "Added to every record as the prefix field"},
+		"level": {"type": "string", "enum": ["debug", "info", "warn", "error"], "description": "Level operations are logged at, failures are always logged at warn. Defaults to info"}
+	}
+}`),
+	}, NewLogging)
+	RegisterNativeWrapper(WrapperLogging, func(config []byte) (NativeMiddleware, error) {
+		d, err := NewLogging(nil, config)
+		if err != nil {
+			return nil, err
+		}
+		return d.(*Logging), nil
+	})
+}
+
+type loggingConfig struct {
+	Prefix string `json:"prefix"`
+	Level  string `json:"level"`
+}
+
+// Logging ... Middleware that logs every call
+type Logging struct {
+	Wrapper
+	Prefix string
+	Level  logger.Level
+	Log    *logger.Logger
+}
+
+// NewLogging ... Wrap a device so every call gets logged
+func NewLogging(inner SimpleDevice, config []byte) (SimpleDevice, error) {
+	conf := &loggingConfig{}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, conf); err != nil {
+			return nil, err
+		}
+	}
+	level := logger.InfoLevel
+	if conf.Level != "" {
+		var err error
+		if level, err = logger.ParseLevel(conf.Level); err != nil {
+			return nil, err
+		}
+	}
+	return &Logging{Wrapper: Wrapper{Inner: inner}, Prefix: conf.Prefix, Level: level, Log: logger.Default()}, nil
+}
+
+// SetLogger ... Log with the mount fields and pass the logger on
+func (l *Logging) SetLogger(lg *logger.Logger) {
+	l.Log = lg
+	l.Wrapper.SetLogger(lg)
+}
+
+func (l *Logging) logOp(op, path string, start time.Time, err error) {
+	kv := []interface{}{"op", op, "path", path, "latency", time.Since(start)}
+	if l.Prefix != "" {
+		kv = append(kv, "prefix", strings.TrimSpace(l.Prefix))
+	}
+	if err != nil {
+		l.Log.Warn("Device operation failed", append(kv, "error", err)...)
+		return
+	}
+	l.Log.Log(l.Level, "Device operation", kv...)
+}
+
+// Unmount ... Logs and forwards
+func (l *Logging) Unmount() error {
+	start := time.Now()
+	err := l.Inner.Unmount()
+	l.logOp("unmount", "", start, err)
+	return err
+}
+
+// List ... Logs and forwards
+func (l *Logging) List(path string) ([]string, error) {
+	start := time.Now()
+	names, err := l.Inner.List(path)
+	l.logOp("list", path, start, err)
+	return names, err
+}
+
+// Remove ... Logs and forwards
+func (l *Logging) Remove(path string) error {
+	start := time.Now()
+	err := l.Inner.Remove(path)
+	l.logOp("remove", path, start, err)
+	return err
+}
+
+// Open ... Logs and forwards, file reads and writes are logged as well
+func (l *Logging) Open(path string) (SimpleFile, error) {
+	start := time.Now()
+	f, err := l.Inner.Open(path)
+	l.logOp("open", path, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingFile{SimpleFile: f, logging: l, path: path}, nil
+}
+
+// OpenStream ... Logs and forwards
+func (l *Logging) OpenStream(path string) (StreamFile, error) {
+	start := time.Now()
+	f, err := l.Wrapper.OpenStream(path)
+	l.logOp("open_stream", path, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingStream{StreamFile: f, logging: l, path: path}, nil
+}
+
+type loggingFile struct {
+	SimpleFile
+	logging *Logging
+	path    string
+}
+
+func (lf *loggingFile) Read() ([]byte, error) {
+	start := time.Now()
+	body, err := lf.SimpleFile.Read()
+	lf.logging.logOp("read", lf.path, start, err)
+	return body, err
+}
+
+func (lf *loggingFile) Write(body []byte) error {
+	start := time.Now()
+	err := lf.SimpleFile.Write(body)
+	lf.logging.logOp("write", lf.path, start, err)
+	return err
+}
+
+func (lf *loggingFile) Close() error {
+	start := time.Now()
+	err := lf.SimpleFile.Close()
+	lf.logging.logOp("close", lf.path, start, err)
+	return err
+}
+
+type loggingStream struct {
+	StreamFile
+	logging *Logging
+	path    string
+}
+
+func (ls *loggingStream) Reader() (io.ReadCloser, error) {
+	start := time.Now()
+	r, err := ls.StreamFile.Reader()
+	ls.logging.logOp("stream_reader", ls.path, start, err)
+	return r, err
+}
+
+func (ls *loggingStream) Writer() (io.WriteCloser, error) {
+	start := time.Now()
+	w, err := ls.StreamFile.Writer()
+	ls.logging.logOp("stream_writer", ls.path, start, err)
+	return w, err
+}
+
+func (ls *loggingStream) Close() error {
+	start := time.Now()
+	err := ls.StreamFile.Close()
+	ls.logging.logOp("close", ls.path, start, err)
+	return err
+}
+
+// Intercept ... Logs requests to a native file system
+func (l *Logging) Intercept(op *NativeOp, next func() error) error {
+	start := time.Now()
+	err := next()
+	l.logOp(op.Op, op.Path, start, err)
+	return err
+}
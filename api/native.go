@@ -0,0 +1,156 @@
+package api
+
+import (
+	"fmt"
+	"io"
+)
+
+// NativeDevice ... Backend that serves its own file system instead of going through buse.
+// Serve blocks until the file system is unmounted. Unmount must be safe to call more than once.
+type NativeDevice interface {
+	Serve(mountPoint string) error
+	Unmount() error
+}
+
+// NativeDeviceBuilder ... Creates a native device, an error is returned for bad config
+type NativeDeviceBuilder func(mountPoint string, config []byte) (NativeDevice, error)
+
+// RegisterNativeDeviceType ... Register a native device along with its description and config schema.
+// Native devices always advertise the native capability
+func RegisterNativeDeviceType(info Registered, imp NativeDeviceBuilder) {
+	if !info.Supports(CapNative) {
+		info.Capabilities = append(info.Capabilities, CapNative)
+	}
+	reg.Mutex.Lock()
+	defer reg.Mutex.Unlock()
+	if err := checkDuplicate(info.FSType); err != nil {
+		panic(err)
+	}
+	reg.NativeDevices[info.FSType] = imp
+	reg.Types[info.FSType] = info
+}
+
+// IsNative ... Check if a registered type serves its own file system
+func IsNative(fsType string) bool {
+	reg.Mutex.RLock()
+	defer reg.Mutex.RUnlock()
+	_, exists := reg.NativeDevices[fsType]
+	return exists
+}
+
+// NewNativeDevice ... Build a native device once the config is valid, the caller serves it
+func NewNativeDevice(fsType, mountPoint string, config []byte) (NativeDevice, error) {
+	reg.Mutex.RLock()
+	imp, exists := reg.NativeDevices[fsType]
+	reg.Mutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("No native file system type %s", fsType)
+	}
+	if err := validateConfig(fsType, config); err != nil {
+		return nil, err
+	}
+	return imp(mountPoint, config)
+}
+
+// Operations middleware sees on a native file system. Reads and writes are single kernel requests,
+// the names match the recorded and fault injected operations of simple devices
+const (
+	NativeOpen    = "open"
+	NativeRead    = "read"
+	NativeWrite   = "write"
+	NativeClose   = "close"
+	NativeList    = "list"
+	NativeRemove  = "remove"
+	NativeCreate  = "create"
+	NativeMkdir   = "mkdir"
+	NativeRename  = "rename"
+	NativeSetattr = "setattr"
+)
+
+// NativeOp ... A request to a native file system as middleware sees it. Paths start with the
+// mount point like the keys of simple devices
+type NativeOp struct {
+	Op   string
+	Path string
+	// NewPath ... Where a rename moves Path to
+	NewPath string
+	// Handle ... Open file a read, write or close belongs to
+	Handle uint64
+	// Flags ... os.OpenFile flags of an open or create
+	Flags  int
+	Offset int64
+	// Size ... Bytes written, bytes read once the request returns, names listed or the size a setattr
+	// truncates to, -1 when a setattr leaves the size alone
+	Size int
+	// Data ... What a write sends or a read returned, middleware can shorten a read
+	Data []byte
+}
+
+// NativeMiddleware ... Middleware that can sit in front of a native file system. Intercept is called
+// for every request and next makes it, not calling next keeps the request from the file system.
+// Middleware that is an io.Closer is closed once the file system is unmounted
+type NativeMiddleware interface {
+	Intercept(op *NativeOp, next func() error) error
+}
+
+// NativeWrapperBuilder ... Creates middleware for a native file system
+type NativeWrapperBuilder func(config []byte) (NativeMiddleware, error)
+
+var nativeWrappers = make(map[string]NativeWrapperBuilder)
+
+// RegisterNativeWrapper ... Let a registered wrapper be applied to native file systems as well,
+// the wrapper advertises the native capability
+func RegisterNativeWrapper(wrapperType string, imp NativeWrapperBuilder) {
+	wrappersMutex.Lock()
+	defer wrappersMutex.Unlock()
+	info, exists := wrapperTypes[wrapperType]
+	if !exists {
+		panic(fmt.Errorf("No wrapper type %s", wrapperType))
+	}
+	if _, exists := nativeWrappers[wrapperType]; exists {
+		panic(fmt.Errorf("Native wrapper %s is already registered", wrapperType))
+	}
+	if !info.Supports(CapNative) {
+		info.Capabilities = append(info.Capabilities, CapNative)
+		wrapperTypes[wrapperType] = info
+	}
+	nativeWrappers[wrapperType] = imp
+}
+
+// WrapNative ... Build the middleware for a native file system, the first is the outermost
+func WrapNative(chain []WrapperConfig) ([]NativeMiddleware, error) {
+	mws := make([]NativeMiddleware, 0, len(chain))
+	for _, wc := range chain {
+		if err := validateWrapper(wc); err != nil {
+			CloseNative(mws)
+			return nil, err
+		}
+		wrappersMutex.RLock()
+		imp, exists := nativeWrappers[wc.Type]
+		wrappersMutex.RUnlock()
+		if !exists {
+			CloseNative(mws)
+			return nil, fmt.Errorf("Wrapper %s can't be applied to native file systems", wc.Type)
+		}
+		mw, err := imp(wc.Config)
+		if err != nil {
+			CloseNative(mws)
+			return nil, err
+		}
+		mws = append(mws, mw)
+	}
+	return mws, nil
+}
+
+// CloseNative ... Close the middleware that holds on to something
+func CloseNative(mws []NativeMiddleware) error {
+	var err error
+	for _, mw := range mws {
+		if c, ok := mw.(io.Closer); ok {
+			if cErr := c.Close(); err == nil {
+				err = cErr
+			}
+		}
+	}
+	return err
+}
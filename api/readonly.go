@@ -0,0 +1,134 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	// WrapperReadOnly ... Name of the read only middleware
+	WrapperReadOnly = "readonly"
+)
+
+// ErrReadOnly ... Returned for any write to a read only device
+var ErrReadOnly = errors.New("Read only device")
+
+func init() {
+	RegisterWrapperType(Registered{
+		FSType:       WrapperReadOnly,
+		Description:  "Rejects every write and remove",
+		Schema:       []byte(`{"type": "object", "additionalProperties": false}`),
+		Capabilities: []Capability{CapReadOnly},
+	}, NewReadOnly)
+	RegisterNativeWrapper(WrapperReadOnly, func(config []byte) (NativeMiddleware, error) {
+		return &ReadOnly{}, nil
+	})
+}
+
+// ReadOnly ... Middleware that rejects writes
+type ReadOnly struct {
+	Wrapper
+}
+
+// NewReadOnly ... Wrap a device so it can only be read
+func NewReadOnly(inner SimpleDevice, config []byte) (SimpleDevice, error) {
+	return &ReadOnly{Wrapper{Inner: inner}}, nil
+}
+
+// Remove ... Not allowed
+func (ro *ReadOnly) Remove(path string) error {
+	return ErrReadOnly
+}
+
+// exists ... Devices may create keys on open so check the parent listing first
+func (ro *ReadOnly) exists(p string) error {
+	dir := path.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+	names, err := ro.Inner.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == p {
+			return nil
+		}
+	}
+	return os.ErrNotExist
+}
+
+// Open ... Files can be read but not written, missing files are never created
+func (ro *ReadOnly) Open(path string) (SimpleFile, error) {
+	if err := ro.exists(path); err != nil {
+		return nil, err
+	}
+	f, err := ro.Inner.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{f}, nil
+}
+
+// OpenStream ... Streams can be read but not written, missing streams are never created
+func (ro *ReadOnly) OpenStream(path string) (StreamFile, error) {
+	if err := ro.exists(path); err != nil {
+		return nil, err
+	}
+	f, err := ro.Wrapper.OpenStream(path)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyStream{f}, nil
+}
+
+// SetAttr ... Not allowed
+func (ro *ReadOnly) SetAttr(path string, attr Attributes) error {
+	return ErrReadOnly
+}
+
+// SetXattr ... Not allowed
+func (ro *ReadOnly) SetXattr(path, name string, value []byte) error {
+	return ErrReadOnly
+}
+
+// RemoveXattr ... Not allowed
+func (ro *ReadOnly) RemoveXattr(path, name string) error {
+	return ErrReadOnly
+}
+
+// Restore ... Not allowed
+func (ro *ReadOnly) Restore(r io.Reader) error {
+	return ErrReadOnly
+}
+
+// Intercept ... Native file systems can be listed, opened for reading and read
+func (ro *ReadOnly) Intercept(op *NativeOp, next func() error) error {
+	switch op.Op {
+	case NativeWrite, NativeRemove, NativeCreate, NativeMkdir, NativeRename, NativeSetattr:
+		return ErrReadOnly
+	case NativeOpen:
+		if op.Flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+			return ErrReadOnly
+		}
+	}
+	return next()
+}
+
+type readOnlyFile struct {
+	SimpleFile
+}
+
+func (rof *readOnlyFile) Write(body []byte) error {
+	return ErrReadOnly
+}
+
+type readOnlyStream struct {
+	StreamFile
+}
+
+func (ros *readOnlyStream) Writer() (io.WriteCloser, error) {
+	return nil, ErrReadOnly
+}
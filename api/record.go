@@ -0,0 +1,638 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// WrapperRecord ... Name of the recording middleware
+	WrapperRecord = "record"
+
+	// RecordOpen ... File or stream opened, the handle ties later reads and writes to it
+	RecordOpen = "open"
+	// RecordRead ... Whole file read or a stream reader closed after reading the size
+	RecordRead = "read"
+	// RecordWrite ... Whole file written or a stream writer closed after writing the size
+	RecordWrite = "write"
+	// RecordClose ... File or stream closed
+	RecordClose = "close"
+	// RecordList ... Path listed, the size is the number of names
+	RecordList = "list"
+	// RecordRemove ... Path removed
+	RecordRemove = "remove"
+	// RecordCreate ... File created and opened on a native file system
+	RecordCreate = NativeCreate
+	// RecordMkdir ... Directory made on a native file system
+	RecordMkdir = NativeMkdir
+	// RecordRename ... Path moved to the new path on a native file system
+	RecordRename = NativeRename
+	// RecordSetattr ... Attributes changed on a native file system, the size is what it was truncated to
+	RecordSetattr = NativeSetattr
+)
+
+func init() {
+	RegisterWrapperType(Registered{
+		FSType:      WrapperRecord,
+		Description: "Records every operation with its timing, size and path so it can be replayed",
+		Schema: []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"required": ["path"],
+	"properties": {
+		"path": {"type": "string", "minLength": 1, "description": "File the operations are appended to, one JSON object per line"}
+	}
+}`),
+	}, NewRecorder)
+	RegisterNativeWrapper(WrapperRecord, func(config []byte) (NativeMiddleware, error) {
+		d, err := NewRecorder(nil, config)
+		if err != nil {
+			return nil, err
+		}
+		return d.(*Recorder), nil
+	})
+}
+
+// Record ... Single operation in a recording. Only sizes are kept, never the data
+type Record struct {
+	// At ... Nanoseconds since the recording started
+	At   int64  `json:"t"`
+	Op   string `json:"op"`
+	Path string `json:"p,omitempty"`
+	// NewPath ... Where a rename moved the path to
+	NewPath string `json:"np,omitempty"`
+	// Handle ... Open file the operation belongs to
+	Handle uint64 `json:"h,omitempty"`
+	Stream bool   `json:"s,omitempty"`
+	// Flags ... os.OpenFile flags of an open or create on a native file system
+	Flags int `json:"f,omitempty"`
+	// Offset ... Where a single read or write on a native file system started
+	Offset int64 `json:"o,omitempty"`
+	Size   int   `json:"n,omitempty"`
+	// Took ... Nanoseconds the device spent on the operation
+	Took int64  `json:"d,omitempty"`
+	Err  string `json:"e,omitempty"`
+}
+
+type recordConfig struct {
+	Path string `json:"path"`
+}
+
+// Recorder ... Middleware that logs every call to a file for replay
+type Recorder struct {
+	Wrapper
+	start   time.Time
+	handles uint64
+	mutex   sync.Mutex
+	out     *os.File
+	enc     *json.Encoder
+}
+
+// NewRecorder ... Wrap a device so every call is appended to the recording
+func NewRecorder(inner SimpleDevice, config []byte) (SimpleDevice, error) {
+	conf := &recordConfig{}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, conf); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Path == "" {
+		return nil, fmt.Errorf("Wrapper %s needs a path to record to", WrapperRecord)
+	}
+	f, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Wrapper: Wrapper{Inner: inner}, start: time.Now(), out: f, enc: json.NewEncoder(f)}, nil
+}
+
+// handle ... Next id for an open file
+func (r *Recorder) handle() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handles++
+	return r.handles
+}
+
+// record ... Append an operation that started at start
+func (r *Recorder) record(rec Record, start time.Time, err error) {
+	rec.At = int64(start.Sub(r.start))
+	rec.Took = int64(time.Since(start))
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.out == nil {
+		return
+	}
+	r.enc.Encode(rec)
+}
+
+// Unmount ... Forwards and closes the recording
+func (r *Recorder) Unmount() error {
+	err := r.Inner.Unmount()
+	if cErr := r.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// Close ... Close the recording, called for native file systems once they are unmounted
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.out == nil {
+		return nil
+	}
+	err := r.out.Close()
+	r.out = nil
+	return err
+}
+
+// Intercept ... Records requests to a native file system, each kernel read and write is a record
+func (r *Recorder) Intercept(op *NativeOp, next func() error) error {
+	start := time.Now()
+	err := next()
+	r.record(Record{Op: op.Op, Path: op.Path, NewPath: op.NewPath, Handle: op.Handle, Flags: op.Flags, Offset: op.Offset, Size: op.Size}, start, err)
+	return err
+}
+
+// List ... Records and forwards
+func (r *Recorder) List(path string) ([]string, error) {
+	start := time.Now()
+	names, err := r.Inner.List(path)
+	r.record(Record{Op: RecordList, Path: path, Size: len(names)}, start, err)
+	return names, err
+}
+
+// Remove ... Records and forwards
+func (r *Recorder) Remove(path string) error {
+	start := time.Now()
+	err := r.Inner.Remove(path)
+	r.record(Record{Op: RecordRemove, Path: path}, start, err)
+	return err
+}
+
+// Open ... Records and forwards, reads and writes of the file are recorded as well
+func (r *Recorder) Open(path string) (SimpleFile, error) {
+	start := time.Now()
+	h := r.handle()
+	f, err := r.Inner.Open(path)
+	r.record(Record{Op: RecordOpen, Path: path, Handle: h}, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &recordFile{SimpleFile: f, recorder: r, path: path, handle: h}, nil
+}
+
+// OpenStream ... Records and forwards, each reader and writer is recorded when it is closed
+func (r *Recorder) OpenStream(path string) (StreamFile, error) {
+	start := time.Now()
+	h := r.handle()
+	f, err := r.Wrapper.OpenStream(path)
+	r.record(Record{Op: RecordOpen, Path: path, Handle: h, Stream: true}, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &recordStream{StreamFile: f, recorder: r, path: path, handle: h}, nil
+}
+
+type recordFile struct {
+	SimpleFile
+	recorder *Recorder
+	path     string
+	handle   uint64
+}
+
+func (rf *recordFile) Read() ([]byte, error) {
+	start := time.Now()
+	body, err := rf.SimpleFile.Read()
+	rf.recorder.record(Record{Op: RecordRead, Path: rf.path, Handle: rf.handle, Size: len(body)}, start, err)
+	return body, err
+}
+
+func (rf *recordFile) Write(body []byte) error {
+	start := time.Now()
+	err := rf.SimpleFile.Write(body)
+	rf.recorder.record(Record{Op: RecordWrite, Path: rf.path, Handle: rf.handle, Size: len(body)}, start, err)
+	return err
+}
+
+func (rf *recordFile) Close() error {
+	start := time.Now()
+	err := rf.SimpleFile.Close()
+	rf.recorder.record(Record{Op: RecordClose, Path: rf.path, Handle: rf.handle}, start, err)
+	return err
+}
+
+type recordStream struct {
+	StreamFile
+	recorder *Recorder
+	path     string
+	handle   uint64
+}
+
+func (rs *recordStream) Reader() (io.ReadCloser, error) {
+	r, err := rs.StreamFile.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return &recordReader{ReadCloser: r, stream: rs, start: time.Now()}, nil
+}
+
+func (rs *recordStream) Writer() (io.WriteCloser, error) {
+	w, err := rs.StreamFile.Writer()
+	if err != nil {
+		return nil, err
+	}
+	return &recordWriter{WriteCloser: w, stream: rs, start: time.Now()}, nil
+}
+
+func (rs *recordStream) Close() error {
+	start := time.Now()
+	err := rs.StreamFile.Close()
+	rs.recorder.record(Record{Op: RecordClose, Path: rs.path, Handle: rs.handle, Stream: true}, start, err)
+	return err
+}
+
+// recordReader ... Counts what was read so the whole stream is a single record
+type recordReader struct {
+	io.ReadCloser
+	stream *recordStream
+	start  time.Time
+	size   int
+	err    error
+}
+
+func (rr *recordReader) Read(p []byte) (int, error) {
+	n, err := rr.ReadCloser.Read(p)
+	rr.size += n
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+func (rr *recordReader) Close() error {
+	err := rr.ReadCloser.Close()
+	recErr := err
+	if rr.err != nil {
+		recErr = rr.err
+	}
+	rs := rr.stream
+	rs.recorder.record(Record{Op: RecordRead, Path: rs.path, Handle: rs.handle, Stream: true, Size: rr.size}, rr.start, recErr)
+	return err
+}
+
+// recordWriter ... Counts what was written so the whole stream is a single record
+type recordWriter struct {
+	io.WriteCloser
+	stream *recordStream
+	start  time.Time
+	size   int
+	err    error
+}
+
+func (rw *recordWriter) Write(p []byte) (int, error) {
+	n, err := rw.WriteCloser.Write(p)
+	rw.size += n
+	if err != nil {
+		rw.err = err
+	}
+	return n, err
+}
+
+func (rw *recordWriter) Close() error {
+	err := rw.WriteCloser.Close()
+	recErr := err
+	if rw.err != nil {
+		recErr = rw.err
+	}
+	rs := rw.stream
+	rs.recorder.record(Record{Op: RecordWrite, Path: rs.path, Handle: rs.handle, Stream: true, Size: rw.size}, rw.start, recErr)
+	return err
+}
+
+// ReplayOptions ... How a recording is played back
+type ReplayOptions struct {
+	// Speed ... 2 plays the recording twice as fast, 0 plays it as fast as possible
+	Speed float64
+	// From ... Path prefix in the recording that is swapped for To, usually the mount points
+	From string
+	To   string
+}
+
+// ReplayStats ... What happened during a replay
+type ReplayStats struct {
+	Ops          int            `json:"ops"`
+	Errors       int            `json:"errors"`
+	BytesRead    int64          `json:"bytes_read"`
+	BytesWritten int64          `json:"bytes_written"`
+	Elapsed      time.Duration  `json:"elapsed"`
+	ByOp         map[string]int `json:"by_op"`
+}
+
+// replayer ... Files opened during a replay keyed by their recorded handle
+type replayer struct {
+	device  SimpleDevice
+	stream  StreamDevice
+	files   map[uint64]SimpleFile
+	streams map[uint64]StreamFile
+	stats   *ReplayStats
+}
+
+// Replay ... Play a recording against a simple device keeping the gaps between operations.
+// Operations run one after another, writes use zeroed data of the recorded size. ReplayFiles
+// works for native types as well
+func Replay(rec io.Reader, d SimpleDevice, opts ReplayOptions) (*ReplayStats, error) {
+	rp := &replayer{
+		device:  d,
+		files:   make(map[uint64]SimpleFile),
+		streams: make(map[uint64]StreamFile),
+		stats:   &ReplayStats{ByOp: make(map[string]int)},
+	}
+	rp.stream, _ = AsStreamDevice(d)
+	scanner := bufio.NewScanner(rec)
+	start := time.Now()
+	line := 0
+	for scanner.Scan() {
+		line++
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return rp.stats, fmt.Errorf("Bad record on line %d: %s", line, err)
+		}
+		if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(r.At) / opts.Speed))
+			time.Sleep(time.Until(due))
+		}
+		r.Path = opts.swap(r.Path)
+		rp.stats.Ops++
+		rp.stats.ByOp[r.Op]++
+		if err := rp.apply(r); err != nil {
+			rp.stats.Errors++
+		}
+	}
+	for _, f := range rp.files {
+		f.Close()
+	}
+	for _, f := range rp.streams {
+		f.Close()
+	}
+	rp.stats.Elapsed = time.Since(start)
+	return rp.stats, scanner.Err()
+}
+
+// apply ... Run a single recorded operation
+func (rp *replayer) apply(r Record) error {
+	switch r.Op {
+	case RecordList:
+		_, err := rp.device.List(r.Path)
+		return err
+	case RecordRemove:
+		return rp.device.Remove(r.Path)
+	case RecordOpen:
+		if r.Stream {
+			if rp.stream == nil {
+				return ErrNotSupported
+			}
+			f, err := rp.stream.OpenStream(r.Path)
+			if err != nil {
+				return err
+			}
+			rp.streams[r.Handle] = f
+			return nil
+		}
+		f, err := rp.device.Open(r.Path)
+		if err != nil {
+			return err
+		}
+		rp.files[r.Handle] = f
+		return nil
+	case RecordClose:
+		if f, open := rp.streams[r.Handle]; open {
+			delete(rp.streams, r.Handle)
+			return f.Close()
+		}
+		if f, open := rp.files[r.Handle]; open {
+			delete(rp.files, r.Handle)
+			return f.Close()
+		}
+		return nil
+	case RecordRead:
+		if f, open := rp.streams[r.Handle]; open {
+			return rp.readStream(f, r.Size)
+		}
+		f, open := rp.files[r.Handle]
+		if !open {
+			return fmt.Errorf("Read of %s before it was opened", r.Path)
+		}
+		body, err := f.Read()
+		rp.stats.BytesRead += int64(len(body))
+		return err
+	case RecordWrite:
+		if f, open := rp.streams[r.Handle]; open {
+			return rp.writeStream(f, r.Size)
+		}
+		f, open := rp.files[r.Handle]
+		if !open {
+			return fmt.Errorf("Write of %s before it was opened", r.Path)
+		}
+		if err := f.Write(make([]byte, r.Size)); err != nil {
+			return err
+		}
+		rp.stats.BytesWritten += int64(r.Size)
+		return nil
+	}
+	return fmt.Errorf("Unknown recorded operation %s", r.Op)
+}
+
+// readStream ... Read as much as was recorded, a queue with fewer messages blocks like it would have
+func (rp *replayer) readStream(f StreamFile, size int) error {
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.CopyN(ioutil.Discard, r, int64(size))
+	rp.stats.BytesRead += n
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// writeStream ... Write zeroes of the recorded size
+func (rp *replayer) writeStream(f StreamFile, size int) error {
+	w, err := f.Writer()
+	if err != nil {
+		return err
+	}
+	n, err := w.Write(make([]byte, size))
+	rp.stats.BytesWritten += int64(n)
+	if cErr := w.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// fileReplayer ... Files opened during a replay through the file system keyed by their recorded handle
+type fileReplayer struct {
+	files map[uint64]*os.File
+	// appends ... Files opened to append can't be written at an offset
+	appends map[uint64]bool
+	stats   *ReplayStats
+}
+
+// ReplayFiles ... Play a recording through the files of a mounted path so it works for every type,
+// native ones included. Operations run one after another in the order they were recorded keeping
+// the gaps between them, so a rename is always replayed before what was done to the new path and a
+// list sees the same creates it did when it was recorded. Calls that overlapped while recording,
+// like a read blocked until another process wrote, can't be reproduced. Writes use zeroed data of
+// the recorded size
+func ReplayFiles(rec io.Reader, opts ReplayOptions) (*ReplayStats, error) {
+	fr := &fileReplayer{
+		files:   make(map[uint64]*os.File),
+		appends: make(map[uint64]bool),
+		stats:   &ReplayStats{ByOp: make(map[string]int)},
+	}
+	scanner := bufio.NewScanner(rec)
+	start := time.Now()
+	line := 0
+	var err error
+	for scanner.Scan() {
+		line++
+		r := Record{}
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			err = fmt.Errorf("Bad record on line %d: %s", line, err)
+			break
+		}
+		if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(r.At) / opts.Speed))
+			time.Sleep(time.Until(due))
+		}
+		r.Path = opts.swap(r.Path)
+		r.NewPath = opts.swap(r.NewPath)
+		fr.stats.Ops++
+		fr.stats.ByOp[r.Op]++
+		if aErr := fr.apply(r); aErr != nil {
+			fr.stats.Errors++
+		}
+	}
+	for _, f := range fr.files {
+		f.Close()
+	}
+	fr.stats.Elapsed = time.Since(start)
+	if err == nil {
+		err = scanner.Err()
+	}
+	return fr.stats, err
+}
+
+// swap ... Recorded mount point to the one being replayed against
+func (opts ReplayOptions) swap(p string) string {
+	if opts.From != "" && strings.HasPrefix(p, opts.From) {
+		return opts.To + p[len(opts.From):]
+	}
+	return p
+}
+
+// count ... Add to the bytes read or written
+func (fr *fileReplayer) count(read, written int) {
+	fr.stats.BytesRead += int64(read)
+	fr.stats.BytesWritten += int64(written)
+}
+
+// open ... Recorded flags are used as is apart from O_EXCL. Simple devices don't record flags so
+// their files are opened for reading and writing, or only reading when that is all that is allowed
+func (fr *fileReplayer) open(r Record) error {
+	var f *os.File
+	var err error
+	switch {
+	case r.Op == RecordCreate:
+		f, err = os.OpenFile(r.Path, (r.Flags|os.O_CREATE)&^os.O_EXCL, 0644)
+	case r.Flags != 0:
+		f, err = os.OpenFile(r.Path, r.Flags&^os.O_EXCL, 0644)
+	default:
+		if f, err = os.OpenFile(r.Path, os.O_RDWR, 0); err != nil {
+			f, err = os.Open(r.Path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fr.files[r.Handle] = f
+	fr.appends[r.Handle] = r.Flags&os.O_APPEND != 0
+	return nil
+}
+
+// apply ... Run a single recorded operation through the file system
+func (fr *fileReplayer) apply(r Record) error {
+	switch r.Op {
+	case RecordOpen, RecordCreate:
+		return fr.open(r)
+	case RecordClose:
+		f, open := fr.files[r.Handle]
+		if !open {
+			return nil
+		}
+		delete(fr.files, r.Handle)
+		delete(fr.appends, r.Handle)
+		return f.Close()
+	case RecordRead:
+		f, open := fr.files[r.Handle]
+		if !open {
+			return fmt.Errorf("Read of %s before it was opened", r.Path)
+		}
+		var n int
+		var err error
+		if r.Stream {
+			var n64 int64
+			n64, err = io.CopyN(ioutil.Discard, f, int64(r.Size))
+			n = int(n64)
+		} else {
+			n, err = f.ReadAt(make([]byte, r.Size), r.Offset)
+		}
+		fr.count(n, 0)
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	case RecordWrite:
+		f, open := fr.files[r.Handle]
+		if !open {
+			return fmt.Errorf("Write of %s before it was opened", r.Path)
+		}
+		var n int
+		var err error
+		if r.Stream || fr.appends[r.Handle] {
+			n, err = f.Write(make([]byte, r.Size))
+		} else {
+			n, err = f.WriteAt(make([]byte, r.Size), r.Offset)
+		}
+		fr.count(0, n)
+		return err
+	case RecordList:
+		_, err := ioutil.ReadDir(r.Path)
+		return err
+	case RecordRemove:
+		return os.Remove(r.Path)
+	case RecordMkdir:
+		return os.Mkdir(r.Path, 0755)
+	case RecordRename:
+		return os.Rename(r.Path, r.NewPath)
+	case RecordSetattr:
+		if r.Size < 0 {
+			return nil
+		}
+		return os.Truncate(r.Path, int64(r.Size))
+	}
+	return fmt.Errorf("Unknown recorded operation %s", r.Op)
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shylock_record")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+	recording := filepath.Join(dir, "ops.log")
+
+	d, _ := newTestDevice("/mnt/prod", nil)
+	wrapped, err := Wrap(d, []WrapperConfig{{Type: WrapperRecord, Config: []byte(fmt.Sprintf(`{"path": %q}`, recording))}})
+	if err != nil {
+		t.Fatalf("Failed to wrap device %s", err)
+	}
+	f, _ := wrapped.Open("/mnt/prod/a")
+	f.Write([]byte("12345"))
+	f.Close()
+	time.Sleep(50 * time.Millisecond)
+	f, _ = wrapped.Open("/mnt/prod/a")
+	f.Read()
+	f.Close()
+	wrapped.List("/mnt/prod")
+	wrapped.Remove("/mnt/prod/b")
+	if err := wrapped.Unmount(); err != nil {
+		t.Fatalf("Failed to unmount %s", err)
+	}
+
+	rf, err := os.Open(recording)
+	if err != nil {
+		t.Fatalf("Failed to open recording %s", err)
+	}
+	ops := make([]string, 0)
+	scanner := bufio.NewScanner(rf)
+	for scanner.Scan() {
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Bad record %s", err)
+		}
+		ops = append(ops, r.Op)
+		if r.Op == RecordWrite && r.Size != 5 {
+			t.Errorf("Expected write of 5 bytes however recorded %d", r.Size)
+		}
+	}
+	rf.Close()
+	expected := []string{RecordOpen, RecordWrite, RecordClose, RecordOpen, RecordRead, RecordClose, RecordList, RecordRemove}
+	if fmt.Sprint(ops) != fmt.Sprint(expected) {
+		t.Fatalf("Expected recorded ops %v however got %v", expected, ops)
+	}
+
+	rf, _ = os.Open(recording)
+	defer rf.Close()
+	target, _ := newTestDevice("/mnt/staging", nil)
+	start := time.Now()
+	stats, err := Replay(rf, target, ReplayOptions{Speed: 2, From: "/mnt/prod", To: "/mnt/staging"})
+	if err != nil {
+		t.Fatalf("Failed to replay %s", err)
+	}
+	if time.Since(start) < 25*time.Millisecond {
+		t.Errorf("Expected the gap to be kept at half speed however replay took %s", time.Since(start))
+	}
+	if stats.Ops != len(expected) || stats.Errors != 0 || stats.BytesWritten != 5 || stats.BytesRead != 5 {
+		t.Errorf("Unexpected replay stats %+v", stats)
+	}
+	names, _ := target.List("/mnt/staging")
+	if len(names) != 1 || names[0] != "/mnt/staging/a" {
+		t.Errorf("Expected replay to write /mnt/staging/a however device has %v", names)
+	}
+}
+
+func TestRecordNeedsPath(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	if _, err := Wrap(d, []WrapperConfig{{Type: WrapperRecord}}); err == nil {
+		t.Fatalf("Expected record without a path to fail")
+	}
+}
+
+func TestRecordNativeAndReplayFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shylock_record_native")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+	recording := filepath.Join(dir, "ops.log")
+	mws, err := WrapNative([]WrapperConfig{{Type: WrapperRecord, Config: []byte(fmt.Sprintf(`{"path": %q}`, recording))}})
+	if err != nil {
+		t.Fatalf("Failed to build native record middleware %s", err)
+	}
+	ops := []NativeOp{
+		{Op: NativeCreate, Path: "/mnt/native/a", Handle: 1, Flags: os.O_WRONLY | os.O_CREATE},
+		{Op: NativeWrite, Path: "/mnt/native/a", Handle: 1, Size: 5},
+		{Op: NativeClose, Path: "/mnt/native/a", Handle: 1},
+		{Op: NativeOpen, Path: "/mnt/native/a", Handle: 2},
+		{Op: NativeRead, Path: "/mnt/native/a", Handle: 2, Size: 5},
+		{Op: NativeClose, Path: "/mnt/native/a", Handle: 2},
+		{Op: NativeSetattr, Path: "/mnt/native/a", Size: 2},
+		{Op: NativeMkdir, Path: "/mnt/native/d"},
+		{Op: NativeRename, Path: "/mnt/native/d", NewPath: "/mnt/native/e"},
+		{Op: NativeCreate, Path: "/mnt/native/b", Handle: 3, Flags: os.O_WRONLY | os.O_CREATE},
+		{Op: NativeClose, Path: "/mnt/native/b", Handle: 3},
+		{Op: NativeRemove, Path: "/mnt/native/b"},
+		{Op: NativeList, Path: "/mnt/native"},
+	}
+	for i := range ops {
+		if err := mws[0].Intercept(&ops[i], func() error { return nil }); err != nil {
+			t.Fatalf("Expected recording to pass the request on however got %s", err)
+		}
+	}
+	if err := CloseNative(mws); err != nil {
+		t.Fatalf("Failed to close the recording %s", err)
+	}
+
+	target := filepath.Join(dir, "target")
+	os.Mkdir(target, 0755)
+	rf, err := os.Open(recording)
+	if err != nil {
+		t.Fatalf("Failed to open recording %s", err)
+	}
+	defer rf.Close()
+	stats, err := ReplayFiles(rf, ReplayOptions{From: "/mnt/native", To: target})
+	if err != nil {
+		t.Fatalf("Failed to replay %s", err)
+	}
+	if stats.Ops != len(ops) || stats.Errors != 0 || stats.BytesWritten != 5 || stats.BytesRead != 5 {
+		t.Errorf("Unexpected replay stats %+v", stats)
+	}
+	if fi, err := os.Stat(filepath.Join(target, "a")); err != nil || fi.Size() != 2 {
+		t.Errorf("Expected a to be written and truncated to 2 bytes however got %v %v", fi, err)
+	}
+	if fi, err := os.Stat(filepath.Join(target, "e")); err != nil || !fi.IsDir() {
+		t.Errorf("Expected d to be renamed to e however got %v", err)
+	}
+	for _, gone := range []string{"b", "d"} {
+		if _, err := os.Stat(filepath.Join(target, gone)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be gone however got %v", gone, err)
+		}
+	}
+}
+
+// TestReplayFilesOrder ... Operations on different paths depend on each other so they have to be
+// replayed in the order they were recorded
+func TestReplayFilesOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shylock_replay_order")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+	recording := strings.Join([]string{
+		`{"t": 0, "op": "create", "p": "/mnt/rec/a", "h": 1, "f": 1}`,
+		`{"t": 1, "op": "write", "p": "/mnt/rec/a", "h": 1, "n": 4}`,
+		`{"t": 2, "op": "close", "p": "/mnt/rec/a", "h": 1}`,
+		`{"t": 3, "op": "rename", "p": "/mnt/rec/a", "np": "/mnt/rec/b"}`,
+		`{"t": 4, "op": "open", "p": "/mnt/rec/b", "h": 2}`,
+		`{"t": 5, "op": "read", "p": "/mnt/rec/b", "h": 2, "n": 4}`,
+		`{"t": 6, "op": "close", "p": "/mnt/rec/b", "h": 2}`,
+		`{"t": 7, "op": "remove", "p": "/mnt/rec/b"}`,
+		`{"t": 8, "op": "list", "p": "/mnt/rec"}`,
+	}, "\n")
+	stats, err := ReplayFiles(strings.NewReader(recording), ReplayOptions{From: "/mnt/rec", To: dir})
+	if err != nil {
+		t.Fatalf("Failed to replay %s", err)
+	}
+	if stats.Ops != 9 || stats.Errors != 0 || stats.BytesRead != 4 || stats.BytesWritten != 4 {
+		t.Errorf("Expected every operation to find what the one before it left however got %+v", stats)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("Expected the renamed file to be removed however got %v", names)
+	}
+}
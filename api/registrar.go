@@ -1,43 +1,177 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 )
 
+// Capability ... Optional behavior a registered device type supports
+type Capability string
+
+const (
+	// CapReadOnly ... Device never accepts writes
+	CapReadOnly Capability = "read-only"
+	// CapStreaming ... Files are streams (message queues, large objects)
+	CapStreaming Capability = "streaming"
+	// CapOffsetIO ... Files support reading / writing at an offset
+	CapOffsetIO Capability = "offset-io"
+	// CapHeaders ... Files carry a header along with the body
+	CapHeaders Capability = "headers"
+	// CapWatch ... Device can push change events
+	CapWatch Capability = "watch"
+	// CapPermissions ... Device stores mode and owner for each key
+	CapPermissions Capability = "permissions"
+	// CapXattr ... Device stores extended attributes for each key
+	CapXattr Capability = "xattr"
+	// CapSnapshot ... Device can save and restore its whole state
+	CapSnapshot Capability = "snapshot"
+	// CapNative ... Device serves its own file system, only wrappers that also have this capability
+	// can be applied to it and uid, gid and umask are left to the device
+	CapNative Capability = "native"
+)
+
+// Registered ... Description of a registered device type
 type Registered struct {
-	MountPoint  string
-	FSType      string
-	Description string
-	Config      []byte
+	FSType       string          `json:"type"`
+	Description  string          `json:"description"`
+	Schema       json.RawMessage `json:"schema,omitempty"`
+	Capabilities []Capability    `json:"capabilities"`
+}
+
+// Supports ... Check if the registered type has a capability
+func (r Registered) Supports(c Capability) bool {
+	for _, rc := range r.Capabilities {
+		if rc == c {
+			return true
+		}
+	}
+	return false
 }
 
 //type HeaderDeviceBuilder func(mountPoint string, config []byte) HeaderDevice
-type DeviceBuilder func(mountPoint string, config []byte) Device
-type SimpleDeviceBuilder func(mountPoint string, config []byte) SimpleDevice
+
+// DeviceBuilder ... Creates a device, an error is returned for bad config or an unreachable backend
+type DeviceBuilder func(mountPoint string, config []byte) (Device, error)
+
+// SimpleDeviceBuilder ... Creates a simple device, an error is returned for bad config or an unreachable backend
+type SimpleDeviceBuilder func(mountPoint string, config []byte) (SimpleDevice, error)
+
+// StreamDeviceBuilder ... Creates a streaming device, an error is returned for bad config or an unreachable backend
+type StreamDeviceBuilder func(mountPoint string, config []byte) (StreamDevice, error)
 
 type Registrar struct {
 	//HeaderDevices map[string]HeaderDeviceBuilder
 	Devices       map[string]DeviceBuilder
 	SimpleDevices map[string]SimpleDeviceBuilder
+	NativeDevices map[string]NativeDeviceBuilder
+	Types         map[string]Registered
+	Mutex         sync.RWMutex
 }
 
-var reg Registrar
+// reg ... Set up before any init runs so devices in this package can register themselves
+var reg = Registrar{SimpleDevices: make(map[string]SimpleDeviceBuilder), Devices: make(map[string]DeviceBuilder), NativeDevices: make(map[string]NativeDeviceBuilder), Types: make(map[string]Registered)}
 
-func init() {
-	reg = Registrar{SimpleDevices: make(map[string]SimpleDeviceBuilder), Devices: make(map[string]DeviceBuilder)}
-	//reg = Registrar{HeaderDevices: make(map[string]HeaderDeviceBuilder), Devices: make(map[string]DeviceBuilder)}
-}
+//reg = Registrar{HeaderDevices: make(map[string]HeaderDeviceBuilder), Devices: make(map[string]DeviceBuilder)}
 
 /*func RegisterHeaderDevice(fsType string, imp HeaderDeviceBuilder) {
 	reg.HeaderDevices[fsType] = imp
 }*/
 func RegisterDevice(fsType string, imp DeviceBuilder) {
-	reg.Devices[fsType] = imp
+	RegisterDeviceType(Registered{FSType: fsType}, imp)
 }
 
 func RegisterSimpleDevice(fsType string, imp SimpleDeviceBuilder) {
-	reg.SimpleDevices[fsType] = imp
+	RegisterSimpleDeviceType(Registered{FSType: fsType}, imp)
+}
+
+// checkDuplicate ... Two plugins registering the same type should never silently overwrite each other
+// must be called with the registrar lock held
+func checkDuplicate(fsType string) error {
+	if _, exists := reg.Types[fsType]; exists {
+		return fmt.Errorf("File system type %s is already registered", fsType)
+	}
+	return nil
+}
+
+// RegisterDeviceType ... Register a device along with its description, config schema and capabilities.
+// Registering the same type twice panics since it is a programming error that should fail fast in init
+func RegisterDeviceType(info Registered, imp DeviceBuilder) {
+	reg.Mutex.Lock()
+	defer reg.Mutex.Unlock()
+	if err := checkDuplicate(info.FSType); err != nil {
+		panic(err)
+	}
+	reg.Devices[info.FSType] = imp
+	reg.Types[info.FSType] = info
+}
+
+// RegisterSimpleDeviceType ... Register a simple device along with its description, config schema and capabilities.
+// Registering the same type twice panics since it is a programming error that should fail fast in init
+func RegisterSimpleDeviceType(info Registered, imp SimpleDeviceBuilder) {
+	reg.Mutex.Lock()
+	defer reg.Mutex.Unlock()
+	if err := checkDuplicate(info.FSType); err != nil {
+		panic(err)
+	}
+	reg.SimpleDevices[info.FSType] = imp
+	reg.Types[info.FSType] = info
+}
+
+// RegisterStreamDevice ... Register a streaming device
+func RegisterStreamDevice(fsType string, imp StreamDeviceBuilder) {
+	RegisterStreamDeviceType(Registered{FSType: fsType}, imp)
+}
+
+// RegisterStreamDeviceType ... Streaming devices are mounted as simple devices that also
+// implement StreamDevice so they always advertise the streaming capability
+func RegisterStreamDeviceType(info Registered, imp StreamDeviceBuilder) {
+	if !info.Supports(CapStreaming) {
+		info.Capabilities = append(info.Capabilities, CapStreaming)
+	}
+	RegisterSimpleDeviceType(info, func(mountPoint string, config []byte) (SimpleDevice, error) {
+		d, err := imp(mountPoint, config)
+		if err != nil {
+			return nil, err
+		}
+		return NewStreamSimpleDevice(d), nil
+	})
+}
+
+// Types ... All the registered device types sorted by type name
+func Types() []Registered {
+	reg.Mutex.RLock()
+	defer reg.Mutex.RUnlock()
+	types := make([]Registered, 0, len(reg.Types))
+	for _, t := range reg.Types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].FSType < types[j].FSType
+	})
+	return types
+}
+
+// LookupType ... Find the registration for a device type
+func LookupType(fsType string) (Registered, bool) {
+	reg.Mutex.RLock()
+	defer reg.Mutex.RUnlock()
+	info, exists := reg.Types[fsType]
+	return info, exists
+}
+
+// validateConfig ... Make sure the config matches the schema of the registered type
+func validateConfig(fsType string, config []byte) error {
+	info, _ := LookupType(fsType)
+	if len(info.Schema) == 0 {
+		return nil
+	}
+	if err := ValidateConfig(info.Schema, config); err != nil {
+		return fmt.Errorf("Invalid config for file system type %s: %s", fsType, err)
+	}
+	return nil
 }
 
 /*func MountHeaderDevice(fsType, mountPoint string, config []byte) (HeaderDevice, error) {
@@ -48,16 +182,40 @@ func RegisterSimpleDevice(fsType string, imp SimpleDeviceBuilder) {
 	return imp(mountPoint, config), nil
 }*/
 func MountSimpleDevice(fsType, mountPoint string, config []byte) (SimpleDevice, error) {
+	reg.Mutex.RLock()
 	imp, exists := reg.SimpleDevices[fsType]
+	reg.Mutex.RUnlock()
 	if !exists {
 		return nil, errors.New(fmt.Sprintf("No file system type %s", fsType))
 	}
-	return imp(mountPoint, config), nil
+	if err := validateConfig(fsType, config); err != nil {
+		return nil, err
+	}
+	d, err := imp(mountPoint, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Mount(config); err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 func MountDevice(fsType, mountPoint string, config []byte) (Device, error) {
+	reg.Mutex.RLock()
 	imp, exists := reg.Devices[fsType]
+	reg.Mutex.RUnlock()
 	if !exists {
 		return nil, errors.New(fmt.Sprintf("No file system type %s", fsType))
 	}
-	return imp(mountPoint, config), nil
+	if err := validateConfig(fsType, config); err != nil {
+		return nil, err
+	}
+	d, err := imp(mountPoint, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Mount(config); err != nil {
+		return nil, err
+	}
+	return d, nil
 }
@@ -1,10 +1,214 @@
 package api
 
 import (
+	"errors"
 	"testing"
 )
 
+type testFile struct {
+	body []byte
+}
+
+func (tf *testFile) Read() ([]byte, error) {
+	return tf.body, nil
+}
+func (tf *testFile) Write(body []byte) error {
+	tf.body = body
+	return nil
+}
+func (tf *testFile) Close() error {
+	return nil
+}
+
+type testDevice struct {
+	files   map[string]*testFile
+	mounted []byte
+}
+
+func newTestDevice(mountPoint string, config []byte) (SimpleDevice, error) {
+	return &testDevice{files: make(map[string]*testFile)}, nil
+}
+
+func (td *testDevice) Mount(config []byte) error {
+	td.mounted = config
+	return nil
+}
+func (td *testDevice) Unmount() error {
+	td.mounted = nil
+	return nil
+}
+func (td *testDevice) List(path string) ([]string, error) {
+	files := make([]string, 0)
+	for k := range td.files {
+		files = append(files, k)
+	}
+	return files, nil
+}
+func (td *testDevice) Remove(path string) error {
+	delete(td.files, path)
+	return nil
+}
+func (td *testDevice) Open(path string) (SimpleFile, error) {
+	f, exists := td.files[path]
+	if !exists {
+		f = &testFile{}
+		td.files[path] = f
+	}
+	return f, nil
+}
+
+// unregister ... Registering a name twice panics so tests drop the names they register, otherwise
+// running the package tests more than once in a process fails
+func unregister(fsTypes ...string) {
+	reg.Mutex.Lock()
+	wrappersMutex.Lock()
+	defer reg.Mutex.Unlock()
+	defer wrappersMutex.Unlock()
+	for _, fsType := range fsTypes {
+		delete(reg.Devices, fsType)
+		delete(reg.SimpleDevices, fsType)
+		delete(reg.NativeDevices, fsType)
+		delete(reg.Types, fsType)
+		delete(wrappers, fsType)
+		delete(wrapperTypes, fsType)
+		delete(nativeWrappers, fsType)
+	}
+}
+
 func TestRegistered(t *testing.T) {
-	//RegisterDevice()
+	fsType := "TEST_REGISTERED"
+	info := Registered{
+		FSType:       fsType,
+		Description:  "Test device",
+		Schema:       []byte(`{"type":"object","properties":{"size":{"type":"integer"}},"required":["size"]}`),
+		Capabilities: []Capability{CapWatch},
+	}
+	RegisterSimpleDeviceType(info, newTestDevice)
+	defer unregister(fsType)
+
+	found, exists := LookupType(fsType)
+	if !exists {
+		t.Fatalf("Expected to find registered type %s", fsType)
+	}
+	if found.Description != info.Description {
+		t.Errorf("Expected description %s but got %s", info.Description, found.Description)
+	}
+	if !found.Supports(CapWatch) {
+		t.Errorf("Expected %s to support %s", fsType, CapWatch)
+	}
+	if found.Supports(CapStreaming) {
+		t.Errorf("Did not expect %s to support %s", fsType, CapStreaming)
+	}
+
+	listed := false
+	for _, r := range Types() {
+		if r.FSType == fsType {
+			listed = true
+		}
+	}
+	if !listed {
+		t.Errorf("Expected %s to be in the list of types %v", fsType, Types())
+	}
+
+	_, err := MountSimpleDevice(fsType, "/mnt/test", []byte(`{"size":"big"}`))
+	if err == nil {
+		t.Errorf("Expected config with a string size to fail validation")
+	}
+	_, err = MountSimpleDevice(fsType, "/mnt/test", nil)
+	if err == nil {
+		t.Errorf("Expected empty config to fail validation of required field")
+	}
+	d, err := MountSimpleDevice(fsType, "/mnt/test", []byte(`{"size":10}`))
+	if err != nil {
+		t.Fatalf("Expected valid config to mount however got error %s", err)
+	}
+	if d == nil {
+		t.Fatalf("Expected a device")
+	}
+	if string(d.(*testDevice).mounted) != `{"size":10}` {
+		t.Errorf("Expected Mount to be called with the config however got %s", string(d.(*testDevice).mounted))
+	}
+
+	_, err = MountSimpleDevice("TEST_DOES_NOT_EXIST", "/mnt/test", nil)
+	if err == nil {
+		t.Errorf("Expected mounting an unknown type to fail")
+	}
+}
+
+func TestRegisteredWithoutSchema(t *testing.T) {
+	fsType := "TEST_NO_SCHEMA"
+	RegisterSimpleDevice(fsType, newTestDevice)
+	defer unregister(fsType)
+	_, err := MountSimpleDevice(fsType, "/mnt/test", []byte("not json at all"))
+	if err != nil {
+		t.Fatalf("Types without a schema should accept any config however got %s", err)
+	}
+}
+
+func TestBuilderError(t *testing.T) {
+	fsType := "TEST_BUILDER_ERROR"
+	builderErr := errors.New("backend unreachable")
+	RegisterSimpleDevice(fsType, func(mountPoint string, config []byte) (SimpleDevice, error) {
+		return nil, builderErr
+	})
+	defer unregister(fsType)
+	_, err := MountSimpleDevice(fsType, "/mnt/test", nil)
+	if err != builderErr {
+		t.Fatalf("Expected builder error %s however got %v", builderErr, err)
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	fsType := "TEST_DUPLICATE"
+	RegisterSimpleDevice(fsType, newTestDevice)
+	defer unregister(fsType)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Expected registering %s a second time to panic", fsType)
+		}
+	}()
+	RegisterDevice(fsType, func(mountPoint string, config []byte) (Device, error) {
+		return nil, nil
+	})
+}
+
+type testNative struct {
+	served string
+}
+
+func (tn *testNative) Serve(mountPoint string) error {
+	tn.served = mountPoint
+	return nil
+}
+func (tn *testNative) Unmount() error {
+	return nil
+}
 
+func TestRegisterNative(t *testing.T) {
+	fsType := "TEST_NATIVE"
+	RegisterNativeDeviceType(Registered{FSType: fsType, Schema: []byte(`{"type": "object", "additionalProperties": false}`)}, func(mountPoint string, config []byte) (NativeDevice, error) {
+		return &testNative{}, nil
+	})
+	defer unregister(fsType)
+	info, _ := LookupType(fsType)
+	if !info.Supports(CapNative) {
+		t.Errorf("Expected native types to advertise %s however got %v", CapNative, info.Capabilities)
+	}
+	if !IsNative(fsType) || IsNative("TEST_NO_SCHEMA") {
+		t.Errorf("Expected only %s to be native", fsType)
+	}
+	if _, err := NewNativeDevice(fsType, "/mnt/test", []byte(`{"extra": 1}`)); err == nil {
+		t.Errorf("Expected invalid config to fail validation")
+	}
+	d, err := NewNativeDevice(fsType, "/mnt/test", nil)
+	if err != nil {
+		t.Fatalf("Expected native device to build however got %s", err)
+	}
+	d.Serve("/mnt/test")
+	if d.(*testNative).served != "/mnt/test" {
+		t.Errorf("Expected device to be served at /mnt/test")
+	}
+	if _, err := MountSimpleDevice(fsType, "/mnt/test", nil); err == nil {
+		t.Errorf("Expected native types to not mount as simple devices")
+	}
 }
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	bits, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bits)
+}
+
+// HandleTypes ... Lists all the registered device types or a single one when the name is in the path
+func HandleTypes(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fsType := ""
+	if len(req.URL.Path) > len("/types/") {
+		fsType = req.URL.Path[len("/types/"):]
+	}
+	if fsType == "" {
+		writeJSON(w, Types())
+		return
+	}
+	info, exists := LookupType(fsType)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "could not find type %s", fsType)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// HandleWrappers ... Lists all the registered middleware
+func HandleWrappers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, WrapperTypes())
+}
+
+// faultUpdate ... Fields that are left out of a PUT are kept as they are
+type faultUpdate struct {
+	Enabled *bool        `json:"enabled"`
+	Rules   *[]FaultRule `json:"rules"`
+}
+
+// HandleFaults ... Lists the mounted faulty devices, shows a single one or changes it with a PUT
+// like {"enabled": false} or {"rules": [...]}
+func HandleFaults(w http.ResponseWriter, req *http.Request) {
+	name := ""
+	if len(req.URL.Path) > len("/faults/") {
+		name = req.URL.Path[len("/faults/"):]
+	}
+	if name == "" {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, FaultyDevices())
+		return
+	}
+	f, exists := LookupFaulty(name)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "could not find faulty device %s", name)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		update := &faultUpdate{}
+		if err := json.NewDecoder(req.Body).Decode(update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error %s", err.Error())
+			return
+		}
+		if update.Rules != nil {
+			if err := f.SetRules(*update.Rules); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Error %s", err.Error())
+				return
+			}
+		}
+		if update.Enabled != nil {
+			f.SetEnabled(*update.Enabled)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, f.State())
+}
+
+// Setup ... Associates the registered types with rest endpoints
+func Setup() {
+	http.HandleFunc("/types", HandleTypes)
+	http.HandleFunc("/types/", HandleTypes)
+	http.HandleFunc("/wrappers", HandleWrappers)
+	http.HandleFunc("/faults", HandleFaults)
+	http.HandleFunc("/faults/", HandleFaults)
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schema ... The subset of JSON schema used to describe device configs
+type schema struct {
+	Type                 json.RawMessage    `json:"type"`
+	Description          string             `json:"description"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+}
+
+// types ... Type can either be a single string or a list of them
+func (s *schema) types() ([]string, error) {
+	if len(s.Type) == 0 {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(s.Type, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(s.Type, &many); err != nil {
+		return nil, fmt.Errorf("type must be a string or list of strings not %s", string(s.Type))
+	}
+	return many, nil
+}
+
+// jsonType ... Name of the JSON schema type for a decoded value
+func jsonType(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func typeMatches(want, got string) bool {
+	// Every integer is also a number
+	return want == got || (want == "number" && got == "integer")
+}
+
+func location(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+func (s *schema) validate(path string, v interface{}) error {
+	types, err := s.types()
+	if err != nil {
+		return err
+	}
+	got := jsonType(v)
+	if len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if typeMatches(t, got) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s should be %s but is %s", location(path), strings.Join(types, " or "), got)
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s should be one of %v", location(path), s.Enum)
+		}
+	}
+
+	switch val := v.(type) {
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			return fmt.Errorf("%s should be at least %v", location(path), *s.Minimum)
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			return fmt.Errorf("%s should be at most %v", location(path), *s.Maximum)
+		}
+	case string:
+		if s.MinLength != nil && len(val) < *s.MinLength {
+			return fmt.Errorf("%s should be at least %d characters", location(path), *s.MinLength)
+		}
+		if s.MaxLength != nil && len(val) > *s.MaxLength {
+			return fmt.Errorf("%s should be at most %d characters", location(path), *s.MaxLength)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range val {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", location(path), i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, exists := val[r]; !exists {
+				return fmt.Errorf("%s is missing required field %s", location(path), r)
+			}
+		}
+		// Sort so the same config always reports the same error
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			sub, exists := s.Properties[k]
+			if !exists {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s is not a known field", p)
+				}
+				continue
+			}
+			if err := sub.validate(p, val[k]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateConfig ... Check a JSON config against a JSON schema. Only the subset of
+// JSON schema needed to describe a device config is supported: type, properties,
+// required, additionalProperties, items, enum, minimum, maximum, minLength and maxLength.
+// An empty config is treated as an empty object.
+func ValidateConfig(schemaBits, config []byte) error {
+	s := &schema{}
+	if err := json.Unmarshal(schemaBits, s); err != nil {
+		return fmt.Errorf("invalid schema: %s", err)
+	}
+	if len(bytes.TrimSpace(config)) == 0 {
+		config = []byte("{}")
+	}
+	var v interface{}
+	if err := json.Unmarshal(config, &v); err != nil {
+		return fmt.Errorf("config is not valid JSON: %s", err)
+	}
+	return s.validate("", v)
+}
+
+// OptionListSeparator ... Separates the items of array options since mount options are comma separated
+const OptionListSeparator = "+"
+
+// optionValue ... Convert the string value of a mount option to the type its property wants
+func (s *schema) optionValue(k, v string) (interface{}, error) {
+	types, err := s.types()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		switch t {
+		case "string":
+			return v, nil
+		case "boolean":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("option %s should be true or false not %s", k, v)
+			}
+			return b, nil
+		case "integer", "number":
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("option %s should be a number not %s", k, v)
+			}
+			return n, nil
+		case "array":
+			items := make([]interface{}, 0)
+			for _, item := range strings.Split(v, OptionListSeparator) {
+				if s.Items == nil {
+					items = append(items, item)
+					continue
+				}
+				iv, err := s.Items.optionValue(k, item)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, iv)
+			}
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("option %s can't be set from a mount option", k)
+}
+
+// ConfigFromOptions ... Set the top level properties of config from key=value mount options. The
+// values are converted to the type in the schema and array items are separated by OptionListSeparator.
+// The resulting config is validated against the schema
+func ConfigFromOptions(schemaBits, config []byte, opts map[string]string) ([]byte, error) {
+	s := &schema{}
+	if err := json.Unmarshal(schemaBits, s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	if len(bytes.TrimSpace(config)) == 0 {
+		config = []byte("{}")
+	}
+	c := make(map[string]interface{})
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil, fmt.Errorf("config is not a valid JSON object: %s", err)
+	}
+	for k, v := range opts {
+		sub, exists := s.Properties[k]
+		if !exists {
+			return nil, fmt.Errorf("Unsupported mount option %s", k)
+		}
+		val, err := sub.optionValue(k, v)
+		if err != nil {
+			return nil, err
+		}
+		c[k] = val
+	}
+	if err := s.validate("", c); err != nil {
+		return nil, err
+	}
+	return json.Marshal(c)
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"additionalProperties": false,
+	"required": ["hosts"],
+	"properties": {
+		"hosts": {"type": "array", "items": {"type": "string", "minLength": 1}},
+		"read_only": {"type": "boolean"},
+		"db": {"type": "integer", "minimum": 0, "maximum": 15},
+		"mode": {"type": "string", "enum": ["fanout", "compete"]},
+		"timeout": {"type": ["number", "null"]}
+	}
+}`
+
+func TestValidateConfig(t *testing.T) {
+	valid := []string{
+		`{"hosts": ["localhost:2379"]}`,
+		`{"hosts": [], "read_only": true, "db": 3, "mode": "fanout", "timeout": 1.5}`,
+		`{"hosts": ["a"], "timeout": null}`,
+	}
+	for _, c := range valid {
+		if err := ValidateConfig([]byte(testSchema), []byte(c)); err != nil {
+			t.Errorf("Expected %s to be valid however got error %s", c, err)
+		}
+	}
+
+	invalid := []string{
+		``,
+		`not json`,
+		`[]`,
+		`{"hosts": "localhost"}`,
+		`{"hosts": [""]}`,
+		`{"hosts": [1]}`,
+		`{"hosts": [], "db": 1.5}`,
+		`{"hosts": [], "db": 16}`,
+		`{"hosts": [], "db": -1}`,
+		`{"hosts": [], "mode": "other"}`,
+		`{"hosts": [], "extra": true}`,
+		`{"hosts": [], "timeout": "1s"}`,
+	}
+	for _, c := range invalid {
+		if err := ValidateConfig([]byte(testSchema), []byte(c)); err == nil {
+			t.Errorf("Expected %s to be invalid", c)
+		}
+	}
+}
+
+func TestValidateConfigBadSchema(t *testing.T) {
+	if err := ValidateConfig([]byte(`{"type": 1}`), []byte(`{}`)); err == nil {
+		t.Errorf("Expected a schema with a numeric type to fail")
+	}
+	if err := ValidateConfig([]byte(`not json`), []byte(`{}`)); err == nil {
+		t.Errorf("Expected a schema that is not JSON to fail")
+	}
+}
+
+func TestConfigFromOptions(t *testing.T) {
+	bits, err := ConfigFromOptions([]byte(testSchema), []byte(`{"hosts": ["a"], "db": 2}`), map[string]string{
+		"hosts":     "http://b:2379+http://c:2379",
+		"read_only": "true",
+		"db":        "3",
+		"timeout":   "1.5",
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config from options %s", err)
+	}
+	expected := `{"db":3,"hosts":["http://b:2379","http://c:2379"],"read_only":true,"timeout":1.5}`
+	if string(bits) != expected {
+		t.Errorf("Expected config %s however got %s", expected, string(bits))
+	}
+
+	invalid := []map[string]string{
+		{"extra": "1"},
+		{"db": "many"},
+		{"db": "16"},
+		{"read_only": "sometimes"},
+		{"mode": "other"},
+	}
+	for _, opts := range invalid {
+		if _, err := ConfigFromOptions([]byte(testSchema), []byte(`{"hosts": ["a"]}`), opts); err == nil {
+			t.Errorf("Expected options %v to be invalid", opts)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"io"
+)
+
+// Snapshotter ... Optional capability for devices that can save and load their whole state.
+// Restore replaces everything in the device with what Snapshot wrote
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// AsSnapshotter ... Walk a middleware chain to find out if the device really takes snapshots
+func AsSnapshotter(d SimpleDevice) (Snapshotter, bool) {
+	s, ok := d.(Snapshotter)
+	if !ok {
+		return nil, false
+	}
+	if u, ok := d.(Unwrapper); ok {
+		if _, inner := AsSnapshotter(u.Unwrap()); !inner {
+			return nil, false
+		}
+	}
+	return s, true
+}
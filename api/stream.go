@@ -0,0 +1,322 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// bytesReadCloser ... Seekable reader over a body that is already in memory
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (brc *bytesReadCloser) Close() error {
+	return nil
+}
+
+// simpleWriter ... Buffers the whole body since a SimpleFile can only write everything at once
+type simpleWriter struct {
+	file SimpleFile
+	buf  bytes.Buffer
+}
+
+func (sw *simpleWriter) Write(p []byte) (int, error) {
+	return sw.buf.Write(p)
+}
+
+func (sw *simpleWriter) Close() error {
+	return sw.file.Write(sw.buf.Bytes())
+}
+
+// simpleStreamFile ... StreamFile on top of a SimpleFile
+type simpleStreamFile struct {
+	file SimpleFile
+}
+
+// NewSimpleStreamFile ... Adapt a SimpleFile to a StreamFile. Readers are seekable,
+// writes are buffered in memory and written when the writer is closed.
+func NewSimpleStreamFile(f SimpleFile) StreamFile {
+	return &simpleStreamFile{file: f}
+}
+
+func (ssf *simpleStreamFile) Reader() (io.ReadCloser, error) {
+	body, err := ssf.file.Read()
+	if err != nil {
+		return nil, err
+	}
+	return &bytesReadCloser{bytes.NewReader(body)}, nil
+}
+
+func (ssf *simpleStreamFile) Writer() (io.WriteCloser, error) {
+	return &simpleWriter{file: ssf.file}, nil
+}
+
+func (ssf *simpleStreamFile) Close() error {
+	return ssf.file.Close()
+}
+
+// streamSimpleFile ... SimpleFile on top of a StreamFile
+type streamSimpleFile struct {
+	file StreamFile
+}
+
+// NewStreamSimpleFile ... Adapt a StreamFile to a SimpleFile, reads consume the whole stream
+func NewStreamSimpleFile(f StreamFile) SimpleFile {
+	return &streamSimpleFile{file: f}
+}
+
+func (ssf *streamSimpleFile) Read() ([]byte, error) {
+	r, err := ssf.file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (ssf *streamSimpleFile) Write(body []byte) error {
+	w, err := ssf.file.Writer()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (ssf *streamSimpleFile) Close() error {
+	return ssf.file.Close()
+}
+
+// fileReader ... Reader that walks a File by offset
+type fileReader struct {
+	file   File
+	offset int64
+}
+
+func (fr *fileReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	body, err := fr.file.Read(int(fr.offset), len(p))
+	n := copy(p, body)
+	fr.offset += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Seek ... Files don't expose their size so seeking from the end is not supported
+func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fr.offset
+	default:
+		return fr.offset, ErrNotSupported
+	}
+	if offset < 0 {
+		return fr.offset, errors.New("Seek to a negative offset")
+	}
+	fr.offset = offset
+	return offset, nil
+}
+
+func (fr *fileReader) Close() error {
+	return nil
+}
+
+// fileWriter ... Writer that appends to a File by offset
+type fileWriter struct {
+	file   File
+	offset int
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	n, err := fw.file.Write(fw.offset, p)
+	fw.offset += n
+	return n, err
+}
+
+func (fw *fileWriter) Close() error {
+	return nil
+}
+
+// largeStreamFile ... StreamFile on top of a File
+type largeStreamFile struct {
+	file File
+}
+
+// NewLargeStreamFile ... Adapt a File to a StreamFile, readers are seekable
+func NewLargeStreamFile(f File) StreamFile {
+	return &largeStreamFile{file: f}
+}
+
+func (lsf *largeStreamFile) Reader() (io.ReadCloser, error) {
+	return &fileReader{file: lsf.file}, nil
+}
+
+func (lsf *largeStreamFile) Writer() (io.WriteCloser, error) {
+	return &fileWriter{file: lsf.file}, nil
+}
+
+func (lsf *largeStreamFile) Close() error {
+	return lsf.file.Close()
+}
+
+// streamLargeFile ... File on top of a StreamFile
+type streamLargeFile struct {
+	file    StreamFile
+	reader  io.ReadCloser
+	readPos int64
+	writer  io.WriteCloser
+	written int
+}
+
+// NewStreamLargeFile ... Adapt a StreamFile to a File. Reads at an offset seek when the
+// reader supports it otherwise the stream is skipped forward or restarted. Streams can
+// only be written sequentially so writes must continue where the last write ended.
+func NewStreamLargeFile(f StreamFile) File {
+	return &streamLargeFile{file: f}
+}
+
+// position ... Move the reader to the offset
+func (slf *streamLargeFile) position(offset int64) error {
+	if slf.reader != nil && slf.readPos == offset {
+		return nil
+	}
+	if slf.reader != nil {
+		if s, ok := slf.reader.(io.Seeker); ok {
+			pos, err := s.Seek(offset, io.SeekStart)
+			slf.readPos = pos
+			return err
+		}
+	}
+	// Going backwards on a stream means starting over
+	if slf.reader == nil || offset < slf.readPos {
+		if slf.reader != nil {
+			slf.reader.Close()
+		}
+		r, err := slf.file.Reader()
+		if err != nil {
+			slf.reader = nil
+			return err
+		}
+		slf.reader = r
+		slf.readPos = 0
+	}
+	skipped, err := io.CopyN(ioutil.Discard, slf.reader, offset-slf.readPos)
+	slf.readPos += skipped
+	return err
+}
+
+func (slf *streamLargeFile) Read(offset, size int) ([]byte, error) {
+	if err := slf.position(int64(offset)); err != nil {
+		return nil, err
+	}
+	body := make([]byte, size)
+	n, err := io.ReadFull(slf.reader, body)
+	slf.readPos += int64(n)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n > 0) {
+		err = nil
+	}
+	return body[:n], err
+}
+
+func (slf *streamLargeFile) Write(offset int, body []byte) (int, error) {
+	if slf.writer == nil {
+		w, err := slf.file.Writer()
+		if err != nil {
+			return 0, err
+		}
+		slf.writer = w
+		slf.written = 0
+	}
+	if offset != slf.written {
+		return 0, ErrNotSupported
+	}
+	n, err := slf.writer.Write(body)
+	slf.written += n
+	return n, err
+}
+
+func (slf *streamLargeFile) Close() error {
+	var err error
+	if slf.reader != nil {
+		err = slf.reader.Close()
+		slf.reader = nil
+	}
+	if slf.writer != nil {
+		if wErr := slf.writer.Close(); err == nil {
+			err = wErr
+		}
+		slf.writer = nil
+	}
+	if cErr := slf.file.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// simpleStreamDevice ... StreamDevice on top of a SimpleDevice
+type simpleStreamDevice struct {
+	SimpleDevice
+}
+
+// NewSimpleStreamDevice ... Adapt a SimpleDevice so its files can be streamed
+func NewSimpleStreamDevice(d SimpleDevice) StreamDevice {
+	return &simpleStreamDevice{SimpleDevice: d}
+}
+
+func (ssd *simpleStreamDevice) OpenStream(path string) (StreamFile, error) {
+	f, err := ssd.SimpleDevice.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewSimpleStreamFile(f), nil
+}
+
+// largeStreamDevice ... StreamDevice on top of a Device
+type largeStreamDevice struct {
+	Device
+}
+
+// NewLargeStreamDevice ... Adapt a Device so its files can be streamed
+func NewLargeStreamDevice(d Device) StreamDevice {
+	return &largeStreamDevice{Device: d}
+}
+
+func (lsd *largeStreamDevice) OpenStream(path string) (StreamFile, error) {
+	f, err := lsd.Device.OpenLarge(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewLargeStreamFile(f), nil
+}
+
+// streamSimpleDevice ... SimpleDevice on top of a StreamDevice that still streams
+type streamSimpleDevice struct {
+	StreamDevice
+}
+
+// NewStreamSimpleDevice ... Adapt a StreamDevice to a SimpleDevice. The returned device
+// still implements StreamDevice so buse can serve it without reading whole files.
+func NewStreamSimpleDevice(d StreamDevice) SimpleDevice {
+	return &streamSimpleDevice{StreamDevice: d}
+}
+
+func (ssd *streamSimpleDevice) Open(path string) (SimpleFile, error) {
+	f, err := ssd.StreamDevice.OpenStream(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamSimpleFile(f), nil
+}
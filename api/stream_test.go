@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testLargeFile ... In memory File for testing offset adapters
+type testLargeFile struct {
+	body []byte
+}
+
+func (tlf *testLargeFile) Read(offset, size int) ([]byte, error) {
+	if offset >= len(tlf.body) {
+		return []byte{}, nil
+	}
+	end := offset + size
+	if end > len(tlf.body) {
+		end = len(tlf.body)
+	}
+	return tlf.body[offset:end], nil
+}
+
+func (tlf *testLargeFile) Write(offset int, body []byte) (int, error) {
+	for len(tlf.body) < offset+len(body) {
+		tlf.body = append(tlf.body, 0)
+	}
+	copy(tlf.body[offset:], body)
+	return len(body), nil
+}
+
+func (tlf *testLargeFile) Close() error {
+	return nil
+}
+
+// onlyReader ... Hide io.Seeker so the non seekable paths get tested
+type onlyReader struct {
+	io.ReadCloser
+}
+
+type unseekableStreamFile struct {
+	StreamFile
+	opened int
+}
+
+func (usf *unseekableStreamFile) Reader() (io.ReadCloser, error) {
+	usf.opened++
+	r, err := usf.StreamFile.Reader()
+	return &onlyReader{r}, err
+}
+
+func TestSimpleStreamFile(t *testing.T) {
+	f := &testFile{}
+	sf := NewSimpleStreamFile(f)
+	w, err := sf.Writer()
+	if err != nil {
+		t.Fatalf("Failed to get writer %s", err)
+	}
+	w.Write([]byte("hello "))
+	w.Write([]byte("world"))
+	if len(f.body) != 0 {
+		t.Errorf("Expected nothing written before close however got %s", string(f.body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer %s", err)
+	}
+	if string(f.body) != "hello world" {
+		t.Fatalf("Expected 'hello world' however got %s", string(f.body))
+	}
+	r, err := sf.Reader()
+	if err != nil {
+		t.Fatalf("Failed to get reader %s", err)
+	}
+	if _, ok := r.(io.Seeker); !ok {
+		t.Errorf("Expected simple file readers to be seekable")
+	}
+	bits, _ := ioutil.ReadAll(r)
+	if string(bits) != "hello world" {
+		t.Errorf("Expected to read 'hello world' however got %s", string(bits))
+	}
+
+	simple := NewStreamSimpleFile(sf)
+	if err := simple.Write([]byte("round trip")); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+	bits, err = simple.Read()
+	if err != nil {
+		t.Fatalf("Failed to read %s", err)
+	}
+	if string(bits) != "round trip" {
+		t.Errorf("Expected 'round trip' however got %s", string(bits))
+	}
+}
+
+func TestLargeStreamFile(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	f := &testLargeFile{}
+	sf := NewLargeStreamFile(f)
+	w, _ := sf.Writer()
+	w.Write(body[:500])
+	w.Write(body[500:])
+	w.Close()
+	if !bytes.Equal(f.body, body) {
+		t.Fatalf("Expected file body to match what was written")
+	}
+	r, _ := sf.Reader()
+	bits, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read all %s", err)
+	}
+	if !bytes.Equal(bits, body) {
+		t.Fatalf("Expected to read back everything written")
+	}
+	s := r.(io.Seeker)
+	s.Seek(995, io.SeekStart)
+	bits, _ = ioutil.ReadAll(r)
+	if string(bits) != "56789" {
+		t.Errorf("Expected '56789' after seek however got %s", string(bits))
+	}
+	if _, err := s.Seek(0, io.SeekEnd); err != ErrNotSupported {
+		t.Errorf("Expected seek from end to not be supported however got %v", err)
+	}
+}
+
+func TestStreamLargeFile(t *testing.T) {
+	body := []byte("0123456789abcdefghij")
+	stream := &unseekableStreamFile{StreamFile: NewSimpleStreamFile(&testFile{body: body})}
+	f := NewStreamLargeFile(stream)
+
+	bits, err := f.Read(5, 5)
+	if err != nil || string(bits) != "56789" {
+		t.Fatalf("Expected '56789' however got %s with error %v", string(bits), err)
+	}
+	bits, _ = f.Read(10, 5)
+	if string(bits) != "abcde" {
+		t.Errorf("Expected sequential read 'abcde' however got %s", string(bits))
+	}
+	if stream.opened != 1 {
+		t.Errorf("Expected forward reads to reuse the stream however it was opened %d times", stream.opened)
+	}
+	bits, _ = f.Read(0, 3)
+	if string(bits) != "012" {
+		t.Errorf("Expected '012' after going backwards however got %s", string(bits))
+	}
+	if stream.opened != 2 {
+		t.Errorf("Expected going backwards to restart the stream however it was opened %d times", stream.opened)
+	}
+	bits, err = f.Read(18, 10)
+	if err != nil || string(bits) != "ij" {
+		t.Errorf("Expected short read 'ij' however got %s with error %v", string(bits), err)
+	}
+	bits, err = f.Read(20, 10)
+	if err != io.EOF || len(bits) != 0 {
+		t.Errorf("Expected EOF at the end however got %s with error %v", string(bits), err)
+	}
+
+	if _, err := f.Write(0, []byte("new ")); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+	if _, err := f.Write(4, []byte("body")); err != nil {
+		t.Fatalf("Failed sequential write %s", err)
+	}
+	if _, err := f.Write(0, []byte("again")); err != ErrNotSupported {
+		t.Errorf("Expected random write to not be supported however got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Failed to close %s", err)
+	}
+}
+
+func TestStreamDeviceAdapters(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	sd := NewSimpleStreamDevice(d)
+	sf, err := sd.OpenStream("/mnt/test/a")
+	if err != nil {
+		t.Fatalf("Failed to open stream %s", err)
+	}
+	w, _ := sf.Writer()
+	w.Write([]byte("streamed"))
+	w.Close()
+
+	simple := NewStreamSimpleDevice(sd)
+	if _, ok := simple.(StreamDevice); !ok {
+		t.Errorf("Expected adapted simple device to still be a StreamDevice")
+	}
+	f, err := simple.Open("/mnt/test/a")
+	if err != nil {
+		t.Fatalf("Failed to open %s", err)
+	}
+	bits, _ := f.Read()
+	if string(bits) != "streamed" {
+		t.Errorf("Expected 'streamed' however got %s", string(bits))
+	}
+}
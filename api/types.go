@@ -1,6 +1,19 @@
 package api
 
-// StdDevice ... Shared device functions
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrNotSupported ... Returned by optional capabilities a device can't provide
+	ErrNotSupported = errors.New("Operation not supported")
+	// ErrWouldBlock ... The device is full and is configured to reject instead of wait
+	ErrWouldBlock = errors.New("Operation would block")
+)
+
+// StdDevice ... Shared device functions. Mount is always called once with the config
+// after the device is built and before it is used. Unmount must be safe to call more than once.
 type StdDevice interface {
 	Mount(config []byte) error
 	Unmount() error
@@ -34,6 +47,21 @@ type Device interface {
 	OpenLarge(path string) (File, error)
 }
 
+// StreamFile ... Streaming access to a file for message streams and large objects.
+// Each call to Reader or Writer starts a new stream at the beginning of the file.
+// Readers may also implement io.Seeker to support reading at an offset.
+type StreamFile interface {
+	Reader() (io.ReadCloser, error)
+	Writer() (io.WriteCloser, error)
+	Close() error
+}
+
+// StreamDevice ... Device that supports streaming files
+type StreamDevice interface {
+	StdDevice
+	OpenStream(path string) (StreamFile, error)
+}
+
 /* Devices with headers concept */
 // HeaderFile ... Support for a file with header
 type HeaderFile interface {
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// EventType ... Kind of change to a path
+type EventType int
+
+const (
+	// EventCreate ... A new path was created
+	EventCreate EventType = iota
+	// EventUpdate ... The contents of a path changed
+	EventUpdate
+	// EventDelete ... A path was removed
+	EventDelete
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventCreate:
+		return "create"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Event ... Change to a path in a device
+type Event struct {
+	Type EventType
+	Path string
+}
+
+// Watcher ... Optional capability for devices that can push change events. The channel
+// gets events for every path that starts with the prefix and is closed once the context is done.
+// Devices that can't watch return ErrNotSupported.
+type Watcher interface {
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+}
+
+// watch ... Single subscriber of a Broadcaster
+type watch struct {
+	prefix string
+	events chan Event
+	ctx    context.Context
+}
+
+// Broadcaster ... Helper for devices implementing Watcher, fans events out to every
+// watcher with a matching prefix
+type Broadcaster struct {
+	mutex   sync.Mutex
+	watches map[*watch]bool
+	closed  bool
+}
+
+// NewBroadcaster ... Create a Broadcaster with no watchers
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{watches: make(map[*watch]bool)}
+}
+
+// Watch ... Implements Watcher
+func (b *Broadcaster) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	w := &watch{prefix: prefix, events: make(chan Event, 64), ctx: ctx}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		close(w.events)
+		return w.events, nil
+	}
+	b.watches[w] = true
+	go func() {
+		<-ctx.Done()
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.watches[w] {
+			delete(b.watches, w)
+			close(w.events)
+		}
+	}()
+	return w.events, nil
+}
+
+// Publish ... Send an event to every matching watcher. This blocks until slow watchers
+// have room so don't call it while holding a lock the watchers may need.
+func (b *Broadcaster) Publish(e Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for w := range b.watches {
+		if !strings.HasPrefix(e.Path, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- e:
+		case <-w.ctx.Done():
+		}
+	}
+}
+
+// Close ... Close every watcher channel, safe to call more than once
+func (b *Broadcaster) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for w := range b.watches {
+		delete(b.watches, w)
+		close(w.events)
+	}
+	b.closed = true
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBroadcaster(t *testing.T) {
+	b := NewBroadcaster()
+	ctx, cancel := context.WithCancel(context.Background())
+	foo, _ := b.Watch(ctx, "/mnt/foo/")
+	all, _ := b.Watch(context.Background(), "/mnt/")
+
+	b.Publish(Event{Type: EventCreate, Path: "/mnt/foo/a"})
+	b.Publish(Event{Type: EventUpdate, Path: "/mnt/bar/b"})
+
+	select {
+	case e := <-foo:
+		if e.Type != EventCreate || e.Path != "/mnt/foo/a" {
+			t.Errorf("Expected create of /mnt/foo/a however got %s of %s", e.Type, e.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for event on /mnt/foo/")
+	}
+	for _, expected := range []string{"/mnt/foo/a", "/mnt/bar/b"} {
+		select {
+		case e := <-all:
+			if e.Path != expected {
+				t.Errorf("Expected event for %s however got %s", expected, e.Path)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %s", expected)
+		}
+	}
+	select {
+	case e := <-foo:
+		t.Errorf("Did not expect event %s for %s on /mnt/foo/", e.Type, e.Path)
+	default:
+	}
+
+	cancel()
+	select {
+	case _, open := <-foo:
+		if open {
+			t.Errorf("Expected channel to be closed after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for channel to close after cancel")
+	}
+
+	b.Close()
+	b.Close()
+	if _, open := <-all; open {
+		t.Errorf("Expected channel to be closed after Close")
+	}
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/lateefj/shylock/logger"
+)
+
+// Unwrapper ... Middleware that can hand back the device it wraps
+type Unwrapper interface {
+	Unwrap() SimpleDevice
+}
+
+// Wrapper ... Base for device middleware, forwards every call to the inner device.
+// Embed it and override the methods the middleware cares about. Optional capabilities
+// are forwarded as well and return ErrNotSupported when the inner device lacks them.
+type Wrapper struct {
+	Inner SimpleDevice
+}
+
+// Unwrap ... The device being wrapped
+func (w *Wrapper) Unwrap() SimpleDevice {
+	return w.Inner
+}
+
+// SetLogger ... Pass the logger on to the inner device
+func (w *Wrapper) SetLogger(l *logger.Logger) {
+	logger.Inject(w.Inner, l)
+}
+
+// Mount ... Forward to the inner device
+func (w *Wrapper) Mount(config []byte) error {
+	return w.Inner.Mount(config)
+}
+
+// Unmount ... Forward to the inner device
+func (w *Wrapper) Unmount() error {
+	return w.Inner.Unmount()
+}
+
+// List ... Forward to the inner device
+func (w *Wrapper) List(path string) ([]string, error) {
+	return w.Inner.List(path)
+}
+
+// Remove ... Forward to the inner device
+func (w *Wrapper) Remove(path string) error {
+	return w.Inner.Remove(path)
+}
+
+// Open ... Forward to the inner device
+func (w *Wrapper) Open(path string) (SimpleFile, error) {
+	return w.Inner.Open(path)
+}
+
+// OpenStream ... Forward to the inner device when it streams
+func (w *Wrapper) OpenStream(path string) (StreamFile, error) {
+	if sd, ok := w.Inner.(StreamDevice); ok {
+		return sd.OpenStream(path)
+	}
+	return nil, ErrNotSupported
+}
+
+// Watch ... Forward to the inner device when it watches
+func (w *Wrapper) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	if wd, ok := w.Inner.(Watcher); ok {
+		return wd.Watch(ctx, prefix)
+	}
+	return nil, ErrNotSupported
+}
+
+// GetAttr ... Forward to the inner device when it stores attributes
+func (w *Wrapper) GetAttr(path string) (Attributes, error) {
+	if as, ok := w.Inner.(AttrStore); ok {
+		return as.GetAttr(path)
+	}
+	return Attributes{}, ErrNotSupported
+}
+
+// SetAttr ... Forward to the inner device when it stores attributes
+func (w *Wrapper) SetAttr(path string, attr Attributes) error {
+	if as, ok := w.Inner.(AttrStore); ok {
+		return as.SetAttr(path, attr)
+	}
+	return ErrNotSupported
+}
+
+// GetXattr ... Forward to the inner device when it stores extended attributes
+func (w *Wrapper) GetXattr(path, name string) ([]byte, error) {
+	if xs, ok := w.Inner.(XattrStore); ok {
+		return xs.GetXattr(path, name)
+	}
+	return nil, ErrNotSupported
+}
+
+// SetXattr ... Forward to the inner device when it stores extended attributes
+func (w *Wrapper) SetXattr(path, name string, value []byte) error {
+	if xs, ok := w.Inner.(XattrStore); ok {
+		return xs.SetXattr(path, name, value)
+	}
+	return ErrNotSupported
+}
+
+// ListXattr ... Forward to the inner device when it stores extended attributes
+func (w *Wrapper) ListXattr(path string) ([]string, error) {
+	if xs, ok := w.Inner.(XattrStore); ok {
+		return xs.ListXattr(path)
+	}
+	return nil, ErrNotSupported
+}
+
+// RemoveXattr ... Forward to the inner device when it stores extended attributes
+func (w *Wrapper) RemoveXattr(path, name string) error {
+	if xs, ok := w.Inner.(XattrStore); ok {
+		return xs.RemoveXattr(path, name)
+	}
+	return ErrNotSupported
+}
+
+// Snapshot ... Forward to the inner device when it takes snapshots
+func (w *Wrapper) Snapshot(out io.Writer) error {
+	if s, ok := w.Inner.(Snapshotter); ok {
+		return s.Snapshot(out)
+	}
+	return ErrNotSupported
+}
+
+// Restore ... Forward to the inner device when it takes snapshots
+func (w *Wrapper) Restore(r io.Reader) error {
+	if s, ok := w.Inner.(Snapshotter); ok {
+		return s.Restore(r)
+	}
+	return ErrNotSupported
+}
+
+// AsStreamDevice ... Wrappers always have an OpenStream method so walk the chain to
+// find out if the device at the bottom really streams
+func AsStreamDevice(d SimpleDevice) (StreamDevice, bool) {
+	sd, ok := d.(StreamDevice)
+	if !ok {
+		return nil, false
+	}
+	if u, ok := d.(Unwrapper); ok {
+		if _, inner := AsStreamDevice(u.Unwrap()); !inner {
+			return nil, false
+		}
+	}
+	return sd, true
+}
+
+// WrapperBuilder ... Creates middleware around an already mounted device
+type WrapperBuilder func(inner SimpleDevice, config []byte) (SimpleDevice, error)
+
+// WrapperConfig ... A link in a middleware chain
+type WrapperConfig struct {
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+var (
+	wrappers      = make(map[string]WrapperBuilder)
+	wrapperTypes  = make(map[string]Registered)
+	wrappersMutex sync.RWMutex
+)
+
+// RegisterWrapperType ... Register middleware along with its description and config schema.
+// Registering the same name twice panics like devices do
+func RegisterWrapperType(info Registered, imp WrapperBuilder) {
+	wrappersMutex.Lock()
+	defer wrappersMutex.Unlock()
+	if _, exists := wrappers[info.FSType]; exists {
+		panic(fmt.Errorf("Wrapper %s is already registered", info.FSType))
+	}
+	wrappers[info.FSType] = imp
+	wrapperTypes[info.FSType] = info
+}
+
+// WrapperTypes ... All the registered middleware sorted by name
+func WrapperTypes() []Registered {
+	wrappersMutex.RLock()
+	defer wrappersMutex.RUnlock()
+	types := make([]Registered, 0, len(wrapperTypes))
+	for _, t := range wrapperTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].FSType < types[j].FSType
+	})
+	return types
+}
+
+// validateWrapper ... The wrapper is registered and its config matches its schema
+func validateWrapper(wc WrapperConfig) error {
+	wrappersMutex.RLock()
+	info, exists := wrapperTypes[wc.Type]
+	wrappersMutex.RUnlock()
+	if !exists {
+		return errors.New(fmt.Sprintf("No wrapper type %s", wc.Type))
+	}
+	if len(info.Schema) > 0 {
+		if err := ValidateConfig(info.Schema, wc.Config); err != nil {
+			return fmt.Errorf("Invalid config for wrapper %s: %s", wc.Type, err)
+		}
+	}
+	return nil
+}
+
+// ValidateChain ... Check a chain before anything is mounted. Every wrapper has to be registered, have
+// a valid config and, for native types, be one that can be applied to native file systems
+func ValidateChain(fsType string, chain []WrapperConfig) error {
+	native := IsNative(fsType)
+	for _, wc := range chain {
+		if err := validateWrapper(wc); err != nil {
+			return err
+		}
+		if !native {
+			continue
+		}
+		wrappersMutex.RLock()
+		_, exists := nativeWrappers[wc.Type]
+		wrappersMutex.RUnlock()
+		if !exists {
+			return fmt.Errorf("Wrapper %s can't be applied to native file system type %s", wc.Type, fsType)
+		}
+	}
+	return nil
+}
+
+// Wrap ... Apply a middleware chain to a device. The first wrapper in the chain is the
+// outermost so it sees every call first. When a link fails the wrappers already built are closed
+// so nothing they registered, like a faulty device name, outlives the failed mount
+func Wrap(d SimpleDevice, chain []WrapperConfig) (SimpleDevice, error) {
+	built := make([]SimpleDevice, 0, len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		wc := chain[i]
+		if err := validateWrapper(wc); err != nil {
+			closeWrappers(built)
+			return nil, err
+		}
+		wrappersMutex.RLock()
+		imp := wrappers[wc.Type]
+		wrappersMutex.RUnlock()
+		wrapped, err := imp(d, wc.Config)
+		if err != nil {
+			closeWrappers(built)
+			return nil, err
+		}
+		d = wrapped
+		built = append(built, wrapped)
+	}
+	return d, nil
+}
+
+// closeWrappers ... Close the wrappers that hold on to something, outermost first
+func closeWrappers(built []SimpleDevice) {
+	for i := len(built) - 1; i >= 0; i-- {
+		if c, ok := built[i].(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// MountWrappedSimpleDevice ... Mount a simple device and apply a middleware chain to it
+func MountWrappedSimpleDevice(fsType, mountPoint string, config []byte, chain []WrapperConfig) (SimpleDevice, error) {
+	d, err := MountSimpleDevice(fsType, mountPoint, config)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := Wrap(d, chain)
+	if err != nil {
+		d.Unmount()
+		return nil, err
+	}
+	return wrapped, nil
+}
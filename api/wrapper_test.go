@@ -0,0 +1,188 @@
+package api
+
+import (
+	"os"
+	"testing"
+)
+
+// orderWrapper ... Records the order wrappers see calls in
+type orderWrapper struct {
+	Wrapper
+	name  string
+	calls *[]string
+}
+
+func (ow *orderWrapper) List(path string) ([]string, error) {
+	*ow.calls = append(*ow.calls, ow.name)
+	return ow.Inner.List(path)
+}
+
+func TestWrapChainOrder(t *testing.T) {
+	calls := make([]string, 0)
+	for _, name := range []string{"test_first", "test_second"} {
+		n := name
+		RegisterWrapperType(Registered{FSType: n}, func(inner SimpleDevice, config []byte) (SimpleDevice, error) {
+			return &orderWrapper{Wrapper: Wrapper{Inner: inner}, name: n, calls: &calls}, nil
+		})
+	}
+	defer unregister("test_first", "test_second")
+	d, _ := newTestDevice("/mnt/test", nil)
+	wrapped, err := Wrap(d, []WrapperConfig{{Type: "test_first"}, {Type: "test_second"}})
+	if err != nil {
+		t.Fatalf("Failed to wrap device %s", err)
+	}
+	wrapped.List("/mnt/test")
+	if len(calls) != 2 || calls[0] != "test_first" || calls[1] != "test_second" {
+		t.Fatalf("Expected the first wrapper to be outermost however got %v", calls)
+	}
+}
+
+func TestWrapUnknown(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	_, err := Wrap(d, []WrapperConfig{{Type: "test_does_not_exist"}})
+	if err == nil {
+		t.Fatalf("Expected unknown wrapper to fail")
+	}
+	_, err = Wrap(d, []WrapperConfig{{Type: WrapperReadOnly, Config: []byte(`{"extra":true}`)}})
+	if err == nil {
+		t.Fatalf("Expected invalid wrapper config to fail validation")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	f, _ := d.Open("/mnt/test/a")
+	f.Write([]byte("before"))
+
+	wrapped, err := Wrap(d, []WrapperConfig{{Type: WrapperReadOnly}})
+	if err != nil {
+		t.Fatalf("Failed to wrap device %s", err)
+	}
+	rf, err := wrapped.Open("/mnt/test/a")
+	if err != nil {
+		t.Fatalf("Expected read only open to work however got %s", err)
+	}
+	body, err := rf.Read()
+	if err != nil || string(body) != "before" {
+		t.Errorf("Expected to read before however got %s error %v", string(body), err)
+	}
+	if err := rf.Write([]byte("after")); err != ErrReadOnly {
+		t.Errorf("Expected write to fail with ErrReadOnly however got %v", err)
+	}
+	if err := wrapped.Remove("/mnt/test/a"); err != ErrReadOnly {
+		t.Errorf("Expected remove to fail with ErrReadOnly however got %v", err)
+	}
+	body, _ = f.Read()
+	if string(body) != "before" {
+		t.Errorf("Expected inner file to be unchanged however got %s", string(body))
+	}
+}
+
+func TestReadOnlyOpenMissing(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	f, _ := d.Open("/mnt/test/a")
+	f.Write([]byte("before"))
+
+	wrapped, err := Wrap(d, []WrapperConfig{{Type: WrapperReadOnly}})
+	if err != nil {
+		t.Fatalf("Failed to wrap device %s", err)
+	}
+	if _, err := wrapped.Open("/mnt/test/missing"); err != os.ErrNotExist {
+		t.Errorf("Expected open of a missing key to fail with ErrNotExist however got %v", err)
+	}
+	names, _ := d.List("/mnt/test")
+	if len(names) != 1 || names[0] != "/mnt/test/a" {
+		t.Errorf("Expected inner listing to be unchanged however got %v", names)
+	}
+}
+
+func TestLoggingForwards(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	wrapped, err := Wrap(d, []WrapperConfig{{Type: WrapperLogging, Config: []byte(`{"prefix":"test "}`)}})
+	if err != nil {
+		t.Fatalf("Failed to wrap device %s", err)
+	}
+	if wrapped.(*Logging).Prefix != "test " {
+		t.Errorf("Expected prefix from config however got %s", wrapped.(*Logging).Prefix)
+	}
+	f, err := wrapped.Open("/mnt/test/a")
+	if err != nil {
+		t.Fatalf("Failed to open %s", err)
+	}
+	if err := f.Write([]byte("logged")); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+	inner, _ := d.Open("/mnt/test/a")
+	body, _ := inner.Read()
+	if string(body) != "logged" {
+		t.Errorf("Expected write to reach the inner device however got %s", string(body))
+	}
+}
+
+// streamTestDevice ... Simple device that also streams
+type streamTestDevice struct {
+	SimpleDevice
+	stream StreamDevice
+}
+
+func (std *streamTestDevice) OpenStream(path string) (StreamFile, error) {
+	return std.stream.OpenStream(path)
+}
+
+func TestAsStreamDevice(t *testing.T) {
+	d, _ := newTestDevice("/mnt/test", nil)
+	wrapped, _ := Wrap(d, []WrapperConfig{{Type: WrapperLogging}})
+	if _, ok := AsStreamDevice(wrapped); ok {
+		t.Errorf("Expected wrapper around a simple device to not stream")
+	}
+	if _, err := wrapped.(StreamDevice).OpenStream("/mnt/test/a"); err != ErrNotSupported {
+		t.Errorf("Expected ErrNotSupported however got %v", err)
+	}
+	// Read only streams have to exist already
+	d.Open("/mnt/test/a")
+	stream := &streamTestDevice{SimpleDevice: d, stream: NewSimpleStreamDevice(d)}
+	wrapped, _ = Wrap(stream, []WrapperConfig{{Type: WrapperReadOnly}})
+	sd, ok := AsStreamDevice(wrapped)
+	if !ok {
+		t.Fatalf("Expected wrapper around a stream device to stream")
+	}
+	f, err := sd.OpenStream("/mnt/test/a")
+	if err != nil {
+		t.Fatalf("Failed to open stream %s", err)
+	}
+	if _, err := f.Writer(); err != ErrReadOnly {
+		t.Errorf("Expected read only stream writer to fail however got %v", err)
+	}
+}
+
+func TestValidateChainNative(t *testing.T) {
+	RegisterNativeDeviceType(Registered{FSType: "TEST_NATIVE_CHAIN"}, func(mountPoint string, config []byte) (NativeDevice, error) {
+		return &testNative{}, nil
+	})
+	RegisterWrapperType(Registered{FSType: "test_simple_only"}, func(inner SimpleDevice, config []byte) (SimpleDevice, error) {
+		return &Wrapper{Inner: inner}, nil
+	})
+	defer unregister("TEST_NATIVE_CHAIN", "test_simple_only")
+	readonly := []WrapperConfig{{Type: WrapperReadOnly}, {Type: WrapperLogging}}
+	if err := ValidateChain("TEST_NATIVE_CHAIN", readonly); err != nil {
+		t.Errorf("Expected readonly and logging to apply to native types however got %s", err)
+	}
+	simpleOnly := []WrapperConfig{{Type: "test_simple_only"}}
+	if err := ValidateChain("TEST_NATIVE_CHAIN", simpleOnly); err == nil {
+		t.Errorf("Expected a wrapper without a native form to be rejected for native types")
+	}
+	if err := ValidateChain("TEST_NO_SCHEMA", simpleOnly); err != nil {
+		t.Errorf("Expected any wrapper to apply to simple types however got %s", err)
+	}
+	if err := ValidateChain("TEST_NATIVE_CHAIN", []WrapperConfig{{Type: WrapperReadOnly, Config: []byte(`{"extra":true}`)}}); err == nil {
+		t.Errorf("Expected invalid wrapper config to fail validation")
+	}
+	for _, info := range WrapperTypes() {
+		if info.FSType == WrapperReadOnly && !info.Supports(CapNative) {
+			t.Errorf("Expected readonly to advertise %s however got %v", CapNative, info.Capabilities)
+		}
+		if info.FSType == "test_simple_only" && info.Supports(CapNative) {
+			t.Errorf("Expected test_simple_only not to advertise %s", CapNative)
+		}
+	}
+}
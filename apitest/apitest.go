@@ -0,0 +1,361 @@
+// Package apitest ... Conformance tests any api device implementation should pass.
+//
+// Backend authors call RunSimpleDevice or RunDevice from their own tests with the
+// builder they register. The battery defines what "correct" means for a device:
+//
+//   - Paths are keys under the mount point, Open creates a file that doesn't exist yet
+//   - Writing a SimpleFile replaces the body, reading returns the last body written
+//   - List(dir) returns the immediate children of dir with or without a trailing slash,
+//     files as full paths and sub directories as full paths ending with a slash, each once
+//   - Remove deletes a file, removing a path that doesn't exist is not an error
+//   - Devices are safe for concurrent use and handle large payloads
+//   - Unmount is safe to call more than once
+package apitest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/lateefj/shylock/api"
+)
+
+const (
+	// MountPoint ... Mount point every device is built with
+	MountPoint = "/apitest"
+	// LargePayload ... Size of the large payload test
+	LargePayload = 8 * 1024 * 1024
+	// Concurrency ... Number of goroutines in the concurrent access test
+	Concurrency = 16
+)
+
+// harness ... Common way to read and write files on either kind of device
+type harness struct {
+	device api.StdDevice
+	write  func(path string, body []byte) error
+	read   func(path string) ([]byte, error)
+}
+
+type builderFunc func() (*harness, error)
+
+// RunSimpleDevice ... Run the conformance battery against a simple device builder
+func RunSimpleDevice(t *testing.T, builder api.SimpleDeviceBuilder, config []byte) {
+	run(t, func() (*harness, error) {
+		d, err := mount(func() (api.StdDevice, error) { return builder(MountPoint, config) }, config)
+		if err != nil {
+			return nil, err
+		}
+		sd := d.(api.SimpleDevice)
+		return &harness{
+			device: sd,
+			write: func(path string, body []byte) error {
+				f, err := sd.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				return f.Write(body)
+			},
+			read: func(path string) ([]byte, error) {
+				f, err := sd.Open(path)
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				return f.Read()
+			},
+		}, nil
+	})
+}
+
+// RunDevice ... Run the conformance battery against a device with offset io, on top
+// of the shared battery it checks reading and writing at offsets
+func RunDevice(t *testing.T, builder api.DeviceBuilder, config []byte) {
+	build := func() (*harness, error) {
+		d, err := mount(func() (api.StdDevice, error) { return builder(MountPoint, config) }, config)
+		if err != nil {
+			return nil, err
+		}
+		ld := d.(api.Device)
+		return &harness{
+			device: ld,
+			// Offset files can't be truncated so replacing a body starts from a new file
+			write: func(path string, body []byte) error {
+				if err := ld.Remove(path); err != nil {
+					return err
+				}
+				f, err := ld.OpenLarge(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				n, err := f.Write(0, body)
+				if err == nil && n != len(body) {
+					err = fmt.Errorf("Short write of %d bytes out of %d", n, len(body))
+				}
+				return err
+			},
+			read: func(path string) ([]byte, error) {
+				f, err := ld.OpenLarge(path)
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				var buf bytes.Buffer
+				for {
+					body, err := f.Read(buf.Len(), 64*1024)
+					buf.Write(body)
+					if err == io.EOF || (err == nil && len(body) == 0) {
+						return buf.Bytes(), nil
+					}
+					if err != nil {
+						return buf.Bytes(), err
+					}
+				}
+			},
+		}, nil
+	}
+	run(t, build)
+	t.Run("OffsetIO", func(t *testing.T) {
+		h := setup(t, build)
+		defer h.device.Unmount()
+		testOffsetIO(t, h.device.(api.Device))
+	})
+}
+
+// mount ... Build and mount the same way the registry does
+func mount(build func() (api.StdDevice, error), config []byte) (api.StdDevice, error) {
+	d, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Mount(config); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func setup(t *testing.T, build builderFunc) *harness {
+	h, err := build()
+	if err != nil {
+		t.Fatalf("Failed to build device %s", err)
+	}
+	return h
+}
+
+func run(t *testing.T, build builderFunc) {
+	tests := []struct {
+		name string
+		test func(*testing.T, *harness)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"List", testList},
+		{"Remove", testRemove},
+		{"Concurrent", testConcurrent},
+		{"LargePayload", testLargePayload},
+	}
+	for _, tc := range tests {
+		test := tc.test
+		t.Run(tc.name, func(t *testing.T) {
+			h := setup(t, build)
+			defer h.device.Unmount()
+			test(t, h)
+		})
+	}
+	t.Run("Unmount", func(t *testing.T) {
+		testUnmount(t, setup(t, build))
+	})
+}
+
+func key(name string) string {
+	return MountPoint + "/" + name
+}
+
+func testRoundTrip(t *testing.T, h *harness) {
+	p := key("round_trip.txt")
+	body := []byte("Test Data")
+	if err := h.write(p, body); err != nil {
+		t.Fatalf("Failed to write %s: %s", p, err)
+	}
+	bits, err := h.read(p)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", p, err)
+	}
+	if !bytes.Equal(bits, body) {
+		t.Fatalf("Expected to read %s from %s however got %s", string(body), p, string(bits))
+	}
+	update := []byte("Updated")
+	if err := h.write(p, update); err != nil {
+		t.Fatalf("Failed to overwrite %s: %s", p, err)
+	}
+	bits, _ = h.read(p)
+	if !bytes.Equal(bits, update) {
+		t.Fatalf("Expected a write to replace the body with %s however got %s", string(update), string(bits))
+	}
+	empty := key("empty.txt")
+	if err := h.write(empty, []byte{}); err != nil {
+		t.Fatalf("Failed to write empty file %s: %s", empty, err)
+	}
+	bits, err = h.read(empty)
+	if err != nil {
+		t.Fatalf("Failed to read empty file %s: %s", empty, err)
+	}
+	if len(bits) != 0 {
+		t.Errorf("Expected empty file to be empty however got %s", string(bits))
+	}
+}
+
+func assertList(t *testing.T, h *harness, dir string, expected []string) {
+	names, err := h.device.List(dir)
+	if err != nil {
+		t.Fatalf("Failed to list %s: %s", dir, err)
+	}
+	sort.Strings(names)
+	sort.Strings(expected)
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("Expected list of %s to be %v however got %v", dir, expected, names)
+	}
+}
+
+func testList(t *testing.T, h *harness) {
+	for _, name := range []string{"a.txt", "b.txt", "sub/c.txt", "sub/d.txt", "sub/deeper/e.txt", "subway.txt"} {
+		if err := h.write(key(name), []byte(name)); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+	top := []string{key("a.txt"), key("b.txt"), key("sub") + "/", key("subway.txt")}
+	assertList(t, h, MountPoint, top)
+	assertList(t, h, MountPoint+"/", top)
+	sub := []string{key("sub/c.txt"), key("sub/d.txt"), key("sub/deeper") + "/"}
+	assertList(t, h, key("sub"), sub)
+	assertList(t, h, key("sub")+"/", sub)
+	assertList(t, h, key("sub/deeper"), []string{key("sub/deeper/e.txt")})
+	assertList(t, h, key("nothing"), []string{})
+}
+
+func testRemove(t *testing.T, h *harness) {
+	keep := key("keep.txt")
+	remove := key("remove.txt")
+	h.write(keep, []byte("keep"))
+	h.write(remove, []byte("remove"))
+	if err := h.device.Remove(remove); err != nil {
+		t.Fatalf("Failed to remove %s: %s", remove, err)
+	}
+	assertList(t, h, MountPoint, []string{keep})
+	if err := h.device.Remove(remove); err != nil {
+		t.Errorf("Removing %s again should not be an error however got %s", remove, err)
+	}
+	if err := h.device.Remove(key("never_existed.txt")); err != nil {
+		t.Errorf("Removing a path that never existed should not be an error however got %s", err)
+	}
+}
+
+func testConcurrent(t *testing.T, h *harness) {
+	shared := key("shared.txt")
+	var wg sync.WaitGroup
+	errs := make(chan error, Concurrency*4)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := key(fmt.Sprintf("concurrent/%d.txt", i))
+			body := []byte(fmt.Sprintf("body %d", i))
+			for j := 0; j < 10; j++ {
+				if err := h.write(p, body); err != nil {
+					errs <- err
+					return
+				}
+				bits, err := h.read(p)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(bits, body) {
+					errs <- fmt.Errorf("Expected %s in %s however got %s", string(body), p, string(bits))
+					return
+				}
+				if err := h.write(shared, body); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := h.read(shared); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := h.device.List(MountPoint); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	names, err := h.device.List(key("concurrent"))
+	if err != nil {
+		t.Fatalf("Failed to list concurrent files: %s", err)
+	}
+	if len(names) != Concurrency {
+		t.Errorf("Expected %d files after concurrent writes however got %d", Concurrency, len(names))
+	}
+}
+
+func testLargePayload(t *testing.T, h *harness) {
+	p := key("large.bin")
+	body := make([]byte, LargePayload)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	if err := h.write(p, body); err != nil {
+		t.Fatalf("Failed to write %d bytes: %s", len(body), err)
+	}
+	bits, err := h.read(p)
+	if err != nil {
+		t.Fatalf("Failed to read %d bytes: %s", len(body), err)
+	}
+	if !bytes.Equal(bits, body) {
+		t.Fatalf("Large payload read back %d bytes that do not match the %d written", len(bits), len(body))
+	}
+}
+
+func testOffsetIO(t *testing.T, d api.Device) {
+	p := key("offset.txt")
+	f, err := d.OpenLarge(p)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", p, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(0, []byte("0123456789")); err != nil {
+		t.Fatalf("Failed to write %s: %s", p, err)
+	}
+	if _, err := f.Write(5, []byte("abc")); err != nil {
+		t.Fatalf("Failed to write at offset 5: %s", err)
+	}
+	bits, err := f.Read(3, 4)
+	if err != nil && err != io.EOF {
+		t.Fatalf("Failed to read at offset 3: %s", err)
+	}
+	if string(bits) != "34ab" {
+		t.Errorf("Expected '34ab' at offset 3 however got %s", string(bits))
+	}
+	bits, _ = f.Read(8, 10)
+	if string(bits) != "89" {
+		t.Errorf("Expected short read '89' at the end however got %s", string(bits))
+	}
+}
+
+func testUnmount(t *testing.T, h *harness) {
+	h.write(key("before_unmount.txt"), []byte("data"))
+	if err := h.device.Unmount(); err != nil {
+		t.Fatalf("Failed to unmount %s", err)
+	}
+	if err := h.device.Unmount(); err != nil {
+		t.Errorf("Unmount should be safe to call more than once however got %s", err)
+	}
+}
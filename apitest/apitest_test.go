@@ -0,0 +1,104 @@
+package apitest
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lateefj/shylock/api"
+)
+
+// memFile ... Minimal offset file used to check the battery itself
+type memFile struct {
+	device *memDevice
+	path   string
+}
+
+func (mf *memFile) Read(offset, size int) ([]byte, error) {
+	mf.device.mutex.Lock()
+	defer mf.device.mutex.Unlock()
+	body := mf.device.files[mf.path]
+	if offset >= len(body) {
+		return []byte{}, nil
+	}
+	end := offset + size
+	if end > len(body) {
+		end = len(body)
+	}
+	bits := make([]byte, end-offset)
+	copy(bits, body[offset:end])
+	return bits, nil
+}
+
+func (mf *memFile) Write(offset int, body []byte) (int, error) {
+	mf.device.mutex.Lock()
+	defer mf.device.mutex.Unlock()
+	current := mf.device.files[mf.path]
+	for len(current) < offset+len(body) {
+		current = append(current, 0)
+	}
+	copy(current[offset:], body)
+	mf.device.files[mf.path] = current
+	return len(body), nil
+}
+
+func (mf *memFile) Close() error {
+	return nil
+}
+
+type memDevice struct {
+	files map[string][]byte
+	mutex sync.Mutex
+}
+
+func newMemDevice(mountPoint string, config []byte) (api.Device, error) {
+	return &memDevice{files: make(map[string][]byte)}, nil
+}
+
+func (md *memDevice) Mount(config []byte) error {
+	return nil
+}
+func (md *memDevice) Unmount() error {
+	return nil
+}
+func (md *memDevice) List(dir string) ([]string, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for k := range md.files {
+		if !strings.HasPrefix(k, dir) {
+			continue
+		}
+		name := k
+		if i := strings.Index(k[len(dir):], "/"); i >= 0 {
+			name = k[:len(dir)+i+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+func (md *memDevice) Remove(path string) error {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	delete(md.files, path)
+	return nil
+}
+func (md *memDevice) OpenLarge(path string) (api.File, error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	if _, exists := md.files[path]; !exists {
+		md.files[path] = []byte{}
+	}
+	return &memFile{device: md, path: path}, nil
+}
+
+func TestRunDevice(t *testing.T) {
+	RunDevice(t, newMemDevice, nil)
+}
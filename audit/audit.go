@@ -0,0 +1,256 @@
+// Package audit ... Record of who created, wrote, removed or changed what through a mount. Entries are
+// written one JSON object per line to a rotating file or syslog
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/logger"
+)
+
+const (
+	// Version ... Changes when a field is removed or changes meaning, new fields can be added without it
+	Version = 1
+
+	// Ops that are audited
+	Create  = "create"
+	Write   = "write"
+	Remove  = "remove"
+	Mkdir   = "mkdir"
+	Rename  = "rename"
+	Setattr = "setattr"
+
+	// ResultOK ... The backend made the change
+	ResultOK = "ok"
+	// ResultError ... The backend refused or failed, Error says why
+	ResultError = "error"
+
+	// DefaultMaxSize ... Bytes written to the audit file before it is rotated
+	DefaultMaxSize = 100 * 1024 * 1024
+	// DefaultMaxBackups ... Rotated audit files kept
+	DefaultMaxBackups = 10
+	// DefaultSyslogTag ... Tag on syslog messages
+	DefaultSyslogTag = "shylock-audit"
+)
+
+// Entry ... One mutating request
+type Entry struct {
+	Version    int       `json:"version"`
+	Time       time.Time `json:"time"`
+	Op         string    `json:"op"`
+	MountID    string    `json:"mount_id,omitempty"`
+	MountPoint string    `json:"mount_point,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	// Path ... Key the backend changed, the real file for PATH_QOS and the etcd key for ETCD
+	Path    string `json:"path"`
+	NewPath string `json:"new_path,omitempty"`
+	// Size ... Bytes written or the size a file was truncated to
+	Size   int64  `json:"size"`
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+	PID    uint32 `json:"pid"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Config ... Where entries go and which paths are recorded
+type Config struct {
+	// File ... Audit file, rotated once it reaches MaxSize
+	File       string `json:"file,omitempty"`
+	MaxSize    int64  `json:"max_size,omitempty"`
+	MaxBackups int    `json:"max_backups,omitempty"`
+	// Syslog ... Send entries to the local syslog instead of a file
+	Syslog    bool   `json:"syslog,omitempty"`
+	SyslogTag string `json:"syslog_tag,omitempty"`
+	// Include ... Only paths starting with one of these are recorded, empty records every path
+	Include []string `json:"include,omitempty"`
+	// Exclude ... Paths starting with one of these are never recorded
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// output ... Shared by an auditor and every mount auditor made from it
+type output struct {
+	w       io.WriteCloser
+	include []string
+	exclude []string
+	now     func() time.Time
+	mutex   sync.Mutex
+}
+
+// Auditor ... Writes entries with the mount they came from, a nil auditor records nothing
+type Auditor struct {
+	out        *output
+	mountID    string
+	mountPoint string
+	fsType     string
+}
+
+// New ... Open the file or syslog from the config
+func New(c Config) (*Auditor, error) {
+	if c.File != "" && c.Syslog {
+		return nil, errors.New("Audit entries go to a file or syslog, not both")
+	}
+	var w io.WriteCloser
+	var err error
+	switch {
+	case c.File != "":
+		if c.MaxSize <= 0 {
+			c.MaxSize = DefaultMaxSize
+		}
+		if c.MaxBackups <= 0 {
+			c.MaxBackups = DefaultMaxBackups
+		}
+		w, err = OpenRotatingFile(c.File, c.MaxSize, c.MaxBackups)
+	case c.Syslog:
+		if c.SyslogTag == "" {
+			c.SyslogTag = DefaultSyslogTag
+		}
+		w, err = openSyslog(c.SyslogTag)
+	default:
+		return nil, errors.New("Audit needs a file or syslog")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(w, c.Include, c.Exclude), nil
+}
+
+// NewWriter ... Write entries to w
+func NewWriter(w io.WriteCloser, include, exclude []string) *Auditor {
+	return &Auditor{out: &output{w: w, include: include, exclude: exclude, now: time.Now}}
+}
+
+var (
+	std      *Auditor
+	stdMutex sync.Mutex
+)
+
+// Default ... The process wide auditor, nil until SetDefault is called
+func Default() *Auditor {
+	stdMutex.Lock()
+	defer stdMutex.Unlock()
+	return std
+}
+
+// SetDefault ... Mounts made after this are audited with a
+func SetDefault(a *Auditor) {
+	stdMutex.Lock()
+	defer stdMutex.Unlock()
+	std = a
+}
+
+// Setter ... Anything an auditor can be injected into
+type Setter interface {
+	SetAuditor(a *Auditor)
+}
+
+// Inject ... Give v the auditor when it takes one
+func Inject(v interface{}, a *Auditor) bool {
+	if s, ok := v.(Setter); ok {
+		s.SetAuditor(a)
+		return true
+	}
+	return false
+}
+
+// With ... An auditor that adds the mount to every entry
+func (a *Auditor) With(mountID, mountPoint, fsType string) *Auditor {
+	if a == nil {
+		return nil
+	}
+	return &Auditor{out: a.out, mountID: mountID, mountPoint: mountPoint, fsType: fsType}
+}
+
+// Close ... Close the file or syslog connection
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.out.w.Close()
+}
+
+// match ... Excludes win over includes
+func (o *output) match(p string) bool {
+	for _, prefix := range o.exclude {
+		if strings.HasPrefix(p, prefix) {
+			return false
+		}
+	}
+	if len(o.include) == 0 {
+		return true
+	}
+	for _, prefix := range o.include {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record ... Fill in the version, time and mount then write the entry when its path passes the filters
+func (a *Auditor) Record(e Entry) {
+	if a == nil {
+		return
+	}
+	if !a.out.match(e.Path) && (e.NewPath == "" || !a.out.match(e.NewPath)) {
+		return
+	}
+	e.Version = Version
+	e.Time = a.out.now().UTC()
+	e.MountID, e.MountPoint, e.Type = a.mountID, a.mountPoint, a.fsType
+	if e.Result == "" {
+		e.Result = ResultOK
+		if e.Error != "" {
+			e.Result = ResultError
+		}
+	}
+	bits, err := json.Marshal(e)
+	if err != nil {
+		logger.Default().Error("Failed to encode audit entry", "op", e.Op, "path", e.Path, "error", err)
+		return
+	}
+	bits = append(bits, '\n')
+	a.out.mutex.Lock()
+	defer a.out.mutex.Unlock()
+	if _, err := a.out.w.Write(bits); err != nil {
+		logger.Default().Error("Failed to write audit entry", "op", e.Op, "path", e.Path, "error", err)
+	}
+}
+
+// Op ... Record a request when it returns, meant to be deferred with the named error result
+func (a *Auditor) Op(op string, h fuse.Header, p string, size int64, errp *error) {
+	if a == nil {
+		return
+	}
+	e := Entry{Op: op, Path: p, Size: size, UID: h.Uid, GID: h.Gid, PID: h.Pid}
+	if errp != nil && *errp != nil {
+		e.Error = (*errp).Error()
+	}
+	a.Record(e)
+}
+
+// Rename ... Record a rename when it returns, meant to be deferred with the named error result
+func (a *Auditor) Rename(h fuse.Header, p, newPath string, errp *error) {
+	if a == nil {
+		return
+	}
+	e := Entry{Op: Rename, Path: p, NewPath: newPath, UID: h.Uid, GID: h.Gid, PID: h.Pid}
+	if errp != nil && *errp != nil {
+		e.Error = (*errp).Error()
+	}
+	a.Record(e)
+}
+
+// SetattrSize ... The size a setattr truncates to, zero when it leaves the size alone
+func SetattrSize(req *fuse.SetattrRequest) int64 {
+	if req.Valid.Size() {
+		return int64(req.Size)
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// bufferCloser ... Entries in memory
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (bc *bufferCloser) Close() error {
+	return nil
+}
+
+func testAuditor(include, exclude []string) (*Auditor, *bufferCloser) {
+	buf := &bufferCloser{}
+	a := NewWriter(buf, include, exclude)
+	a.out.now = func() time.Time {
+		return time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	}
+	return a, buf
+}
+
+func TestRecord(t *testing.T) {
+	a, buf := testAuditor(nil, nil)
+	a = a.With("1", "/mnt/kv", "LOOPBACK_KV")
+	h := fuse.Header{Uid: 1000, Gid: 100, Pid: 42}
+	a.Op(Write, h, "/mnt/kv/a", 5, nil)
+	err := errors.New("No space")
+	a.Op(Remove, h, "/mnt/kv/b", 0, &err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 entries however got %d: %s", len(lines), buf.String())
+	}
+	expected := `{"version":1,"time":"2018-06-01T12:00:00Z","op":"write","mount_id":"1","mount_point":"/mnt/kv","type":"LOOPBACK_KV","path":"/mnt/kv/a","size":5,"uid":1000,"gid":100,"pid":42,"result":"ok"}`
+	if lines[0] != expected {
+		t.Errorf("Expected\n%s however got\n%s", expected, lines[0])
+	}
+	e := Entry{}
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Result != ResultError || e.Error != "No space" {
+		t.Errorf("Expected a failed remove however got %+v", e)
+	}
+
+	var nilAuditor *Auditor
+	nilAuditor.With("2", "/mnt/off", "LOOPBACK_KV").Op(Create, h, "/mnt/off/a", 0, nil)
+}
+
+func TestRecordFilters(t *testing.T) {
+	a, buf := testAuditor([]string{"/mnt/kv/secure/"}, []string{"/mnt/kv/secure/tmp/"})
+	for _, p := range []string{"/mnt/kv/a", "/mnt/kv/secure/a", "/mnt/kv/secure/tmp/a"} {
+		a.Op(Create, fuse.Header{}, p, 0, nil)
+	}
+	a.Record(Entry{Op: Rename, Path: "/mnt/kv/b", NewPath: "/mnt/kv/secure/b"})
+	out := buf.String()
+	if strings.Count(out, "\n") != 2 || !strings.Contains(out, `"path":"/mnt/kv/secure/a"`) || !strings.Contains(out, `"new_path":"/mnt/kv/secure/b"`) {
+		t.Errorf("Expected only the included paths that aren't excluded however got %s", out)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "audit.log")
+	rf, err := OpenRotatingFile(p, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+	expected := map[string]string{p: "fourth\n", p + ".1": "third\n", p + ".2": "second\n"}
+	for name, body := range expected {
+		bits, err := ioutil.ReadFile(name)
+		if err != nil || string(bits) != body {
+			t.Errorf("Expected %s to have %q however got %q %v", name, body, string(bits), err)
+		}
+	}
+	if _, err := os.Stat(p + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+	fi, _ := os.Stat(p)
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected only the owner to read the audit file however mode is %s", fi.Mode())
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Errorf("Expected an error without a file or syslog")
+	}
+	if _, err := New(Config{File: "/tmp/a", Syslog: true}); err == nil {
+		t.Errorf("Expected an error with both a file and syslog")
+	}
+}
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile ... Appends to Path and once it reaches MaxSize moves it to Path.1, Path.1 to Path.2 and so
+// on, dropping the oldest past MaxBackups. Each write is kept whole in one file
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	file       *os.File
+	size       int64
+	mutex      sync.Mutex
+}
+
+// OpenRotatingFile ... Append to the file, only the owner can read it
+func OpenRotatingFile(p string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{Path: p, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = fi.Size()
+	return nil
+}
+
+// backup ... Name of the nth rotated file
+func (rf *RotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", rf.Path, n)
+}
+
+// rotate ... Shift the backups up by one and start an empty file
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(rf.backup(rf.MaxBackups))
+	for n := rf.MaxBackups - 1; n > 0; n-- {
+		if err := os.Rename(rf.backup(n), rf.backup(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(rf.Path, rf.backup(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.open()
+}
+
+// Write ... Rotate first when b doesn't fit, an entry larger than MaxSize gets a file of its own
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.MaxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close ... Close the current file
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
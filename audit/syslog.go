@@ -0,0 +1,13 @@
+// +build !windows,!plan9
+
+package audit
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog ... Entries are security relevant so they go to the authpriv facility
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTHPRIV, tag)
+}
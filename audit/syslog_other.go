@@ -0,0 +1,13 @@
+// +build windows plan9
+
+package audit
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog ... There is no syslog to send to
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return nil, errors.New("Syslog is not supported on this platform, use an audit file")
+}
@@ -0,0 +1,207 @@
+package buse
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultUmask ... Applied to 0777 for directories and 0666 for files when the device doesn't store modes
+	DefaultUmask = os.FileMode(0022)
+)
+
+// attr ... Fill in the mode and owner of a key, falling back to the mount level uid, gid and umask
+func (fd *FuseSimpleDevice) attr(key string, dir bool, attr *fuse.Attr) error {
+	attr.Inode = fd.inodes.Inode(key)
+	attr.Uid = fd.Uid
+	attr.Gid = fd.Gid
+	if dir {
+		attr.Mode = os.ModeDir | (0777 &^ fd.Umask)
+	} else {
+		attr.Mode = 0666 &^ fd.Umask
+	}
+	if fd.attrs == nil {
+		return nil
+	}
+	a, err := fd.attrs.GetAttr(key)
+	if err == api.ErrNoAttr {
+		return nil
+	}
+	if err != nil {
+		return errno(err)
+	}
+	attr.Mode = (attr.Mode & os.ModeType) | a.Mode.Perm()
+	attr.Uid = a.Uid
+	attr.Gid = a.Gid
+	return nil
+}
+
+// setattr ... Store mode and owner changes, devices without an AttrStore can't change them
+func (fd *FuseSimpleDevice) setattr(key string, dir bool, req *fuse.SetattrRequest) error {
+	if !req.Valid.Mode() && !req.Valid.Uid() && !req.Valid.Gid() {
+		return nil
+	}
+	if fd.attrs == nil {
+		return errno(api.ErrNotSupported)
+	}
+	current := &fuse.Attr{}
+	if err := fd.attr(key, dir, current); err != nil {
+		return err
+	}
+	a := api.Attributes{Mode: current.Mode.Perm(), Uid: current.Uid, Gid: current.Gid}
+	if req.Valid.Mode() {
+		a.Mode = req.Mode.Perm()
+	}
+	if req.Valid.Uid() {
+		a.Uid = req.Uid
+	}
+	if req.Valid.Gid() {
+		a.Gid = req.Gid
+	}
+	return errno(fd.attrs.SetAttr(key, a))
+}
+
+// xattrErrno ... Missing names and missing support have their own errors in fuse
+func xattrErrno(err error) error {
+	if err == api.ErrNoXattr {
+		return fuse.ErrNoXattr
+	}
+	return errno(err)
+}
+
+func (fd *FuseSimpleDevice) getxattr(key string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if fd.xattrs == nil {
+		return fuse.ENOTSUP
+	}
+	value, err := fd.xattrs.GetXattr(key, req.Name)
+	if err != nil {
+		return xattrErrno(err)
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func (fd *FuseSimpleDevice) listxattr(key string, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if fd.xattrs == nil {
+		return fuse.ENOTSUP
+	}
+	names, err := fd.xattrs.ListXattr(key)
+	if err != nil {
+		return xattrErrno(err)
+	}
+	resp.Append(names...)
+	return nil
+}
+
+func (fd *FuseSimpleDevice) setxattr(key string, req *fuse.SetxattrRequest) error {
+	if fd.xattrs == nil {
+		return fuse.ENOTSUP
+	}
+	value := make([]byte, len(req.Xattr))
+	copy(value, req.Xattr)
+	return xattrErrno(fd.xattrs.SetXattr(key, req.Name, value))
+}
+
+func (fd *FuseSimpleDevice) removexattr(key string, req *fuse.RemovexattrRequest) error {
+	if fd.xattrs == nil {
+		return fuse.ENOTSUP
+	}
+	return xattrErrno(fd.xattrs.RemoveXattr(key, req.Name))
+}
+
+// Setattr ... Change the mode or owner of a directory
+func (fdd *FDDir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer fdd.FS.logOp("setattr", fdd.Key, time.Now(), &err)
+	defer fdd.FS.Audit.Op(audit.Setattr, req.Header, fdd.Key, 0, &err)
+	return fdd.FS.setattr(fdd.Key, true, req)
+}
+
+// Getxattr ... Read an extended attribute
+func (fdd *FDDir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return fdd.FS.getxattr(fdd.Key, req, resp)
+}
+
+// Listxattr ... List the extended attributes
+func (fdd *FDDir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return fdd.FS.listxattr(fdd.Key, req, resp)
+}
+
+// Setxattr ... Write an extended attribute
+func (fdd *FDDir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return fdd.FS.setxattr(fdd.Key, req)
+}
+
+// Removexattr ... Remove an extended attribute
+func (fdd *FDDir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return fdd.FS.removexattr(fdd.Key, req)
+}
+
+// Getxattr ... Read an extended attribute
+func (fdf *FDFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return fdf.FS.getxattr(fdf.Key, req, resp)
+}
+
+// Listxattr ... List the extended attributes
+func (fdf *FDFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return fdf.FS.listxattr(fdf.Key, req, resp)
+}
+
+// Setxattr ... Write an extended attribute
+func (fdf *FDFile) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return fdf.FS.setxattr(fdf.Key, req)
+}
+
+// Removexattr ... Remove an extended attribute
+func (fdf *FDFile) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return fdf.FS.removexattr(fdf.Key, req)
+}
+
+// Setattr ... Change the mode or owner of a stream
+func (fds *FDStreamFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer fds.FS.logOp("setattr", fds.Key, time.Now(), &err)
+	defer fds.FS.Audit.Op(audit.Setattr, req.Header, fds.Key, audit.SetattrSize(req), &err)
+	return fds.FS.setattr(fds.Key, false, req)
+}
+
+// Getxattr ... Read an extended attribute
+func (fds *FDStreamFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return fds.FS.getxattr(fds.Key, req, resp)
+}
+
+// Listxattr ... List the extended attributes
+func (fds *FDStreamFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return fds.FS.listxattr(fds.Key, req, resp)
+}
+
+// Setxattr ... Write an extended attribute
+func (fds *FDStreamFile) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return fds.FS.setxattr(fds.Key, req)
+}
+
+// Removexattr ... Remove an extended attribute
+func (fds *FDStreamFile) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return fds.FS.removexattr(fds.Key, req)
+}
+
+var (
+	_ fs.NodeSetattrer     = (*FDDir)(nil)
+	_ fs.NodeGetxattrer    = (*FDDir)(nil)
+	_ fs.NodeListxattrer   = (*FDDir)(nil)
+	_ fs.NodeSetxattrer    = (*FDDir)(nil)
+	_ fs.NodeRemovexattrer = (*FDDir)(nil)
+	_ fs.NodeGetxattrer    = (*FDFile)(nil)
+	_ fs.NodeListxattrer   = (*FDFile)(nil)
+	_ fs.NodeSetxattrer    = (*FDFile)(nil)
+	_ fs.NodeRemovexattrer = (*FDFile)(nil)
+	_ fs.NodeSetattrer     = (*FDStreamFile)(nil)
+	_ fs.NodeGetxattrer    = (*FDStreamFile)(nil)
+	_ fs.NodeListxattrer   = (*FDStreamFile)(nil)
+	_ fs.NodeSetxattrer    = (*FDStreamFile)(nil)
+	_ fs.NodeRemovexattrer = (*FDStreamFile)(nil)
+)
@@ -0,0 +1,78 @@
+package buse
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/loopback"
+	"golang.org/x/net/context"
+)
+
+func TestAttrFallback(t *testing.T) {
+	fd, _ := NewFuseSimpleDevice("/mnt/test", &listDevice{})
+	fd.Uid, fd.Gid, fd.Umask = 100, 200, 0027
+	ctx := context.Background()
+
+	attr := &fuse.Attr{}
+	(&FDFile{Key: "/mnt/test/a", FS: fd}).Attr(ctx, attr)
+	if attr.Mode != 0640 || attr.Uid != 100 || attr.Gid != 200 {
+		t.Errorf("Expected mount level mode 0640 owner 100:200 however got %s %d:%d", attr.Mode, attr.Uid, attr.Gid)
+	}
+	(&FDDir{Key: "/mnt/test", FS: fd}).Attr(ctx, attr)
+	if attr.Mode != os.ModeDir|0750 {
+		t.Errorf("Expected directory mode 0750 however got %s", attr.Mode)
+	}
+
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0600}
+	if err := (&FDFile{Key: "/mnt/test/a", FS: fd}).Setattr(ctx, req, &fuse.SetattrResponse{}); err != fuse.Errno(fuse.ENOTSUP) {
+		t.Errorf("Expected chmod to be unsupported without an AttrStore however got %v", err)
+	}
+	err := (&FDFile{Key: "/mnt/test/a", FS: fd}).Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.a"})
+	if err != fuse.ENOTSUP {
+		t.Errorf("Expected setxattr to be unsupported without an XattrStore however got %v", err)
+	}
+}
+
+func TestAttrStore(t *testing.T) {
+	device, _ := loopback.NewMemoryLoopbackKV("/mnt/test", nil)
+	fd, _ := NewFuseSimpleDevice("/mnt/test", device)
+	ctx := context.Background()
+	node := &FDFile{Key: "/mnt/test/a", FS: fd}
+
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrMode | fuse.SetattrUid, Mode: 0600, Uid: 42}
+	if err := node.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatalf("Failed to chmod %s", err)
+	}
+	attr := &fuse.Attr{}
+	node.Attr(ctx, attr)
+	if attr.Mode != 0600 || attr.Uid != 42 || attr.Gid != fd.Gid {
+		t.Errorf("Expected mode 0600 owner 42:%d however got %s %d:%d", fd.Gid, attr.Mode, attr.Uid, attr.Gid)
+	}
+
+	if err := node.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.color", Xattr: []byte("blue")}); err != nil {
+		t.Fatalf("Failed to setxattr %s", err)
+	}
+	resp := &fuse.GetxattrResponse{}
+	if err := node.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.color"}, resp); err != nil || string(resp.Xattr) != "blue" {
+		t.Errorf("Expected xattr blue however got %s error %v", string(resp.Xattr), err)
+	}
+	list := &fuse.ListxattrResponse{}
+	node.Listxattr(ctx, &fuse.ListxattrRequest{}, list)
+	if string(list.Xattr) != "user.color\x00" {
+		t.Errorf("Expected one xattr name however got %q", string(list.Xattr))
+	}
+	node.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.color"})
+	if err := node.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.color"}, resp); err != fuse.ErrNoXattr {
+		t.Errorf("Expected ErrNoXattr after remove however got %v", err)
+	}
+
+	ro, _ := api.Wrap(device, []api.WrapperConfig{{Type: api.WrapperReadOnly}})
+	fd, _ = NewFuseSimpleDevice("/mnt/test", ro)
+	err := (&FDFile{Key: "/mnt/test/a", FS: fd}).Setattr(ctx, req, &fuse.SetattrResponse{})
+	if err != fuse.Errno(syscall.EROFS) {
+		t.Errorf("Expected chmod through a read only wrapper to be EROFS however got %v", err)
+	}
+}
@@ -2,91 +2,308 @@
 package buse
 
 import (
-	"fmt"
-	"hash/crc64"
-	"log"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/inode"
+	"github.com/lateefj/shylock/logger"
 	"github.com/lateefj/shylock/qos"
 	"golang.org/x/net/context"
 )
 
-var (
-	crc = crc64.MakeTable(crc64.ECMA)
-)
-
-// Get the checksum for a key
-func checksum(key string) uint64 {
-	return crc64.Checksum([]byte(key), crc)
+// errno ... Map api errors to what the kernel expects, devices can also return a syscall.Errno
+func errno(err error) error {
+	if e, ok := err.(syscall.Errno); ok {
+		return fuse.Errno(e)
+	}
+	switch err {
+	case api.ErrReadOnly:
+		return fuse.Errno(syscall.EROFS)
+	case api.ErrNotSupported:
+		return fuse.Errno(syscall.ENOTSUP)
+	case api.ErrWouldBlock:
+		return fuse.Errno(syscall.EAGAIN)
+	case os.ErrNotExist:
+		return fuse.ENOENT
+	}
+	return err
 }
 
 // Fuse ... Fuse wrapper
 type FuseSimpleDevice struct {
 	MountPoint string
 	api.SimpleDevice
-	fuseConn *fuse.Conn
+	// ReadAhead ... Size of the read ahead buffer for each open stream
+	ReadAhead int
+	// WriteBuffer ... Size of the write buffer for each open stream
+	WriteBuffer int
+	// Uid ... Owner of keys the device has no attributes for
+	Uid uint32
+	// Gid ... Group of keys the device has no attributes for
+	Gid uint32
+	// Umask ... Removed from the default modes of keys the device has no attributes for
+	Umask os.FileMode
+	// Kernel ... Mount options, default permissions are always on
+	Kernel KernelOptions
+	// IOMap ... Read and write limits looked up by file key, nil means no limits
+	IOMap *qos.IOMap
+	// Log ... Every request is logged at debug with the op, path and latency
+	Log *logger.Logger
+	// Audit ... Records creates, writes, removes, setattrs and refused mkdirs and renames, nil records nothing
+	Audit  *audit.Auditor
+	stream api.StreamDevice
+	attrs  api.AttrStore
+	xattrs api.XattrStore
+	life   lifecycle
+	server *fs.Server
+	// watching ... When the device pushes changes the kernel page cache is safe to use
+	watching  bool
+	stopWatch context.CancelFunc
+	// sizes ... File sizes while watching so getattr doesn't read the body, dropped when a key changes
+	sizes map[string]uint64
+	// inodes ... Stable inode numbers for the life of the mount
+	inodes  *inode.Table
+	nodes   map[string]fs.Node
+	handles map[fuse.HandleID]*FDHandle
+	// opened ... Handles by key from the moment Open or Create returns them, before their id is known
+	opened map[string]map[*FDHandle]bool
+	mutex  sync.Mutex
 }
 
-// NewFuse ... Create a new Fuse instance
+// NewFuse ... Create a new Fuse instance, devices that also implement api.StreamDevice are served as streams.
+// Keys are owned by the mounting user unless the device implements api.AttrStore
 func NewFuseSimpleDevice(mountPoint string, device api.SimpleDevice) (*FuseSimpleDevice, error) {
-	return &FuseSimpleDevice{MountPoint: mountPoint, SimpleDevice: device}, nil
+	fd := &FuseSimpleDevice{MountPoint: path.Clean(mountPoint), SimpleDevice: device, ReadAhead: DefaultReadAhead, WriteBuffer: DefaultWriteBuffer, nodes: make(map[string]fs.Node), handles: make(map[fuse.HandleID]*FDHandle), opened: make(map[string]map[*FDHandle]bool), sizes: make(map[string]uint64)}
+	fd.inodes = inode.NewTable(fd.MountPoint)
+	fd.Uid = uint32(os.Getuid())
+	fd.Gid = uint32(os.Getgid())
+	fd.Umask = DefaultUmask
+	fd.Log = logger.Default().With("mount_point", fd.MountPoint)
+	if sd, ok := api.AsStreamDevice(device); ok {
+		fd.stream = sd
+	}
+	if as, ok := api.AsAttrStore(device); ok {
+		fd.attrs = as
+	}
+	if xs, ok := api.AsXattrStore(device); ok {
+		fd.xattrs = xs
+	}
+	return fd, nil
 }
 
-// fsNode ... Looks up the in device
-func (fd *FuseSimpleDevice) fsNode(ctx context.Context, key string) (fs.Node, error) {
+// SetLogger ... Use l for the device and hand it to the api device when it logs
+func (fd *FuseSimpleDevice) SetLogger(l *logger.Logger) {
+	fd.Log = l
+	logger.Inject(fd.SimpleDevice, l)
+}
+
+// SetAuditor ... Record the mutating requests of the mount
+func (fd *FuseSimpleDevice) SetAuditor(a *audit.Auditor) {
+	fd.Audit = a
+}
+
+func (fd *FuseSimpleDevice) log() *logger.Logger {
+	if fd.Log == nil {
+		return logger.Default()
+	}
+	return fd.Log
+}
+
+// logOp ... Requests are logged at debug, failures other than a missing key at warn
+func (fd *FuseSimpleDevice) logOp(op, key string, start time.Time, errp *error) {
+	var err error
+	if errp != nil {
+		err = *errp
+	}
+	l := fd.log()
+	level := logger.DebugLevel
+	if en, ok := err.(fuse.ErrorNumber); err != nil && (!ok || en.Errno() != fuse.ENOENT) {
+		level = logger.WarnLevel
+	}
+	if !l.Enabled(level) {
+		return
+	}
+	kv := []interface{}{"op", op, "path", key, "latency", time.Since(start)}
+	if err != nil {
+		kv = append(kv, "error", err)
+		if level == logger.WarnLevel {
+			l.Warn("Fuse request failed", kv...)
+			return
+		}
+	}
+	l.Debug("Fuse request", kv...)
+}
+
+func isDir(key string) bool {
+	return strings.HasSuffix(key, "/")
+}
+
+// cachedNode ... The same node has to be returned for a key so the kernel cache can be invalidated
+func (fd *FuseSimpleDevice) cachedNode(key string) (fs.Node, bool) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	n, exists := fd.nodes[key]
+	return n, exists
+}
+
+// cacheNode ... Keep the first node created for a key
+func (fd *FuseSimpleDevice) cacheNode(key string, n fs.Node) fs.Node {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	if existing, exists := fd.nodes[key]; exists {
+		return existing
+	}
+	fd.nodes[key] = n
+	return n
+}
+
+// forgetNode ... Drop a removed key from the cache, recreating it gets a new inode
+func (fd *FuseSimpleDevice) forgetNode(key string) (fs.Node, bool) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	n, exists := fd.nodes[key]
+	delete(fd.nodes, key)
+	delete(fd.sizes, key)
+	fd.inodes.Forget(key)
+	return n, exists
+}
 
-	if key[:len(key)-1] == "/" {
-		return &FDDir{FS: fd, Key: key}, nil
+// size ... Size of a file, read from the device once and kept until the key changes
+func (fd *FuseSimpleDevice) size(key string) (uint64, error) {
+	fd.mutex.Lock()
+	s, exists := fd.sizes[key]
+	fd.mutex.Unlock()
+	if exists {
+		return s, nil
 	}
 	f, err := fd.SimpleDevice.Open(key)
 	if err != nil {
-		return nil, err
+		return 0, errno(err)
+	}
+	defer f.Close()
+	bits, err := f.Read()
+	if err != nil {
+		return 0, errno(err)
 	}
-	return &FDFile{FS: fd, Key: key, File: f}, nil
+	s = uint64(len(bits))
+	fd.setSize(key, s)
+	return s, nil
+}
+
+// setSize ... Keep the size of a file while watching
+func (fd *FuseSimpleDevice) setSize(key string, s uint64) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	if fd.watching {
+		fd.sizes[key] = s
+	}
+}
+
+// forgetSize ... The key changed so the next getattr reads it again
+func (fd *FuseSimpleDevice) forgetSize(key string) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	delete(fd.sizes, key)
+}
+
+// fsNode ... Looks up the in device
+func (fd *FuseSimpleDevice) fsNode(ctx context.Context, key string, dir bool) (fs.Node, error) {
+	if n, exists := fd.cachedNode(key); exists {
+		return n, nil
+	}
+	if dir || isDir(key) {
+		return fd.cacheNode(key, &FDDir{FS: fd, Key: key}), nil
+	}
+	if fd.stream != nil {
+		return fd.cacheNode(key, &FDStreamFile{FS: fd, Key: key}), nil
+	}
+	return fd.cacheNode(key, &FDFile{FS: fd, Key: key}), nil
 }
 
 // Root ... Required for fuse system
 func (fd *FuseSimpleDevice) Root() (fs.Node, error) {
-	return fd.fsNode(context.Background(), fd.MountPoint)
+	return fd.fsNode(context.Background(), fd.MountPoint, true)
 }
 
-// Mount ... Connect to fuse
+// Mount ... Connect to fuse and serve until unmounted
 func (fd *FuseSimpleDevice) Mount(mountPoint string, ioMap *qos.IOMap) error {
 
-	var err error
-	fd.fuseConn, err = fuse.Mount(mountPoint)
+	// The kernel checks the mode and owner from Attr on every access
+	ko := fd.Kernel
+	ko.DefaultPermissions = true
+	c, err := fuse.Mount(mountPoint, ko.mountOptions()...)
 	if err != nil {
+		fd.life.ready(err)
 		return err
 	}
-	defer fd.fuseConn.Close()
+	srv := fs.New(c, nil)
+	fd.mutex.Lock()
+	if ioMap != nil {
+		fd.IOMap = ioMap
+	}
+	fd.server = srv
+	fd.mutex.Unlock()
+	fd.life.start(mountPoint, c)
+	defer fd.Unmount()
+
+	fd.watch()
 
-	err = fs.Serve(fd.fuseConn, fd)
+	go fd.life.waitReady(c)
+	err = srv.Serve(fd)
+	fd.life.served()
 	if err != nil {
 		return err
 	}
-	// check if the mount process has an error to report
-	<-fd.fuseConn.Ready
-	if err := fd.fuseConn.MountError; err != nil {
-		log.Printf("Failed to mount because %s", err)
-	}
-	if err == nil {
-		fmt.Printf("Fuse mount successful for mount point %s\n", mountPoint)
+	// Serve also returns when the mount failed
+	<-c.Ready
+	return c.MountError
+}
+
+// OnReady ... f is called with nil once the kernel has mounted the device or with why it failed
+func (fd *FuseSimpleDevice) OnReady(f func(error)) {
+	fd.life.notifyReady(f)
+}
+
+// Health ... The fuse connection is being served and the device can reach its backend
+func (fd *FuseSimpleDevice) Health(ctx context.Context) error {
+	if err := fd.life.health(); err != nil {
+		return err
 	}
-	return err
+	return api.CheckHealth(ctx, fd.SimpleDevice)
 }
+
 func (fd *FuseSimpleDevice) Exit() error {
 	return fd.Unmount()
 }
-// Unmount ... Unmount hook
+
+// Unmount ... Same as Shutdown waiting DefaultShutdownTimeout, safe to call more than once
 func (fd *FuseSimpleDevice) Unmount() error {
-	if fd.fuseConn != nil {
-		return fd.fuseConn.Close()
-	}
-	return nil
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	return fd.Shutdown(ctx)
+}
+
+// Shutdown ... Unmount so no new requests come in, wait for the ones in flight until ctx is done and
+// then unmount the device so it can flush
+func (fd *FuseSimpleDevice) Shutdown(ctx context.Context) error {
+	return fd.life.stop(ctx, func() error {
+		fd.mutex.Lock()
+		stopWatch := fd.stopWatch
+		fd.stopWatch = nil
+		fd.mutex.Unlock()
+		if stopWatch != nil {
+			stopWatch()
+		}
+		return fd.SimpleDevice.Unmount()
+	})
 }
 
 // FDDir ... Directory entry which is not really a thing
@@ -97,32 +314,33 @@ type FDDir struct {
 
 // Attr ... Required for fuse
 func (fdd *FDDir) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = checksum(fdd.Key)
-	attr.Mode = os.ModeDir | 0655
-	return nil
+	return fdd.FS.attr(fdd.Key, true, attr)
 }
 
 var _ fs.Node = (*FDDir)(nil)
 
 // ReadDirAll ... Get everything in a directory
-func (fdd *FDDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+func (fdd *FDDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer fdd.FS.logOp("readdir", fdd.Key, time.Now(), &err)
 	// Refresh the directory listing
 	fileNames, err := fdd.FS.SimpleDevice.List(fdd.Key)
 	if err != nil {
-		return make([]fuse.Dirent, 0), err
+		return make([]fuse.Dirent, 0), errno(err)
 	}
 	nodes := make([]fuse.Dirent, len(fileNames))
 	for i := 0; i < len(fileNames); i++ {
 		n := fileNames[i]
 		var t fuse.DirentType
-		if n[:len(n)-1] == "/" {
+		if isDir(n) {
 			t = fuse.DT_Dir
+			// Directory nodes are keyed without the slash
+			n = strings.TrimSuffix(n, "/")
 		} else {
 			t = fuse.DT_File
 		}
 
 		nodes[i] = fuse.Dirent{
-			Inode: checksum(n),
+			Inode: fdd.FS.inodes.Inode(n),
 			Name:  path.Base(n),
 			Type:  t,
 		}
@@ -133,95 +351,165 @@ func (fdd *FDDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 var _ = fs.HandleReadDirAller(&FDDir{})
 
 // Lookup ... Fuse lookup
-func (fdd *FDDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
-
-	fmt.Printf("Lookup request %s\n", req.Name)
-	return fdd.FS.fsNode(ctx, path.Join(fdd.Key, req.Name))
+func (fdd *FDDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node, err error) {
+	p := path.Join(fdd.Key, req.Name)
+	defer fdd.FS.logOp("lookup", p, time.Now(), &err)
+	// The listing decides if a name is a file, a directory or doesn't exist
+	names, err := fdd.FS.SimpleDevice.List(fdd.Key)
+	if err != nil {
+		return nil, errno(err)
+	}
+	for _, n := range names {
+		if n != p && n != p+"/" {
+			continue
+		}
+		// A key created again after a remove gets a new generation along with its new inode
+		resp.Generation = fdd.FS.inodes.Lookup(p).Generation
+		return fdd.FS.fsNode(ctx, p, n != p)
+	}
+	return nil, fuse.ENOENT
 }
 
 var _ = fs.NodeRequestLookuper(&FDDir{})
 
+// Remove ... Remove a file from the device
+func (fdd *FDDir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	p := path.Join(fdd.Key, req.Name)
+	defer fdd.FS.logOp("remove", p, time.Now(), &err)
+	defer fdd.FS.Audit.Op(audit.Remove, req.Header, p, 0, &err)
+	if err := fdd.FS.SimpleDevice.Remove(p); err != nil {
+		return errno(err)
+	}
+	fdd.FS.forgetNode(p)
+	return nil
+}
+
+var _ = fs.NodeRemover(&FDDir{})
+
+// Mkdir ... Directories only exist through the keys in them, the attempt is still audited
+func (fdd *FDDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	p := path.Join(fdd.Key, req.Name)
+	defer fdd.FS.logOp("mkdir", p, time.Now(), &err)
+	defer fdd.FS.Audit.Op(audit.Mkdir, req.Header, p, 0, &err)
+	return nil, errno(api.ErrNotSupported)
+}
+
+var _ = fs.NodeMkdirer(&FDDir{})
+
+// Rename ... Devices can't move keys, the attempt is still audited
+func (fdd *FDDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	p := path.Join(fdd.Key, req.OldName)
+	defer fdd.FS.logOp("rename", p, time.Now(), &err)
+	np := req.NewName
+	if nd, ok := newDir.(*FDDir); ok {
+		np = path.Join(nd.Key, req.NewName)
+	}
+	defer fdd.FS.Audit.Rename(req.Header, p, np, &err)
+	return errno(api.ErrNotSupported)
+}
+
+var _ = fs.NodeRenamer(&FDDir{})
+
 // Create ... file creating implementation
-func (fdd *FDDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	fmt.Printf("Trying to create file %s\n", req.Name)
+func (fdd *FDDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
 	p := path.Join(fdd.Key, req.Name)
-	f, err := fdd.FS.SimpleDevice.Open(p)
+	defer fdd.FS.logOp("create", p, time.Now(), &err)
+	defer fdd.FS.Audit.Op(audit.Create, req.Header, p, 0, &err)
+	if fdd.FS.stream != nil {
+		sf, err := fdd.FS.stream.OpenStream(p)
+		if err != nil {
+			return nil, nil, errno(err)
+		}
+		resp.Flags |= fuse.OpenDirectIO
+		n := fdd.FS.cacheNode(p, &FDStreamFile{Key: p, FS: fdd.FS})
+		return n, &FDStreamHandle{File: sf, FS: fdd.FS, Key: p}, nil
+	}
+	fdh, err := fdd.FS.openHandle(p, true)
 	if err != nil {
 		return nil, nil, err
 	}
-	err = f.Write([]byte(""))
-	if err != nil {
+	// Commit the empty file so it shows up in listings before the first flush
+	if err := fdh.commit(); err != nil {
+		fdh.File.Close()
 		return nil, nil, err
 	}
+	resp.Flags |= fuse.OpenDirectIO
+	n := fdd.FS.cacheNode(p, &FDFile{Key: p, FS: fdd.FS})
+	fdd.FS.registerHandle(fdh)
 
-	fdf := &FDFile{Key: p, File: f, FS: fdd.FS}
-
-	return fdf, fdf, nil
+	return n, fdh, nil
 }
 
 var _ = fs.NodeCreater(&FDDir{})
 
-// FDFile ... File entry in Device
+// FDFile ... File entry in Device, all the state of an open file lives in its FDHandle
 type FDFile struct {
-	File api.SimpleFile
-	Key  string
-	FS   *FuseSimpleDevice
+	Key string
+	FS  *FuseSimpleDevice
 }
 
 // Attr ... Fuse atter
 func (fdf *FDFile) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Mode = 0555
-	if fdf.File != nil {
-		attr.Inode = checksum(fdf.Key)
-		// TODO: Maybe be worth setting the size
-		//attr.Size = uint64(fdf.File.Size())
+	if err := fdf.FS.attr(fdf.Key, false, attr); err != nil {
+		return err
+	}
+	// The page cache needs the size to know how much to read
+	if fdf.FS.watching {
+		s, err := fdf.FS.size(fdf.Key)
+		if err != nil {
+			return err
+		}
+		attr.Size = s
 	}
 	return nil
 }
 
 var _ fs.Node = (*FDFile)(nil)
 
-// Open ... file should already be open
-func (fdf *FDFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	fmt.Printf("Open is being called  %s...\n", fdf.Key)
-	// Disable cache
-	resp.Flags |= fuse.OpenDirectIO
-	return fdf, nil
-}
-
-var _ fs.NodeOpener = (*FDFile)(nil)
-
-// Flush ... Basically closes the file
-func (fdf *FDFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	return fdf.File.Close()
-}
-
-var _ = fs.HandleFlusher(&FDFile{})
-
-// ReadAll ... Read entire file since it is a simple interface
-func (fdf *FDFile) ReadAll(ctx context.Context) ([]byte, error) {
-	if fdf.File == nil {
-		return make([]byte, 0), fuse.ENOENT
+// Open ... Every open gets its own handle so one process can't close the file for another
+func (fdf *FDFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer fdf.FS.logOp("open", fdf.Key, time.Now(), &err)
+	if fdf.FS.watching {
+		// Changes invalidate the cache so keep it between opens
+		resp.Flags |= fuse.OpenKeepCache
+	} else {
+		// Disable cache
+		resp.Flags |= fuse.OpenDirectIO
 	}
-	bits, err := fdf.File.Read()
+	fdh, err := fdf.FS.openHandle(fdf.Key, req.Flags&fuse.OpenTruncate != 0)
 	if err != nil {
-		return make([]byte, 0), err
+		return nil, err
 	}
-	return bits, nil
+	fdf.FS.registerHandle(fdh)
+	return fdh, nil
 }
 
-var _ = fs.HandleReadAller(&FDFile{})
-
-// Write ... Implements write fuse handler
-func (fdf *FDFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+var _ fs.NodeOpener = (*FDFile)(nil)
 
-	err := fdf.File.Write(req.Data)
+// Setattr ... Mode and owner go to the device, truncating an open handle only touches its buffer
+func (fdf *FDFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer fdf.FS.logOp("setattr", fdf.Key, time.Now(), &err)
+	defer fdf.FS.Audit.Op(audit.Setattr, req.Header, fdf.Key, audit.SetattrSize(req), &err)
+	if err := fdf.FS.setattr(fdf.Key, false, req); err != nil {
+		return err
+	}
+	if !req.Valid.Size() {
+		return nil
+	}
+	if req.Valid.Handle() {
+		if fdh, exists := fdf.FS.handleFor(req.Handle, fdf.Key); exists {
+			return fdh.truncate(req.Size)
+		}
+	}
+	fdh, err := fdf.FS.openHandle(fdf.Key, false)
 	if err != nil {
 		return err
 	}
-
-	resp.Size = len(req.Data)
-	return err
+	if err := fdh.truncate(req.Size); err != nil {
+		fdh.File.Close()
+		return err
+	}
+	return fdh.close()
 }
 
-var _ = fs.HandleWriter(&FDFile{})
+var _ fs.NodeSetattrer = (*FDFile)(nil)
@@ -0,0 +1,116 @@
+package buse
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/api"
+	"golang.org/x/net/context"
+)
+
+// listDevice ... Device with a fixed listing
+type listDevice struct {
+	names []string
+}
+
+func (ld *listDevice) Mount(config []byte) error {
+	return nil
+}
+func (ld *listDevice) Unmount() error {
+	return nil
+}
+func (ld *listDevice) List(path string) ([]string, error) {
+	return ld.names, nil
+}
+func (ld *listDevice) Remove(path string) error {
+	return nil
+}
+func (ld *listDevice) Open(path string) (api.SimpleFile, error) {
+	return &memFile{}, nil
+}
+
+func TestInodesMatchDirents(t *testing.T) {
+	fd, _ := NewFuseSimpleDevice("/mnt/test/", &listDevice{names: []string{"/mnt/test/a", "/mnt/test/sub/"}})
+	ctx := context.Background()
+	root, _ := fd.Root()
+	attr := &fuse.Attr{}
+	root.Attr(ctx, attr)
+	if attr.Inode != 1 {
+		t.Errorf("Expected root inode 1 however got %d", attr.Inode)
+	}
+	dirents, err := root.(*FDDir).ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, de := range dirents {
+		n, err := root.(*FDDir).Lookup(ctx, &fuse.LookupRequest{Name: de.Name}, &fuse.LookupResponse{})
+		if err != nil {
+			t.Fatalf("Failed to lookup %s %s", de.Name, err)
+		}
+		attr := &fuse.Attr{}
+		n.Attr(ctx, attr)
+		if attr.Inode != de.Inode {
+			t.Errorf("Expected %s to have dirent inode %d however Attr has %d", de.Name, de.Inode, attr.Inode)
+		}
+	}
+	if dirents[0].Inode == dirents[1].Inode {
+		t.Errorf("Expected different keys to have different inodes")
+	}
+
+	before := dirents[0].Inode
+	resp := &fuse.LookupResponse{}
+	root.(*FDDir).Lookup(ctx, &fuse.LookupRequest{Name: "a"}, resp)
+	generation := resp.Generation
+	root.(*FDDir).Remove(ctx, &fuse.RemoveRequest{Name: "a"})
+	if fd.inodes.Inode("/mnt/test/a") == before {
+		t.Errorf("Expected a removed key to get a new inode")
+	}
+	root.(*FDDir).Lookup(ctx, &fuse.LookupRequest{Name: "a"}, resp)
+	if resp.Generation <= generation {
+		t.Errorf("Expected lookup of a recreated key to move the generation on from %d however got %d", generation, resp.Generation)
+	}
+}
+
+// countDevice ... Counts the opens of a shared body
+type countDevice struct {
+	sharedDevice
+	opens int
+}
+
+func (cd *countDevice) Open(path string) (api.SimpleFile, error) {
+	cd.opens++
+	return cd.sharedDevice.Open(path)
+}
+
+func TestFDFileAttrSizeCached(t *testing.T) {
+	device := &countDevice{sharedDevice: sharedDevice{body: []byte("hello world")}}
+	fd, _ := NewFuseSimpleDevice("/mnt/test", device)
+	fd.watching = true
+	ctx := context.Background()
+	node := &FDFile{Key: "/mnt/test/a", FS: fd}
+	size := func() uint64 {
+		attr := &fuse.Attr{}
+		if err := node.Attr(ctx, attr); err != nil {
+			t.Fatal(err)
+		}
+		return attr.Size
+	}
+	if size() != 11 || size() != 11 || device.opens != 1 {
+		t.Errorf("Expected the size to be read once however the device was opened %d times", device.opens)
+	}
+	device.body = []byte("hi")
+	fd.invalidate(api.Event{Type: api.EventUpdate, Path: "/mnt/test/a"})
+	if s := size(); s != 2 || device.opens != 2 {
+		t.Errorf("Expected a change to read the size again however got %d after %d opens", s, device.opens)
+	}
+
+	h, _ := node.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	write(t, h.(*FDHandle), 1, 0, "hello")
+	if err := h.(*FDHandle).Flush(ctx, &fuse.FlushRequest{Handle: 1}); err != nil {
+		t.Fatal(err)
+	}
+	opens := device.opens
+	if s := size(); s != 5 || device.opens != opens {
+		t.Errorf("Expected a flush to keep the new size however got %d", s)
+	}
+}
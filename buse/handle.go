@@ -0,0 +1,257 @@
+package buse
+
+import (
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"golang.org/x/net/context"
+)
+
+// FDHandle ... Open file with its own buffer. Writes stay in the buffer until flush or
+// release so other processes see them on their next open (close-to-open consistency)
+type FDHandle struct {
+	File   api.SimpleFile
+	Key    string
+	FS     *FuseSimpleDevice
+	mutex  sync.Mutex
+	body   []byte
+	loaded bool
+	dirty  bool
+	// tracked ... The kernel id of the handle is known, guarded by the device mutex
+	tracked bool
+	// writer ... Who wrote to the buffer since the last commit, the write is audited when it reaches the device
+	writer  *fuse.Header
+	written int64
+}
+
+// openHandle ... Open the file in the device for a new handle, truncated handles start empty
+func (fd *FuseSimpleDevice) openHandle(key string, truncate bool) (*FDHandle, error) {
+	f, err := fd.SimpleDevice.Open(key)
+	if err != nil {
+		return nil, errno(err)
+	}
+	fdh := &FDHandle{File: f, Key: key, FS: fd}
+	if truncate {
+		fdh.body = make([]byte, 0)
+		fdh.loaded = true
+		fdh.dirty = true
+	}
+	return fdh, nil
+}
+
+// registerHandle ... Handles are registered by key as soon as Open or Create returns them so a
+// truncate through a handle that hasn't been read or written yet still finds it
+func (fd *FuseSimpleDevice) registerHandle(fdh *FDHandle) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	if fd.opened == nil {
+		fd.opened = make(map[string]map[*FDHandle]bool)
+	}
+	if fd.opened[fdh.Key] == nil {
+		fd.opened[fdh.Key] = make(map[*FDHandle]bool)
+	}
+	fd.opened[fdh.Key][fdh] = true
+}
+
+// trackHandle ... The kernel only tells us the handle id on requests so ids are added
+// to the table the first time a handle is used
+func (fd *FuseSimpleDevice) trackHandle(id fuse.HandleID, fdh *FDHandle) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	fd.track(id, fdh)
+}
+
+// track ... Must hold the mutex
+func (fd *FuseSimpleDevice) track(id fuse.HandleID, fdh *FDHandle) {
+	if fd.handles != nil {
+		fd.handles[id] = fdh
+		fdh.tracked = true
+	}
+}
+
+// handle ... Find an open handle by id
+func (fd *FuseSimpleDevice) handle(id fuse.HandleID) (*FDHandle, bool) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	fdh, exists := fd.handles[id]
+	return fdh, exists
+}
+
+// handleFor ... Find an open handle of a key by id. An id that hasn't been seen belongs to a handle of
+// the key that hasn't been used yet, when there is only one of those it must be the one
+func (fd *FuseSimpleDevice) handleFor(id fuse.HandleID, key string) (*FDHandle, bool) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	if fdh, exists := fd.handles[id]; exists {
+		return fdh, true
+	}
+	var found *FDHandle
+	for fdh := range fd.opened[key] {
+		if fdh.tracked {
+			continue
+		}
+		if found != nil {
+			return nil, false
+		}
+		found = fdh
+	}
+	if found == nil {
+		return nil, false
+	}
+	fd.track(id, found)
+	return found, true
+}
+
+// releaseHandle ... Drop a closed handle from the tables
+func (fd *FuseSimpleDevice) releaseHandle(id fuse.HandleID, fdh *FDHandle) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	if fd.handles[id] == fdh {
+		delete(fd.handles, id)
+	}
+	delete(fd.opened[fdh.Key], fdh)
+	if len(fd.opened[fdh.Key]) == 0 {
+		delete(fd.opened, fdh.Key)
+	}
+}
+
+// load ... Read the file the first time the handle needs it, must hold the mutex
+func (fdh *FDHandle) load() error {
+	if fdh.loaded {
+		return nil
+	}
+	bits, err := fdh.File.Read()
+	if err != nil {
+		return errno(err)
+	}
+	fdh.body = append([]byte(nil), bits...)
+	fdh.loaded = true
+	return nil
+}
+
+// truncate ... Change the size of the buffer
+func (fdh *FDHandle) truncate(size uint64) error {
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	if err := fdh.load(); err != nil {
+		return err
+	}
+	if size <= uint64(len(fdh.body)) {
+		fdh.body = fdh.body[:size]
+	} else {
+		fdh.body = append(fdh.body, make([]byte, size-uint64(len(fdh.body)))...)
+	}
+	fdh.dirty = true
+	return nil
+}
+
+// commit ... Write the buffer to the device when it has changed, must hold the mutex
+func (fdh *FDHandle) commit() error {
+	if !fdh.dirty {
+		return nil
+	}
+	err := fdh.File.Write(fdh.body)
+	if fdh.writer != nil {
+		fdh.FS.Audit.Op(audit.Write, *fdh.writer, fdh.Key, fdh.written, &err)
+	}
+	if err != nil {
+		return errno(err)
+	}
+	fdh.dirty = false
+	fdh.writer = nil
+	fdh.written = 0
+	fdh.FS.setSize(fdh.Key, uint64(len(fdh.body)))
+	return nil
+}
+
+// Read ... Serve reads from the handle buffer, the read budget is waited for without holding the handle
+func (fdh *FDHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer fdh.FS.logOp("read", fdh.Key, time.Now(), &err)
+	fdh.FS.trackHandle(req.Handle, fdh)
+	data, err := fdh.read(req.Offset, req.Size)
+	if err != nil {
+		return err
+	}
+	fdh.FS.checkoutRead(fdh.Key, len(data))
+	resp.Data = data
+	return nil
+}
+
+// read ... Copy of the buffer at offset
+func (fdh *FDHandle) read(offset int64, size int) ([]byte, error) {
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	if err := fdh.load(); err != nil {
+		return nil, err
+	}
+	if offset >= int64(len(fdh.body)) {
+		return make([]byte, 0), nil
+	}
+	end := offset + int64(size)
+	if end > int64(len(fdh.body)) {
+		end = int64(len(fdh.body))
+	}
+	return append([]byte(nil), fdh.body[offset:end]...), nil
+}
+
+var _ = fs.HandleReader(&FDHandle{})
+
+// Write ... Writes only change the buffer until the handle is flushed, the write budget is waited for
+// before taking the handle. The write is audited by the commit that sends it to the device
+func (fdh *FDHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer fdh.FS.logOp("write", fdh.Key, time.Now(), &err)
+	fdh.FS.trackHandle(req.Handle, fdh)
+	fdh.FS.checkoutWrite(fdh.Key, len(req.Data))
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	if err := fdh.load(); err != nil {
+		return err
+	}
+	end := req.Offset + int64(len(req.Data))
+	if end > int64(len(fdh.body)) {
+		fdh.body = append(fdh.body, make([]byte, end-int64(len(fdh.body)))...)
+	}
+	copy(fdh.body[req.Offset:], req.Data)
+	fdh.dirty = true
+	h := req.Header
+	fdh.writer = &h
+	fdh.written += int64(len(req.Data))
+	resp.Size = len(req.Data)
+	return nil
+}
+
+var _ = fs.HandleWriter(&FDHandle{})
+
+// Flush ... Commit buffered writes, called on every close of a file descriptor
+func (fdh *FDHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer fdh.FS.logOp("flush", fdh.Key, time.Now(), &err)
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	return fdh.commit()
+}
+
+var _ = fs.HandleFlusher(&FDHandle{})
+
+// Release ... Commit anything left and close the file
+func (fdh *FDHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer fdh.FS.logOp("release", fdh.Key, time.Now(), &err)
+	fdh.FS.releaseHandle(req.Handle, fdh)
+	return fdh.close()
+}
+
+var _ fs.HandleReleaser = (*FDHandle)(nil)
+
+// close ... Commit and close the file in the device
+func (fdh *FDHandle) close() error {
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	err := fdh.commit()
+	if cErr := fdh.File.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
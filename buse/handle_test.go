@@ -0,0 +1,225 @@
+package buse
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"golang.org/x/net/context"
+)
+
+// sharedFile ... Opens of the same key share the body but can be closed on their own
+type sharedFile struct {
+	body   *[]byte
+	closed bool
+}
+
+func (sf *sharedFile) Read() ([]byte, error) {
+	return *sf.body, nil
+}
+func (sf *sharedFile) Write(body []byte) error {
+	if sf.closed {
+		return fuse.EIO
+	}
+	*sf.body = append([]byte(nil), body...)
+	return nil
+}
+func (sf *sharedFile) Close() error {
+	sf.closed = true
+	return nil
+}
+
+// sharedDevice ... Device where every file is the same body
+type sharedDevice struct {
+	listDevice
+	body []byte
+}
+
+func (sd *sharedDevice) Open(path string) (api.SimpleFile, error) {
+	return &sharedFile{body: &sd.body}, nil
+}
+
+func read(t *testing.T, fdh *FDHandle, id fuse.HandleID) string {
+	resp := &fuse.ReadResponse{}
+	if err := fdh.Read(context.Background(), &fuse.ReadRequest{Handle: id, Size: 1024}, resp); err != nil {
+		t.Fatalf("Failed to read %s", err)
+	}
+	return string(resp.Data)
+}
+
+func write(t *testing.T, fdh *FDHandle, id fuse.HandleID, offset int64, data string) {
+	if err := fdh.Write(context.Background(), &fuse.WriteRequest{Handle: id, Offset: offset, Data: []byte(data)}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+}
+
+func TestFDHandlesAreSeparate(t *testing.T) {
+	device := &sharedDevice{body: []byte("hello world")}
+	fd, _ := NewFuseSimpleDevice("/mnt/test", device)
+	ctx := context.Background()
+	node := &FDFile{Key: "/mnt/test/a", FS: fd}
+
+	h1, err := node.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, _ := node.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	first, second := h1.(*FDHandle), h2.(*FDHandle)
+	if first == second {
+		t.Fatalf("Expected every open to get its own handle")
+	}
+
+	write(t, first, 1, 6, "there")
+	if string(device.body) != "hello world" {
+		t.Errorf("Expected writes to be buffered until flush however device has %s", string(device.body))
+	}
+	if got := read(t, first, 1); got != "hello there" {
+		t.Errorf("Expected the writing handle to see its own write however got %s", got)
+	}
+	if got := read(t, second, 2); got != "hello world" {
+		t.Errorf("Expected the other handle to keep what it opened however got %s", got)
+	}
+	if h, exists := fd.handle(1); !exists || h != first {
+		t.Errorf("Expected handle 1 to be in the handle table")
+	}
+
+	if err := first.Flush(ctx, &fuse.FlushRequest{Handle: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if string(device.body) != "hello there" {
+		t.Errorf("Expected flush to commit however device has %s", string(device.body))
+	}
+	if err := first.Release(ctx, &fuse.ReleaseRequest{Handle: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := fd.handle(1); exists {
+		t.Errorf("Expected release to drop the handle from the table")
+	}
+
+	// Closing one handle must not close the file for the other
+	write(t, second, 2, 0, "HELLO")
+	if err := second.Release(ctx, &fuse.ReleaseRequest{Handle: 2}); err != nil {
+		t.Fatalf("Expected the second handle to still be usable however got %s", err)
+	}
+	if string(device.body) != "HELLO world" {
+		t.Errorf("Expected release to commit the second handle however device has %s", string(device.body))
+	}
+
+	h3, _ := node.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if got := read(t, h3.(*FDHandle), 3); got != "HELLO world" {
+		t.Errorf("Expected a new open to see the last commit however got %s", got)
+	}
+}
+
+func TestFDHandleTruncate(t *testing.T) {
+	device := &sharedDevice{body: []byte("hello world")}
+	fd, _ := NewFuseSimpleDevice("/mnt/test", device)
+	ctx := context.Background()
+	node := &FDFile{Key: "/mnt/test/a", FS: fd}
+
+	// Truncate without an open handle goes straight to the device
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 5}
+	if err := node.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if string(device.body) != "hello" {
+		t.Errorf("Expected truncate to 5 however device has %s", string(device.body))
+	}
+
+	h, _ := node.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenTruncate}, &fuse.OpenResponse{})
+	fdh := h.(*FDHandle)
+	write(t, fdh, 7, 0, "new")
+	fdh.Release(ctx, &fuse.ReleaseRequest{Handle: 7})
+	if string(device.body) != "new" {
+		t.Errorf("Expected a truncating open to replace the body however device has %s", string(device.body))
+	}
+
+	// Truncate through a handle that hasn't been read or written yet
+	h, _ = node.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenTruncate}, &fuse.OpenResponse{})
+	fdh = h.(*FDHandle)
+	req = &fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrHandle, Handle: 8, Size: 5}
+	if err := node.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if tracked, _ := fd.handle(8); tracked != fdh {
+		t.Errorf("Expected the truncate to find the handle it came through")
+	}
+	write(t, fdh, 8, 0, "ab")
+	fdh.Release(ctx, &fuse.ReleaseRequest{Handle: 8})
+	if string(device.body) != "ab\x00\x00\x00" {
+		t.Errorf("Expected the truncate to survive the flush however device has %q", string(device.body))
+	}
+	if len(fd.opened) != 0 {
+		t.Errorf("Expected released handles to be dropped however got %v", fd.opened)
+	}
+}
+
+// auditBuffer ... Audit entries in memory
+type auditBuffer struct {
+	bytes.Buffer
+}
+
+func (ab *auditBuffer) Close() error {
+	return nil
+}
+
+func TestFDHandleAudit(t *testing.T) {
+	device := &sharedDevice{body: []byte("hello world")}
+	fd, _ := NewFuseSimpleDevice("/mnt/test", device)
+	buf := &auditBuffer{}
+	fd.SetAuditor(audit.NewWriter(buf, nil, nil))
+	ctx := context.Background()
+	node := &FDFile{Key: "/mnt/test/a", FS: fd}
+
+	h, _ := node.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	fdh := h.(*FDHandle)
+	read(t, fdh, 1)
+	req := &fuse.WriteRequest{Header: fuse.Header{Uid: 1000, Gid: 100, Pid: 42}, Handle: 1, Data: []byte("HELLO")}
+	if err := fdh.Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "" {
+		t.Errorf("Expected the write to be audited when it reaches the device however got %s", buf.String())
+	}
+	if err := fdh.Flush(ctx, &fuse.FlushRequest{Handle: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 5}, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the write and setattr to be audited and not the open or read however got %s", buf.String())
+	}
+	if !strings.Contains(lines[0], `"op":"write","path":"/mnt/test/a","size":5,"uid":1000,"gid":100,"pid":42,"result":"ok"`) {
+		t.Errorf("Expected the write with who made it however got %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"op":"setattr","path":"/mnt/test/a","size":5`) {
+		t.Errorf("Expected the truncate size however got %s", lines[1])
+	}
+	buf.Reset()
+	// A write the device refuses is audited as an error
+	write(t, fdh, 1, 0, "again")
+	fdh.File.Close()
+	if err := fdh.Flush(ctx, &fuse.FlushRequest{Handle: 1}); err == nil {
+		t.Errorf("Expected the flush to a closed file to fail")
+	}
+	if !strings.Contains(buf.String(), `"op":"write","path":"/mnt/test/a","size":5`) || !strings.Contains(buf.String(), `"result":"error"`) {
+		t.Errorf("Expected the failed device write to be audited however got %s", buf.String())
+	}
+	buf.Reset()
+	dir := &FDDir{Key: "/mnt/test", FS: fd}
+	if _, err := dir.Mkdir(ctx, &fuse.MkdirRequest{Name: "d"}); err == nil {
+		t.Errorf("Expected mkdir to be refused")
+	}
+	if err := dir.Rename(ctx, &fuse.RenameRequest{OldName: "a", NewName: "b"}, dir); err == nil {
+		t.Errorf("Expected rename to be refused")
+	}
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"op":"mkdir","path":"/mnt/test/d"`) || !strings.Contains(lines[1], `"op":"rename","path":"/mnt/test/a","new_path":"/mnt/test/b"`) || !strings.Contains(lines[1], `"result":"error"`) {
+		t.Errorf("Expected refused mkdir and rename to be audited however got %s", buf.String())
+	}
+}
@@ -0,0 +1,399 @@
+package buse
+
+import (
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
+)
+
+// middlewareFS ... Puts middleware and QOS limits in front of a native file system. Nodes and handles
+// are wrapped so each request goes through the chain with the path it is for. A request the file system
+// doesn't handle gets the same error fs.Serve would give. Getattr and xattrs aren't passed on
+type middlewareFS struct {
+	inner      fs.FS
+	mountPoint string
+	chain      []api.NativeMiddleware
+	ioMap      *qos.IOMap
+	handles    uint64
+	// nodes ... The same node keeps the same wrapper so the kernel keeps the same node id
+	nodes map[fs.Node]*middlewareNode
+	mutex sync.Mutex
+}
+
+func newMiddlewareFS(inner fs.FS, mountPoint string, chain []api.NativeMiddleware, ioMap *qos.IOMap) *middlewareFS {
+	return &middlewareFS{inner: inner, mountPoint: path.Clean(mountPoint), chain: chain, ioMap: ioMap, nodes: make(map[fs.Node]*middlewareNode)}
+}
+
+// Root ... The mount point
+func (mf *middlewareFS) Root() (fs.Node, error) {
+	n, err := mf.inner.Root()
+	if err != nil {
+		return nil, err
+	}
+	return mf.node(n, mf.mountPoint), nil
+}
+
+// Statfs ... Forward when the file system reports usage
+func (mf *middlewareFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	if s, ok := mf.inner.(fs.FSStatfser); ok {
+		return s.Statfs(ctx, req, resp)
+	}
+	return nil
+}
+
+// Destroy ... Forward when the file system cleans up
+func (mf *middlewareFS) Destroy() {
+	if d, ok := mf.inner.(fs.FSDestroyer); ok {
+		d.Destroy()
+	}
+}
+
+// GenerateInode ... Forward when the file system picks its own inodes
+func (mf *middlewareFS) GenerateInode(parentInode uint64, name string) uint64 {
+	if g, ok := mf.inner.(fs.FSInodeGenerator); ok {
+		return g.GenerateInode(parentInode, name)
+	}
+	return fs.GenerateDynamicInode(parentInode, name)
+}
+
+// node ... Wrapper for a node at p
+func (mf *middlewareFS) node(n fs.Node, p string) *middlewareNode {
+	if !reflect.TypeOf(n).Comparable() {
+		return &middlewareNode{fs: mf, inner: n, path: p}
+	}
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
+	if mn, exists := mf.nodes[n]; exists {
+		mn.setPath(p)
+		return mn
+	}
+	mn := &middlewareNode{fs: mf, inner: n, path: p}
+	mf.nodes[n] = mn
+	return mn
+}
+
+// forget ... The kernel dropped the node
+func (mf *middlewareFS) forget(mn *middlewareNode) {
+	if !reflect.TypeOf(mn.inner).Comparable() {
+		return
+	}
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
+	if mf.nodes[mn.inner] == mn {
+		delete(mf.nodes, mn.inner)
+	}
+}
+
+// handle ... Wrapper for a handle opened at p
+func (mf *middlewareFS) handle(h fs.Handle, p string, id uint64, dir bool) *middlewareHandle {
+	return &middlewareHandle{fs: mf, inner: h, path: p, id: id, dir: dir}
+}
+
+// call ... Run op through the chain, the first middleware sees it first and the last one calls do
+func (mf *middlewareFS) call(op *api.NativeOp, do func() error) error {
+	next := do
+	for i := len(mf.chain) - 1; i >= 0; i-- {
+		mw, inner := mf.chain[i], next
+		next = func() error {
+			return mw.Intercept(op, inner)
+		}
+	}
+	return errno(next())
+}
+
+// checkout ... Wait for the read or write budget of a path
+func (mf *middlewareFS) checkout(p string, size int, read bool) {
+	if mf.ioMap == nil {
+		return
+	}
+	checkout(mf.ioMap.FindPath(p), size, read)
+}
+
+type middlewareNode struct {
+	fs    *middlewareFS
+	inner fs.Node
+	path  string
+	mutex sync.Mutex
+}
+
+// Path ... Where the node was last looked up
+func (mn *middlewareNode) Path() string {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	return mn.path
+}
+
+func (mn *middlewareNode) setPath(p string) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	mn.path = p
+}
+
+// Attr ... Forward
+func (mn *middlewareNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	return mn.inner.Attr(ctx, attr)
+}
+
+// Setattr ... Through the chain, attributes are only read again when the node can't be changed
+func (mn *middlewareNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	op := &api.NativeOp{Op: api.NativeSetattr, Path: mn.Path(), Size: -1}
+	if req.Valid.Size() {
+		op.Size = int(req.Size)
+	}
+	return mn.fs.call(op, func() error {
+		if n, ok := mn.inner.(fs.NodeSetattrer); ok {
+			return n.Setattr(ctx, req, resp)
+		}
+		return nil
+	})
+}
+
+// Access ... Forward when the node checks access
+func (mn *middlewareNode) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	if n, ok := mn.inner.(fs.NodeAccesser); ok {
+		return n.Access(ctx, req)
+	}
+	return nil
+}
+
+// Lookup ... Forward, the node found is wrapped
+func (mn *middlewareNode) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	var n fs.Node
+	var err error
+	switch l := mn.inner.(type) {
+	case fs.NodeStringLookuper:
+		n, err = l.Lookup(ctx, req.Name)
+	case fs.NodeRequestLookuper:
+		n, err = l.Lookup(ctx, req, resp)
+	default:
+		return nil, fuse.ENOENT
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mn.fs.node(n, path.Join(mn.Path(), req.Name)), nil
+}
+
+// Open ... Files are opened through the chain, nodes that can't be opened are their own handle
+func (mn *middlewareNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	p := mn.Path()
+	open := func() (fs.Handle, error) {
+		if n, ok := mn.inner.(fs.NodeOpener); ok {
+			return n.Open(ctx, req, resp)
+		}
+		return mn.inner, nil
+	}
+	if req.Dir {
+		h, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return mn.fs.handle(h, p, 0, true), nil
+	}
+	op := &api.NativeOp{Op: api.NativeOpen, Path: p, Handle: atomic.AddUint64(&mn.fs.handles, 1), Flags: int(req.Flags)}
+	var h fs.Handle
+	err := mn.fs.call(op, func() (err error) {
+		h, err = open()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mn.fs.handle(h, p, op.Handle, false), nil
+}
+
+// Create ... Through the chain
+func (mn *middlewareNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	p := path.Join(mn.Path(), req.Name)
+	op := &api.NativeOp{Op: api.NativeCreate, Path: p, Handle: atomic.AddUint64(&mn.fs.handles, 1), Flags: int(req.Flags)}
+	var n fs.Node
+	var h fs.Handle
+	err := mn.fs.call(op, func() (err error) {
+		c, ok := mn.inner.(fs.NodeCreater)
+		if !ok {
+			return fuse.EPERM
+		}
+		n, h, err = c.Create(ctx, req, resp)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return mn.fs.node(n, p), mn.fs.handle(h, p, op.Handle, false), nil
+}
+
+// Mkdir ... Through the chain
+func (mn *middlewareNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	p := path.Join(mn.Path(), req.Name)
+	var n fs.Node
+	err := mn.fs.call(&api.NativeOp{Op: api.NativeMkdir, Path: p}, func() (err error) {
+		m, ok := mn.inner.(fs.NodeMkdirer)
+		if !ok {
+			return fuse.EPERM
+		}
+		n, err = m.Mkdir(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mn.fs.node(n, p), nil
+}
+
+// Remove ... Through the chain
+func (mn *middlewareNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	return mn.fs.call(&api.NativeOp{Op: api.NativeRemove, Path: path.Join(mn.Path(), req.Name)}, func() error {
+		r, ok := mn.inner.(fs.NodeRemover)
+		if !ok {
+			return fuse.EIO
+		}
+		return r.Remove(ctx, req)
+	})
+}
+
+// Rename ... Through the chain, the file system gets its own node for the new directory
+func (mn *middlewareNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	nd, ok := newDir.(*middlewareNode)
+	if !ok {
+		return fuse.EIO
+	}
+	op := &api.NativeOp{Op: api.NativeRename, Path: path.Join(mn.Path(), req.OldName), NewPath: path.Join(nd.Path(), req.NewName)}
+	return mn.fs.call(op, func() error {
+		r, ok := mn.inner.(fs.NodeRenamer)
+		if !ok {
+			return fuse.EIO
+		}
+		return r.Rename(ctx, req, nd.inner)
+	})
+}
+
+// Fsync ... Forward
+func (mn *middlewareNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if n, ok := mn.inner.(fs.NodeFsyncer); ok {
+		return n.Fsync(ctx, req)
+	}
+	return fuse.EIO
+}
+
+// Forget ... Drop the wrapper and forward
+func (mn *middlewareNode) Forget() {
+	mn.fs.forget(mn)
+	if n, ok := mn.inner.(fs.NodeForgetter); ok {
+		n.Forget()
+	}
+}
+
+type middlewareHandle struct {
+	fs    *middlewareFS
+	inner fs.Handle
+	path  string
+	id    uint64
+	dir   bool
+	// data ... Whole file from a handle that reads everything at once, read on the first request
+	data  []byte
+	mutex sync.Mutex
+}
+
+// ReadDirAll ... Listed through the chain
+func (mh *middlewareHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	r, ok := mh.inner.(fs.HandleReadDirAller)
+	if !ok {
+		return nil, nil
+	}
+	var dirs []fuse.Dirent
+	op := &api.NativeOp{Op: api.NativeList, Path: mh.path}
+	err := mh.fs.call(op, func() (err error) {
+		dirs, err = r.ReadDirAll(ctx)
+		op.Size = len(dirs)
+		return err
+	})
+	return dirs, err
+}
+
+// Read ... Through the chain then limited by QOS. A handle that reads everything at once is read on
+// the first request and served from memory after that, the same as fs.Serve does
+func (mh *middlewareHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	op := &api.NativeOp{Op: api.NativeRead, Path: mh.path, Handle: mh.id, Offset: req.Offset}
+	err := mh.fs.call(op, func() error {
+		switch h := mh.inner.(type) {
+		case fs.HandleReadAller:
+			mh.mutex.Lock()
+			if mh.data == nil {
+				data, err := h.ReadAll(ctx)
+				if err != nil {
+					mh.mutex.Unlock()
+					return err
+				}
+				if data == nil {
+					data = []byte{}
+				}
+				mh.data = data
+			}
+			if cap(resp.Data) < req.Size {
+				resp.Data = make([]byte, 0, req.Size)
+			}
+			fuseutil.HandleRead(req, resp, mh.data)
+			mh.mutex.Unlock()
+		case fs.HandleReader:
+			if err := h.Read(ctx, req, resp); err != nil {
+				return err
+			}
+		default:
+			return fuse.ENOTSUP
+		}
+		op.Data = resp.Data
+		op.Size = len(resp.Data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Data = op.Data
+	mh.fs.checkout(mh.path, len(resp.Data), true)
+	return nil
+}
+
+// Write ... Limited by QOS then through the chain
+func (mh *middlewareHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	w, ok := mh.inner.(fs.HandleWriter)
+	if !ok {
+		return fuse.EIO
+	}
+	mh.fs.checkout(mh.path, len(req.Data), false)
+	// Middleware that drops the write still answers for all of it
+	resp.Size = len(req.Data)
+	op := &api.NativeOp{Op: api.NativeWrite, Path: mh.path, Handle: mh.id, Offset: req.Offset, Size: len(req.Data), Data: req.Data}
+	return mh.fs.call(op, func() error {
+		return w.Write(ctx, req, resp)
+	})
+}
+
+// Flush ... Forward
+func (mh *middlewareHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if f, ok := mh.inner.(fs.HandleFlusher); ok {
+		return f.Flush(ctx, req)
+	}
+	return nil
+}
+
+// Release ... Files are closed through the chain
+func (mh *middlewareHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	release := func() error {
+		if r, ok := mh.inner.(fs.HandleReleaser); ok {
+			return r.Release(ctx, req)
+		}
+		return nil
+	}
+	if mh.dir {
+		return release()
+	}
+	return mh.fs.call(&api.NativeOp{Op: api.NativeClose, Path: mh.path, Handle: mh.id}, release)
+}
@@ -0,0 +1,183 @@
+package buse
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/lateefj/shylock/api"
+	"golang.org/x/net/context"
+)
+
+// nativeMemFS ... Native file system with a single directory of files that are read all at once
+type nativeMemFS struct {
+	files map[string]*nativeMemFile
+}
+
+func (m *nativeMemFS) Root() (fs.Node, error) {
+	return &nativeMemDir{fs: m}, nil
+}
+
+type nativeMemDir struct {
+	fs *nativeMemFS
+}
+
+func (md *nativeMemDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	return nil
+}
+
+func (md *nativeMemDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	f, exists := md.fs.files[name]
+	if !exists {
+		return nil, fuse.ENOENT
+	}
+	return f, nil
+}
+
+func (md *nativeMemDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirs := make([]fuse.Dirent, 0, len(md.fs.files))
+	for name := range md.fs.files {
+		dirs = append(dirs, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	return dirs, nil
+}
+
+func (md *nativeMemDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	delete(md.fs.files, req.Name)
+	return nil
+}
+
+type nativeMemFile struct {
+	body  []byte
+	reads int
+}
+
+func (mf *nativeMemFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0644
+	a.Size = uint64(len(mf.body))
+	return nil
+}
+
+func (mf *nativeMemFile) ReadAll(ctx context.Context) ([]byte, error) {
+	mf.reads++
+	return mf.body, nil
+}
+
+func (mf *nativeMemFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	mf.body = append(mf.body[:req.Offset], req.Data...)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// opsMiddleware ... Keeps the operations and paths it sees
+type opsMiddleware struct {
+	ops []api.NativeOp
+}
+
+func (om *opsMiddleware) Intercept(op *api.NativeOp, next func() error) error {
+	err := next()
+	om.ops = append(om.ops, *op)
+	return err
+}
+
+func newMiddlewareTest(t *testing.T, mws ...api.NativeMiddleware) (*nativeMemFS, *middlewareNode) {
+	m := &nativeMemFS{files: map[string]*nativeMemFile{"file": {body: []byte("hello world")}}}
+	root, err := newMiddlewareFS(m, "/mnt/native/", mws, nil).Root()
+	if err != nil {
+		t.Fatalf("Failed to get the root %s", err)
+	}
+	return m, root.(*middlewareNode)
+}
+
+func TestMiddlewarePaths(t *testing.T) {
+	om := &opsMiddleware{}
+	m, root := newMiddlewareTest(t, om)
+	ctx := context.Background()
+	n, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "file"}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatalf("Failed to look up file %s", err)
+	}
+	if again, _ := root.Lookup(ctx, &fuse.LookupRequest{Name: "file"}, &fuse.LookupResponse{}); again != n {
+		t.Errorf("Expected the same node to keep the same wrapper")
+	}
+	h, err := n.(*middlewareNode).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Failed to open file %s", err)
+	}
+	mh := h.(*middlewareHandle)
+	for _, offset := range []int64{0, 5} {
+		resp := &fuse.ReadResponse{}
+		if err := mh.Read(ctx, &fuse.ReadRequest{Offset: offset, Size: 5}, resp); err != nil {
+			t.Fatalf("Failed to read %s", err)
+		}
+	}
+	if m.files["file"].reads != 1 {
+		t.Errorf("Expected the whole file to be read once however it was read %d times", m.files["file"].reads)
+	}
+	if err := mh.Write(ctx, &fuse.WriteRequest{Offset: 5, Data: []byte("!")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+	if err := mh.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("Failed to release %s", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Failed to remove %s", err)
+	}
+	expected := []api.NativeOp{
+		{Op: api.NativeOpen, Path: "/mnt/native/file"},
+		{Op: api.NativeRead, Path: "/mnt/native/file", Size: 5},
+		{Op: api.NativeRead, Path: "/mnt/native/file", Size: 5},
+		{Op: api.NativeWrite, Path: "/mnt/native/file", Size: 1},
+		{Op: api.NativeClose, Path: "/mnt/native/file"},
+		{Op: api.NativeRemove, Path: "/mnt/native/file"},
+	}
+	if len(om.ops) != len(expected) {
+		t.Fatalf("Expected %d operations however got %+v", len(expected), om.ops)
+	}
+	for i, e := range expected {
+		op := om.ops[i]
+		if op.Op != e.Op || op.Path != e.Path || op.Size != e.Size {
+			t.Errorf("Expected operation %d to be %s %s of %d however got %+v", i, e.Op, e.Path, e.Size, op)
+		}
+		if e.Op != api.NativeRemove && op.Handle != om.ops[0].Handle {
+			t.Errorf("Expected operation %d to be on handle %d however got %d", i, om.ops[0].Handle, op.Handle)
+		}
+	}
+}
+
+func TestMiddlewareReadOnly(t *testing.T) {
+	mws, err := api.WrapNative([]api.WrapperConfig{{Type: api.WrapperReadOnly}})
+	if err != nil {
+		t.Fatalf("Failed to build readonly middleware %s", err)
+	}
+	m, root := newMiddlewareTest(t, mws...)
+	ctx := context.Background()
+	n, _ := root.Lookup(ctx, &fuse.LookupRequest{Name: "file"}, &fuse.LookupResponse{})
+	mn := n.(*middlewareNode)
+	if _, err := mn.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{}); err != fuse.Errno(syscall.EROFS) {
+		t.Errorf("Expected EROFS opening for writing however got %v", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != fuse.Errno(syscall.EROFS) {
+		t.Errorf("Expected EROFS removing however got %v", err)
+	}
+	if err := mn.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize}, &fuse.SetattrResponse{}); err != fuse.Errno(syscall.EROFS) {
+		t.Errorf("Expected EROFS truncating however got %v", err)
+	}
+	h, err := mn.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Expected opening for reading to work however got %s", err)
+	}
+	resp := &fuse.ReadResponse{}
+	if err := h.(*middlewareHandle).Read(ctx, &fuse.ReadRequest{Size: 1024}, resp); err != nil || string(resp.Data) != "hello world" {
+		t.Errorf("Expected to read hello world however got %q %v", resp.Data, err)
+	}
+	if err := h.(*middlewareHandle).Write(ctx, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{}); err != fuse.Errno(syscall.EROFS) {
+		t.Errorf("Expected EROFS writing however got %v", err)
+	}
+	if _, exists := m.files["file"]; !exists {
+		t.Errorf("Expected the file to still be there")
+	}
+}
@@ -0,0 +1,114 @@
+package buse
+
+import (
+	"io"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/logger"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
+)
+
+// Native ... Serves a backend's own fuse file system so the backend can register as an
+// api.NativeDevice. When the file system is an io.Closer it is closed after the last request
+type Native struct {
+	FS fs.FS
+	// Kernel ... Mount options
+	Kernel KernelOptions
+	// Middleware ... Sees every request before the file system, closed along with it
+	Middleware []api.NativeMiddleware
+	// IOMap ... Read and write limits for the paths under the mount point
+	IOMap *qos.IOMap
+	life  lifecycle
+}
+
+// SetLogger ... Hand the mount logger to the file system and middleware that log
+func (n *Native) SetLogger(l *logger.Logger) {
+	logger.Inject(n.FS, l)
+	for _, mw := range n.Middleware {
+		logger.Inject(mw, l)
+	}
+}
+
+// SetMiddleware ... Must be called before Serve
+func (n *Native) SetMiddleware(mws []api.NativeMiddleware) {
+	n.Middleware = mws
+}
+
+// SetIOMap ... Limits applied by buse, must be called before Serve
+func (n *Native) SetIOMap(ioMap *qos.IOMap) {
+	n.IOMap = ioMap
+}
+
+// SetAuditor ... Hand the mount auditor to the file system when it records changes
+func (n *Native) SetAuditor(a *audit.Auditor) {
+	audit.Inject(n.FS, a)
+}
+
+// SetKernelOptions ... Must be called before Serve
+func (n *Native) SetKernelOptions(ko KernelOptions) {
+	n.Kernel = ko
+}
+
+// Serve ... Mount the file system and serve it until it is unmounted
+func (n *Native) Serve(mountPoint string) error {
+	c, err := fuse.Mount(mountPoint, n.Kernel.mountOptions()...)
+	if err != nil {
+		n.life.ready(err)
+		return err
+	}
+	n.life.start(mountPoint, c)
+	defer n.Unmount()
+
+	go n.life.waitReady(c)
+	var filesys fs.FS = n.FS
+	if len(n.Middleware) > 0 || n.IOMap != nil {
+		filesys = newMiddlewareFS(n.FS, mountPoint, n.Middleware, n.IOMap)
+	}
+	err = fs.Serve(c, filesys)
+	n.life.served()
+	if err != nil {
+		return err
+	}
+	// Serve also returns when the mount failed
+	<-c.Ready
+	return c.MountError
+}
+
+// OnReady ... f is called with nil once the kernel has mounted the file system or with why it failed
+func (n *Native) OnReady(f func(error)) {
+	n.life.notifyReady(f)
+}
+
+// Health ... The fuse connection is being served and the file system can reach its backend
+func (n *Native) Health(ctx context.Context) error {
+	if err := n.life.health(); err != nil {
+		return err
+	}
+	return api.CheckHealth(ctx, n.FS)
+}
+
+// Unmount ... Same as Shutdown waiting DefaultShutdownTimeout, safe to call more than once
+func (n *Native) Unmount() error {
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	return n.Shutdown(ctx)
+}
+
+// Shutdown ... Unmount so no new requests come in, wait for the ones in flight until ctx is done and
+// then close the file system and middleware
+func (n *Native) Shutdown(ctx context.Context) error {
+	return n.life.stop(ctx, func() error {
+		var err error
+		if c, ok := n.FS.(io.Closer); ok {
+			err = c.Close()
+		}
+		if mErr := api.CloseNative(n.Middleware); err == nil {
+			err = mErr
+		}
+		return err
+	})
+}
@@ -0,0 +1,34 @@
+package buse
+
+import (
+	"bazil.org/fuse"
+)
+
+// KernelOptions ... Mount options the kernel enforces
+type KernelOptions struct {
+	// FSName ... Shown as the source of the mount, the backend type
+	FSName   string
+	ReadOnly bool
+	// AllowOther ... Let users other than the one mounting access the mount
+	AllowOther bool
+	// DefaultPermissions ... The kernel checks the mode and owner from Attr
+	DefaultPermissions bool
+}
+
+// mountOptions ... Mounts show up as fuse.shylock like `mount -t fuse.shylock` expects
+func (ko KernelOptions) mountOptions() []fuse.MountOption {
+	opts := []fuse.MountOption{fuse.Subtype("shylock")}
+	if ko.FSName != "" {
+		opts = append(opts, fuse.FSName(ko.FSName))
+	}
+	if ko.ReadOnly {
+		opts = append(opts, fuse.ReadOnly())
+	}
+	if ko.AllowOther {
+		opts = append(opts, fuse.AllowOther())
+	}
+	if ko.DefaultPermissions {
+		opts = append(opts, fuse.DefaultPermissions())
+	}
+	return opts
+}
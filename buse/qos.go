@@ -0,0 +1,42 @@
+package buse
+
+import (
+	"github.com/lateefj/shylock/qos"
+)
+
+// ioc ... Find the controller for a key, nil when there is no limit. Mount sets the map under the mutex
+func (fd *FuseSimpleDevice) ioc(key string) *qos.IOC {
+	fd.mutex.Lock()
+	ioMap := fd.IOMap
+	fd.mutex.Unlock()
+	if ioMap == nil {
+		return nil
+	}
+	return ioMap.FindPath(key)
+}
+
+// checkout ... Blocks until all the requested bytes have been checked out
+func checkout(ioc *qos.IOC, size int, read bool) {
+	if ioc == nil || size <= 0 {
+		return
+	}
+	stream := make(chan uint64, 1)
+	if read {
+		go ioc.CheckoutRead(uint64(size), stream)
+	} else {
+		go ioc.CheckoutWrite(uint64(size), stream)
+	}
+	// Drain until the controller has handed out everything or stopped
+	for range stream {
+	}
+}
+
+// checkoutRead ... Wait for the read budget of a key
+func (fd *FuseSimpleDevice) checkoutRead(key string, size int) {
+	checkout(fd.ioc(key), size, true)
+}
+
+// checkoutWrite ... Wait for the write budget of a key
+func (fd *FuseSimpleDevice) checkoutWrite(key string, size int) {
+	checkout(fd.ioc(key), size, false)
+}
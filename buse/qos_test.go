@@ -0,0 +1,116 @@
+package buse
+
+import (
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
+)
+
+// memFile ... Simple file kept in memory
+type memFile struct {
+	body []byte
+}
+
+func (mf *memFile) Read() ([]byte, error) {
+	return mf.body, nil
+}
+func (mf *memFile) Write(body []byte) error {
+	mf.body = append([]byte(nil), body...)
+	return nil
+}
+func (mf *memFile) Close() error {
+	return nil
+}
+
+func TestFDHandleQOS(t *testing.T) {
+	iom := qos.NewIOMap()
+	iom.Add("/mnt/limited", 100*time.Millisecond, 10, 10)
+	defer iom.Remove("/mnt/limited")
+	// Start runs in its own goroutine and checkouts fail until it has
+	for ioc, _ := iom.Get("/mnt/limited"); !ioc.Active(); {
+		time.Sleep(time.Millisecond)
+	}
+	fd := &FuseSimpleDevice{IOMap: iom}
+	file := func(key string) *FDHandle {
+		return &FDHandle{Key: key, File: &memFile{}, FS: fd}
+	}
+	ctx := context.Background()
+
+	limited := file("/mnt/limited/a")
+	start := time.Now()
+	data := make([]byte, 25)
+	if err := limited.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected 25 bytes at 10 bytes per 100ms to be throttled however took %s", elapsed)
+	}
+	start = time.Now()
+	resp := &fuse.ReadResponse{}
+	err := limited.Read(ctx, &fuse.ReadRequest{Size: 100}, resp)
+	if err != nil || len(resp.Data) != 25 {
+		t.Fatalf("Expected to read 25 bytes however got %d error %v", len(resp.Data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected 25 bytes read to be throttled however took %s", elapsed)
+	}
+
+	open := file("/mnt/open/a")
+	start = time.Now()
+	if err := open.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected a path without limits to not be throttled however took %s", elapsed)
+	}
+}
+
+func TestFDHandleQOSUnlocked(t *testing.T) {
+	iom := qos.NewIOMap()
+	iom.Add("/mnt/limited", 100*time.Millisecond, 10, 100)
+	defer iom.Remove("/mnt/limited")
+	for ioc, _ := iom.Get("/mnt/limited"); !ioc.Active(); {
+		time.Sleep(time.Millisecond)
+	}
+	fd := &FuseSimpleDevice{IOMap: iom}
+	fdh := &FDHandle{Key: "/mnt/limited/a", File: &memFile{body: make([]byte, 30)}, FS: fd}
+	ctx := context.Background()
+	done := make(chan error)
+	go func() {
+		done <- fdh.Read(ctx, &fuse.ReadRequest{Size: 30}, &fuse.ReadResponse{})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if err := fdh.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected a flush to not wait for a throttled read however took %s", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIOCWhileMounting ... Mount sets the map while requests look up their limits, run with -race
+func TestIOCWhileMounting(t *testing.T) {
+	fd := &FuseSimpleDevice{}
+	iom := qos.NewIOMap()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			fd.ioc("/mnt/limited/a")
+		}
+	}()
+	fd.mutex.Lock()
+	fd.IOMap = iom
+	fd.mutex.Unlock()
+	<-done
+	if fd.ioc("/mnt/limited/a") != nil {
+		t.Errorf("Expected no limit for a key missing from the map")
+	}
+}
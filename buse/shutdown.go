@@ -0,0 +1,174 @@
+package buse
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/logger"
+	"golang.org/x/net/context"
+)
+
+var (
+	// DefaultShutdownTimeout ... How long Unmount waits for requests in flight
+	DefaultShutdownTimeout = 10 * time.Second
+	// ErrDrainTimeout ... Requests were still in flight when the shutdown timed out, the connection is
+	// closed and the backend flushed once they are answered
+	ErrDrainTimeout = errors.New("Timed out waiting for requests in flight")
+	// ErrNotReady ... The kernel hasn't finished mounting yet
+	ErrNotReady = errors.New("Mount is not ready")
+	// ErrNotServing ... The fuse connection is no longer being served
+	ErrNotServing = errors.New("Fuse connection is not being served")
+)
+
+// lifecycle ... A served fuse connection that is shut down once. Unmounting in the kernel stops
+// new requests, fs.Server.Serve returns once every request in flight has been answered and then
+// the backend is flushed
+type lifecycle struct {
+	mountPoint string
+	conn       *fuse.Conn
+	done       chan struct{}
+	shutdown   bool
+	// isReady ... Set once the mount finished, readyErr says how it went
+	isReady  bool
+	readyErr error
+	onReady  []func(error)
+	mutex    sync.Mutex
+}
+
+// start ... Called once the connection is mounted and before serving
+func (l *lifecycle) start(mountPoint string, conn *fuse.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.mountPoint = mountPoint
+	l.conn = conn
+	l.done = make(chan struct{})
+}
+
+// waitReady ... Run alongside Serve since some platforms only finish mounting once requests are answered
+func (l *lifecycle) waitReady(conn *fuse.Conn) {
+	<-conn.Ready
+	l.ready(conn.MountError)
+}
+
+// ready ... Call the ready callbacks, only the first call does anything
+func (l *lifecycle) ready(err error) {
+	l.mutex.Lock()
+	if l.isReady {
+		l.mutex.Unlock()
+		return
+	}
+	l.isReady = true
+	l.readyErr = err
+	callbacks := l.onReady
+	l.onReady = nil
+	l.mutex.Unlock()
+	for _, f := range callbacks {
+		f(err)
+	}
+}
+
+// notifyReady ... f is called once the mount is ready or failed, right away when that already happened
+func (l *lifecycle) notifyReady(f func(error)) {
+	l.mutex.Lock()
+	if !l.isReady {
+		l.onReady = append(l.onReady, f)
+		l.mutex.Unlock()
+		return
+	}
+	err := l.readyErr
+	l.mutex.Unlock()
+	f(err)
+}
+
+// health ... nil while the mount is ready and its connection is being served
+func (l *lifecycle) health() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.isReady {
+		return ErrNotReady
+	}
+	if l.readyErr != nil {
+		return l.readyErr
+	}
+	if l.shutdown || l.done == nil {
+		return ErrNotServing
+	}
+	select {
+	case <-l.done:
+		return ErrNotServing
+	default:
+	}
+	return nil
+}
+
+// served ... Serve returned, nothing is in flight anymore
+func (l *lifecycle) served() {
+	l.mutex.Lock()
+	done := l.done
+	l.mutex.Unlock()
+	if done != nil {
+		close(done)
+	}
+}
+
+// stop ... Unmount, drain until ctx is done and then flush. When requests are still in flight the mount
+// is already detached so the flush waits for them in the background. Only the first call does anything
+func (l *lifecycle) stop(ctx context.Context, flush func() error) error {
+	l.mutex.Lock()
+	if l.shutdown {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.shutdown = true
+	conn, done, mountPoint := l.conn, l.done, l.mountPoint
+	l.conn = nil
+	l.mutex.Unlock()
+
+	var err error
+	if conn != nil {
+		select {
+		case <-done:
+			// Unmounted from outside
+		default:
+			err = unmountDir(mountPoint)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				go func() {
+					<-done
+					conn.Close()
+					if flush != nil {
+						if err := flush(); err != nil {
+							logger.Default().Error("Failed to flush after requests drained", "mount_point", mountPoint, "error", err)
+						}
+					}
+				}()
+				return ErrDrainTimeout
+			}
+		}
+		if cErr := conn.Close(); err == nil {
+			err = cErr
+		}
+	}
+	if flush != nil {
+		if fErr := flush(); err == nil {
+			err = fErr
+		}
+	}
+	return err
+}
+
+// unmountDir ... A busy mount is detached lazily so open files can finish while no new ones are opened
+func unmountDir(mountPoint string) error {
+	if err := fuse.Unmount(mountPoint); err == nil {
+		return nil
+	}
+	return lazyUnmount(mountPoint)
+}
+
+// shutdownContext ... Context for Unmount
+func shutdownContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+}
@@ -0,0 +1,88 @@
+package buse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+func TestLifecycleStopOnce(t *testing.T) {
+	l := &lifecycle{}
+	flushed := 0
+	flush := func() error {
+		flushed++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.stop(context.Background(), flush); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if flushed != 1 {
+		t.Errorf("Expected a single flush however got %d", flushed)
+	}
+}
+
+func TestLifecycleStopDrainTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shylock-drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &lifecycle{}
+	l.start(dir, &fuse.Conn{})
+	flushed := make(chan bool, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.stop(ctx, func() error {
+		flushed <- true
+		return nil
+	}); err != ErrDrainTimeout {
+		t.Fatalf("Expected the drain to time out however got %v", err)
+	}
+	select {
+	case <-flushed:
+		t.Fatalf("Expected no flush while requests are in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.served()
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Errorf("Expected a flush once the requests in flight were answered")
+	}
+}
+
+func TestLifecycleReady(t *testing.T) {
+	l := &lifecycle{}
+	if err := l.health(); err != ErrNotReady {
+		t.Errorf("Expected not ready before mounting however got %v", err)
+	}
+	called := 0
+	l.notifyReady(func(err error) {
+		if err != nil {
+			t.Errorf("Expected a successful mount however got %s", err)
+		}
+		called++
+	})
+	l.start("/mnt/ready", nil)
+	l.ready(nil)
+	l.ready(nil)
+	l.notifyReady(func(err error) {
+		called++
+	})
+	if called != 2 {
+		t.Errorf("Expected both callbacks to be called once however got %d calls", called)
+	}
+	if err := l.health(); err != nil {
+		t.Errorf("Expected a served mount to be healthy however got %s", err)
+	}
+	l.served()
+	if err := l.health(); err != ErrNotServing {
+		t.Errorf("Expected a mount that stopped serving to fail however got %v", err)
+	}
+}
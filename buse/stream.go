@@ -0,0 +1,204 @@
+package buse
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultReadAhead ... Bytes buffered ahead of the reader for each open stream
+	DefaultReadAhead = 128 * 1024
+	// DefaultWriteBuffer ... Bytes buffered before writing to the stream
+	DefaultWriteBuffer = 64 * 1024
+)
+
+// FDStreamFile ... File entry in a device that supports streaming
+type FDStreamFile struct {
+	Key string
+	FS  *FuseSimpleDevice
+}
+
+// Attr ... Streams don't have a known size
+func (fds *FDStreamFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	return fds.FS.attr(fds.Key, false, attr)
+}
+
+var _ fs.Node = (*FDStreamFile)(nil)
+
+// Open ... Every open gets its own stream so memory is bounded by the buffers
+func (fds *FDStreamFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer fds.FS.logOp("open", fds.Key, time.Now(), &err)
+	f, err := fds.FS.stream.OpenStream(fds.Key)
+	if err != nil {
+		return nil, errno(err)
+	}
+	// Size is unknown so the page cache can't be used
+	resp.Flags |= fuse.OpenDirectIO
+	return &FDStreamHandle{File: f, FS: fds.FS, Key: fds.Key}, nil
+}
+
+var _ fs.NodeOpener = (*FDStreamFile)(nil)
+
+// FDStreamHandle ... Open stream with read ahead and write buffers
+type FDStreamHandle struct {
+	File     api.StreamFile
+	FS       *FuseSimpleDevice
+	Key      string
+	mutex    sync.Mutex
+	reader   io.ReadCloser
+	buffered *bufio.Reader
+	readPos  int64
+	writer   io.WriteCloser
+	wbuf     *bufio.Writer
+	written  int64
+}
+
+// openReader ... Start a new stream from the beginning
+func (fdh *FDStreamHandle) openReader() error {
+	if fdh.reader != nil {
+		fdh.reader.Close()
+	}
+	r, err := fdh.File.Reader()
+	if err != nil {
+		fdh.reader = nil
+		return err
+	}
+	fdh.reader = r
+	fdh.buffered = bufio.NewReaderSize(r, fdh.FS.ReadAhead)
+	fdh.readPos = 0
+	return nil
+}
+
+// position ... Move the stream to the offset the kernel asked for
+func (fdh *FDStreamHandle) position(offset int64) error {
+	if fdh.reader == nil {
+		if err := fdh.openReader(); err != nil {
+			return err
+		}
+	}
+	if offset == fdh.readPos {
+		return nil
+	}
+	if s, ok := fdh.reader.(io.Seeker); ok {
+		pos, err := s.Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		fdh.buffered.Reset(fdh.reader)
+		fdh.readPos = pos
+		return nil
+	}
+	if offset < fdh.readPos {
+		if err := fdh.openReader(); err != nil {
+			return err
+		}
+	}
+	skipped, err := io.CopyN(ioutil.Discard, fdh.buffered, offset-fdh.readPos)
+	fdh.readPos += skipped
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// Read ... Returns what is available up to the requested size, short reads are fine with direct io.
+// The read budget is waited for without holding the handle
+func (fdh *FDStreamHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer fdh.FS.logOp("read", fdh.Key, time.Now(), &err)
+	data, err := fdh.read(req.Offset, req.Size)
+	fdh.FS.checkoutRead(fdh.Key, len(data))
+	resp.Data = data
+	return errno(err)
+}
+
+// read ... Read from the stream at offset
+func (fdh *FDStreamHandle) read(offset int64, size int) ([]byte, error) {
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	if err := fdh.position(offset); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	n, err := fdh.buffered.Read(buf)
+	fdh.readPos += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+var _ = fs.HandleReader(&FDStreamHandle{})
+
+// Write ... Streams can only be written sequentially, the write budget is waited for before taking the handle
+func (fdh *FDStreamHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer fdh.FS.logOp("write", fdh.Key, time.Now(), &err)
+	defer fdh.FS.Audit.Op(audit.Write, req.Header, fdh.Key, int64(len(req.Data)), &err)
+	fdh.FS.checkoutWrite(fdh.Key, len(req.Data))
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	if fdh.writer == nil {
+		w, err := fdh.File.Writer()
+		if err != nil {
+			return errno(err)
+		}
+		fdh.writer = w
+		fdh.wbuf = bufio.NewWriterSize(w, fdh.FS.WriteBuffer)
+		fdh.written = 0
+	}
+	if req.Offset != fdh.written {
+		return fuse.Errno(syscall.ESPIPE)
+	}
+	n, err := fdh.wbuf.Write(req.Data)
+	fdh.written += int64(n)
+	resp.Size = n
+	return errno(err)
+}
+
+var _ = fs.HandleWriter(&FDStreamHandle{})
+
+// Flush ... Push buffered writes to the stream
+func (fdh *FDStreamHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer fdh.FS.logOp("flush", fdh.Key, time.Now(), &err)
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	if fdh.wbuf != nil {
+		return errno(fdh.wbuf.Flush())
+	}
+	return nil
+}
+
+var _ = fs.HandleFlusher(&FDStreamHandle{})
+
+// Release ... Close the streams and the file
+func (fdh *FDStreamHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer fdh.FS.logOp("release", fdh.Key, time.Now(), &err)
+	fdh.mutex.Lock()
+	defer fdh.mutex.Unlock()
+	if fdh.writer != nil {
+		err = fdh.wbuf.Flush()
+		if cErr := fdh.writer.Close(); err == nil {
+			err = cErr
+		}
+		fdh.writer = nil
+	}
+	if fdh.reader != nil {
+		fdh.reader.Close()
+		fdh.reader = nil
+	}
+	if cErr := fdh.File.Close(); err == nil {
+		err = cErr
+	}
+	return errno(err)
+}
+
+var _ fs.HandleReleaser = (*FDStreamHandle)(nil)
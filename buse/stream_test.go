@@ -0,0 +1,144 @@
+package buse
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/logger"
+	"golang.org/x/net/context"
+)
+
+// streamRecorder ... Stream file that counts how many readers were opened
+type streamRecorder struct {
+	body    []byte
+	written bytes.Buffer
+	readers int
+	closed  bool
+}
+
+type bufferCloser struct {
+	*bytes.Buffer
+}
+
+func (bc *bufferCloser) Close() error {
+	return nil
+}
+
+func (sr *streamRecorder) Reader() (io.ReadCloser, error) {
+	sr.readers++
+	// NopCloser hides Seek so the stream has to be restarted
+	return ioutil.NopCloser(bytes.NewReader(sr.body)), nil
+}
+func (sr *streamRecorder) Writer() (io.WriteCloser, error) {
+	return &bufferCloser{&sr.written}, nil
+}
+func (sr *streamRecorder) Close() error {
+	sr.closed = true
+	return nil
+}
+
+func newTestHandle(f api.StreamFile) *FDStreamHandle {
+	fd := &FuseSimpleDevice{ReadAhead: 16, WriteBuffer: 16}
+	return &FDStreamHandle{File: f, FS: fd}
+}
+
+func TestFDStreamHandleRead(t *testing.T) {
+	body := bytes.Repeat([]byte("abcdefghij"), 10)
+	sr := &streamRecorder{body: body}
+	h := newTestHandle(sr)
+	ctx := context.Background()
+
+	resp := &fuse.ReadResponse{}
+	if err := h.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 8}, resp); err != nil {
+		t.Fatalf("Failed to read %s", err)
+	}
+	if string(resp.Data) != "abcdefgh" {
+		t.Errorf("Expected 'abcdefgh' however got %s", string(resp.Data))
+	}
+	// Skip forward within the same stream
+	resp = &fuse.ReadResponse{}
+	h.Read(ctx, &fuse.ReadRequest{Offset: 52, Size: 4}, resp)
+	if string(resp.Data) != "cdef" {
+		t.Errorf("Expected 'cdef' however got %s", string(resp.Data))
+	}
+	if sr.readers != 1 {
+		t.Errorf("Expected a single reader for forward reads however got %d", sr.readers)
+	}
+	// Going backwards starts a new stream since the reader can't seek
+	resp = &fuse.ReadResponse{}
+	h.Read(ctx, &fuse.ReadRequest{Offset: 1, Size: 2}, resp)
+	if string(resp.Data) != "bc" {
+		t.Errorf("Expected 'bc' however got %s", string(resp.Data))
+	}
+	if sr.readers != 2 {
+		t.Errorf("Expected going backwards to open a new reader however got %d", sr.readers)
+	}
+	// Reading past the end is an empty response
+	resp = &fuse.ReadResponse{}
+	if err := h.Read(ctx, &fuse.ReadRequest{Offset: 200, Size: 10}, resp); err != nil {
+		t.Fatalf("Expected no error reading past the end however got %s", err)
+	}
+	if len(resp.Data) != 0 {
+		t.Errorf("Expected no data past the end however got %s", string(resp.Data))
+	}
+}
+
+func TestFDStreamHandleWrite(t *testing.T) {
+	sr := &streamRecorder{}
+	h := newTestHandle(sr)
+	ctx := context.Background()
+
+	resp := &fuse.WriteResponse{}
+	if err := h.Write(ctx, &fuse.WriteRequest{Offset: 0, Data: []byte("hello ")}, resp); err != nil {
+		t.Fatalf("Failed to write %s", err)
+	}
+	if resp.Size != 6 {
+		t.Errorf("Expected 6 bytes written however got %d", resp.Size)
+	}
+	h.Write(ctx, &fuse.WriteRequest{Offset: 6, Data: []byte("world")}, &fuse.WriteResponse{})
+	if sr.written.Len() != 0 {
+		t.Errorf("Expected writes to be buffered until flush however got %s", sr.written.String())
+	}
+	if err := h.Write(ctx, &fuse.WriteRequest{Offset: 0, Data: []byte("again")}, &fuse.WriteResponse{}); err == nil {
+		t.Errorf("Expected a write that is not sequential to fail")
+	}
+	h.Flush(ctx, &fuse.FlushRequest{})
+	if sr.written.String() != "hello world" {
+		t.Errorf("Expected 'hello world' after flush however got %s", sr.written.String())
+	}
+	if err := h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("Failed to release %s", err)
+	}
+	if !sr.closed {
+		t.Errorf("Expected release to close the file")
+	}
+}
+
+func TestFDStreamHandleLog(t *testing.T) {
+	h := newTestHandle(&streamRecorder{body: []byte("hello")})
+	buf := &bytes.Buffer{}
+	h.FS.Log = logger.New(buf, logger.Logfmt, logger.DebugLevel)
+	h.Key = "/mnt/stream/a"
+	ctx := context.Background()
+	h.Read(ctx, &fuse.ReadRequest{Size: 5}, &fuse.ReadResponse{})
+	h.Write(ctx, &fuse.WriteRequest{Data: []byte("hi")}, &fuse.WriteResponse{})
+	h.Write(ctx, &fuse.WriteRequest{Offset: 10, Data: []byte("hi")}, &fuse.WriteResponse{})
+	h.Flush(ctx, &fuse.FlushRequest{})
+	h.Release(ctx, &fuse.ReleaseRequest{})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []string{"level=debug op=read", "level=debug op=write", "level=warn op=write", "level=debug op=flush", "level=debug op=release"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d requests logged however got\n%s", len(expected), buf.String())
+	}
+	for i, e := range expected {
+		level, op := strings.Fields(e)[0], strings.Fields(e)[1]
+		if !strings.Contains(lines[i], level) || !strings.Contains(lines[i], op+" path=/mnt/stream/a") {
+			t.Errorf("Expected %s however got %s", e, lines[i])
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package buse
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// lazyUnmount ... Detach the mount now and clean it up once nothing uses it
+func lazyUnmount(mountPoint string) error {
+	out, err := exec.Command("fusermount", "-u", "-z", mountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fusermount -u -z %s: %s %s", mountPoint, err, out)
+	}
+	return nil
+}
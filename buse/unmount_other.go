@@ -0,0 +1,17 @@
+// +build !linux
+
+package buse
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// lazyUnmount ... There is no lazy unmount so the mount is forced
+func lazyUnmount(mountPoint string) error {
+	out, err := exec.Command("umount", "-f", mountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("umount -f %s: %s %s", mountPoint, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package buse
+
+import (
+	"path"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock/api"
+	"golang.org/x/net/context"
+)
+
+// watch ... Start invalidating the kernel cache when the device can push changes
+func (fd *FuseSimpleDevice) watch() {
+	w, ok := fd.SimpleDevice.(api.Watcher)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := w.Watch(ctx, fd.MountPoint)
+	if err != nil {
+		cancel()
+		if err != api.ErrNotSupported {
+			fd.log().Warn("Failed to watch so caching is disabled", "error", err)
+		}
+		return
+	}
+	fd.mutex.Lock()
+	fd.watching = true
+	fd.stopWatch = cancel
+	fd.mutex.Unlock()
+	go func() {
+		for e := range events {
+			fd.invalidate(e)
+		}
+	}()
+}
+
+// invalidate ... Tell the kernel the cached data or directory entry for a path is stale
+func (fd *FuseSimpleDevice) invalidate(e api.Event) {
+	fd.forgetSize(e.Path)
+	fd.mutex.Lock()
+	srv := fd.server
+	fd.mutex.Unlock()
+	if srv == nil {
+		return
+	}
+	var err error
+	switch e.Type {
+	case api.EventUpdate:
+		if n, exists := fd.cachedNode(e.Path); exists {
+			err = srv.InvalidateNodeData(n)
+		}
+	case api.EventCreate, api.EventDelete:
+		if e.Type == api.EventDelete {
+			fd.forgetNode(e.Path)
+		}
+		parentKey := path.Dir(e.Path)
+		if parent, exists := fd.cachedNode(parentKey); exists {
+			err = srv.InvalidateEntry(parent, path.Base(e.Path))
+			if err == nil || err == fuse.ErrNotCached {
+				// Directory listing changed as well
+				err = srv.InvalidateNodeData(parent)
+			}
+		}
+	}
+	if err != nil && err != fuse.ErrNotCached {
+		fd.log().Warn("Failed to invalidate", "path", e.Path, "event", e.Type, "error", err)
+	}
+}
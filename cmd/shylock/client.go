@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/lateefj/shylock"
+)
+
+// errNotFound ... The daemon doesn't have what was asked for
+var errNotFound = errors.New("Not found")
+
+// client ... Talks to the control plane http server of a running shylock
+type client struct {
+	addr string
+	http *http.Client
+}
+
+// defaultAddr ... The control plane on this host, HTTP_PORT picks the port
+func defaultAddr() string {
+	port := os.Getenv("HTTP_PORT")
+	if port == "" {
+		port = "7070"
+	}
+	return "localhost:" + port
+}
+
+// clientFlags ... Every client subcommand takes -addr
+func clientFlags(name string, args []string) (*flag.FlagSet, *client) {
+	fset := flag.NewFlagSet(name, flag.ExitOnError)
+	addr := fset.String("addr", defaultAddr(), "Address of the shylock http server")
+	fset.Parse(args)
+	return fset, &client{addr: *addr, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// do ... Send the request and decode a JSON response into v when it isn't nil
+func (c *client) do(method, p string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		bits, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(bits)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", c.addr, p), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s %s", method, p, resp.Status, strings.TrimSpace(string(bits)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(bits, v)
+}
+
+// stream ... Send body as is and copy a successful response to out
+func (c *client) stream(method, p string, body io.Reader, out io.Writer) error {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", c.addr, p), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode >= 300 {
+		bits, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s %s", method, p, resp.Status, strings.TrimSpace(string(bits)))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// mountID ... Id of what the daemon has mounted at the mount point
+func (c *client) mountID(mountPoint string) (string, error) {
+	mountPoint = path.Clean(mountPoint)
+	infos := make([]shylock.MountInfo, 0)
+	if err := c.do(http.MethodGet, "/mounts", nil, &infos); err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if info.MountPoint == mountPoint {
+			return info.ID, nil
+		}
+	}
+	return "", fmt.Errorf("Nothing is mounted at %s", mountPoint)
+}
+
+// snapshot ... Save the state of the device mounted at the mount point
+func (c *client) snapshot(mountPoint string, out io.Writer) error {
+	id, err := c.mountID(mountPoint)
+	if err != nil {
+		return err
+	}
+	return c.stream(http.MethodGet, "/mounts/"+id+"/snapshot", nil, out)
+}
+
+// restore ... Replace the state of the device mounted at the mount point
+func (c *client) restore(mountPoint string, snap io.Reader) error {
+	id, err := c.mountID(mountPoint)
+	if err != nil {
+		return err
+	}
+	return c.stream(http.MethodPut, "/mounts/"+id+"/snapshot", snap, ioutil.Discard)
+}
+
+// snapshotCommand ... Write the state of a mounted device to stdout
+func snapshotCommand(args []string) {
+	fset, c := clientFlags("snapshot", args)
+	if fset.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	if err := c.snapshot(fset.Arg(0), os.Stdout); err != nil {
+		log.Fatalf("Could not snapshot %s: %s", fset.Arg(0), err)
+	}
+}
+
+// restoreCommand ... Load a snapshot from a file or stdin into a mounted device
+func restoreCommand(args []string) {
+	fset, c := clientFlags("restore", args)
+	if fset.NArg() < 1 || fset.NArg() > 2 {
+		usage()
+		os.Exit(2)
+	}
+	var snap io.Reader = os.Stdin
+	if fset.NArg() == 2 {
+		f, err := os.Open(fset.Arg(1))
+		if err != nil {
+			log.Fatalf("Could not open snapshot %s", err)
+		}
+		defer f.Close()
+		snap = f
+	}
+	if err := c.restore(fset.Arg(0), snap); err != nil {
+		log.Fatalf("Could not restore %s: %s", fset.Arg(0), err)
+	}
+}
+
+// statusCommand ... Show what a running shylock has mounted
+func statusCommand(args []string) {
+	_, c := clientFlags("status", args)
+	infos := make([]shylock.MountInfo, 0)
+	if err := c.do(http.MethodGet, "/mounts", nil, &infos); err != nil {
+		log.Fatalf("Could not get the mounts from %s: %s", c.addr, err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tMOUNT POINT\tSTATE\tUPTIME")
+	for _, info := range infos {
+		state := info.State
+		if info.Error != "" {
+			state = fmt.Sprintf("%s (%s)", state, info.Error)
+		}
+		uptime := time.Duration(info.Uptime * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", info.ID, info.Type, info.MountPoint, state, uptime)
+	}
+	w.Flush()
+}
+
+// unmountCommand ... Ask the daemon to unmount, a mount it doesn't know about is unmounted directly
+func unmountCommand(args []string) {
+	fset, c := clientFlags("unmount", args)
+	if fset.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	mountPoint := path.Clean(fset.Arg(0))
+	infos := make([]shylock.MountInfo, 0)
+	if err := c.do(http.MethodGet, "/mounts", nil, &infos); err != nil {
+		log.Printf("Could not reach %s (%s), unmounting %s directly", c.addr, err, mountPoint)
+	}
+	for _, info := range infos {
+		if info.MountPoint == mountPoint {
+			if err := c.do(http.MethodDelete, "/mounts/"+info.ID, nil, nil); err != nil {
+				log.Fatalf("Failed to unmount %s: %s", mountPoint, err)
+			}
+			return
+		}
+	}
+	if err := fuse.Unmount(mountPoint); err != nil {
+		log.Fatalf("Failed to unmount %s: %s", mountPoint, err)
+	}
+}
+
+// qosRule ... Same JSON as the qos http api
+type qosRule struct {
+	Key        string `json:"key"`
+	ReadLimit  uint64 `json:"read_limit"`
+	WriteLimit uint64 `json:"write_limit"`
+}
+
+// qosPath ... Keys are paths so the leading slash is dropped from the url
+func qosPath(key string) string {
+	return "/key/" + strings.TrimPrefix(key, "/")
+}
+
+// qosCommand ... List, set or remove the QOS rules of a running shylock
+func qosCommand(args []string) {
+	fset, c := clientFlags("qos", args)
+	switch {
+	case fset.Arg(0) == "list" && fset.NArg() == 1:
+		rules := make([]qosRule, 0)
+		if err := c.do(http.MethodGet, "/key/", nil, &rules); err != nil {
+			log.Fatalf("Could not list qos rules: %s", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tREAD LIMIT\tWRITE LIMIT")
+		for _, r := range rules {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", r.Key, r.ReadLimit, r.WriteLimit)
+		}
+		w.Flush()
+	case fset.Arg(0) == "set" && fset.NArg() == 4:
+		rule := qosRule{Key: fset.Arg(1)}
+		var err error
+		if rule.ReadLimit, err = strconv.ParseUint(fset.Arg(2), 10, 64); err != nil {
+			log.Fatalf("Invalid read limit %s", fset.Arg(2))
+		}
+		if rule.WriteLimit, err = strconv.ParseUint(fset.Arg(3), 10, 64); err != nil {
+			log.Fatalf("Invalid write limit %s", fset.Arg(3))
+		}
+		// Update when the rule exists otherwise add it
+		err = c.do(http.MethodPut, qosPath(rule.Key), rule, nil)
+		if err == errNotFound {
+			err = c.do(http.MethodPost, qosPath(rule.Key), rule, nil)
+		}
+		if err != nil {
+			log.Fatalf("Could not set qos rule %s: %s", rule.Key, err)
+		}
+	case fset.Arg(0) == "rm" && fset.NArg() == 2:
+		if err := c.do(http.MethodDelete, qosPath(fset.Arg(1)), nil, nil); err != nil {
+			log.Fatalf("Could not remove qos rule %s: %s", fset.Arg(1), err)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// logLevelCommand ... Show or change the log level of a running shylock
+func logLevelCommand(args []string) {
+	fset, c := clientFlags("log-level", args)
+	if fset.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+	lb := struct {
+		Level string `json:"level"`
+	}{}
+	var err error
+	if fset.NArg() == 1 {
+		err = c.do(http.MethodPut, "/log/level", map[string]string{"level": fset.Arg(0)}, &lb)
+	} else {
+		err = c.do(http.MethodGet, "/log/level", nil, &lb)
+	}
+	if err != nil {
+		log.Fatalf("Could not reach %s: %s", c.addr, err)
+	}
+	fmt.Println(lb.Level)
+}
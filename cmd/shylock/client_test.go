@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientSnapshotRestore(t *testing.T) {
+	var restored []byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mounts", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[{"id": "7", "mount_point": "/mnt/kv"}]`))
+	})
+	mux.HandleFunc("/mounts/7/snapshot", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			restored, _ = ioutil.ReadAll(req.Body)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(`{"files": {}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c := &client{addr: strings.TrimPrefix(srv.URL, "http://"), http: srv.Client()}
+
+	out := &bytes.Buffer{}
+	if err := c.snapshot("/mnt/kv/", out); err != nil || out.String() != `{"files": {}}` {
+		t.Fatalf("Expected the snapshot of mount 7 however got %q %v", out.String(), err)
+	}
+	if err := c.restore("/mnt/kv", strings.NewReader(`{"files": {"/mnt/kv/a": ""}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if string(restored) != `{"files": {"/mnt/kv/a": ""}}` {
+		t.Errorf("Expected the snapshot to be sent as is however got %s", restored)
+	}
+	if err := c.snapshot("/mnt/other", out); err == nil {
+		t.Errorf("Expected a mount point that isn't mounted to fail")
+	}
+}
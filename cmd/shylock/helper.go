@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+const (
+	// helperChildEnv ... Set for the daemonized helper so it serves the mount instead of forking again
+	helperChildEnv = "SHYLOCK_HELPER_CHILD"
+	// helperReadyFd ... The daemonized helper writes ready or why it failed here then closes it
+	helperReadyFd = 3
+	helperReady   = "ready"
+)
+
+// fstabMount ... `shylock TYPE /mnt/point -o options` the way mount(8) runs helpers. mount(8) waits
+// for the helper so it daemonizes and exits once the mount is ready, unless the foreground option is set
+func fstabMount(args []string) {
+	ms, err := parseHelperArgs(args)
+	if err != nil {
+		log.Print(err)
+		usage()
+		os.Exit(2)
+	}
+	if ms.Foreground || os.Getenv(helperChildEnv) != "" {
+		ms.serve()
+		return
+	}
+	if err := daemonize(ms); err != nil {
+		log.Fatalf("Failed to mount %s: %s", ms.MountPoint, err)
+	}
+}
+
+// daemonize ... Run the helper again in its own session and wait for it to say the mount is ready
+func daemonize(ms *mountSpec) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	// Same name so the child is dispatched the same way
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), helperChildEnv+"=1")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if ms.LogFile != "" {
+		f, err := os.OpenFile(ms.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		defer f.Close()
+		cmd.Stdout = f
+		cmd.Stderr = f
+	}
+	err = cmd.Start()
+	// Only the child holds the write end now so a child that dies closes the pipe
+	w.Close()
+	if err != nil {
+		return err
+	}
+	bits, _ := ioutil.ReadAll(r)
+	msg := strings.TrimSpace(string(bits))
+	if msg == helperReady {
+		return cmd.Process.Release()
+	}
+	if msg == "" {
+		return fmt.Errorf("exited before the mount was ready: %v", cmd.Wait())
+	}
+	cmd.Wait()
+	return errors.New(msg)
+}
+
+// notifyHelper ... Tell the parent of a daemonized helper how mounting went
+func notifyHelper(err error) {
+	if os.Getenv(helperChildEnv) == "" {
+		return
+	}
+	f := os.NewFile(helperReadyFd, "ready")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	if err != nil {
+		fmt.Fprintln(f, err)
+		return
+	}
+	fmt.Fprintln(f, helperReady)
+}
@@ -1,40 +1,177 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"sort"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"github.com/lateefj/shylock/etcd"
-	"github.com/lateefj/shylock/kafka"
-	"github.com/lateefj/shylock/pathqos"
+	"github.com/lateefj/shylock"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/buse"
+	_ "github.com/lateefj/shylock/etcd"
+	_ "github.com/lateefj/shylock/kafka"
+	"github.com/lateefj/shylock/logger"
+	_ "github.com/lateefj/shylock/loopback"
+	_ "github.com/lateefj/shylock/pathqos"
 	"github.com/lateefj/shylock/qos"
-	"github.com/lateefj/shylock/redisfs"
+	_ "github.com/lateefj/shylock/redisfs"
 )
 
 const (
-	progName = "skylock"
+	progName = "shylock"
+
+	// Exit codes after a signal
+	exitClean = 0
+	// exitUnmountError ... A mount failed to unmount or its backend failed to flush
+	exitUnmountError = 1
+	// exitDrainTimeout ... Requests were still in flight when the shutdown timeout ran out
+	exitDrainTimeout = 3
+)
+
+var (
+	shutdownTimeout = flag.Duration("shutdown-timeout", buse.DefaultShutdownTimeout, "How long to wait for requests in flight when stopping")
+	logLevel        = flag.String("log-level", envDefault("LOG_LEVEL", "info"), "debug, info, warn or error, LOG_LEVEL sets the default")
+	logFormat       = flag.String("log-format", envDefault("LOG_FORMAT", "logfmt"), "logfmt or json, LOG_FORMAT sets the default")
+	auditFile       = flag.String("audit-file", "", "Record creates, writes, removes, mkdirs, renames and setattrs as JSON lines in this file")
+	auditSyslog     = flag.Bool("audit-syslog", false, "Send audit entries to syslog instead of a file")
+	auditInclude    = flag.String("audit-include", "", "Comma separated path prefixes to audit, every path when empty")
+	auditExclude    = flag.String("audit-exclude", "", "Comma separated path prefixes to never audit")
 )
 
+// envDefault ... The environment variable when it is set
+func envDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// configureLogging ... Apply the log flags to the default logger everything else logs through
+func configureLogging() {
+	level, err := logger.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := logger.ParseFormat(*logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.Configure(os.Stderr, format, level)
+}
+
+// splitList ... Empty values give an empty list
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// auditFlags ... The audit config from the -audit flags
+func auditFlags() audit.Config {
+	return audit.Config{File: *auditFile, Syslog: *auditSyslog, Include: splitList(*auditInclude), Exclude: splitList(*auditExclude)}
+}
+
+// configureAudit ... Record mutating requests on every mount made after this, nothing happens
+// without a file or syslog. Only commands that serve mounts call it
+func configureAudit(c audit.Config) {
+	if c.File == "" && !c.Syslog {
+		return
+	}
+	a, err := audit.New(c)
+	if err != nil {
+		notifyHelper(err)
+		log.Fatalf("Could not open the audit log: %s", err)
+	}
+	audit.SetDefault(a)
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s type /mnt/point (types: pathqos|kafka|etcd|redis)", progName)
+	fmt.Fprintf(os.Stderr, "usage: %s [-shutdown-timeout 10s] [-log-level info] [-log-format logfmt]\n", progName)
+	fmt.Fprintf(os.Stderr, "  [-audit-file file | -audit-syslog] [-audit-include prefixes] [-audit-exclude prefixes] command [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "  mount [-config json] [-config-file file] [-wrap json] [-http-port port] [-qos-file file] [-o options] type /mnt/point\n")
+	fmt.Fprintf(os.Stderr, "  unmount [-addr host:port] /mnt/point\n")
+	fmt.Fprintf(os.Stderr, "  status [-addr host:port]\n")
+	fmt.Fprintf(os.Stderr, "  qos [-addr host:port] list | set key read_limit write_limit | rm key\n")
+	fmt.Fprintf(os.Stderr, "  log-level [-addr host:port] [debug|info|warn|error]\n")
+	fmt.Fprintf(os.Stderr, "  snapshot [-addr host:port] /mnt/point > snapshot.json\n")
+	fmt.Fprintf(os.Stderr, "  restore [-addr host:port] /mnt/point [snapshot.json]\n")
+	fmt.Fprintf(os.Stderr, "  types [type]\n")
+	fmt.Fprintf(os.Stderr, "  daemon config.json\n")
+	fmt.Fprintf(os.Stderr, "  csi [-node-id id] [-type type] [-config json] /var/lib/kubelet/plugins/shylock/csi.sock\n")
+	fmt.Fprintf(os.Stderr, "  docker [-root dir] [-type type] [-config json] /run/docker/plugins/shylock.sock\n")
+	fmt.Fprintf(os.Stderr, "  replay [-speed 1] [-from /recorded/mount] recording /mnt/point\n")
+	fmt.Fprintf(os.Stderr, "  replay [-speed 1] [-from /recorded/mount] [-config json] recording type /mnt/point\n\n")
+	fmt.Fprintf(os.Stderr, "As a mount helper (mount -t fuse.shylock): %s type /mnt/point [-o options]\n\n", progName)
+	fmt.Fprintf(os.Stderr, "Options: ro, allow_other, default_permissions, uid=N, gid=N, umask=022, qos_file=, http_port=,\n")
+	fmt.Fprintf(os.Stderr, "config_file=, log_file=, foreground, audit_file=, audit_syslog, audit_include=/a+/b, audit_exclude=\n")
+	fmt.Fprintf(os.Stderr, "and key=value for any config property of the type\n")
 }
 
-func httpInterface(iom *qos.IOMap) {
-	port := os.Getenv("HTTP_PORT")
+// printTypes ... List the registered device types or the details of a single type
+func printTypes(fsType string) {
+	if fsType != "" {
+		info, exists := api.LookupType(fsType)
+		if !exists {
+			log.Fatalf("No file system type %s", fsType)
+		}
+		fmt.Printf("Type:         %s\n", info.FSType)
+		fmt.Printf("Description:  %s\n", info.Description)
+		fmt.Printf("Capabilities: %s\n", joinCapabilities(info.Capabilities))
+		if len(info.Schema) > 0 {
+			fmt.Printf("Config schema:\n%s\n", string(info.Schema))
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tCAPABILITIES\tDESCRIPTION")
+	for _, info := range api.Types() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", info.FSType, joinCapabilities(info.Capabilities), info.Description)
+	}
+	fmt.Fprintln(w, "\nWRAPPER\tCAPABILITIES\tDESCRIPTION")
+	for _, info := range api.WrapperTypes() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", info.FSType, joinCapabilities(info.Capabilities), info.Description)
+	}
+	w.Flush()
+}
+
+func joinCapabilities(caps []api.Capability) string {
+	if len(caps) == 0 {
+		return "-"
+	}
+	names := make([]string, len(caps))
+	for i, c := range caps {
+		names[i] = string(c)
+	}
+	return strings.Join(names, ",")
+}
+
+func httpInterface(port string, iom *qos.IOMap) {
 	if port == "" { // If port is not set don't start the http server
-		log.Println("Not starting http server")
+		logger.Default().Info("Not starting http server")
 		return
 	}
 	go func() {
 		qos.Setup(iom)
-		log.Printf("Http server on port %s\n", port)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+		api.Setup()
+		shylock.Setup(iom)
+		logger.Setup()
+		logger.Default().Info("Http server started", "port", port)
+		logger.Default().Fatal("Http server stopped", "error", http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 	}()
 
 }
@@ -48,79 +185,346 @@ func loadIOCConfig(configFile string) (*qos.IOMap, error) {
 	return qos.LoadIOCConfig(f), nil
 }
 
-type exitFunc func() error
+// replay ... Play a recording made by the record wrapper through the files of a mount point. With a
+// type the mount is made first and unmounted once the replay is done, any registered type works
+func replay(args []string) {
+	fset := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fset.Float64("speed", 1, "Time scale, 2 is twice as fast and 0 is as fast as possible")
+	from := fset.String("from", "", "Mount point in the recording, swapped for the mount point being replayed against")
+	config := fset.String("config", "", "JSON config for the device")
+	fset.Parse(args)
+	if fset.NArg() != 2 && fset.NArg() != 3 {
+		usage()
+		os.Exit(2)
+	}
+	recording, mountPoint := fset.Arg(0), fset.Arg(fset.NArg()-1)
+	f, err := os.Open(recording)
+	if err != nil {
+		log.Fatalf("Failed to open recording %s with error: %s", recording, err)
+	}
+	defer f.Close()
+	if fset.NArg() == 3 {
+		fsType, exists := lookupType(fset.Arg(1))
+		if !exists {
+			log.Fatalf("No file system type %s", fset.Arg(1))
+		}
+		info, err := shylock.MountWithConfig(shylock.MountConfig{Type: fsType, MountPoint: mountPoint, Config: []byte(*config)}, nil)
+		if err != nil {
+			log.Fatalf("Failed to mount %s with error: %s", fsType, err)
+		}
+		defer shylock.Unmount(info.ID)
+	}
+	stats, err := api.ReplayFiles(f, api.ReplayOptions{Speed: *speed, From: *from, To: mountPoint})
+	if err != nil {
+		log.Printf("Replay stopped with error: %s", err)
+	}
+	fmt.Printf("Operations:    %d\n", stats.Ops)
+	fmt.Printf("Errors:        %d\n", stats.Errors)
+	fmt.Printf("Bytes read:    %d\n", stats.BytesRead)
+	fmt.Printf("Bytes written: %d\n", stats.BytesWritten)
+	fmt.Printf("Elapsed:       %s\n", stats.Elapsed)
+	ops := make([]string, 0, len(stats.ByOp))
+	for op := range stats.ByOp {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Printf("  %-8s %d\n", op, stats.ByOp[op])
+	}
+}
+
+// lookupType ... Registered types are upper case, the old lower case names still work
+func lookupType(name string) (string, bool) {
+	if _, exists := api.LookupType(name); exists {
+		return name, true
+	}
+	upper := strings.ToUpper(name)
+	_, exists := api.LookupType(upper)
+	return upper, exists
+}
+
+// loadConfig ... Config comes from the flag or a file, a device gets an empty config without either
+func loadConfig(config, configFile string) ([]byte, error) {
+	if config != "" && configFile != "" {
+		return nil, errors.New("Use either -config or -config-file")
+	}
+	if configFile != "" {
+		return ioutil.ReadFile(configFile)
+	}
+	return []byte(config), nil
+}
+
+// commands ... Every subcommand gets the arguments after its name
+var commands = map[string]func(args []string){
+	"mount":     mountCommand,
+	"unmount":   unmountCommand,
+	"status":    statusCommand,
+	"qos":       qosCommand,
+	"log-level": logLevelCommand,
+	"snapshot":  snapshotCommand,
+	"restore":   restoreCommand,
+	"types":     typesCommand,
+	"daemon":    daemonCommand,
+	"docker":    docker,
+	"csi":       csiNode,
+	"replay":    replay,
+}
 
 func main() {
 
 	log.SetFlags(0)
 	log.SetPrefix(progName + ": ")
 
+	// mount(8) runs mount.fuse.shylock or shylock with the source first and the options last
+	if strings.HasPrefix(path.Base(os.Args[0]), "mount.") {
+		configureLogging()
+		fstabMount(os.Args[1:])
+		return
+	}
+
 	flag.Usage = usage
 	flag.Parse()
+	configureLogging()
+	buse.DefaultShutdownTimeout = *shutdownTimeout
 
-	if flag.NArg() != 2 {
+	if cmd, exists := commands[flag.Arg(0)]; exists {
+		cmd(flag.Args()[1:])
+		return
+	}
+	if _, exists := lookupType(strings.TrimPrefix(flag.Arg(0), "shylock#")); exists {
+		fstabMount(flag.Args())
+		return
+	}
+	usage()
+	os.Exit(2)
+}
+
+// typesCommand ... List the registered types or show one of them
+func typesCommand(args []string) {
+	if len(args) > 1 {
 		usage()
 		os.Exit(2)
 	}
+	fsType := ""
+	if len(args) == 1 {
+		fsType = args[0]
+	}
+	printTypes(fsType)
+}
+
+// mountCommand ... Mount a single backend and serve it until the process is told to stop
+func mountCommand(args []string) {
+	fset := flag.NewFlagSet("mount", flag.ExitOnError)
+	config := fset.String("config", "", "JSON config for the device, see `types TYPE` for the schema")
+	configFile := fset.String("config-file", "", "File with the JSON config for the device")
+	wrap := fset.String("wrap", "", "JSON list of wrappers to apply like [{\"type\": \"readonly\"}]")
+	httpPort := fset.String("http-port", os.Getenv("HTTP_PORT"), "Port for the control plane http server, none when empty")
+	qosFile := fset.String("qos-file", os.Getenv("QOS_FILE"), "CSV file with path,read_limit,write_limit QOS rules")
+	opts := fset.String("o", "", "Comma separated mount options")
+	fset.Parse(args)
+	if fset.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+	ms := &mountSpec{FSType: fset.Arg(0), MountPoint: fset.Arg(1), HTTPPort: *httpPort, QOSFile: *qosFile}
 	var err error
+	if ms.Config, err = loadConfig(*config, *configFile); err != nil {
+		log.Fatalf("Could not load device config: %s", err)
+	}
+	if *wrap != "" {
+		if err := json.Unmarshal([]byte(*wrap), &ms.Wrap); err != nil {
+			log.Fatalf("Could not parse wrappers %s: %s", *wrap, err)
+		}
+	}
+	if err := ms.applyOptions(*opts); err != nil {
+		log.Fatal(err)
+	}
+	ms.serve()
+}
+
+// serve ... Mount and block until the process is told to stop
+func (ms *mountSpec) serve() {
+	mountType, exists := lookupType(ms.FSType)
+	if !exists {
+		notifyHelper(fmt.Errorf("No file system type %s", ms.FSType))
+		log.Printf("No file system type %s", ms.FSType)
+		usage()
+		os.Exit(2)
+	}
+	config, err := ms.deviceConfig(mountType)
+	if err != nil {
+		notifyHelper(err)
+		log.Fatal(err)
+	}
+	if ms.Audit.File == "" && !ms.Audit.Syslog {
+		ms.Audit = auditFlags()
+	}
+	configureAudit(ms.Audit)
 	iom := qos.NewIOMap()
-	configFile := os.Getenv("QOS_FILE")
-	if configFile != "" {
-		iom, err = loadIOCConfig(configFile)
+	if ms.QOSFile != "" {
+		iom, err = loadIOCConfig(ms.QOSFile)
 		if err != nil {
-			log.Fatalf("Could not load config file %s with error: %s", configFile, err)
+			log.Fatalf("Could not load config file %s with error: %s", ms.QOSFile, err)
 		}
 	}
+	logger.Default().Info("Mounting", "type", mountType, "mount_point", ms.MountPoint)
+	httpInterface(ms.HTTPPort, iom)
+	ready := make(chan error, 1)
+	ms.Options.Ready = func(info shylock.MountInfo, err error) {
+		ready <- err
+	}
+	if err := shylock.MountFuseOptions(ms.MountPoint, mountType, config, ms.Wrap, iom, ms.Options); err != nil {
+		notifyHelper(err)
+		log.Fatal(err)
+	}
+	select {
+	case err = <-ready:
+	case <-time.After(shylock.MountReadyTimeout):
+		err = fmt.Errorf("not mounted after %s", shylock.MountReadyTimeout)
+	}
+	notifyHelper(err)
+	if err != nil {
+		shylock.Exit()
+		logger.Default().Fatal("Mount is not ready", "mount_point", ms.MountPoint, "error", err)
+	}
+	logger.Default().Info("Mount is ready", "mount_point", ms.MountPoint)
+	sdNotify("READY=1")
+	waitForSignal()
+}
 
-	var exf exitFunc
+// daemonCommand ... Serve every mount in the config file from this process
+func daemonCommand(args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
+	}
+	daemon(args[0])
+}
 
-	mountType := flag.Arg(0)
-	mountPoint := flag.Arg(1)
-	log.Printf("Mount type %s point %s\n", mountType, mountPoint)
-	httpInterface(iom)
-	switch mountType {
-	case "pathqos":
-		if err := pathqos.Mount(mountPoint, iom); err != nil {
-			log.Fatal(err)
-		}
-	case "kafka":
-		if err := kafka.Mount(mountPoint); err != nil {
-			log.Fatal(err)
-		}
-	case "etcd":
-		if err := etcd.Mount(mountPoint, iom); err != nil {
-			log.Fatal(err)
-		}
-		exf = etcd.Exit
-	case "redis":
-		if err := redisfs.Mount(mountPoint, iom); err != nil {
-			log.Fatal(err)
+// daemon ... Serve every mount in the config file from this process
+func daemon(configFile string) {
+	f, err := os.Open(configFile)
+	if err != nil {
+		log.Fatalf("Failed to open daemon config %s with error: %s", configFile, err)
+	}
+	dc, err := shylock.LoadDaemonConfig(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Invalid daemon config %s: %s", configFile, err)
+	}
+	configureAudit(auditFlags())
+	port := dc.HTTPPort
+	if port == "" {
+		port = os.Getenv("HTTP_PORT")
+	}
+	iom := qos.NewIOMap()
+	httpInterface(port, iom)
+	if err := shylock.MountAll(dc, iom); err != nil {
+		logger.Default().Fatal("Failed to mount", "error", err)
+	}
+	for _, mc := range dc.Mounts {
+		logger.Default().Info("Mounted", "type", mc.Type, "mount_point", mc.MountPoint)
+	}
+	sdNotify("READY=1")
+	waitForSignal()
+}
+
+// docker ... Serve the Docker volume plugin protocol until the process is told to stop
+func docker(args []string) {
+	fset := flag.NewFlagSet("docker", flag.ExitOnError)
+	root := fset.String("root", shylock.DockerVolumeRoot, "Directory volumes are mounted under")
+	fsType := fset.String("type", "", "Device type for volumes created without the type option")
+	config := fset.String("config", "", "JSON device config for volumes created without the config option")
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	if *fsType != "" {
+		name, exists := lookupType(*fsType)
+		if !exists {
+			log.Fatalf("No file system type %s", *fsType)
 		}
-		exf = redisfs.Exit
-	default:
+		*fsType = name
+	}
+	iom := qos.NewIOMap()
+	httpInterface(os.Getenv("HTTP_PORT"), iom)
+	configureAudit(auditFlags())
+	dp := shylock.NewDockerPlugin(*root, *fsType, []byte(*config), iom)
+	if err := shylock.MountDockerPlugin(dp, fset.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+	logger.Default().Info("Docker volume plugin started", "socket", fset.Arg(0))
+	sdNotify("READY=1")
+	waitForSignal()
+}
+
+// csiNode ... Serve the CSI node service until the process is told to stop
+func csiNode(args []string) {
+	fset := flag.NewFlagSet("csi", flag.ExitOnError)
+	nodeID := fset.String("node-id", "", "Node id reported to the orchestrator, defaults to the host name")
+	fsType := fset.String("type", "", "Device type for volumes without the type option")
+	config := fset.String("config", "", "JSON device config for volumes without the config option")
+	fset.Parse(args)
+	if fset.NArg() != 1 {
 		usage()
+		os.Exit(2)
+	}
+	if *fsType != "" {
+		name, exists := lookupType(*fsType)
+		if !exists {
+			log.Fatalf("No file system type %s", *fsType)
+		}
+		*fsType = name
+	}
+	iom := qos.NewIOMap()
+	httpInterface(os.Getenv("HTTP_PORT"), iom)
+	configureAudit(auditFlags())
+	cn := shylock.NewCSINode(*fsType, []byte(*config), iom)
+	if *nodeID != "" {
+		cn.NodeID = *nodeID
+	}
+	if err := shylock.MountCSINode(cn, fset.Arg(0)); err != nil {
+		log.Fatal(err)
 	}
+	logger.Default().Info("CSI node service started", "socket", fset.Arg(0))
+	sdNotify("READY=1")
+	waitForSignal()
+}
 
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
+// waitForSignal ... Block until the process is told to stop then shut everything down and exit
+func waitForSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sigs
+	l := logger.Default()
+	l.Info("Caught signal, shutting down", "signal", s)
+	sdNotify("STOPPING=1")
 
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	closeErrChan := make(chan error, 1)
+	go func() {
+		closeErrChan <- shylock.Shutdown(ctx)
+	}()
 	select {
-	case s := <-sigs:
-		log.Printf("Caught signal: %v", s)
-		closeErrChan := make(chan error)
-		if exf != nil {
-			go func() {
-				closeErrChan <- exf()
-			}()
-		}
-		select {
-		case e := <-closeErrChan:
-			if e != nil {
-				log.Printf("Error closing %s\n", e)
-			}
-		case <-time.After(1 * time.Second):
-			log.Fatalf("FAILED Waiting for fuse mount to close\n")
-			os.Exit(1)
+	case err := <-closeErrChan:
+		switch err {
+		case nil:
+			os.Exit(exitClean)
+		case buse.ErrDrainTimeout:
+			l.Warn("Gave up waiting for requests in flight", "timeout", *shutdownTimeout)
+			os.Exit(exitDrainTimeout)
+		default:
+			l.Error("Error shutting down", "error", err)
+			os.Exit(exitUnmountError)
 		}
+	case <-time.After(*shutdownTimeout + 5*time.Second):
+		// A backend is stuck flushing
+		l.Error("Failed waiting for mounts to close")
+		os.Exit(exitDrainTimeout)
+	case s := <-sigs:
+		l.Warn("Caught signal again, exiting without waiting", "signal", s)
+		os.Exit(exitDrainTimeout)
 	}
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/lateefj/shylock/logger"
+)
+
+// sdNotify ... Tell systemd about the state of a Type=notify service, nothing happens outside systemd
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// A leading @ is an abstract socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logger.Default().Warn("Could not notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Default().Warn("Could not notify systemd", "state", state, "error", err)
+	}
+}
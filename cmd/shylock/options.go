@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lateefj/shylock"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+)
+
+// ignoredOptions ... Options mount(8) handles itself or passes along to every helper
+var ignoredOptions = map[string]bool{
+	"rw": true, "defaults": true, "auto": true, "noauto": true, "user": true, "nouser": true, "users": true,
+	"exec": true, "noexec": true, "suid": true, "nosuid": true, "dev": true, "nodev": true,
+	"_netdev": true, "nofail": true, "atime": true, "noatime": true, "relatime": true,
+}
+
+// optionAliases ... Backend option names that read better in fstab than the config property
+var optionAliases = map[string]string{
+	"etcd_hosts": "endpoints",
+}
+
+// mountSpec ... Everything needed to mount a single backend
+type mountSpec struct {
+	FSType     string
+	MountPoint string
+	Config     []byte
+	Wrap       []api.WrapperConfig
+	HTTPPort   string
+	QOSFile    string
+	Options    shylock.MountOptions
+	// Foreground ... The helper stays attached instead of daemonizing once the mount is ready
+	Foreground bool
+	// LogFile ... Where a daemonized helper logs, nowhere when empty
+	LogFile string
+	// Backend ... key=value options set in the device config
+	Backend map[string]string
+	// Audit ... Set by the audit_ options, the -audit flags are used when it is empty
+	Audit audit.Config
+}
+
+// parseID ... uid and gid are decimal
+func parseID(k, v string) (*uint32, error) {
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mount option %s=%s", k, v)
+	}
+	i := uint32(id)
+	return &i, nil
+}
+
+// applyOptions ... Comma separated mount options like the ones in /etc/fstab. Options that aren't
+// mount options are set in the device config, see `types TYPE` for the schema
+func (ms *mountSpec) applyOptions(opts string) error {
+	for _, opt := range strings.Split(opts, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" || ignoredOptions[opt] || strings.HasPrefix(opt, "x-") {
+			continue
+		}
+		k, v := opt, ""
+		hasValue := false
+		if i := strings.Index(opt, "="); i >= 0 {
+			k, v, hasValue = opt[:i], opt[i+1:], true
+		}
+		var err error
+		switch {
+		case k == "ro" && !hasValue:
+			ms.Options.ReadOnly = true
+		case k == "allow_other" && !hasValue:
+			ms.Options.AllowOther = true
+		case k == "default_permissions" && !hasValue:
+			ms.Options.DefaultPermissions = true
+		case k == "foreground" && !hasValue:
+			ms.Foreground = true
+		case k == "audit_syslog" && !hasValue:
+			ms.Audit.Syslog = true
+		case k == "audit_file" && hasValue:
+			ms.Audit.File = v
+		case k == "audit_include" && hasValue:
+			ms.Audit.Include = strings.Split(v, api.OptionListSeparator)
+		case k == "audit_exclude" && hasValue:
+			ms.Audit.Exclude = strings.Split(v, api.OptionListSeparator)
+		case k == "uid" && hasValue:
+			ms.Options.UID, err = parseID(k, v)
+		case k == "gid" && hasValue:
+			ms.Options.GID, err = parseID(k, v)
+		case k == "umask" && hasValue:
+			mask, perr := strconv.ParseUint(v, 8, 32)
+			if perr != nil {
+				return fmt.Errorf("Invalid mount option umask=%s, it should be octal", v)
+			}
+			umask := os.FileMode(mask) & os.ModePerm
+			ms.Options.Umask = &umask
+		case k == "qos_file" && hasValue:
+			ms.QOSFile = v
+		case k == "http_port" && hasValue:
+			ms.HTTPPort = v
+		case k == "log_file" && hasValue:
+			ms.LogFile = v
+		case k == "config_file" && hasValue:
+			if len(ms.Config) > 0 {
+				return errors.New("Use either a config or the config_file option")
+			}
+			if ms.Config, err = ioutil.ReadFile(v); err != nil {
+				return fmt.Errorf("Could not read config_file %s", err)
+			}
+		case k == "ro" || k == "allow_other" || k == "default_permissions" || k == "foreground" || k == "audit_syslog":
+			return fmt.Errorf("Mount option %s takes no value", k)
+		case hasValue:
+			if alias, exists := optionAliases[k]; exists {
+				k = alias
+			}
+			if ms.Backend == nil {
+				ms.Backend = make(map[string]string)
+			}
+			ms.Backend[k] = v
+		default:
+			return fmt.Errorf("Unsupported mount option %s", opt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deviceConfig ... The config with the backend options set, they are typed and checked by the schema
+func (ms *mountSpec) deviceConfig(fsType string) ([]byte, error) {
+	if len(ms.Backend) == 0 {
+		return ms.Config, nil
+	}
+	info, _ := api.LookupType(fsType)
+	if len(info.Schema) == 0 {
+		return nil, fmt.Errorf("Type %s has no config schema so it takes no backend options", fsType)
+	}
+	config, err := api.ConfigFromOptions(info.Schema, ms.Config, ms.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid options for %s: %s", fsType, err)
+	}
+	return config, nil
+}
+
+// parseHelperArgs ... mount(8) runs helpers as `helper source /mnt/point -o options` and may add
+// -n, -s, -f or -v which are ignored. The source is the type, optionally as shylock#TYPE
+func parseHelperArgs(args []string) (*mountSpec, error) {
+	positional := make([]string, 0, 2)
+	opts := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o":
+			if i+1 >= len(args) {
+				return nil, errors.New("Missing options after -o")
+			}
+			i++
+			opts = append(opts, args[i])
+		case strings.HasPrefix(arg, "-o"):
+			opts = append(opts, arg[2:])
+		case strings.HasPrefix(arg, "-"):
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("Expected a type and a mount point however got %v", positional)
+	}
+	ms := &mountSpec{FSType: strings.TrimPrefix(positional[0], "shylock#"), MountPoint: positional[1]}
+	ms.HTTPPort = os.Getenv("HTTP_PORT")
+	ms.QOSFile = os.Getenv("QOS_FILE")
+	if err := ms.applyOptions(strings.Join(opts, ",")); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
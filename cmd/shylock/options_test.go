@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestParseHelperArgs(t *testing.T) {
+	ms, err := parseHelperArgs([]string{"shylock#LOOPBACK_KV", "/mnt/kv", "-n", "-o", "rw,noauto,_netdev,x-systemd.automount"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.FSType != "LOOPBACK_KV" || ms.MountPoint != "/mnt/kv" {
+		t.Errorf("Unexpected mount %+v", ms)
+	}
+	if _, err := parseHelperArgs([]string{"-odefaults", "LOOPBACK_KV", "/mnt/kv"}); err != nil {
+		t.Errorf("Expected options before the source to work however got %s", err)
+	}
+	bad := [][]string{
+		{"LOOPBACK_KV"},
+		{"LOOPBACK_KV", "/mnt/kv", "-o"},
+		{"LOOPBACK_KV", "/mnt/kv", "-o", "not_an_option"},
+	}
+	for _, args := range bad {
+		if _, err := parseHelperArgs(args); err == nil {
+			t.Errorf("Expected %v to fail", args)
+		}
+	}
+}
+
+func TestApplyOptions(t *testing.T) {
+	ms := &mountSpec{FSType: "ETCD"}
+	err := ms.applyOptions("ro,allow_other,default_permissions,uid=1000,gid=100,umask=027,qos_file=/etc/shylock/qos.csv,http_port=7071,etcd_hosts=http://a:2379+http://b:2379,foreground,audit_file=/var/log/shylock/audit.log,audit_include=/a+/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ms.Options
+	if !o.ReadOnly || !o.AllowOther || !o.DefaultPermissions || !ms.Foreground {
+		t.Errorf("Expected flag options to be set however got %+v", ms)
+	}
+	if o.UID == nil || *o.UID != 1000 || o.GID == nil || *o.GID != 100 || o.Umask == nil || *o.Umask != 027 {
+		t.Errorf("Expected uid 1000, gid 100 and umask 027 however got %+v", o)
+	}
+	if ms.QOSFile != "/etc/shylock/qos.csv" || ms.HTTPPort != "7071" {
+		t.Errorf("Expected qos_file and http_port to be set however got %+v", ms)
+	}
+	if ms.Audit.File != "/var/log/shylock/audit.log" || len(ms.Audit.Include) != 2 || ms.Audit.Include[1] != "/b" {
+		t.Errorf("Expected the audit file and include prefixes however got %+v", ms.Audit)
+	}
+	config, err := ms.deviceConfig("ETCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"endpoints":["http://a:2379","http://b:2379"]}`
+	if string(config) != expected {
+		t.Errorf("Expected config %s however got %s", expected, string(config))
+	}
+
+	bad := []string{"uid=me", "umask=999", "ro=1", "audit_syslog=yes", "not_an_option"}
+	for _, opts := range bad {
+		if err := (&mountSpec{}).applyOptions(opts); err == nil {
+			t.Errorf("Expected %s to fail", opts)
+		}
+	}
+	ms = &mountSpec{}
+	if err := ms.applyOptions("no_such_property=1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.deviceConfig("ETCD"); err == nil {
+		t.Errorf("Expected an option that isn't in the schema to fail")
+	}
+}
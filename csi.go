@@ -0,0 +1,282 @@
+package shylock
+
+import (
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/logger"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// CSIDriverName ... Name the node plugin reports to the container orchestrator
+	CSIDriverName = "shylock.lateefj.github.com"
+	// CSIVendorVersion ... Version reported with the driver name
+	CSIVendorVersion = "0.0.1"
+	// csiContextPrefix ... Volume context the orchestrator adds on its own like the pod name
+	csiContextPrefix = "csi.storage.k8s.io/"
+)
+
+// csiVolume ... A volume published at a target path
+type csiVolume struct {
+	volumeID string
+	mountID  string
+	// pending ... Closed once a publish or unpublish that is mounting or unmounting is done
+	pending chan struct{}
+}
+
+// CSINode ... Implements the CSI identity and node services. Every published volume is a registered
+// device type served by a fuse mount at the target path, the volume context has the same options
+// as a Docker volume
+type CSINode struct {
+	// Newer spec releases only register servers that embed these, they also answer any rpc added later
+	csi.UnimplementedIdentityServer
+	csi.UnimplementedNodeServer
+
+	// NodeID ... Defaults to the host name
+	NodeID string
+	// Type ... Device type used when the volume context doesn't have the type option
+	Type string
+	// Config ... Device config used when the volume context doesn't have the config option
+	Config []byte
+	IOMap  *qos.IOMap
+
+	// mount and unmount are swapped out in tests so no fuse is needed
+	mount   func(MountConfig, *qos.IOMap) (MountInfo, error)
+	unmount func(id string) error
+
+	// published ... Keyed by target path
+	published map[string]*csiVolume
+	mutex     sync.Mutex
+	server    *grpc.Server
+}
+
+// NewCSINode ... Node service publishing volumes of fsType by default
+func NewCSINode(fsType string, config []byte, iom *qos.IOMap) *CSINode {
+	nodeID, _ := os.Hostname()
+	return &CSINode{NodeID: nodeID, Type: fsType, Config: config, IOMap: iom, mount: MountWithConfig, unmount: Unmount, published: make(map[string]*csiVolume)}
+}
+
+// GetPluginInfo ... CSI identity
+func (cn *CSINode) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: CSIDriverName, VendorVersion: CSIVendorVersion}, nil
+}
+
+// GetPluginCapabilities ... There is no controller service, volumes only exist on the node
+func (cn *CSINode) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+// Probe ... Serving means ready
+func (cn *CSINode) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+// NodeStageVolume ... Not supported, volumes are published directly
+func (cn *CSINode) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeStageVolume is not supported")
+}
+
+// NodeUnstageVolume ... Not supported, volumes are published directly
+func (cn *CSINode) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeUnstageVolume is not supported")
+}
+
+// NodePublishVolume ... Mount the volume at the target path, publishing the same volume at the
+// same path again is fine
+func (cn *CSINode) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume id is required")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path is required")
+	}
+	target := path.Clean(req.GetTargetPath())
+	opts := make(map[string]string)
+	for k, v := range req.GetVolumeContext() {
+		if !strings.HasPrefix(k, csiContextPrefix) {
+			opts[k] = v
+		}
+	}
+	mc, err := volumeMountConfig(target, cn.Type, cn.Config, opts)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetReadonly() {
+		mc.Wrap = append([]api.WrapperConfig{{Type: api.WrapperReadOnly}}, mc.Wrap...)
+		mc.Options.ReadOnly = true
+	}
+	if err := api.ValidateChain(mc.Type, mc.Wrap); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The target is claimed while mounting so other volumes can be published at the same time
+	cn.mutex.Lock()
+	v, exists := cn.wait(target)
+	if exists {
+		cn.mutex.Unlock()
+		if v.volumeID == req.GetVolumeId() {
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.AlreadyExists, "Volume %s is published at %s", v.volumeID, target)
+	}
+	v = &csiVolume{volumeID: req.GetVolumeId(), pending: make(chan struct{})}
+	cn.published[target] = v
+	cn.mutex.Unlock()
+
+	info, err := cn.publish(mc)
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+	close(v.pending)
+	v.pending = nil
+	if err != nil {
+		delete(cn.published, target)
+		return nil, status.Errorf(codes.Internal, "Failed to mount volume %s: %s", req.GetVolumeId(), err)
+	}
+	v.mountID = info.ID
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// wait ... The volume at target once nothing is mounting or unmounting it, must hold the mutex
+func (cn *CSINode) wait(target string) (*csiVolume, bool) {
+	for {
+		v, exists := cn.published[target]
+		if !exists || v.pending == nil {
+			return v, exists
+		}
+		pending := v.pending
+		cn.mutex.Unlock()
+		<-pending
+		cn.mutex.Lock()
+	}
+}
+
+// publish ... Make the target path and mount it
+func (cn *CSINode) publish(mc MountConfig) (MountInfo, error) {
+	if err := os.MkdirAll(mc.MountPoint, 0755); err != nil {
+		return MountInfo{}, err
+	}
+	return cn.mount(mc, cn.IOMap)
+}
+
+// NodeUnpublishVolume ... Unmount the target path, a path that isn't published is already done
+func (cn *CSINode) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume id is required")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path is required")
+	}
+	target := path.Clean(req.GetTargetPath())
+	cn.mutex.Lock()
+	v, exists := cn.wait(target)
+	if !exists {
+		cn.mutex.Unlock()
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+	if v.volumeID != req.GetVolumeId() {
+		cn.mutex.Unlock()
+		return nil, status.Errorf(codes.NotFound, "Volume %s is not published at %s", req.GetVolumeId(), target)
+	}
+	v.pending = make(chan struct{})
+	cn.mutex.Unlock()
+
+	err := cn.unmount(v.mountID)
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+	close(v.pending)
+	v.pending = nil
+	if err != nil && err != ErrMountNotFound {
+		return nil, status.Errorf(codes.Internal, "Failed to unmount volume %s: %s", v.volumeID, err)
+	}
+	delete(cn.published, target)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetVolumeStats ... Not supported
+func (cn *CSINode) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not supported")
+}
+
+// NodeExpandVolume ... Not supported
+func (cn *CSINode) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeExpandVolume is not supported")
+}
+
+// NodeGetCapabilities ... Publish and unpublish is all there is
+func (cn *CSINode) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+// NodeGetInfo ... Which node this is
+func (cn *CSINode) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: cn.NodeID}, nil
+}
+
+// Listen ... Serve the identity and node services on a unix socket
+func (cn *CSINode) Listen(socketPath string) error {
+	l, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	csi.RegisterIdentityServer(s, cn)
+	csi.RegisterNodeServer(s, cn)
+	cn.mutex.Lock()
+	cn.server = s
+	cn.mutex.Unlock()
+	go func() {
+		if err := s.Serve(l); err != nil {
+			logger.Default().Error("CSI node service stopped", "socket", socketPath, "error", err)
+		}
+	}()
+	return nil
+}
+
+// Close ... Stop serving, published volumes stay mounted until Exit
+func (cn *CSINode) Close() error {
+	cn.mutex.Lock()
+	s := cn.server
+	cn.server = nil
+	cn.mutex.Unlock()
+	if s != nil {
+		s.Stop()
+	}
+	return nil
+}
+
+// MountCSI ... Serve the CSI node service on the unix socket at mountPath. Volumes are fsType with
+// config unless the volume context says otherwise
+func MountCSI(mountPath, fsType string, config []byte) error {
+	return MountCSINode(NewCSINode(fsType, config, qos.NewIOMap()), mountPath)
+}
+
+// MountCSINode ... Same as MountCSI for a node service that has already been set up
+func MountCSINode(cn *CSINode, socketPath string) error {
+	if err := cn.Listen(socketPath); err != nil {
+		return err
+	}
+	trackServer(cn)
+	return nil
+}
+
+// listenUnix ... Listen on a unix socket, a stale socket file is removed first
+func listenUnix(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(path.Dir(socketPath), 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(socketPath)
+	return net.Listen("unix", socketPath)
+}
+
+var _ csi.IdentityServer = (*CSINode)(nil)
+var _ csi.NodeServer = (*CSINode)(nil)
@@ -0,0 +1,159 @@
+package shylock
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestCSINode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shylock-csi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cn := NewCSINode("LOOPBACK_MQ", nil, qos.NewIOMap())
+	cn.NodeID = "node-1"
+	mounts := make(map[string]MountConfig)
+	cn.mount = func(mc MountConfig, ioMap *qos.IOMap) (MountInfo, error) {
+		mounts[mc.MountPoint] = mc
+		return MountInfo{ID: mc.MountPoint, Type: mc.Type, MountPoint: mc.MountPoint}, nil
+	}
+	cn.unmount = func(id string) error {
+		delete(mounts, id)
+		return nil
+	}
+	socketPath := path.Join(dir, "csi.sock")
+	if err := MountCSINode(cn, socketPath); err != nil {
+		t.Fatal(err)
+	}
+	defer Exit()
+
+	conn, err := grpc.NewClient("unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	identity := csi.NewIdentityClient(conn)
+	node := csi.NewNodeClient(conn)
+
+	pi, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil || pi.Name != CSIDriverName {
+		t.Fatalf("Expected plugin info however got %v %v", pi, err)
+	}
+	ni, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil || ni.NodeId != "node-1" {
+		t.Fatalf("Expected node id however got %v %v", ni, err)
+	}
+	if _, err := node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	target := path.Join(dir, "pods", "p1", "volume")
+	if _, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{TargetPath: target}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected missing volume id to be invalid however got %v", err)
+	}
+	bad := &csi.NodePublishVolumeRequest{VolumeId: "v1", TargetPath: target, VolumeContext: map[string]string{"type": "DOES_NOT_EXIST"}}
+	if _, err := node.NodePublishVolume(ctx, bad); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected unknown type to be invalid however got %v", err)
+	}
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "v1",
+		TargetPath: target,
+		Readonly:   true,
+		VolumeContext: map[string]string{
+			"type":                        "LOOPBACK_KV",
+			"write_limit":                 "2048",
+			"csi.storage.k8s.io/pod.name": "p1",
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := node.NodePublishVolume(ctx, req); err != nil {
+			t.Fatalf("Expected publish %d to work however got %s", i, err)
+		}
+	}
+	mc, exists := mounts[target]
+	if !exists || mc.Type != "LOOPBACK_KV" || len(mounts) != 1 {
+		t.Fatalf("Expected a single mount at %s however got %+v", target, mounts)
+	}
+	if len(mc.Wrap) != 1 || mc.Wrap[0].Type != api.WrapperReadOnly {
+		t.Errorf("Expected read only volume to be wrapped however got %+v", mc.Wrap)
+	}
+	if len(mc.QOS) != 1 || mc.QOS[0].Key != target+"/" || mc.QOS[0].WriteLimit != 2048 {
+		t.Errorf("Expected qos rule for the volume however got %+v", mc.QOS)
+	}
+	other := &csi.NodePublishVolumeRequest{VolumeId: "v2", TargetPath: target}
+	if _, err := node.NodePublishVolume(ctx, other); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected another volume at the same path to already exist however got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "v1", TargetPath: target}); err != nil {
+			t.Fatalf("Expected unpublish %d to work however got %s", i, err)
+		}
+	}
+	if len(mounts) != 0 {
+		t.Errorf("Expected volume to be unmounted however got %+v", mounts)
+	}
+}
+
+func TestCSINodePublishOutsideLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shylock-csi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cn := NewCSINode("TEST_DAEMON_NATIVE", nil, qos.NewIOMap())
+	started, block := make(chan struct{}), make(chan struct{})
+	mounted := make(chan MountConfig, 2)
+	cn.mount = func(mc MountConfig, ioMap *qos.IOMap) (MountInfo, error) {
+		if path.Base(mc.MountPoint) == "slow" {
+			close(started)
+			<-block
+		}
+		mounted <- mc
+		return MountInfo{ID: mc.MountPoint, Type: mc.Type, MountPoint: mc.MountPoint}, nil
+	}
+	cn.unmount = func(id string) error { return nil }
+	ctx := context.Background()
+
+	slow := &csi.NodePublishVolumeRequest{VolumeId: "slow", TargetPath: path.Join(dir, "slow"), Readonly: true}
+	done := make(chan error)
+	go func() {
+		_, err := cn.NodePublishVolume(ctx, slow)
+		done <- err
+	}()
+	<-started
+	fast := &csi.NodePublishVolumeRequest{VolumeId: "fast", TargetPath: path.Join(dir, "fast")}
+	if _, err := cn.NodePublishVolume(ctx, fast); err != nil {
+		t.Fatalf("Expected publish while another volume is mounting to work however got %s", err)
+	}
+	if mc := <-mounted; path.Base(mc.MountPoint) != "fast" {
+		t.Fatalf("Expected fast to be mounted first however got %s", mc.MountPoint)
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected read only publish of a native type to work however got %s", err)
+	}
+	mc := <-mounted
+	if !mc.Options.ReadOnly || len(mc.Wrap) != 1 || mc.Wrap[0].Type != api.WrapperReadOnly {
+		t.Errorf("Expected read only native volume to be wrapped and mounted read only however got %+v", mc)
+	}
+
+	bad := &csi.NodePublishVolumeRequest{VolumeId: "bad", TargetPath: path.Join(dir, "bad"), VolumeContext: map[string]string{volumeOptWrap: `[{"type": "test_simple_only"}]`}}
+	if _, err := cn.NodePublishVolume(ctx, bad); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected a wrapper without a native form to be invalid however got %v", err)
+	}
+}
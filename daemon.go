@@ -0,0 +1,205 @@
+package shylock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/buse"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Options a container orchestrator passes with a volume
+	volumeOptType       = "type"
+	volumeOptConfig     = "config"
+	volumeOptWrap       = "wrap"
+	volumeOptReadLimit  = "read_limit"
+	volumeOptWriteLimit = "write_limit"
+)
+
+// QOSRule ... Read and write limits in bytes per second for every path under the key
+type QOSRule struct {
+	Key        string `json:"key"`
+	ReadLimit  uint64 `json:"read_limit"`
+	WriteLimit uint64 `json:"write_limit"`
+}
+
+// MountConfig ... A single mount served by the daemon
+type MountConfig struct {
+	Type       string              `json:"type"`
+	MountPoint string              `json:"mount_point"`
+	Config     json.RawMessage     `json:"config,omitempty"`
+	Wrap       []api.WrapperConfig `json:"wrap,omitempty"`
+	QOS        []QOSRule           `json:"qos,omitempty"`
+	Options    MountOptions        `json:"options"`
+}
+
+// DaemonConfig ... Every mount one process serves along with the control plane http port.
+// The http server is not started when the port is empty
+type DaemonConfig struct {
+	HTTPPort string        `json:"http_port"`
+	Mounts   []MountConfig `json:"mounts"`
+	// Audit ... Record mutating requests on every mount
+	Audit *audit.Config `json:"audit,omitempty"`
+}
+
+// LoadDaemonConfig ... Parse the config and make sure every mount has a registered type, its own
+// mount point and wrappers that can be applied to the type. Device configs are validated against
+// their schema when mounted
+func LoadDaemonConfig(r io.Reader) (*DaemonConfig, error) {
+	dc := &DaemonConfig{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dc); err != nil {
+		return nil, err
+	}
+	if len(dc.Mounts) == 0 {
+		return nil, fmt.Errorf("No mounts in the config")
+	}
+	seen := make(map[string]bool)
+	for i, mc := range dc.Mounts {
+		if mc.MountPoint == "" {
+			return nil, fmt.Errorf("Mount %d has no mount_point", i)
+		}
+		mp := path.Clean(mc.MountPoint)
+		if seen[mp] {
+			return nil, fmt.Errorf("Mount point %s is used more than once", mp)
+		}
+		seen[mp] = true
+		if _, exists := api.LookupType(mc.Type); !exists {
+			return nil, fmt.Errorf("No file system type %s for mount point %s", mc.Type, mp)
+		}
+		if err := api.ValidateChain(mc.Type, mc.Wrap); err != nil {
+			return nil, fmt.Errorf("Bad wrap for mount point %s: %s", mp, err)
+		}
+		for _, rule := range mc.QOS {
+			if rule.Key == "" {
+				return nil, fmt.Errorf("QOS rule without a key for mount point %s", mp)
+			}
+		}
+	}
+	return dc, nil
+}
+
+// MountAll ... Add every QOS rule to the shared IO map and mount everything in the config.
+// When a mount fails the ones that already worked are unmounted. An audit section replaces the default auditor first
+func MountAll(dc *DaemonConfig, ioMap *qos.IOMap) error {
+	if dc.Audit != nil {
+		a, err := audit.New(*dc.Audit)
+		if err != nil {
+			return fmt.Errorf("Failed to open the audit log: %s", err)
+		}
+		audit.SetDefault(a)
+	}
+	for _, mc := range dc.Mounts {
+		if _, err := MountWithConfig(mc, ioMap); err != nil {
+			Exit()
+			return fmt.Errorf("Failed to mount %s at %s: %s", mc.Type, mc.MountPoint, err)
+		}
+	}
+	return nil
+}
+
+// MountWithConfig ... Mount a single backend along with its QOS rules. Keys that already have limits
+// are rejected, the rules are removed again when the mount is unmounted
+func MountWithConfig(mc MountConfig, ioMap *qos.IOMap) (MountInfo, error) {
+	if mc.MountPoint == "" {
+		return MountInfo{}, fmt.Errorf("Mount has no mount_point")
+	}
+	if _, exists := api.LookupType(mc.Type); !exists {
+		return MountInfo{}, fmt.Errorf("No file system type %s", mc.Type)
+	}
+	if len(mc.QOS) > 0 && ioMap == nil {
+		return MountInfo{}, fmt.Errorf("QOS rules given without an IO map")
+	}
+	for _, rule := range mc.QOS {
+		if rule.Key == "" {
+			return MountInfo{}, fmt.Errorf("QOS rule without a key for mount point %s", mc.MountPoint)
+		}
+	}
+	// Limits are in place before the first read or write. A key that is already limited belongs to
+	// another mount or the QOS api, changing it would leave the wrong limits behind on unmount
+	added := make([]string, 0, len(mc.QOS))
+	for _, rule := range mc.QOS {
+		if !ioMap.AddNew(rule.Key, 1*time.Second, rule.ReadLimit, rule.WriteLimit) {
+			for _, key := range added {
+				ioMap.Remove(key)
+			}
+			return MountInfo{}, ErrQOSKeyInUse
+		}
+		added = append(added, rule.Key)
+	}
+	me, err := mountFuseChain(mc.MountPoint, mc.Type, mc.Config, mc.Wrap, ioMap, mc.Options)
+	if err != nil {
+		for _, key := range added {
+			ioMap.Remove(key)
+		}
+		return MountInfo{}, err
+	}
+	mountedMutex.Lock()
+	me.qosKeys = added
+	me.ioMap = ioMap
+	mountedMutex.Unlock()
+	// Callers can use the mount as soon as this returns
+	ctx, cancel := context.WithTimeout(context.Background(), MountReadyTimeout)
+	defer cancel()
+	if err := WaitReady(ctx, me.info.ID); err != nil {
+		uctx, ucancel := context.WithTimeout(context.Background(), buse.DefaultShutdownTimeout)
+		defer ucancel()
+		unmount(uctx, me)
+		return MountInfo{}, fmt.Errorf("Mount %s is not ready: %s", mc.MountPoint, err)
+	}
+	info, _ := LookupMount(me.info.ID)
+	return info, nil
+}
+
+// volumeMountConfig ... Turn volume options into a mount at mp, fsType and config are used when the
+// options don't have them. QOS limits apply to the whole volume
+func volumeMountConfig(mp, fsType string, config []byte, opts map[string]string) (MountConfig, error) {
+	mc := MountConfig{Type: fsType, MountPoint: mp, Config: config}
+	for k, v := range opts {
+		switch k {
+		case volumeOptType:
+			mc.Type = v
+		case volumeOptConfig:
+			mc.Config = json.RawMessage(v)
+		case volumeOptWrap:
+			if err := json.Unmarshal([]byte(v), &mc.Wrap); err != nil {
+				return mc, fmt.Errorf("Invalid wrap option %s", err)
+			}
+		case volumeOptReadLimit, volumeOptWriteLimit:
+		default:
+			return mc, fmt.Errorf("Unknown option %s", k)
+		}
+	}
+	if _, exists := api.LookupType(mc.Type); !exists {
+		return mc, fmt.Errorf("No file system type %s", mc.Type)
+	}
+	if err := api.ValidateChain(mc.Type, mc.Wrap); err != nil {
+		return mc, err
+	}
+	if opts[volumeOptReadLimit] == "" && opts[volumeOptWriteLimit] == "" {
+		return mc, nil
+	}
+	rule := QOSRule{Key: mp + "/"}
+	var err error
+	if opts[volumeOptReadLimit] != "" {
+		if rule.ReadLimit, err = strconv.ParseUint(opts[volumeOptReadLimit], 10, 64); err != nil {
+			return mc, fmt.Errorf("Invalid read_limit %s", err)
+		}
+	}
+	if opts[volumeOptWriteLimit] != "" {
+		if rule.WriteLimit, err = strconv.ParseUint(opts[volumeOptWriteLimit], 10, 64); err != nil {
+			return mc, fmt.Errorf("Invalid write_limit %s", err)
+		}
+	}
+	mc.QOS = []QOSRule{rule}
+	return mc, nil
+}
@@ -0,0 +1,89 @@
+package shylock
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lateefj/shylock/api"
+	_ "github.com/lateefj/shylock/loopback"
+)
+
+// testNative ... Native type that is never served, only checked
+type testNative struct{}
+
+func (tn *testNative) Serve(mountPoint string) error {
+	return nil
+}
+
+func (tn *testNative) Unmount() error {
+	return nil
+}
+
+func init() {
+	api.RegisterNativeDeviceType(api.Registered{FSType: "TEST_DAEMON_NATIVE"}, func(mountPoint string, config []byte) (api.NativeDevice, error) {
+		return &testNative{}, nil
+	})
+	api.RegisterWrapperType(api.Registered{FSType: "test_simple_only"}, func(inner api.SimpleDevice, config []byte) (api.SimpleDevice, error) {
+		return &api.Wrapper{Inner: inner}, nil
+	})
+}
+
+func TestLoadDaemonConfig(t *testing.T) {
+	config := `{
+	"http_port": "7070",
+	"mounts": [
+		{"type": "LOOPBACK_KV", "mount_point": "/mnt/kv", "config": {"compact_after": 10},
+		 "wrap": [{"type": "readonly"}],
+		 "qos": [{"key": "/mnt/kv/tenant/", "read_limit": 1024, "write_limit": 512}]},
+		{"type": "LOOPBACK_MQ", "mount_point": "/mnt/mq"}
+	]
+}`
+	dc, err := LoadDaemonConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("Expected config to load however got %s", err)
+	}
+	if dc.HTTPPort != "7070" || len(dc.Mounts) != 2 {
+		t.Fatalf("Unexpected config %+v", dc)
+	}
+	kv := dc.Mounts[0]
+	if string(kv.Config) != `{"compact_after": 10}` || len(kv.Wrap) != 1 || kv.Wrap[0].Type != "readonly" {
+		t.Errorf("Expected device config and wrappers to be kept however got %+v", kv)
+	}
+	if len(kv.QOS) != 1 || kv.QOS[0].ReadLimit != 1024 || kv.QOS[0].WriteLimit != 512 {
+		t.Errorf("Expected qos rule however got %+v", kv.QOS)
+	}
+}
+
+func TestLoadDaemonConfigInvalid(t *testing.T) {
+	bad := map[string]string{
+		"not json":        `{`,
+		"unknown field":   `{"mounts": [{"type": "LOOPBACK_KV", "mount_point": "/mnt/kv", "extra": 1}]}`,
+		"no mounts":       `{"mounts": []}`,
+		"no mount point":  `{"mounts": [{"type": "LOOPBACK_KV"}]}`,
+		"unknown type":    `{"mounts": [{"type": "DOES_NOT_EXIST", "mount_point": "/mnt/kv"}]}`,
+		"duplicate":       `{"mounts": [{"type": "LOOPBACK_KV", "mount_point": "/mnt/kv"}, {"type": "LOOPBACK_MQ", "mount_point": "/mnt/kv/"}]}`,
+		"qos without key": `{"mounts": [{"type": "LOOPBACK_KV", "mount_point": "/mnt/kv", "qos": [{"read_limit": 1}]}]}`,
+	}
+	for name, config := range bad {
+		if _, err := LoadDaemonConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected %s to fail", name)
+		}
+	}
+}
+
+func TestLoadDaemonConfigNativeWrap(t *testing.T) {
+	ok := `{"mounts": [{"type": "TEST_DAEMON_NATIVE", "mount_point": "/mnt/native", "wrap": [{"type": "readonly"}]}]}`
+	if _, err := LoadDaemonConfig(strings.NewReader(ok)); err != nil {
+		t.Errorf("Expected readonly to apply to a native type however got %s", err)
+	}
+	bad := `{"mounts": [{"type": "TEST_DAEMON_NATIVE", "mount_point": "/mnt/native", "wrap": [{"type": "test_simple_only"}]}]}`
+	if _, err := LoadDaemonConfig(strings.NewReader(bad)); err == nil {
+		t.Errorf("Expected a wrapper without a native form to be rejected when the config is loaded")
+	}
+	if _, err := volumeMountConfig("/mnt/native", "TEST_DAEMON_NATIVE", nil, map[string]string{volumeOptWrap: `[{"type": "test_simple_only"}]`}); err == nil {
+		t.Errorf("Expected a wrapper without a native form to be rejected in volume options")
+	}
+	if _, err := volumeMountConfig("/mnt/native", "TEST_DAEMON_NATIVE", nil, map[string]string{volumeOptWrap: `[{"type": "readonly"}]`}); err != nil {
+		t.Errorf("Expected readonly to apply to a native volume however got %s", err)
+	}
+}
@@ -0,0 +1,311 @@
+package shylock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/lateefj/shylock/logger"
+	"github.com/lateefj/shylock/qos"
+)
+
+const (
+	// DockerVolumeRoot ... Volumes are mounted in a directory named after the volume under here
+	DockerVolumeRoot = "/var/lib/shylock/volumes"
+	// dockerContentType ... Every plugin response has this content type
+	dockerContentType = "application/vnd.docker.plugins.v1+json"
+)
+
+// dockerVolume ... A created volume, it is only mounted while a container is using it
+type dockerVolume struct {
+	mount MountConfig
+	// mountID ... Id of the mount while it is mounted
+	mountID string
+	// users ... Container mount ids using the volume
+	users map[string]bool
+	// pending ... Closed once the volume is done mounting or unmounting
+	pending chan struct{}
+}
+
+// DockerPlugin ... Implements the Docker volume plugin protocol, every volume is a registered
+// device type served by a fuse mount while at least one container uses it
+type DockerPlugin struct {
+	// Root ... Directory the volumes are mounted under
+	Root string
+	// Type ... Device type used when a volume doesn't have the type option
+	Type string
+	// Config ... Device config used when a volume doesn't have the config option
+	Config []byte
+	IOMap  *qos.IOMap
+
+	// mount and unmount are swapped out in tests so no fuse is needed
+	mount   func(MountConfig, *qos.IOMap) (MountInfo, error)
+	unmount func(id string) error
+
+	volumes  map[string]*dockerVolume
+	mutex    sync.Mutex
+	listener net.Listener
+}
+
+// NewDockerPlugin ... Plugin mounting volumes under root
+func NewDockerPlugin(root, fsType string, config []byte, iom *qos.IOMap) *DockerPlugin {
+	return &DockerPlugin{Root: root, Type: fsType, Config: config, IOMap: iom, mount: MountWithConfig, unmount: Unmount, volumes: make(map[string]*dockerVolume)}
+}
+
+type dockerRequest struct {
+	Name string            `json:"Name"`
+	ID   string            `json:"ID"`
+	Opts map[string]string `json:"Opts"`
+}
+
+type dockerVolumeInfo struct {
+	Name       string                 `json:"Name"`
+	Mountpoint string                 `json:"Mountpoint,omitempty"`
+	Status     map[string]interface{} `json:"Status,omitempty"`
+}
+
+type dockerResponse struct {
+	Err          string             `json:"Err"`
+	Mountpoint   string             `json:"Mountpoint,omitempty"`
+	Volume       *dockerVolumeInfo  `json:"Volume,omitempty"`
+	Volumes      []dockerVolumeInfo `json:"Volumes,omitempty"`
+	Capabilities map[string]string  `json:"Capabilities,omitempty"`
+	Implements   []string           `json:"Implements,omitempty"`
+}
+
+// Handler ... Routes for the plugin protocol
+func (dp *DockerPlugin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", dp.handle(func(dr *dockerRequest) *dockerResponse {
+		return &dockerResponse{Implements: []string{"VolumeDriver"}}
+	}))
+	mux.HandleFunc("/VolumeDriver.Create", dp.handle(dp.create))
+	mux.HandleFunc("/VolumeDriver.Remove", dp.handle(dp.remove))
+	mux.HandleFunc("/VolumeDriver.Mount", dp.handle(dp.mountVolume))
+	mux.HandleFunc("/VolumeDriver.Unmount", dp.handle(dp.unmountVolume))
+	mux.HandleFunc("/VolumeDriver.Path", dp.handle(dp.path))
+	mux.HandleFunc("/VolumeDriver.Get", dp.handle(dp.get))
+	mux.HandleFunc("/VolumeDriver.List", dp.handle(dp.list))
+	mux.HandleFunc("/VolumeDriver.Capabilities", dp.handle(func(dr *dockerRequest) *dockerResponse {
+		return &dockerResponse{Capabilities: map[string]string{"Scope": "local"}}
+	}))
+	return mux
+}
+
+// handle ... Docker posts a JSON body and expects errors in the Err field of a 200 response
+func (dp *DockerPlugin) handle(f func(*dockerRequest) *dockerResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		dr := &dockerRequest{}
+		// Activate, List and Capabilities have an empty body
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(dr); err != nil {
+				dp.write(w, &dockerResponse{Err: fmt.Sprintf("Invalid request %s", err)})
+				return
+			}
+		}
+		dp.write(w, f(dr))
+	}
+}
+
+func (dp *DockerPlugin) write(w http.ResponseWriter, resp *dockerResponse) {
+	bits, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dockerContentType)
+	w.Write(bits)
+}
+
+func dockerError(format string, a ...interface{}) *dockerResponse {
+	return &dockerResponse{Err: fmt.Sprintf(format, a...)}
+}
+
+func (dp *DockerPlugin) create(dr *dockerRequest) *dockerResponse {
+	if dr.Name == "" || dr.Name != path.Base(dr.Name) || dr.Name == "." || dr.Name == ".." {
+		return dockerError("Invalid volume name %s", dr.Name)
+	}
+	mc, err := volumeMountConfig(path.Join(dp.Root, dr.Name), dp.Type, dp.Config, dr.Opts)
+	if err != nil {
+		return dockerError("%s", err)
+	}
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	if _, exists := dp.volumes[dr.Name]; exists {
+		return dockerError("Volume %s already exists", dr.Name)
+	}
+	dp.volumes[dr.Name] = &dockerVolume{mount: mc, users: make(map[string]bool)}
+	return &dockerResponse{}
+}
+
+func (dp *DockerPlugin) remove(dr *dockerRequest) *dockerResponse {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	v, exists := dp.wait(dr.Name)
+	if !exists {
+		return dockerError("No volume %s", dr.Name)
+	}
+	if len(v.users) > 0 {
+		return dockerError("Volume %s is in use", dr.Name)
+	}
+	delete(dp.volumes, dr.Name)
+	return &dockerResponse{}
+}
+
+// wait ... The volume once nothing is mounting or unmounting it, must hold the mutex
+func (dp *DockerPlugin) wait(name string) (*dockerVolume, bool) {
+	for {
+		v, exists := dp.volumes[name]
+		if !exists || v.pending == nil {
+			return v, exists
+		}
+		pending := v.pending
+		dp.mutex.Unlock()
+		<-pending
+		dp.mutex.Lock()
+	}
+}
+
+// mountVolume ... The first container using a volume mounts it, without holding the mutex so other
+// volumes aren't held up
+func (dp *DockerPlugin) mountVolume(dr *dockerRequest) *dockerResponse {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	v, exists := dp.wait(dr.Name)
+	if !exists {
+		return dockerError("No volume %s", dr.Name)
+	}
+	if len(v.users) == 0 {
+		v.pending = make(chan struct{})
+		dp.mutex.Unlock()
+		info, err := dp.mountPoint(v.mount)
+		dp.mutex.Lock()
+		close(v.pending)
+		v.pending = nil
+		if err != nil {
+			return dockerError("Failed to mount volume %s: %s", dr.Name, err)
+		}
+		v.mountID = info.ID
+	}
+	v.users[dr.ID] = true
+	return &dockerResponse{Mountpoint: v.mount.MountPoint}
+}
+
+// mountPoint ... Make the mount point and mount it
+func (dp *DockerPlugin) mountPoint(mc MountConfig) (MountInfo, error) {
+	if err := os.MkdirAll(mc.MountPoint, 0755); err != nil {
+		return MountInfo{}, err
+	}
+	return dp.mount(mc, dp.IOMap)
+}
+
+// unmountVolume ... The last container using a volume unmounts it
+func (dp *DockerPlugin) unmountVolume(dr *dockerRequest) *dockerResponse {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	v, exists := dp.wait(dr.Name)
+	if !exists {
+		return dockerError("No volume %s", dr.Name)
+	}
+	if !v.users[dr.ID] {
+		return dockerError("Volume %s is not mounted by %s", dr.Name, dr.ID)
+	}
+	delete(v.users, dr.ID)
+	if len(v.users) == 0 {
+		id := v.mountID
+		v.mountID = ""
+		v.pending = make(chan struct{})
+		dp.mutex.Unlock()
+		err := dp.unmount(id)
+		dp.mutex.Lock()
+		close(v.pending)
+		v.pending = nil
+		if err != nil && err != ErrMountNotFound {
+			return dockerError("Failed to unmount volume %s: %s", dr.Name, err)
+		}
+	}
+	return &dockerResponse{}
+}
+
+// info ... Only mounted volumes have a mount point
+func (v *dockerVolume) info(name string) dockerVolumeInfo {
+	vi := dockerVolumeInfo{Name: name, Status: map[string]interface{}{"type": v.mount.Type}}
+	if len(v.users) > 0 {
+		vi.Mountpoint = v.mount.MountPoint
+	}
+	return vi
+}
+
+func (dp *DockerPlugin) path(dr *dockerRequest) *dockerResponse {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	v, exists := dp.volumes[dr.Name]
+	if !exists {
+		return dockerError("No volume %s", dr.Name)
+	}
+	return &dockerResponse{Mountpoint: v.info(dr.Name).Mountpoint}
+}
+
+func (dp *DockerPlugin) get(dr *dockerRequest) *dockerResponse {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	v, exists := dp.volumes[dr.Name]
+	if !exists {
+		return dockerError("No volume %s", dr.Name)
+	}
+	vi := v.info(dr.Name)
+	return &dockerResponse{Volume: &vi}
+}
+
+func (dp *DockerPlugin) list(dr *dockerRequest) *dockerResponse {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	names := make([]string, 0, len(dp.volumes))
+	for name := range dp.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vols := make([]dockerVolumeInfo, len(names))
+	for i, name := range names {
+		vols[i] = dp.volumes[name].info(name)
+	}
+	return &dockerResponse{Volumes: vols}
+}
+
+// Listen ... Serve the plugin protocol on a unix socket
+func (dp *DockerPlugin) Listen(socketPath string) error {
+	l, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	dp.mutex.Lock()
+	dp.listener = l
+	dp.mutex.Unlock()
+	go func() {
+		if err := http.Serve(l, dp.Handler()); err != nil {
+			logger.Default().Error("Docker plugin stopped", "socket", socketPath, "error", err)
+		}
+	}()
+	return nil
+}
+
+// Close ... Stop listening, volumes that are mounted stay mounted until Exit
+func (dp *DockerPlugin) Close() error {
+	dp.mutex.Lock()
+	l := dp.listener
+	dp.listener = nil
+	dp.mutex.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
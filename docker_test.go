@@ -0,0 +1,124 @@
+package shylock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	_ "github.com/lateefj/shylock/loopback"
+	"github.com/lateefj/shylock/qos"
+)
+
+func dockerClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}}
+}
+
+func dockerCall(t *testing.T, c *http.Client, call string, req interface{}) *dockerResponse {
+	bits, _ := json.Marshal(req)
+	resp, err := c.Post("http://plugin/VolumeDriver."+call, dockerContentType, bytes.NewReader(bits))
+	if err != nil {
+		t.Fatalf("Failed to call %s: %s", call, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %s to be ok however got %d", call, resp.StatusCode)
+	}
+	dr := &dockerResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(dr); err != nil {
+		t.Fatalf("Failed to decode %s response: %s", call, err)
+	}
+	return dr
+}
+
+func TestDockerPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shylock-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	iom := qos.NewIOMap()
+	dp := NewDockerPlugin(path.Join(dir, "volumes"), "LOOPBACK_MQ", nil, iom)
+	mounts := make(map[string]MountConfig)
+	dp.mount = func(mc MountConfig, ioMap *qos.IOMap) (MountInfo, error) {
+		mounts["1"] = mc
+		return MountInfo{ID: "1", Type: mc.Type, MountPoint: mc.MountPoint}, nil
+	}
+	dp.unmount = func(id string) error {
+		delete(mounts, id)
+		return nil
+	}
+	socketPath := path.Join(dir, "plugins", "shylock.sock")
+	if err := MountDockerPlugin(dp, socketPath); err != nil {
+		t.Fatal(err)
+	}
+	defer Exit()
+	c := dockerClient(socketPath)
+
+	if dr := dockerCall(t, c, "Capabilities", nil); dr.Capabilities["Scope"] != "local" {
+		t.Errorf("Expected local scope however got %+v", dr)
+	}
+	if dr := dockerCall(t, c, "Create", dockerRequest{Name: "bad", Opts: map[string]string{"type": "DOES_NOT_EXIST"}}); dr.Err == "" {
+		t.Errorf("Expected unknown type to fail")
+	}
+	if dr := dockerCall(t, c, "Create", dockerRequest{Name: "../escape"}); dr.Err == "" {
+		t.Errorf("Expected name with a path to fail")
+	}
+	opts := map[string]string{"type": "LOOPBACK_KV", "config": `{"compact_after": 10}`, "wrap": `[{"type": "readonly"}]`, "read_limit": "1024"}
+	if dr := dockerCall(t, c, "Create", dockerRequest{Name: "kv", Opts: opts}); dr.Err != "" {
+		t.Fatalf("Expected create to work however got %s", dr.Err)
+	}
+	if dr := dockerCall(t, c, "Create", dockerRequest{Name: "kv"}); dr.Err == "" {
+		t.Errorf("Expected duplicate create to fail")
+	}
+	if dr := dockerCall(t, c, "Path", dockerRequest{Name: "kv"}); dr.Err != "" || dr.Mountpoint != "" {
+		t.Errorf("Expected no mount point before mount however got %+v", dr)
+	}
+
+	mp := path.Join(dir, "volumes", "kv")
+	for _, id := range []string{"a", "b"} {
+		dr := dockerCall(t, c, "Mount", dockerRequest{Name: "kv", ID: id})
+		if dr.Err != "" || dr.Mountpoint != mp {
+			t.Fatalf("Expected mount at %s however got %+v", mp, dr)
+		}
+	}
+	mc, exists := mounts["1"]
+	if !exists || mc.Type != "LOOPBACK_KV" || string(mc.Config) != `{"compact_after": 10}` || len(mc.Wrap) != 1 {
+		t.Fatalf("Expected volume options in the mount however got %+v", mc)
+	}
+	if len(mc.QOS) != 1 || mc.QOS[0].Key != mp+"/" || mc.QOS[0].ReadLimit != 1024 {
+		t.Errorf("Expected qos rule for the volume however got %+v", mc.QOS)
+	}
+	if dr := dockerCall(t, c, "Get", dockerRequest{Name: "kv"}); dr.Volume == nil || dr.Volume.Mountpoint != mp {
+		t.Errorf("Expected volume to be mounted however got %+v", dr)
+	}
+	if dr := dockerCall(t, c, "Remove", dockerRequest{Name: "kv"}); dr.Err == "" {
+		t.Errorf("Expected remove of a volume in use to fail")
+	}
+
+	dockerCall(t, c, "Unmount", dockerRequest{Name: "kv", ID: "a"})
+	if len(mounts) != 1 {
+		t.Errorf("Expected volume to stay mounted while b uses it")
+	}
+	dockerCall(t, c, "Unmount", dockerRequest{Name: "kv", ID: "b"})
+	if len(mounts) != 0 {
+		t.Errorf("Expected volume to be unmounted")
+	}
+	if dr := dockerCall(t, c, "List", nil); len(dr.Volumes) != 1 || dr.Volumes[0].Name != "kv" {
+		t.Errorf("Expected one volume however got %+v", dr.Volumes)
+	}
+	if dr := dockerCall(t, c, "Remove", dockerRequest{Name: "kv"}); dr.Err != "" {
+		t.Errorf("Expected remove to work however got %s", dr.Err)
+	}
+	if dr := dockerCall(t, c, "Get", dockerRequest{Name: "kv"}); dr.Err == "" {
+		t.Errorf("Expected removed volume to be gone")
+	}
+}
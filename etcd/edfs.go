@@ -3,35 +3,32 @@ package etcd
 
 import (
 	"bytes"
-	"hash/crc64"
-	"log"
+	"encoding/json"
 	"os"
 	"path"
-	"strings"
 	"syscall"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/coreos/etcd/client"
-	"github.com/lateefj/shylock/qos"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/buse"
+	"github.com/lateefj/shylock/inode"
+	"github.com/lateefj/shylock/logger"
 	"golang.org/x/net/context"
 )
 
-var (
-	crc      = crc64.MakeTable(crc64.ECMA)
-	fuseConn *fuse.Conn
-)
-
-// Get the checksum for a key
-func checksum(key string) uint64 {
-	return crc64.Checksum([]byte(key), crc)
-}
-
 // EDFS ... etcd root structure
 type EDFS struct {
 	Path     string
 	KApi     client.KeysAPI
 	ReadOnly bool
+	// Inodes ... Stable inode numbers for etcd keys
+	Inodes *inode.Table
+	Log    *logger.Logger
+	// Audit ... Records mkdirs, creates and writes, nil records nothing
+	Audit *audit.Auditor
 }
 
 // NewEDFS ... Create a new EDFS instance
@@ -47,7 +44,23 @@ func NewEDFS(mountPoint string, servers []string, readOnly bool) (*EDFS, error)
 		return nil, err
 	}
 	kapi := client.NewKeysAPI(c)
-	return &EDFS{Path: mountPoint, KApi: kapi, ReadOnly: readOnly}, nil
+	return &EDFS{Path: mountPoint, KApi: kapi, ReadOnly: readOnly, Inodes: inode.NewTable("/"), Log: logger.Default().With("mount_point", mountPoint)}, nil
+}
+
+// SetLogger ... Log with the mount fields
+func (ed *EDFS) SetLogger(l *logger.Logger) {
+	ed.Log = l
+}
+
+// SetAuditor ... Record the mutating requests of the mount
+func (ed *EDFS) SetAuditor(a *audit.Auditor) {
+	ed.Audit = a
+}
+
+// Health ... A quorum read of the root means the cluster can be reached
+func (ed *EDFS) Health(ctx context.Context) error {
+	_, err := ed.KApi.Get(ctx, "/", &client.GetOptions{Quorum: true})
+	return err
 }
 
 // fsNode ... Looks up the key in etcd and handles the appropriate error
@@ -62,7 +75,7 @@ func (ed *EDFS) fsNode(ctx context.Context, key string) (fs.Node, error) {
 	if err != nil {
 		switch err.(type) {
 		case *client.ClusterError:
-			log.Printf("ERROR: Cluster connection error %s", err)
+			ed.Log.Warn("Cluster connection error", "key", key, "error", err)
 			return nil, fuse.ENOSYS
 		}
 
@@ -103,7 +116,7 @@ type EDDir struct {
 
 // Attr ... Required for fuse
 func (e *EDDir) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = checksum(e.Key)
+	attr.Inode = e.FS.Inodes.Inode(e.Key)
 	attr.Mode = os.ModeDir | 0555
 	return nil
 }
@@ -111,7 +124,8 @@ func (e *EDDir) Attr(ctx context.Context, attr *fuse.Attr) error {
 var _ fs.Node = (*EDDir)(nil)
 
 // Mkdir ... Fuse make directory hook
-func (e *EDDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+func (e *EDDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	defer e.FS.Audit.Op(audit.Mkdir, req.Header, path.Join(e.Node.Key, req.Name), 0, &err)
 	resp, err := e.FS.KApi.Set(ctx, req.Name, "", &client.SetOptions{
 		Dir: true,
 	})
@@ -145,7 +159,7 @@ func (e *EDDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		}
 
 		nodes[i] = fuse.Dirent{
-			Inode: checksum(n.Key),
+			Inode: e.FS.Inodes.Inode(n.Key),
 			Name:  path.Base(n.Key),
 			Type:  t,
 		}
@@ -157,18 +171,24 @@ var _ = fs.HandleReadDirAller(&EDDir{})
 
 // Lookup ... Fuse lookup
 func (e *EDDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
-
-	return e.FS.fsNode(ctx, path.Join(e.Node.Key, req.Name))
+	p := path.Join(e.Node.Key, req.Name)
+	n, err := e.FS.fsNode(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	resp.Generation = e.FS.Inodes.Lookup(p).Generation
+	return n, nil
 }
 
 var _ = fs.NodeRequestLookuper(&EDDir{})
 
 // Create ... file creating implementation
-func (e *EDDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+func (e *EDDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	p := path.Join(e.Key, req.Name)
+	defer e.FS.Audit.Op(audit.Create, req.Header, p, 0, &err)
 	if e.FS.ReadOnly {
 		return nil, nil, fuse.Errno(syscall.EACCES)
 	}
-	p := path.Join(e.Key, req.Name)
 	v, err := e.FS.KApi.Set(ctx, p, "", &client.SetOptions{
 		Dir: false,
 	})
@@ -196,7 +216,7 @@ func (ef *EDFile) Attr(ctx context.Context, attr *fuse.Attr) error {
 		attr.Mode = 0444
 	}
 	if ef.Node != nil {
-		attr.Inode = checksum(ef.Node.Key)
+		attr.Inode = ef.FS.Inodes.Inode(ef.Node.Key)
 		attr.Size = uint64(len(ef.Node.Value))
 	}
 	return nil
@@ -224,7 +244,8 @@ func (ef *EDFile) ReadAll(ctx context.Context) ([]byte, error) {
 var _ = fs.HandleReadAller(&EDFile{})
 
 // Write ... Implements write fuse handler
-func (ef *EDFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+func (ef *EDFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer ef.FS.Audit.Op(audit.Write, req.Header, ef.Key, int64(len(req.Data)), &err)
 	// ReadOnly should not be writing
 	if ef.FS.ReadOnly {
 		return fuse.Errno(syscall.EACCES)
@@ -239,60 +260,54 @@ func (ef *EDFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.
 	buf.Write(req.Data)
 	resp.Size = buf.Len()
 	v, err := ef.FS.KApi.Set(ctx, ef.Key, buf.String(), nil)
+	if err != nil {
+		return err
+	}
 	ef.Node = v.Node
-	return err
+	return nil
 }
 
 var _ = fs.HandleWriter(&EDFile{})
 
-var (
-	etcdHosts    []string
-	etcdReadOnly bool
+const (
+	// FSEtcd ... Registered type for etcd
+	FSEtcd = "ETCD"
 )
 
 func init() {
-	hosts := os.Getenv("ETC_HOSTS")
-	if hosts == "" {
-		etcdHosts = []string{"http://127.0.0.1:2379"}
-	} else {
-		etcdHosts = strings.Split(hosts, ",")
+	api.RegisterNativeDeviceType(api.Registered{
+		FSType:      FSEtcd,
+		Description: "etcd keys as files, a distributed store for configuration",
+		Schema: []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"endpoints": {"type": "array", "items": {"type": "string"}, "description": "etcd servers, defaults to http://127.0.0.1:2379"},
+		"read_only": {"type": "boolean", "description": "Reject every write"}
 	}
-
-	ro := os.Getenv("ETC_READ_ONLY")
-	if ro != "" {
-		etcdReadOnly = true
-	}
-
+}`),
+	}, NewDevice)
 }
 
-// Mount ... Place to mount etcd
-func Mount(mountPoint string, ioMap *qos.IOMap) error {
+type etcdConfig struct {
+	Endpoints []string `json:"endpoints"`
+	ReadOnly  bool     `json:"read_only"`
+}
 
-	var err error
-	fuseConn, err = fuse.Mount(mountPoint)
-	if err != nil {
-		return err
+// NewDevice ... Serve etcd at the mount point
+func NewDevice(mountPoint string, config []byte) (api.NativeDevice, error) {
+	conf := &etcdConfig{}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, conf); err != nil {
+			return nil, err
+		}
 	}
-	defer fuseConn.Close()
-
-	filesys, err := NewEDFS(mountPoint, etcdHosts, etcdReadOnly)
-	if err != nil {
-		return err
+	if len(conf.Endpoints) == 0 {
+		conf.Endpoints = []string{"http://127.0.0.1:2379"}
 	}
-
-	err = fs.Serve(fuseConn, filesys)
+	filesys, err := NewEDFS(mountPoint, conf.Endpoints, conf.ReadOnly)
 	if err != nil {
-		return err
-	}
-	// check if the mount process has an error to report
-	<-fuseConn.Ready
-	if err := fuseConn.MountError; err != nil {
-		log.Printf("Failed to mount because %s", err)
+		return nil, err
 	}
-	return err
-}
-
-// Exit ... Exit hook
-func Exit() error {
-	return fuseConn.Close()
+	return &buse.Native{FS: filesys}, nil
 }
@@ -0,0 +1,27 @@
+package etcd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestEDFSHealthUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := "http://" + l.Addr().String()
+	l.Close()
+	ed, err := NewEDFS("/mnt/etcd", []string{endpoint}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := ed.Health(ctx); err == nil {
+		t.Errorf("Expected an endpoint that refuses connections to fail the health check")
+	}
+}
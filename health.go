@@ -0,0 +1,153 @@
+package shylock
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lateefj/shylock/buse"
+	"golang.org/x/net/context"
+)
+
+var (
+	// HealthCheckTimeout ... How long /healthz and /readyz wait for backends to answer
+	HealthCheckTimeout = 5 * time.Second
+	// MountReadyTimeout ... How long MountWithConfig waits for the kernel to finish mounting
+	MountReadyTimeout = 30 * time.Second
+)
+
+// healther ... Devices that check their fuse connection and backend
+type healther interface {
+	Health(ctx context.Context) error
+}
+
+// MountHealth ... Whether a mount is ready and can still reach its backend
+type MountHealth struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	MountPoint string `json:"mount_point"`
+	Ready      bool   `json:"ready"`
+	// Healthy ... A mount that is still starting is healthy but not ready
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// checkMount ... Mounts without a device to ask are judged by how mounting went
+func checkMount(ctx context.Context, me *mountEntry) MountHealth {
+	mountedMutex.Lock()
+	info, device := me.info, me.device
+	mountedMutex.Unlock()
+	var err error
+	select {
+	case <-me.ready:
+		err = me.readyErr
+	default:
+		err = buse.ErrNotReady
+	}
+	if err == nil && (info.State == StateFailed || info.State == StateExited) {
+		err = errors.New(info.Error)
+	}
+	if h, ok := device.(healther); ok && err == nil {
+		err = h.Health(ctx)
+	}
+	mh := MountHealth{ID: info.ID, Type: info.Type, MountPoint: info.MountPoint, Ready: err == nil, Healthy: err == nil || err == buse.ErrNotReady}
+	if err != nil {
+		mh.Error = err.Error()
+	}
+	return mh
+}
+
+// Health ... Check the fuse connection and backend of every mount at the same time
+func Health(ctx context.Context) []MountHealth {
+	mountedMutex.Lock()
+	entries := make([]*mountEntry, 0, len(mounted))
+	for _, me := range mounted {
+		entries = append(entries, me)
+	}
+	mountedMutex.Unlock()
+	results := make([]MountHealth, len(entries))
+	var wg sync.WaitGroup
+	for i, me := range entries {
+		wg.Add(1)
+		go func(i int, me *mountEntry) {
+			defer wg.Done()
+			results[i] = checkMount(ctx, me)
+		}(i, me)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		a, _ := strconv.Atoi(results[i].ID)
+		b, _ := strconv.Atoi(results[j].ID)
+		return a < b
+	})
+	return results
+}
+
+// WaitReady ... Block until the kernel has mounted id or mounting failed
+func WaitReady(ctx context.Context, id string) error {
+	mountedMutex.Lock()
+	me, exists := mounted[id]
+	mountedMutex.Unlock()
+	if !exists {
+		return ErrMountNotFound
+	}
+	select {
+	case <-me.ready:
+		return me.readyErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitAllReady ... Block until everything mounted so far is ready, the first failure is returned
+func WaitAllReady(ctx context.Context) error {
+	mountedMutex.Lock()
+	ids := make([]string, 0, len(mounted))
+	for id := range mounted {
+		ids = append(ids, id)
+	}
+	mountedMutex.Unlock()
+	for _, id := range ids {
+		// Unmounted while waiting is not a failure
+		if err := WaitReady(ctx, id); err != nil && err != ErrMountNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// HealthStatus ... Body of /healthz and /readyz
+type HealthStatus struct {
+	Status string        `json:"status"`
+	Mounts []MountHealth `json:"mounts"`
+}
+
+// healthHandler ... 200 when every mount passes, 503 with the mounts otherwise
+func healthHandler(pass func(MountHealth) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), HealthCheckTimeout)
+		defer cancel()
+		hs := HealthStatus{Status: "ok", Mounts: Health(ctx)}
+		status := http.StatusOK
+		for _, mh := range hs.Mounts {
+			if !pass(mh) {
+				hs.Status = "unavailable"
+				status = http.StatusServiceUnavailable
+			}
+		}
+		writeJSON(w, status, hs)
+	}
+}
+
+// Healthz ... Fails when a mount lost its fuse connection or can't reach its backend
+var Healthz = healthHandler(func(mh MountHealth) bool { return mh.Healthy })
+
+// Readyz ... Fails until every mount is ready and while any of them can't reach its backend
+var Readyz = healthHandler(func(mh MountHealth) bool { return mh.Ready })
@@ -0,0 +1,137 @@
+package shylock
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/kafka"
+	"golang.org/x/net/context"
+)
+
+// readyDevice ... Becomes ready when told to and fails health checks while its backend is down
+type readyDevice struct {
+	onReady func(error)
+	backend error
+}
+
+func (rd *readyDevice) Unmount() error {
+	return nil
+}
+
+func (rd *readyDevice) OnReady(f func(error)) {
+	rd.onReady = f
+}
+
+func (rd *readyDevice) Health(ctx context.Context) error {
+	return rd.backend
+}
+
+func healthStatus(t *testing.T, handler http.HandlerFunc, path string) (int, HealthStatus) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	hs := HealthStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &hs); err != nil {
+		t.Fatalf("Expected a json health status however got %s", err)
+	}
+	return w.Code, hs
+}
+
+func TestHealth(t *testing.T) {
+	me, err := track("/mnt/health", "LOOPBACK_KV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer untrack(me)
+	rd := &readyDevice{}
+	me.device = rd
+	var readyInfo MountInfo
+	watchReady(me, rd, func(info MountInfo, err error) {
+		readyInfo = info
+	})
+
+	if code, _ := healthStatus(t, Healthz, "/healthz"); code != http.StatusOK {
+		t.Errorf("Expected a mount that is starting to be healthy however got %d", code)
+	}
+	if code, _ := healthStatus(t, Readyz, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a mount that is starting to not be ready however got %d", code)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := WaitReady(ctx, me.info.ID); err != context.DeadlineExceeded {
+		t.Errorf("Expected waiting to time out however got %v", err)
+	}
+
+	rd.onReady(nil)
+	if err := WaitReady(context.Background(), me.info.ID); err != nil {
+		t.Errorf("Expected the mount to be ready however got %s", err)
+	}
+	if !readyInfo.Ready || readyInfo.MountPoint != "/mnt/health" {
+		t.Errorf("Expected the ready callback to get the mount however got %+v", readyInfo)
+	}
+	if code, hs := healthStatus(t, Readyz, "/readyz"); code != http.StatusOK || hs.Status != "ok" {
+		t.Errorf("Expected the mount to be ready however got %d %+v", code, hs)
+	}
+
+	rd.backend = errors.New("connection refused")
+	code, hs := healthStatus(t, Healthz, "/healthz")
+	if code != http.StatusServiceUnavailable || len(hs.Mounts) != 1 || hs.Mounts[0].Error != "connection refused" {
+		t.Errorf("Expected a backend that is down to fail however got %d %+v", code, hs)
+	}
+	if code, _ := healthStatus(t, Readyz, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a backend that is down to not be ready however got %d", code)
+	}
+}
+
+func TestMountFailedNotReady(t *testing.T) {
+	me, err := track("/mnt/failed", "LOOPBACK_KV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer untrack(me)
+	markReady(me, errors.New("fusermount failed"))
+	if err := WaitReady(context.Background(), me.info.ID); err == nil || err.Error() != "fusermount failed" {
+		t.Errorf("Expected the mount error however got %v", err)
+	}
+	info, _ := LookupMount(me.info.ID)
+	if info.Ready || info.State != StateFailed {
+		t.Errorf("Expected a failed mount however got %+v", info)
+	}
+}
+
+// backendDevice ... Ready device whose health is the backend of a real file system
+type backendDevice struct {
+	readyDevice
+	fs api.HealthChecker
+}
+
+func (bd *backendDevice) Health(ctx context.Context) error {
+	return bd.fs.Health(ctx)
+}
+
+func TestReadyzUnreachableBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := l.Addr().String()
+	l.Close()
+	me, err := track("/mnt/kafka", "KAFKA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer untrack(me)
+	bd := &backendDevice{fs: kafka.NewKFS("/mnt/kafka", []string{broker})}
+	me.device = bd
+	markReady(me, nil)
+
+	code, hs := healthStatus(t, Readyz, "/readyz")
+	if code != http.StatusServiceUnavailable || len(hs.Mounts) != 1 || hs.Mounts[0].Ready || hs.Mounts[0].Error == "" {
+		t.Errorf("Expected a broker that refuses connections to fail readiness however got %d %+v", code, hs)
+	}
+}
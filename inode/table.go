@@ -0,0 +1,124 @@
+// Package inode ... Stable inode numbers for file systems that only have keys.
+// Hashing keys can collide and gives different numbers for different spellings of the
+// same key, so numbers are handed out from a counter instead and kept for the life
+// of the mount. Numbers are never reused, the generation changes every time a key
+// is created again after being forgotten so (inode, generation) is always unique.
+package inode
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+const (
+	// RootInode ... Inode the kernel expects for the root of a mount
+	RootInode = 1
+)
+
+// Entry ... Inode assigned to a key
+type Entry struct {
+	Inode      uint64
+	Generation uint64
+}
+
+// Table ... Per mount key to inode table, safe for concurrent use
+type Table struct {
+	root       string
+	next       uint64
+	generation uint64
+	entries    map[string]Entry
+	mutex      sync.Mutex
+}
+
+// NewTable ... Create a table where the root key is always RootInode
+func NewTable(root string) *Table {
+	root = Key(root)
+	t := &Table{root: root, next: RootInode + 1, entries: make(map[string]Entry)}
+	t.entries[root] = Entry{Inode: RootInode}
+	return t
+}
+
+// Key ... Normalize a key so "/a/b", "/a/b/" and "/a//b" share an inode
+func Key(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return path.Clean(p)
+}
+
+// Lookup ... The entry for a key, allocating one the first time the key is seen
+func (t *Table) Lookup(key string) Entry {
+	key = Key(key)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e, exists := t.entries[key]
+	if !exists {
+		e = Entry{Inode: t.next, Generation: t.generation}
+		t.next++
+		t.entries[key] = e
+	}
+	return e
+}
+
+// Inode ... Shortcut for the inode number of a key
+func (t *Table) Inode(key string) uint64 {
+	return t.Lookup(key).Inode
+}
+
+// Forget ... Drop a removed key, recreating it gets a new inode and generation.
+// The root is never forgotten
+func (t *Table) Forget(key string) {
+	key = Key(key)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if key == t.root {
+		return
+	}
+	if _, exists := t.entries[key]; exists {
+		delete(t.entries, key)
+		t.generation++
+	}
+}
+
+// Rename ... Move the inode of a key to a new key, whatever was at the new key is forgotten
+func (t *Table) Rename(from, to string) {
+	from, to = Key(from), Key(to)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e, exists := t.entries[from]
+	if !exists || from == t.root {
+		return
+	}
+	if _, replaced := t.entries[to]; replaced {
+		t.generation++
+	}
+	delete(t.entries, from)
+	t.entries[to] = e
+}
+
+// Len ... Number of keys with an inode
+func (t *Table) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.entries)
+}
+
+// ForgetFile ... Forget a removed file once its last hard link is gone
+func (t *Table) ForgetFile(p string, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 && !fi.IsDir() {
+		return
+	}
+	t.Forget(FileKey(p, fi))
+}
+
+// FileKey ... Key for a file on a real file system. Hard links share the device and
+// inode so they share a key and end up with the same inode in the table
+func FileKey(p string, fi os.FileInfo) string {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("dev:%d:%d", st.Dev, st.Ino)
+	}
+	return Key(p)
+}
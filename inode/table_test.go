@@ -0,0 +1,107 @@
+package inode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTableStable(t *testing.T) {
+	table := NewTable("/mnt/test/")
+	if ino := table.Inode("/mnt/test"); ino != RootInode {
+		t.Errorf("Expected root to be %d however got %d", RootInode, ino)
+	}
+	a := table.Inode("/mnt/test/a")
+	if a == RootInode {
+		t.Fatalf("Expected a new inode for a child")
+	}
+	for _, k := range []string{"/mnt/test/a/", "/mnt/test//a", "/mnt/test/./a"} {
+		if ino := table.Inode(k); ino != a {
+			t.Errorf("Expected %s to have inode %d however got %d", k, a, ino)
+		}
+	}
+	if b := table.Inode("/mnt/test/b"); b == a {
+		t.Errorf("Expected different keys to have different inodes")
+	}
+}
+
+func TestTableForget(t *testing.T) {
+	table := NewTable("/")
+	before := table.Lookup("/a")
+	table.Forget("/a")
+	after := table.Lookup("/a")
+	if after.Inode == before.Inode {
+		t.Errorf("Expected a recreated key to get a new inode however got %d again", after.Inode)
+	}
+	if after.Generation <= before.Generation {
+		t.Errorf("Expected generation to move forward from %d however got %d", before.Generation, after.Generation)
+	}
+	table.Forget("/")
+	if ino := table.Inode("/"); ino != RootInode {
+		t.Errorf("Expected root to never be forgotten however got %d", ino)
+	}
+}
+
+func TestTableRename(t *testing.T) {
+	table := NewTable("/")
+	a := table.Inode("/a")
+	table.Inode("/b")
+	table.Rename("/a", "/b")
+	if b := table.Inode("/b"); b != a {
+		t.Errorf("Expected renamed key to keep inode %d however got %d", a, b)
+	}
+	if table.Len() != 2 {
+		t.Errorf("Expected root and /b in the table however got %d entries", table.Len())
+	}
+}
+
+func TestTableConcurrent(t *testing.T) {
+	table := NewTable("/")
+	var wg sync.WaitGroup
+	results := make([]uint64, 32)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = table.Inode("/same")
+		}(i)
+	}
+	wg.Wait()
+	for _, ino := range results {
+		if ino != results[0] {
+			t.Fatalf("Expected every goroutine to get the same inode however got %v", results)
+		}
+	}
+}
+
+func TestFileKeyHardLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig := filepath.Join(dir, "orig")
+	link := filepath.Join(dir, "link")
+	other := filepath.Join(dir, "other")
+	ioutil.WriteFile(orig, []byte("data"), 0600)
+	ioutil.WriteFile(other, []byte("data"), 0600)
+	if err := os.Link(orig, link); err != nil {
+		t.Skipf("Hard links not supported %s", err)
+	}
+	table := NewTable(dir)
+	inodeOf := func(p string) uint64 {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return table.Inode(FileKey(p, fi))
+	}
+	if inodeOf(orig) != inodeOf(link) {
+		t.Errorf("Expected hard links to share an inode")
+	}
+	if inodeOf(orig) == inodeOf(other) {
+		t.Errorf("Expected different files to have different inodes")
+	}
+}
@@ -2,14 +2,19 @@ package kafka
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
 
 	cluster "github.com/bsm/sarama-cluster"
+	"github.com/lateefj/shylock/logger"
 )
 
 func main() {
+	consume(logger.Default())
+}
+
+// consume ... Print every message of the topics, errors and rebalances go to the logger
+func consume(l *logger.Logger) {
 	// init (custom) config, enable errors and notifications
 	config := cluster.NewConfig()
 	config.Consumer.Return.Errors = true
@@ -18,7 +23,9 @@ func main() {
 	// init consumer
 	brokers := []string{"127.0.0.1:9092"}
 	topics := []string{"my_topic", "other_topic"}
-	consumer, err := cluster.NewConsumer(brokers, "my-consumer-group", topics, config)
+	group := "my-consumer-group"
+	l = l.With("group", group)
+	consumer, err := cluster.NewConsumer(brokers, group, topics, config)
 	if err != nil {
 		panic(err)
 	}
@@ -27,14 +34,14 @@ func main() {
 	// watch errors
 	go func() {
 		for err := range consumer.Errors() {
-			log.Printf("Error: %s\n", err.Error())
+			l.Error("Consumer error", "error", err)
 		}
 	}()
 
 	// watch notifications
 	go func() {
 		for note := range consumer.Notifications() {
-			log.Printf("Rebalanced: %+v\n", note)
+			l.Debug("Rebalanced", "claimed", note.Claimed, "released", note.Released, "current", note.Current)
 		}
 	}()
 
@@ -3,19 +3,24 @@ package kafka
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"os"
-	"os/signal"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	cluster "github.com/bsm/sarama-cluster"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/buse"
+	"github.com/lateefj/shylock/logger"
 	"golang.org/x/net/context"
 )
 
@@ -29,11 +34,9 @@ func parsePath(path string) (string, string, string, error) {
 	pMap := make(map[string]string)
 	for i, match := range matches {
 		if i != 0 {
-			fmt.Println(names[i], match)
 			pMap[names[i]] = match
 		}
 	}
-	fmt.Printf("Pmap %s\n", pMap)
 	if len(pMap) != 3 {
 		return "", "", "", fmt.Errorf("Expected path wit /topic/cluster/name however could not parse this path %s", path)
 	}
@@ -44,12 +47,71 @@ func parsePath(path string) (string, string, string, error) {
 type KFS struct {
 	Path    string
 	Brokers []string
+	// pipes ... Keyed by path so producers and consumers can be closed on unmount
+	pipes map[string]*ClusterPipe
+	mutex sync.Mutex
+	Log   *logger.Logger
+	// Audit ... Records creates, writes and refused removes and mkdirs, nil records nothing
+	Audit *audit.Auditor
 }
 
 // NewKFS ... Create a new fs
 func NewKFS(path string, brokers []string) *KFS {
 
-	return &KFS{Path: path, Brokers: brokers}
+	return &KFS{Path: path, Brokers: brokers, pipes: make(map[string]*ClusterPipe), Log: logger.Default().With("mount_point", path)}
+}
+
+// SetLogger ... Log with the mount fields
+func (kfs *KFS) SetLogger(l *logger.Logger) {
+	kfs.Log = l
+}
+
+// SetAuditor ... Record the mutating requests of the mount
+func (kfs *KFS) SetAuditor(a *audit.Auditor) {
+	kfs.Audit = a
+}
+
+// Health ... The cluster can be reached when any broker accepts a connection
+func (kfs *KFS) Health(ctx context.Context) error {
+	if len(kfs.Brokers) == 0 {
+		return errors.New("No kafka brokers")
+	}
+	var d net.Dialer
+	var err error
+	for _, broker := range kfs.Brokers {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", broker); err == nil {
+			return conn.Close()
+		}
+	}
+	return err
+}
+
+// pipe ... The same pipe is used for a path every time it is looked up
+func (kfs *KFS) pipe(path, topic, cluster, name string) *ClusterPipe {
+	kfs.mutex.Lock()
+	defer kfs.mutex.Unlock()
+	if kp, exists := kfs.pipes[path]; exists {
+		return kp
+	}
+	kp := &ClusterPipe{Path: path, Brokers: kfs.Brokers, Topic: topic, Cluster: cluster, FileName: name, Log: kfs.Log.With("topic", topic, "cluster", cluster), Audit: kfs.Audit}
+	kfs.pipes[path] = kp
+	return kp
+}
+
+// Close ... Flush every producer and close the consumers, called after the last request on unmount
+func (kfs *KFS) Close() error {
+	kfs.mutex.Lock()
+	pipes := kfs.pipes
+	kfs.pipes = make(map[string]*ClusterPipe)
+	kfs.mutex.Unlock()
+	var err error
+	for _, kp := range pipes {
+		if cErr := kp.closeClients(); err == nil {
+			err = cErr
+		}
+	}
+	return err
 }
 
 var _ fs.FS = (*KFS)(nil)
@@ -121,7 +183,7 @@ func (kd *KDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 
 			//XXX: Uhg this is so bad! FIX ME !!
 			if reader == "reader" || reader == "errors" || reader == "writer" || reader == "messages" {
-				return &ClusterPipe{Brokers: kd.KFS.Brokers, Topic: topic, Cluster: cluster, FileName: req.Name}, nil
+				return kd.KFS.pipe(path, topic, cluster, req.Name), nil
 			}
 		}
 	}
@@ -139,7 +201,7 @@ func (kd *KDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	topics, err := Topics(kd.KFS.Brokers)
 	var res []fuse.Dirent
 	if err != nil {
-		log.Printf("ERROR: getting topics %s\n", err)
+		kd.KFS.Log.Warn("Failed to list topics", "error", err)
 		return res, err
 	}
 	for _, t := range topics {
@@ -176,17 +238,37 @@ func (kd *KDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 // Register callback
 var _ fs.HandleReadDirAller = (*KDir)(nil)
 
+// Remove ... Topics and their pipes can't be removed through the mount, the attempt is still audited
+func (kd *KDir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer kd.KFS.Audit.Op(audit.Remove, req.Header, kd.Path+"/"+req.Name, 0, &err)
+	return fuse.Errno(syscall.ENOTSUP)
+}
+
+var _ fs.NodeRemover = (*KDir)(nil)
+
+// Mkdir ... Topics are made in kafka not through the mount, the attempt is still audited
+func (kd *KDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	defer kd.KFS.Audit.Op(audit.Mkdir, req.Header, kd.Path+"/"+req.Name, 0, &err)
+	return nil, fuse.Errno(syscall.ENOTSUP)
+}
+
+var _ fs.NodeMkdirer = (*KDir)(nil)
+
 //TODO: Implement ReadDirAll for helpers
 // partitions/ - List of the partitions
 // cluster/ - Cluster consumer
 
 type ClusterPipe struct {
+	Path     string
 	Brokers  []string
 	Topic    string
 	Cluster  string
 	FileName string
 	Consumer *cluster.Consumer
 	Producer *Producer
+	Log      *logger.Logger
+	Audit    *audit.Auditor
+	mutex    sync.Mutex
 }
 
 func (kp *ClusterPipe) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -205,7 +287,7 @@ func (kp *ClusterPipe) connectConsumer() error {
 	c := ClusterConfig{KafkaConfig: kc, Name: kp.Cluster}
 	consumer, err := NewConsumer(c)
 	if err != nil {
-		log.Printf("ERROR: Failed to connect to kafka %s\n", err)
+		kp.Log.Error("Failed to connect to kafka", "error", err)
 		return err
 	}
 	kp.Consumer = consumer
@@ -216,12 +298,12 @@ func (kp *ClusterPipe) connectProducer() error {
 	if kp.Producer != nil {
 		return nil
 	}
-	var err error
-	kp.Producer, err = NewProducer(kafkaBrokers, kp.Topic)
+	p, err := NewProducer(kp.Brokers, kp.Topic)
 	if err != nil {
-		log.Printf("ERROR: Failed to create a producer: %s", err)
+		kp.Log.Error("Failed to create a producer", "error", err)
 		return err
 	}
+	kp.Producer = p
 	return nil
 }
 
@@ -233,19 +315,29 @@ func (kp *ClusterPipe) Open(ctx context.Context, req *fuse.OpenRequest, resp *fu
 var _ = fs.NodeOpener(&ClusterPipe{})
 
 func (kp *ClusterPipe) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return kp.closeClients()
+}
+
+// closeClients ... Closing the producer sends what it has buffered
+func (kp *ClusterPipe) closeClients() error {
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
 	var err error
 	if kp.Consumer != nil {
 		err = kp.Consumer.Close()
 		kp.Consumer = nil
 	}
 	if kp.Producer != nil {
-		err = kp.Producer.Close()
+		if pErr := kp.Producer.Close(); err == nil {
+			err = pErr
+		}
 		kp.Producer = nil
 	}
 	return err
 }
 
-func (kp *ClusterPipe) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+func (kp *ClusterPipe) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	defer kp.Audit.Op(audit.Create, req.Header, kp.Path, 0, &err)
 	return kp, kp, nil
 }
 
@@ -276,7 +368,7 @@ func (kp *ClusterPipe) Read(ctx context.Context, req *fuse.ReadRequest, resp *fu
 	case "errors":
 		err = <-kp.Consumer.Errors()
 		if err != nil {
-			log.Printf("ERROR: From topic %s\n", err)
+			kp.Log.Warn("Consumer error", "error", err)
 			buf.WriteString(err.Error())
 		}
 	}
@@ -286,9 +378,10 @@ func (kp *ClusterPipe) Read(ctx context.Context, req *fuse.ReadRequest, resp *fu
 
 var _ = fs.HandleReader(&ClusterPipe{})
 
-func (kp *ClusterPipe) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	if kp.Producer == nil {
-		kp.connectProducer()
+func (kp *ClusterPipe) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer kp.Audit.Op(audit.Write, req.Header, kp.Path, int64(len(req.Data)), &err)
+	if err := kp.connectProducer(); err != nil {
+		return err
 	}
 	// TODO: Figure out how to do a KeySend
 	kp.Producer.Send(req.Data)
@@ -298,84 +391,36 @@ func (kp *ClusterPipe) Write(ctx context.Context, req *fuse.WriteRequest, resp *
 
 var _ = fs.HandleWriter(&ClusterPipe{})
 
-var (
-	kafkaBrokers   []string
-	kafkaTopic     string
-	autoCommitSize int
-	autoCommitTime *time.Duration
+const (
+	// FSKafka ... Registered type for kafka
+	FSKafka = "KAFKA"
 )
 
 func init() {
-	brokers := os.Getenv("KAFKA_BROKERS")
-	if brokers == "" {
-		kafkaBrokers = []string{"127.0.0.1:9092"}
-	} else {
-		kafkaBrokers = strings.Split(brokers, ",")
-	}
-
-	kafkaTopic = os.Getenv("KAFKA_TOPIC")
-	if kafkaTopic == "" {
-		kafkaTopic = "my_topic"
-	}
-
-	autoCommitDuration := os.Getenv("KAFKA_AUTOCOMMIT_DURATION")
-	if autoCommitDuration == "" {
-		autoCommitTime = nil
-	} else {
-		t, err := strconv.Atoi(autoCommitDuration)
-		if err != nil {
-			log.Fatalf("Unable to parse KAFKA_AUTOCOMMIT_DURATION Milliseconds %s\n", autoCommitDuration)
-		}
-		d := time.Duration(t) * time.Millisecond
-		autoCommitTime = &d
-	}
-	var err error
-	autoCommitBatch := os.Getenv("KAFKA_AUTOCOMMIT_BATCH")
-	if autoCommitBatch == "" {
-		autoCommitSize = -1
-	} else {
-		autoCommitSize, err = strconv.Atoi(autoCommitBatch)
-		if err != nil {
-			log.Fatalf("Unable to parse KAFKA_AUTOCOMMIT_BATCH size %s\n", autoCommitBatch)
-		}
+	api.RegisterNativeDeviceType(api.Registered{
+		FSType:      FSKafka,
+		Description: "Kafka topics as files at /topic/cluster/(reader|messages|errors|writer)",
+		Schema: []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"brokers": {"type": "array", "items": {"type": "string"}, "description": "Kafka brokers, defaults to 127.0.0.1:9092"}
 	}
+}`),
+		Capabilities: []api.Capability{api.CapStreaming},
+	}, NewDevice)
 }
 
-func Mount(mountPoint string) error {
-	fmt.Printf("Kafka topic %s and brokers %s\n", kafkaTopic, kafkaBrokers)
-	//go testProducer()
-	c, err := fuse.Mount(mountPoint)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	filesys := NewKFS(mountPoint, kafkaBrokers)
-
-	fsErr := make(chan error)
-	go func() {
-		fsErr <- fs.Serve(c, filesys)
-	}()
-
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		log.Printf("ERROR: Failed to mount because %s\n", err)
-		return err
+// NewDevice ... Serve kafka at the mount point
+func NewDevice(mountPoint string, config []byte) (api.NativeDevice, error) {
+	conf := &KafkaConfig{}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, conf); err != nil {
+			return nil, err
+		}
 	}
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
-
-	select {
-	case err := <-fsErr:
-		return err
-	case s := <-sigs:
-		log.Printf("Caught signal: %v", s)
-		err := c.Close()
-		log.Printf("Error: %v", err)
-		return err
+	if len(conf.Brokers) == 0 {
+		conf.Brokers = []string{"127.0.0.1:9092"}
 	}
-
-	return nil
-
+	return &buse.Native{FS: NewKFS(mountPoint, conf.Brokers)}, nil
 }
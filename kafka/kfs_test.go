@@ -0,0 +1,39 @@
+package kafka
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// closedAddr ... Address nothing listens on so connections are refused
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestKFSHealth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	kfs := NewKFS("/mnt/kafka", []string{closedAddr(t)})
+	if err := kfs.Health(ctx); err == nil {
+		t.Errorf("Expected an unreachable broker to fail the health check")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	kfs = NewKFS("/mnt/kafka", []string{closedAddr(t), l.Addr().String()})
+	if err := kfs.Health(ctx); err != nil {
+		t.Errorf("Expected any broker that accepts a connection to be enough however got %s", err)
+	}
+}
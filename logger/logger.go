@@ -0,0 +1,247 @@
+// Package logger ... Leveled structured logging as logfmt or JSON. Every logger made from another
+// with With shares its output so changing the level changes it for all of them
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level ... How important a record is, records below the logger level are dropped
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel ... debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "warning" {
+		name = "warn"
+	}
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level %s, use debug, info, warn or error", s)
+}
+
+// Format ... How records are written
+type Format int
+
+const (
+	Logfmt Format = iota
+	JSON
+)
+
+// ParseFormat ... logfmt or json
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "logfmt", "text":
+		return Logfmt, nil
+	case "json":
+		return JSON, nil
+	}
+	return Logfmt, fmt.Errorf("Unknown log format %s, use logfmt or json", s)
+}
+
+// output ... Shared by a logger and everything made from it with With
+type output struct {
+	level  int32
+	w      io.Writer
+	format Format
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+// Logger ... Writes records with the fields it was made with
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+var std = New(os.Stderr, Logfmt, InfoLevel)
+
+// Default ... The process wide logger packages start from
+func Default() *Logger {
+	return std
+}
+
+// Configure ... Change where and how the default logger and every logger made from it write
+func Configure(w io.Writer, format Format, level Level) {
+	std.out.mutex.Lock()
+	std.out.w = w
+	std.out.format = format
+	std.out.mutex.Unlock()
+	std.SetLevel(level)
+}
+
+// New ... A logger with its own output
+func New(w io.Writer, format Format, level Level) *Logger {
+	return &Logger{out: &output{level: int32(level), w: w, format: format, now: time.Now}}
+}
+
+// Setter ... Anything a logger can be injected into
+type Setter interface {
+	SetLogger(l *Logger)
+}
+
+// Inject ... Give v the logger when it takes one
+func Inject(v interface{}, l *Logger) bool {
+	if s, ok := v.(Setter); ok {
+		s.SetLogger(l)
+		return true
+	}
+	return false
+}
+
+// With ... A logger that adds the key value pairs to every record
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// SetLevel ... Changes the level of every logger sharing the output
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// Level ... Records below this are dropped
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.out.level))
+}
+
+// Enabled ... Check before building fields that are expensive
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// Log ... A record at level
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	l.log(level, msg, kv)
+}
+
+// Debug ... Details only wanted while tracking something down
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(DebugLevel, msg, kv)
+}
+
+// Info ... Normal operation
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(InfoLevel, msg, kv)
+}
+
+// Warn ... Something failed and was handled
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(WarnLevel, msg, kv)
+}
+
+// Error ... Something failed that needs attention
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+}
+
+// Fatal ... Log at error and exit
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	pairs := make([]interface{}, 0, len(l.fields)+len(kv))
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "MISSING")
+	}
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	buf := &bytes.Buffer{}
+	ts := l.out.now().Format(time.RFC3339Nano)
+	if l.out.format == JSON {
+		writeJSON(buf, ts, level, msg, pairs)
+	} else {
+		writeLogfmt(buf, ts, level, msg, pairs)
+	}
+	l.out.w.Write(buf.Bytes())
+}
+
+// value ... Errors and durations are written as text
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, ts string, level Level, msg string, pairs []interface{}) {
+	writePair := func(k string, v interface{}) {
+		key, _ := json.Marshal(k)
+		bits, err := json.Marshal(value(v))
+		if err != nil {
+			bits, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(bits)
+	}
+	buf.WriteString(`{"time":`)
+	bits, _ := json.Marshal(ts)
+	buf.Write(bits)
+	writePair("level", level.String())
+	writePair("msg", msg)
+	for i := 0; i < len(pairs); i += 2 {
+		writePair(fmt.Sprint(pairs[i]), pairs[i+1])
+	}
+	buf.WriteString("}\n")
+}
+
+// logfmtValue ... Quoted when it has spaces, quotes or equals signs
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(value(v))
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func writeLogfmt(buf *bytes.Buffer, ts string, level Level, msg string, pairs []interface{}) {
+	fmt.Fprintf(buf, "time=%s level=%s msg=%s", ts, level, logfmtValue(msg))
+	for i := 0; i < len(pairs); i += 2 {
+		fmt.Fprintf(buf, " %s=%s", fmt.Sprint(pairs[i]), logfmtValue(pairs[i+1]))
+	}
+	buf.WriteByte('\n')
+}
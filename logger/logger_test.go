@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLogger(format Format, level Level) (*Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	l := New(buf, format, level)
+	l.out.now = func() time.Time {
+		return time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	}
+	return l, buf
+}
+
+func TestLogfmt(t *testing.T) {
+	l, buf := testLogger(Logfmt, InfoLevel)
+	l = l.With("mount_point", "/mnt/kv", "type", "LOOPBACK_KV")
+	l.Debug("dropped", "path", "/a")
+	l.Info("write", "path", "/mnt/kv/a b", "latency", 1500*time.Microsecond, "error", errors.New("No space"))
+	expected := `time=2018-06-01T12:00:00Z level=info msg=write mount_point=/mnt/kv type=LOOPBACK_KV path="/mnt/kv/a b" latency=1.5ms error="No space"` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s however got\n%s", expected, buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := testLogger(JSON, DebugLevel)
+	l.With("op", "lookup").Debug("fuse op", "size", 12, "odd")
+	expected := `{"time":"2018-06-01T12:00:00Z","level":"debug","msg":"fuse op","op":"lookup","size":12,"odd":"MISSING"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s however got\n%s", expected, buf.String())
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Errorf("Expected valid JSON however got %s", err)
+	}
+}
+
+func TestLevelShared(t *testing.T) {
+	l, buf := testLogger(Logfmt, WarnLevel)
+	child := l.With("mount_id", "1")
+	child.Info("dropped")
+	l.SetLevel(DebugLevel)
+	child.Debug("kept")
+	if !strings.Contains(buf.String(), "msg=kept") || strings.Contains(buf.String(), "dropped") {
+		t.Errorf("Expected the level change to apply to the child logger however got %s", buf.String())
+	}
+	for _, s := range []string{"debug", "INFO", "warning", "error"} {
+		if _, err := ParseLevel(s); err != nil {
+			t.Errorf("Expected %s to be a level however got %s", s, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("Expected loud to not be a level")
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	defer std.SetLevel(std.Level())
+	w := httptest.NewRecorder()
+	LevelHandler(w, httptest.NewRequest(http.MethodPut, "/log/level", strings.NewReader(`{"level": "debug"}`)))
+	if w.Code != http.StatusOK || std.Level() != DebugLevel {
+		t.Errorf("Expected the level to be debug however got %d %s", w.Code, std.Level())
+	}
+	w = httptest.NewRecorder()
+	LevelHandler(w, httptest.NewRequest(http.MethodGet, "/log/level", nil))
+	if strings.TrimSpace(w.Body.String()) != `{"level":"debug"}` {
+		t.Errorf("Expected the debug level however got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	LevelHandler(w, httptest.NewRequest(http.MethodPut, "/log/level", strings.NewReader(`{"level": "loud"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown level to be a bad request however got %d", w.Code)
+	}
+}
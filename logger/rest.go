@@ -0,0 +1,54 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// levelBody ... JSON for /log/level
+type levelBody struct {
+	Level string `json:"level"`
+}
+
+// LevelHandler ... GET shows the level of the default logger, PUT {"level": "debug"} changes it
+func LevelHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		bits, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error %s", err.Error())
+			return
+		}
+		lb := &levelBody{}
+		if err := json.Unmarshal(bits, lb); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unmarshal error: %s", err.Error())
+			return
+		}
+		level, err := ParseLevel(lb.Level)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error %s", err.Error())
+			return
+		}
+		if level != std.Level() {
+			std.Info("Log level changed", "from", std.Level(), "to", level)
+			std.SetLevel(level)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	bits, _ := json.Marshal(levelBody{Level: std.Level().String()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bits)
+}
+
+// Setup ... Associates the log level endpoint with the default http server
+func Setup() {
+	http.HandleFunc("/log/level", LevelHandler)
+}
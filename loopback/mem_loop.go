@@ -1,14 +1,22 @@
 package loopback
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/logger"
 )
 
-var unknownError error
+var (
+	unknownError error
+	errLogClosed = errors.New("Loopback log is closed")
+)
 
 const (
 	FSMemoryLoopbackHeaderMQ = "LOOPBACK_HEADER_MQ"
@@ -20,7 +28,12 @@ func init() {
 	unknownError = errors.New("Unknown Error")
 	/*api.RegisterHeaderDevice(FSMemoryLoopbackHeaderMQ, NewHeaderMemoryLoopbackMQ)
 	api.RegisterHeaderDevice(FSMemoryLoopbacHeaderKV, NewHeaderMemoryLoopbackKV)*/
-	api.RegisterSimpleDevice(FSMemoryLoopbacKV, NewMemoryLoopbackKV)
+	api.RegisterSimpleDeviceType(api.Registered{
+		FSType:       FSMemoryLoopbacKV,
+		Description:  "In memory key / value store with an optional append only log, mostly useful for testing",
+		Schema:       kvSchema,
+		Capabilities: []api.Capability{api.CapWatch, api.CapPermissions, api.CapXattr, api.CapSnapshot},
+	}, NewMemoryLoopbackKV)
 }
 
 type HeaderMemoryFileMQ struct {
@@ -43,6 +56,7 @@ func (mf *HeaderMemoryFileMQ) Close() {
 
 type HeaderMemoryLoopbackMQ struct {
 	queues map[string]*HeaderMemoryFileMQ
+	mutex  sync.Mutex
 }
 
 func NewHeaderMemoryLoopbackMQ(mountPoint string, config []byte) api.HeaderDevice {
@@ -56,6 +70,8 @@ func (mmq *HeaderMemoryLoopbackMQ) Mount(config []byte) error {
 
 // Unmount ... Close all open files and remove files from map
 func (mmq *HeaderMemoryLoopbackMQ) Unmount() error {
+	mmq.mutex.Lock()
+	defer mmq.mutex.Unlock()
 	for k, q := range mmq.queues {
 		q.Close()
 		delete(mmq.queues, k)
@@ -64,6 +80,8 @@ func (mmq *HeaderMemoryLoopbackMQ) Unmount() error {
 }
 
 func (mmq *HeaderMemoryLoopbackMQ) List(path string) ([]string, error) {
+	mmq.mutex.Lock()
+	defer mmq.mutex.Unlock()
 	files := make([]string, 0)
 	for k, _ := range mmq.queues {
 		files = append(files, k)
@@ -72,6 +90,8 @@ func (mmq *HeaderMemoryLoopbackMQ) List(path string) ([]string, error) {
 }
 
 func (mmq *HeaderMemoryLoopbackMQ) Open(path string) (api.HeaderFile, error) {
+	mmq.mutex.Lock()
+	defer mmq.mutex.Unlock()
 	q, exists := mmq.queues[path]
 	if !exists {
 		q = &HeaderMemoryFileMQ{queue: make(chan [][]byte)}
@@ -83,13 +103,18 @@ func (mmq *HeaderMemoryLoopbackMQ) Open(path string) (api.HeaderFile, error) {
 type HeaderMemoryFileKV struct {
 	header []byte
 	body   []byte
+	mutex  sync.RWMutex
 }
 
 func (mf *HeaderMemoryFileKV) Read() (header, body []byte, err error) {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
 	return mf.header, mf.body, nil
 
 }
 func (mf *HeaderMemoryFileKV) Write(offset int, header, body []byte) (int, error) {
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
 	mf.header = header
 	for i := 0; i < len(body); i++ {
 		if len(mf.body)+offset < len(body) {
@@ -102,7 +127,8 @@ func (mf *HeaderMemoryFileKV) Write(offset int, header, body []byte) (int, error
 }
 
 type HeaderMemoryLoopbackKV struct {
-	db map[string]*HeaderMemoryFileKV
+	db    map[string]*HeaderMemoryFileKV
+	mutex sync.RWMutex
 }
 
 func NewHeaderMemoryLoopbackKV(mountPoint string, config []byte) api.HeaderDevice {
@@ -116,27 +142,18 @@ func (mkv *HeaderMemoryLoopbackKV) Unmount() error {
 	return nil
 }
 func (mkv *HeaderMemoryLoopbackKV) List(path string) ([]string, error) {
-
-	files := make([]string, 0)
-	for k, _ := range mkv.db {
-		if len(k) > len(path) {
-			p := k[:len(path)]
-			if strings.Compare(path, p) == 0 {
-				s := k[len(path):]
-				next := strings.Index(s, "/")
-				if next > 0 {
-					s = s[:next]
-				}
-				if len(s) > 0 {
-					files = append(files, k)
-				}
-			}
-		}
+	mkv.mutex.RLock()
+	keys := make([]string, 0, len(mkv.db))
+	for k := range mkv.db {
+		keys = append(keys, k)
 	}
-	return files, nil
+	mkv.mutex.RUnlock()
+	return children(keys, path), nil
 }
 
 func (mkv *HeaderMemoryLoopbackKV) Open(path string) (api.HeaderFile, error) {
+	mkv.mutex.Lock()
+	defer mkv.mutex.Unlock()
 	f, exists := mkv.db[path]
 	if !exists {
 		f = &HeaderMemoryFileKV{}
@@ -145,72 +162,254 @@ func (mkv *HeaderMemoryLoopbackKV) Open(path string) (api.HeaderFile, error) {
 	return f, nil
 }
 
+// children ... Immediate children of dir, sub directories are listed once ending with a slash
+func children(keys []string, dir string) []string {
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir = dir + "/"
+	}
+	seen := make(map[string]bool)
+	files := make([]string, 0)
+	for _, k := range keys {
+		if len(k) <= len(dir) || !strings.HasPrefix(k, dir) {
+			continue
+		}
+		name := k
+		rest := k[len(dir):]
+		if next := strings.Index(rest, "/"); next >= 0 {
+			name = dir + rest[:next+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
 type MemoryFileKV struct {
-	body []byte
+	body  []byte
+	path  string
+	kv    *MemoryLoopbackKV
+	mutex sync.RWMutex
 }
 
 func (mf *MemoryFileKV) Read() (body []byte, err error) {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
 	return mf.body, nil
 
 }
+
+// Write ... Copies the body since callers like fuse reuse their buffers
 func (mf *MemoryFileKV) Write(body []byte) error {
-	mf.body = body
+	bits := make([]byte, len(body))
+	copy(bits, body)
+	if mf.kv == nil {
+		mf.mutex.Lock()
+		mf.body = bits
+		mf.mutex.Unlock()
+		return nil
+	}
+	// The device lock keeps the log in the same order as memory, removed files aren't logged
+	mf.kv.mutex.RLock()
+	mf.mutex.Lock()
+	var err error
+	if mf.kv.db[mf.path] == mf {
+		err = mf.kv.appendLog(&logRecord{Op: opWrite, Path: mf.path, Body: bits})
+	}
+	if err == nil {
+		mf.body = bits
+	}
+	mf.mutex.Unlock()
+	mf.kv.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	mf.kv.events.Publish(api.Event{Type: api.EventUpdate, Path: mf.path})
+	mf.kv.maybeCompact()
 	return nil
 }
 func (mf *MemoryFileKV) Close() error {
 	return nil
 }
 
+// MemoryLoopbackKV ... Key value store in memory, every change is appended to a log
+// when the config has a path so the data survives unmounting
 type MemoryLoopbackKV struct {
-	db map[string]*MemoryFileKV
+	db       map[string]*MemoryFileKV
+	attrs    map[string]api.Attributes
+	xattrs   map[string]map[string][]byte
+	events   *api.Broadcaster
+	mutex    sync.RWMutex
+	config   kvConfig
+	log      *os.File
+	appended int
+	logMutex sync.Mutex
+	// Log ... Problems with the log file
+	Log *logger.Logger
+}
+
+// NewMemoryLoopbackKV ... Config is optional, see kvSchema
+func NewMemoryLoopbackKV(mountPoint string, config []byte) (api.SimpleDevice, error) {
+	mkv := &MemoryLoopbackKV{
+		db:     make(map[string]*MemoryFileKV),
+		attrs:  make(map[string]api.Attributes),
+		xattrs: make(map[string]map[string][]byte),
+		events: api.NewBroadcaster(),
+		config: kvConfig{CompactAfter: DefaultCompactAfter},
+		Log:    logger.Default().With("mount_point", mountPoint),
+	}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &mkv.config); err != nil {
+			return nil, err
+		}
+	}
+	return mkv, nil
 }
 
-func NewMemoryLoopbackKV(mountPoint string, config []byte) api.SimpleDevice {
-	return &MemoryLoopbackKV{db: make(map[string]*MemoryFileKV)}
+// SetLogger ... Log with the mount fields
+func (mkv *MemoryLoopbackKV) SetLogger(l *logger.Logger) {
+	mkv.Log = l
 }
 
+// Mount ... Loads the log when there is one
 func (mkv *MemoryLoopbackKV) Mount(config []byte) error {
-	return nil
+	if mkv.config.Path == "" {
+		return nil
+	}
+	return mkv.openLog()
 }
+
+// Unmount ... Stops all the watchers and closes the log
 func (mkv *MemoryLoopbackKV) Unmount() error {
-	return nil
+	mkv.events.Close()
+	return mkv.closeLog()
 }
-func (mkv *MemoryLoopbackKV) List(path string) ([]string, error) {
 
-	fmt.Printf("List for kv\n")
-	files := make([]string, 0)
-	for k, _ := range mkv.db {
-		if len(k) > len(path) {
-			p := k[:len(path)]
-			if strings.Compare(path, p) == 0 {
-				s := k[len(path):]
-				next := strings.Index(s, "/")
-				if next > 0 {
-					s = s[:next]
-				}
-				if len(s) > 0 {
-					files = append(files, k)
-				}
-			}
-		}
+// Watch ... Events for every create, write and remove
+func (mkv *MemoryLoopbackKV) Watch(ctx context.Context, prefix string) (<-chan api.Event, error) {
+	return mkv.events.Watch(ctx, prefix)
+}
+
+// List ... Immediate children of path, sub directories end with a slash
+func (mkv *MemoryLoopbackKV) List(path string) ([]string, error) {
+	mkv.mutex.RLock()
+	keys := make([]string, 0, len(mkv.db))
+	for k := range mkv.db {
+		keys = append(keys, k)
 	}
-	return files, nil
+	mkv.mutex.RUnlock()
+	return children(keys, path), nil
 }
 
 func (mkv *MemoryLoopbackKV) Open(path string) (api.SimpleFile, error) {
-	fmt.Printf("Trying to Open %s\n", path)
+	mkv.mutex.Lock()
 	f, exists := mkv.db[path]
 	if !exists {
-		f = &MemoryFileKV{}
+		if err := mkv.appendLog(&logRecord{Op: opWrite, Path: path}); err != nil {
+			mkv.mutex.Unlock()
+			return nil, err
+		}
+		f = &MemoryFileKV{path: path, kv: mkv}
 		mkv.db[path] = f
 	}
+	mkv.mutex.Unlock()
+	// Publish without the lock held since watchers may call back into the device
+	if !exists {
+		mkv.events.Publish(api.Event{Type: api.EventCreate, Path: path})
+	}
 	return f, nil
 }
 
 func (mkv *MemoryLoopbackKV) Remove(path string) error {
+	mkv.mutex.Lock()
+	if err := mkv.appendLog(&logRecord{Op: opRemove, Path: path}); err != nil {
+		mkv.mutex.Unlock()
+		return err
+	}
 	_, exists := mkv.db[path]
 	if exists {
 		delete(mkv.db, path)
 	}
+	delete(mkv.attrs, path)
+	delete(mkv.xattrs, path)
+	mkv.mutex.Unlock()
+	if exists {
+		mkv.events.Publish(api.Event{Type: api.EventDelete, Path: path})
+	}
+	return nil
+}
+
+// GetAttr ... Mode and owner set with SetAttr
+func (mkv *MemoryLoopbackKV) GetAttr(path string) (api.Attributes, error) {
+	mkv.mutex.RLock()
+	defer mkv.mutex.RUnlock()
+	a, exists := mkv.attrs[path]
+	if !exists {
+		return a, api.ErrNoAttr
+	}
+	return a, nil
+}
+
+// SetAttr ... Keep the mode and owner of a key
+func (mkv *MemoryLoopbackKV) SetAttr(path string, attr api.Attributes) error {
+	mkv.mutex.Lock()
+	defer mkv.mutex.Unlock()
+	if err := mkv.appendLog(&logRecord{Op: opAttr, Path: path, Attr: &attr}); err != nil {
+		return err
+	}
+	mkv.attrs[path] = attr
+	return nil
+}
+
+// GetXattr ... Extended attribute of a key
+func (mkv *MemoryLoopbackKV) GetXattr(path, name string) ([]byte, error) {
+	mkv.mutex.RLock()
+	defer mkv.mutex.RUnlock()
+	value, exists := mkv.xattrs[path][name]
+	if !exists {
+		return nil, api.ErrNoXattr
+	}
+	return value, nil
+}
+
+// SetXattr ... Keep an extended attribute of a key
+func (mkv *MemoryLoopbackKV) SetXattr(path, name string, value []byte) error {
+	mkv.mutex.Lock()
+	defer mkv.mutex.Unlock()
+	if err := mkv.appendLog(&logRecord{Op: opXattr, Path: path, Name: name, Value: value}); err != nil {
+		return err
+	}
+	if mkv.xattrs[path] == nil {
+		mkv.xattrs[path] = make(map[string][]byte)
+	}
+	mkv.xattrs[path][name] = value
+	return nil
+}
+
+// ListXattr ... Names of the extended attributes of a key
+func (mkv *MemoryLoopbackKV) ListXattr(path string) ([]string, error) {
+	mkv.mutex.RLock()
+	defer mkv.mutex.RUnlock()
+	names := make([]string, 0, len(mkv.xattrs[path]))
+	for name := range mkv.xattrs[path] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RemoveXattr ... Drop an extended attribute of a key
+func (mkv *MemoryLoopbackKV) RemoveXattr(path, name string) error {
+	mkv.mutex.Lock()
+	defer mkv.mutex.Unlock()
+	if _, exists := mkv.xattrs[path][name]; !exists {
+		return api.ErrNoXattr
+	}
+	if err := mkv.appendLog(&logRecord{Op: opRemoveXattr, Path: path, Name: name}); err != nil {
+		return err
+	}
+	delete(mkv.xattrs[path], name)
 	return nil
 }
@@ -26,7 +26,7 @@ func TestFuseMemoryLoopbackKV(t *testing.T) {
 			t.Fatalf("Failed to create directory %s error: %s", TestFuseMemoryLoopbackKVPath, err)
 		}
 	}
-	err := shylock.MountFuse(TestFuseMemoryLoopbackKVPath, FSMemoryLoopbacKV, []byte("Empty Config"))
+	err := shylock.MountFuse(TestFuseMemoryLoopbackKVPath, FSMemoryLoopbacKV, []byte("{}"))
 	if err != nil {
 		t.Fatalf("Failed to mount with error %s", err)
 	}
@@ -2,7 +2,12 @@ package loopback
 
 import (
 	"bytes"
+	"context"
 	"testing"
+	"time"
+
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/apitest"
 )
 
 func TestMemoryLoopbackMQ(t *testing.T) {
@@ -87,3 +92,78 @@ func TestMemoryLoopbackKV(t *testing.T) {
 		t.Errorf("Expected a single file however got %d", len(names))
 	}
 }
+
+func TestMemoryLoopbackKVWatch(t *testing.T) {
+	d, _ := NewMemoryLoopbackKV("/mnt/kv", nil)
+	w, ok := d.(api.Watcher)
+	if !ok {
+		t.Fatalf("Expected loopback kv to implement api.Watcher")
+	}
+	events, err := w.Watch(context.Background(), "/mnt/kv/")
+	if err != nil {
+		t.Fatalf("Failed to watch %s", err)
+	}
+	f, _ := d.Open("/mnt/kv/a")
+	f.Write([]byte("a"))
+	d.Remove("/mnt/kv/a")
+	for _, expected := range []api.EventType{api.EventCreate, api.EventUpdate, api.EventDelete} {
+		select {
+		case e := <-events:
+			if e.Type != expected || e.Path != "/mnt/kv/a" {
+				t.Errorf("Expected %s of /mnt/kv/a however got %s of %s", expected, e.Type, e.Path)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s event", expected)
+		}
+	}
+	d.Unmount()
+	if _, open := <-events; open {
+		t.Errorf("Expected events to be closed after unmount")
+	}
+}
+
+func TestMemoryLoopbackKVAttributes(t *testing.T) {
+	d, _ := NewMemoryLoopbackKV("/mnt/kv", nil)
+	as, ok := api.AsAttrStore(d)
+	if !ok {
+		t.Fatalf("Expected loopback kv to implement api.AttrStore")
+	}
+	if _, err := as.GetAttr("/mnt/kv/a"); err != api.ErrNoAttr {
+		t.Errorf("Expected ErrNoAttr before anything is set however got %v", err)
+	}
+	as.SetAttr("/mnt/kv/a", api.Attributes{Mode: 0600, Uid: 10, Gid: 20})
+	a, err := as.GetAttr("/mnt/kv/a")
+	if err != nil || a.Mode != 0600 || a.Uid != 10 || a.Gid != 20 {
+		t.Errorf("Expected stored attributes however got %v error %v", a, err)
+	}
+
+	xs, ok := api.AsXattrStore(d)
+	if !ok {
+		t.Fatalf("Expected loopback kv to implement api.XattrStore")
+	}
+	xs.SetXattr("/mnt/kv/a", "user.b", []byte("2"))
+	xs.SetXattr("/mnt/kv/a", "user.a", []byte("1"))
+	names, _ := xs.ListXattr("/mnt/kv/a")
+	if len(names) != 2 || names[0] != "user.a" || names[1] != "user.b" {
+		t.Errorf("Expected sorted names however got %v", names)
+	}
+	if err := xs.RemoveXattr("/mnt/kv/a", "user.a"); err != nil {
+		t.Errorf("Failed to remove xattr %s", err)
+	}
+	if _, err := xs.GetXattr("/mnt/kv/a", "user.a"); err != api.ErrNoXattr {
+		t.Errorf("Expected ErrNoXattr after remove however got %v", err)
+	}
+
+	d.Open("/mnt/kv/a")
+	d.Remove("/mnt/kv/a")
+	if _, err := as.GetAttr("/mnt/kv/a"); err != api.ErrNoAttr {
+		t.Errorf("Expected attributes to be removed with the key however got %v", err)
+	}
+	if _, err := xs.GetXattr("/mnt/kv/a", "user.b"); err != api.ErrNoXattr {
+		t.Errorf("Expected xattrs to be removed with the key however got %v", err)
+	}
+}
+
+func TestMemoryLoopbackKVConformance(t *testing.T) {
+	apitest.RunSimpleDevice(t, NewMemoryLoopbackKV, nil)
+}
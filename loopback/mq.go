@@ -0,0 +1,340 @@
+package loopback
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/lateefj/shylock/api"
+)
+
+const (
+	// FSMemoryLoopbackMQ ... In memory message queue device
+	FSMemoryLoopbackMQ = "LOOPBACK_MQ"
+
+	// MQCompeting ... Every message goes to exactly one reader of the topic
+	MQCompeting = "competing"
+	// MQFanout ... Every reader subscribed to the topic gets every message
+	MQFanout = "fanout"
+
+	// MQBlock ... Writers wait for room in a full queue
+	MQBlock = "block"
+	// MQDropOldest ... The oldest message is dropped to make room
+	MQDropOldest = "drop_oldest"
+	// MQReject ... Writes to a full queue fail with api.ErrWouldBlock
+	MQReject = "reject"
+
+	// DefaultMQBuffer ... Messages a queue holds before backpressure kicks in
+	DefaultMQBuffer = 64
+)
+
+var errMQClosed = errors.New("Message queue is closed")
+
+func init() {
+	api.RegisterSimpleDeviceType(api.Registered{
+		FSType:      FSMemoryLoopbackMQ,
+		Description: "In memory message queue, writes enqueue a message and reads block until one arrives",
+		Schema: []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"buffer": {"type": "integer", "minimum": 1, "description": "Messages held per queue before backpressure"},
+		"mode": {"type": "string", "enum": ["competing", "fanout"], "description": "Share messages between readers or copy them to every reader"},
+		"backpressure": {"type": "string", "enum": ["block", "drop_oldest", "reject"], "description": "What a write to a full queue does"}
+	}
+}`),
+		Capabilities: []api.Capability{api.CapStreaming},
+	}, NewMemoryLoopbackMQ)
+}
+
+type mqConfig struct {
+	Buffer       int    `json:"buffer"`
+	Mode         string `json:"mode"`
+	Backpressure string `json:"backpressure"`
+}
+
+// mqTopic ... Queues for a single path. Competing topics have one queue, fanout topics
+// have one per subscribed reader
+type mqTopic struct {
+	path        string
+	queue       chan []byte
+	subscribers map[chan []byte]bool
+	removed     chan struct{}
+	mutex       sync.Mutex
+}
+
+// MemoryLoopbackMQ ... Message queue where every path is a topic
+type MemoryLoopbackMQ struct {
+	config  mqConfig
+	topics  map[string]*mqTopic
+	closed  chan struct{}
+	closing sync.Once
+	mutex   sync.RWMutex
+}
+
+// NewMemoryLoopbackMQ ... Config is optional, defaults to competing readers with blocking writes
+func NewMemoryLoopbackMQ(mountPoint string, config []byte) (api.SimpleDevice, error) {
+	mmq := &MemoryLoopbackMQ{
+		config: mqConfig{Buffer: DefaultMQBuffer, Mode: MQCompeting, Backpressure: MQBlock},
+		topics: make(map[string]*mqTopic),
+		closed: make(chan struct{}),
+	}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &mmq.config); err != nil {
+			return nil, err
+		}
+	}
+	return mmq, nil
+}
+
+// Mount ... Noop
+func (mmq *MemoryLoopbackMQ) Mount(config []byte) error {
+	return nil
+}
+
+// Unmount ... Wakes up every blocked reader and writer
+func (mmq *MemoryLoopbackMQ) Unmount() error {
+	mmq.closing.Do(func() {
+		close(mmq.closed)
+	})
+	return nil
+}
+
+// List ... Topics under path
+func (mmq *MemoryLoopbackMQ) List(path string) ([]string, error) {
+	mmq.mutex.RLock()
+	keys := make([]string, 0, len(mmq.topics))
+	for k := range mmq.topics {
+		keys = append(keys, k)
+	}
+	mmq.mutex.RUnlock()
+	return children(keys, path), nil
+}
+
+// Remove ... Drop a topic, readers waiting on it get io.EOF
+func (mmq *MemoryLoopbackMQ) Remove(path string) error {
+	mmq.mutex.Lock()
+	t, exists := mmq.topics[path]
+	delete(mmq.topics, path)
+	mmq.mutex.Unlock()
+	if exists {
+		close(t.removed)
+	}
+	return nil
+}
+
+// topic ... Find or create the topic for a path
+func (mmq *MemoryLoopbackMQ) topic(path string) *mqTopic {
+	mmq.mutex.Lock()
+	defer mmq.mutex.Unlock()
+	t, exists := mmq.topics[path]
+	if !exists {
+		t = &mqTopic{path: path, subscribers: make(map[chan []byte]bool), removed: make(chan struct{})}
+		if mmq.config.Mode != MQFanout {
+			t.queue = make(chan []byte, mmq.config.Buffer)
+		}
+		mmq.topics[path] = t
+	}
+	return t
+}
+
+// subscribe ... Queue a reader takes messages from
+func (mmq *MemoryLoopbackMQ) subscribe(t *mqTopic) chan []byte {
+	if t.queue != nil {
+		return t.queue
+	}
+	q := make(chan []byte, mmq.config.Buffer)
+	t.mutex.Lock()
+	t.subscribers[q] = true
+	t.mutex.Unlock()
+	return q
+}
+
+// unsubscribe ... Stop copying messages to a fanout reader
+func (mmq *MemoryLoopbackMQ) unsubscribe(t *mqTopic, q chan []byte) {
+	if q == nil || q == t.queue {
+		return
+	}
+	t.mutex.Lock()
+	delete(t.subscribers, q)
+	t.mutex.Unlock()
+}
+
+// publish ... Enqueue a copy of the message for every queue of the topic
+func (mmq *MemoryLoopbackMQ) publish(t *mqTopic, message []byte) error {
+	m := make([]byte, len(message))
+	copy(m, message)
+	if t.queue != nil {
+		return mmq.enqueue(t, t.queue, m)
+	}
+	t.mutex.Lock()
+	queues := make([]chan []byte, 0, len(t.subscribers))
+	for q := range t.subscribers {
+		queues = append(queues, q)
+	}
+	t.mutex.Unlock()
+	for _, q := range queues {
+		if err := mmq.enqueue(t, q, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue ... Apply the backpressure policy when the queue is full
+func (mmq *MemoryLoopbackMQ) enqueue(t *mqTopic, q chan []byte, m []byte) error {
+	select {
+	case q <- m:
+		return nil
+	default:
+	}
+	switch mmq.config.Backpressure {
+	case MQReject:
+		return api.ErrWouldBlock
+	case MQDropOldest:
+		for {
+			select {
+			case q <- m:
+				return nil
+			default:
+			}
+			select {
+			case <-q:
+			default:
+			}
+		}
+	}
+	select {
+	case q <- m:
+		return nil
+	case <-t.removed:
+		return nil
+	case <-mmq.closed:
+		return errMQClosed
+	}
+}
+
+// dequeue ... Block until there is a message, io.EOF once the topic or device is gone
+// and everything queued has been read
+func (mmq *MemoryLoopbackMQ) dequeue(t *mqTopic, q chan []byte) ([]byte, error) {
+	select {
+	case m := <-q:
+		return m, nil
+	default:
+	}
+	select {
+	case m := <-q:
+		return m, nil
+	case <-t.removed:
+		return nil, io.EOF
+	case <-mmq.closed:
+		return nil, io.EOF
+	}
+}
+
+// Open ... Every Read dequeues a single message and every Write enqueues one
+func (mmq *MemoryLoopbackMQ) Open(path string) (api.SimpleFile, error) {
+	return &mqFile{mq: mmq, topic: mmq.topic(path)}, nil
+}
+
+// OpenStream ... Readers get messages back to back until the device is unmounted and
+// writers enqueue everything written as one message when they are closed
+func (mmq *MemoryLoopbackMQ) OpenStream(path string) (api.StreamFile, error) {
+	return &mqStream{mq: mmq, topic: mmq.topic(path)}, nil
+}
+
+// mqFile ... Fanout readers subscribe on their first read so writers that never read
+// don't hold up the topic
+type mqFile struct {
+	mq    *MemoryLoopbackMQ
+	topic *mqTopic
+	queue chan []byte
+	mutex sync.Mutex
+}
+
+func (mf *mqFile) Read() ([]byte, error) {
+	mf.mutex.Lock()
+	if mf.queue == nil {
+		mf.queue = mf.mq.subscribe(mf.topic)
+	}
+	q := mf.queue
+	mf.mutex.Unlock()
+	return mf.mq.dequeue(mf.topic, q)
+}
+
+func (mf *mqFile) Write(body []byte) error {
+	return mf.mq.publish(mf.topic, body)
+}
+
+func (mf *mqFile) Close() error {
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
+	mf.mq.unsubscribe(mf.topic, mf.queue)
+	mf.queue = nil
+	return nil
+}
+
+type mqStream struct {
+	mq    *MemoryLoopbackMQ
+	topic *mqTopic
+}
+
+func (ms *mqStream) Reader() (io.ReadCloser, error) {
+	return &mqReader{mq: ms.mq, topic: ms.topic, queue: ms.mq.subscribe(ms.topic)}, nil
+}
+
+func (ms *mqStream) Writer() (io.WriteCloser, error) {
+	return &mqWriter{mq: ms.mq, topic: ms.topic}, nil
+}
+
+func (ms *mqStream) Close() error {
+	return nil
+}
+
+// mqReader ... Hands out messages back to back, blocking between them
+type mqReader struct {
+	mq      *MemoryLoopbackMQ
+	topic   *mqTopic
+	queue   chan []byte
+	pending []byte
+}
+
+func (mr *mqReader) Read(p []byte) (int, error) {
+	if len(mr.pending) == 0 {
+		m, err := mr.mq.dequeue(mr.topic, mr.queue)
+		if err != nil {
+			return 0, err
+		}
+		mr.pending = m
+	}
+	n := copy(p, mr.pending)
+	mr.pending = mr.pending[n:]
+	return n, nil
+}
+
+func (mr *mqReader) Close() error {
+	mr.mq.unsubscribe(mr.topic, mr.queue)
+	return nil
+}
+
+// mqWriter ... Collects a message until it is closed
+type mqWriter struct {
+	mq     *MemoryLoopbackMQ
+	topic  *mqTopic
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (mw *mqWriter) Write(p []byte) (int, error) {
+	return mw.buf.Write(p)
+}
+
+func (mw *mqWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+	return mw.mq.publish(mw.topic, mw.buf.Bytes())
+}
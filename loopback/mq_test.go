@@ -0,0 +1,173 @@
+package loopback
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/lateefj/shylock/api"
+)
+
+func newMQ(t *testing.T, config string) *MemoryLoopbackMQ {
+	d, err := api.MountSimpleDevice(FSMemoryLoopbackMQ, "/mnt/mq", []byte(config))
+	if err != nil {
+		t.Fatalf("Failed to mount %s", err)
+	}
+	return d.(*MemoryLoopbackMQ)
+}
+
+func readMessage(t *testing.T, f api.SimpleFile) string {
+	result := make(chan string, 1)
+	go func() {
+		m, _ := f.Read()
+		result <- string(m)
+	}()
+	select {
+	case m := <-result:
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for a message")
+	}
+	return ""
+}
+
+func TestMemoryLoopbackMQCompeting(t *testing.T) {
+	mq := newMQ(t, `{}`)
+	defer mq.Unmount()
+	w, _ := mq.Open("/mnt/mq/jobs")
+	r1, _ := mq.Open("/mnt/mq/jobs")
+	r2, _ := mq.Open("/mnt/mq/jobs")
+	w.Write([]byte("a"))
+	w.Write([]byte("b"))
+	got := map[string]bool{readMessage(t, r1): true, readMessage(t, r2): true}
+	if !got["a"] || !got["b"] {
+		t.Errorf("Expected each reader to get one of the messages however got %v", got)
+	}
+	names, _ := mq.List("/mnt/mq")
+	if len(names) != 1 || names[0] != "/mnt/mq/jobs" {
+		t.Errorf("Expected the topic to be listed however got %v", names)
+	}
+}
+
+func TestMemoryLoopbackMQFanout(t *testing.T) {
+	mq := newMQ(t, `{"mode": "fanout"}`)
+	defer mq.Unmount()
+	w, _ := mq.Open("/mnt/mq/events")
+	// Messages before anyone reads are not kept
+	w.Write([]byte("early"))
+	r1, _ := mq.Open("/mnt/mq/events")
+	r2, _ := mq.Open("/mnt/mq/events")
+	read1 := make(chan string, 1)
+	read2 := make(chan string, 1)
+	go func() { m, _ := r1.Read(); read1 <- string(m) }()
+	go func() { m, _ := r2.Read(); read2 <- string(m) }()
+	// Wait for both readers to subscribe
+	for {
+		mq.topic("/mnt/mq/events").mutex.Lock()
+		subscribed := len(mq.topic("/mnt/mq/events").subscribers)
+		mq.topic("/mnt/mq/events").mutex.Unlock()
+		if subscribed == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.Write([]byte("broadcast"))
+	for _, c := range []chan string{read1, read2} {
+		select {
+		case m := <-c:
+			if m != "broadcast" {
+				t.Errorf("Expected every reader to get broadcast however got %s", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for fanout")
+		}
+	}
+	r1.Close()
+	if len(mq.topic("/mnt/mq/events").subscribers) != 1 {
+		t.Errorf("Expected close to unsubscribe")
+	}
+}
+
+func TestMemoryLoopbackMQBackpressure(t *testing.T) {
+	reject := newMQ(t, `{"buffer": 1, "backpressure": "reject"}`)
+	defer reject.Unmount()
+	f, _ := reject.Open("/mnt/mq/q")
+	f.Write([]byte("1"))
+	if err := f.Write([]byte("2")); err != api.ErrWouldBlock {
+		t.Errorf("Expected a full queue to reject however got %v", err)
+	}
+
+	drop := newMQ(t, `{"buffer": 2, "backpressure": "drop_oldest"}`)
+	defer drop.Unmount()
+	f, _ = drop.Open("/mnt/mq/q")
+	for _, m := range []string{"1", "2", "3"} {
+		if err := f.Write([]byte(m)); err != nil {
+			t.Fatalf("Expected drop oldest to never fail however got %s", err)
+		}
+	}
+	if m := readMessage(t, f); m != "2" {
+		t.Errorf("Expected the oldest message to be dropped however read %s", m)
+	}
+
+	block := newMQ(t, `{"buffer": 1}`)
+	f, _ = block.Open("/mnt/mq/q")
+	f.Write([]byte("1"))
+	written := make(chan error, 1)
+	go func() { written <- f.Write([]byte("2")) }()
+	select {
+	case <-written:
+		t.Fatalf("Expected write to a full queue to block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	readMessage(t, f)
+	if err := <-written; err != nil {
+		t.Errorf("Expected blocked write to finish after a read however got %s", err)
+	}
+	go func() { written <- f.Write([]byte("3")) }()
+	block.Unmount()
+	if err := <-written; err == nil {
+		t.Errorf("Expected blocked write to fail on unmount")
+	}
+}
+
+func TestMemoryLoopbackMQUnmount(t *testing.T) {
+	mq := newMQ(t, `{}`)
+	f, _ := mq.Open("/mnt/mq/q")
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.Read()
+		done <- err
+	}()
+	mq.Remove("/mnt/mq/q")
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("Expected io.EOF when the topic is removed however got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected remove to wake up the reader")
+	}
+	mq.Unmount()
+	mq.Unmount()
+}
+
+func TestMemoryLoopbackMQStream(t *testing.T) {
+	mq := newMQ(t, `{}`)
+	sd, ok := api.AsStreamDevice(mq)
+	if !ok {
+		t.Fatalf("Expected the mq to be served as a stream")
+	}
+	s, _ := sd.OpenStream("/mnt/mq/lines")
+	for _, m := range []string{"one\n", "two\n"} {
+		w, _ := s.Writer()
+		w.Write([]byte(m))
+		w.Close()
+	}
+	r, _ := s.Reader()
+	mq.Unmount()
+	bits, err := ioutil.ReadAll(r)
+	if err != nil || string(bits) != "one\ntwo\n" {
+		t.Errorf("Expected messages back to back however got %q error %v", string(bits), err)
+	}
+}
@@ -0,0 +1,326 @@
+package loopback
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/lateefj/shylock/api"
+)
+
+const (
+	// DefaultCompactAfter ... Records appended to the log before it is rewritten
+	DefaultCompactAfter = 1000
+
+	opWrite       = "write"
+	opRemove      = "remove"
+	opAttr        = "attr"
+	opXattr       = "xattr"
+	opRemoveXattr = "remove_xattr"
+)
+
+// kvSchema ... Config for LOOPBACK_KV, an empty config keeps everything in memory
+var kvSchema = []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"path": {"type": "string", "minLength": 1, "description": "Append only log file, the device is only in memory without it"},
+		"compact_after": {"type": "integer", "minimum": 1, "description": "Records appended before the log is compacted"},
+		"sync": {"type": "boolean", "description": "Sync the log to disk after every record"}
+	}
+}`)
+
+type kvConfig struct {
+	Path         string `json:"path"`
+	CompactAfter int    `json:"compact_after"`
+	Sync         bool   `json:"sync"`
+}
+
+// logRecord ... Single change in the append only log, one JSON object per line
+type logRecord struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Body  []byte          `json:"body,omitempty"`
+	Attr  *api.Attributes `json:"attr,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Value []byte          `json:"value,omitempty"`
+}
+
+// kvSnapshot ... Full state of the device
+type kvSnapshot struct {
+	Files  map[string][]byte            `json:"files"`
+	Attrs  map[string]api.Attributes    `json:"attrs,omitempty"`
+	Xattrs map[string]map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// apply ... Replay a record against the maps, must hold the write lock
+func (mkv *MemoryLoopbackKV) apply(rec *logRecord) error {
+	switch rec.Op {
+	case opWrite:
+		f, exists := mkv.db[rec.Path]
+		if !exists {
+			f = &MemoryFileKV{path: rec.Path, kv: mkv}
+			mkv.db[rec.Path] = f
+		}
+		f.body = rec.Body
+	case opRemove:
+		delete(mkv.db, rec.Path)
+		delete(mkv.attrs, rec.Path)
+		delete(mkv.xattrs, rec.Path)
+	case opAttr:
+		if rec.Attr != nil {
+			mkv.attrs[rec.Path] = *rec.Attr
+		}
+	case opXattr:
+		if mkv.xattrs[rec.Path] == nil {
+			mkv.xattrs[rec.Path] = make(map[string][]byte)
+		}
+		mkv.xattrs[rec.Path][rec.Name] = rec.Value
+	case opRemoveXattr:
+		delete(mkv.xattrs[rec.Path], rec.Name)
+	default:
+		return fmt.Errorf("Unknown log operation %s", rec.Op)
+	}
+	return nil
+}
+
+// replay ... Load the log into memory. A partial last line from a crash is dropped
+func (mkv *MemoryLoopbackKV) replay(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	line := 0
+	for scanner.Scan() {
+		line++
+		rec := &logRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			mkv.Log.Warn("Dropping the rest of the log", "log_file", mkv.config.Path, "line", line, "error", err)
+			return nil
+		}
+		if err := mkv.apply(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// openLog ... Replay the log then compact it so it starts out small
+func (mkv *MemoryLoopbackKV) openLog() error {
+	mkv.mutex.Lock()
+	defer mkv.mutex.Unlock()
+	f, err := os.Open(mkv.config.Path)
+	if err == nil {
+		err = mkv.replay(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return mkv.compact()
+}
+
+// appendLog ... Add a record to the log, callers hold the device lock (read or write)
+func (mkv *MemoryLoopbackKV) appendLog(rec *logRecord) error {
+	if mkv.config.Path == "" {
+		return nil
+	}
+	bits, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	mkv.logMutex.Lock()
+	defer mkv.logMutex.Unlock()
+	if mkv.log == nil {
+		return errLogClosed
+	}
+	if _, err := mkv.log.Write(append(bits, '\n')); err != nil {
+		return err
+	}
+	if mkv.config.Sync {
+		if err := mkv.log.Sync(); err != nil {
+			return err
+		}
+	}
+	mkv.appended++
+	return nil
+}
+
+// maybeCompact ... Rewrite the log once enough records have been appended
+func (mkv *MemoryLoopbackKV) maybeCompact() {
+	if mkv.config.Path == "" {
+		return
+	}
+	mkv.logMutex.Lock()
+	due := mkv.log != nil && mkv.appended >= mkv.config.CompactAfter
+	mkv.logMutex.Unlock()
+	if !due {
+		return
+	}
+	mkv.mutex.Lock()
+	defer mkv.mutex.Unlock()
+	if err := mkv.compact(); err != nil {
+		mkv.Log.Error("Failed to compact the log", "log_file", mkv.config.Path, "error", err)
+	}
+}
+
+// records ... Everything in memory as log records, must hold the lock
+func (mkv *MemoryLoopbackKV) records() []*logRecord {
+	paths := make([]string, 0, len(mkv.db))
+	for p := range mkv.db {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	recs := make([]*logRecord, 0, len(paths))
+	for _, p := range paths {
+		f := mkv.db[p]
+		f.mutex.RLock()
+		recs = append(recs, &logRecord{Op: opWrite, Path: p, Body: f.body})
+		f.mutex.RUnlock()
+	}
+	for p, a := range mkv.attrs {
+		attr := a
+		recs = append(recs, &logRecord{Op: opAttr, Path: p, Attr: &attr})
+	}
+	for p, names := range mkv.xattrs {
+		for name, value := range names {
+			recs = append(recs, &logRecord{Op: opXattr, Path: p, Name: name, Value: value})
+		}
+	}
+	return recs
+}
+
+// compact ... Write the current state to a new log and swap it in, must hold the write lock
+func (mkv *MemoryLoopbackKV) compact() error {
+	tmpPath := mkv.config.Path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, rec := range mkv.records() {
+		if err := enc.Encode(rec); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, mkv.config.Path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mkv.config.Path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	mkv.logMutex.Lock()
+	defer mkv.logMutex.Unlock()
+	if mkv.log != nil {
+		mkv.log.Close()
+	}
+	mkv.log = f
+	mkv.appended = 0
+	return nil
+}
+
+// closeLog ... Safe to call more than once
+func (mkv *MemoryLoopbackKV) closeLog() error {
+	mkv.logMutex.Lock()
+	defer mkv.logMutex.Unlock()
+	if mkv.log == nil {
+		return nil
+	}
+	err := mkv.log.Sync()
+	if cErr := mkv.log.Close(); err == nil {
+		err = cErr
+	}
+	mkv.log = nil
+	return err
+}
+
+// Snapshot ... Write the full state of the device as JSON
+func (mkv *MemoryLoopbackKV) Snapshot(w io.Writer) error {
+	mkv.mutex.RLock()
+	snap := kvSnapshot{
+		Files:  make(map[string][]byte, len(mkv.db)),
+		Attrs:  make(map[string]api.Attributes, len(mkv.attrs)),
+		Xattrs: make(map[string]map[string][]byte, len(mkv.xattrs)),
+	}
+	for p, f := range mkv.db {
+		f.mutex.RLock()
+		snap.Files[p] = f.body
+		f.mutex.RUnlock()
+	}
+	for p, a := range mkv.attrs {
+		snap.Attrs[p] = a
+	}
+	for p, names := range mkv.xattrs {
+		snap.Xattrs[p] = make(map[string][]byte, len(names))
+		for name, value := range names {
+			snap.Xattrs[p][name] = value
+		}
+	}
+	mkv.mutex.RUnlock()
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Restore ... Replace the full state of the device with a snapshot. Watchers get a
+// delete for every key that is gone and an update for every key in the snapshot
+func (mkv *MemoryLoopbackKV) Restore(r io.Reader) error {
+	snap := kvSnapshot{}
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	events := make([]api.Event, 0)
+	mkv.mutex.Lock()
+	for p := range mkv.db {
+		if _, kept := snap.Files[p]; !kept {
+			events = append(events, api.Event{Type: api.EventDelete, Path: p})
+		}
+	}
+	db := make(map[string]*MemoryFileKV, len(snap.Files))
+	for p, body := range snap.Files {
+		// Files that are already open keep working
+		f, exists := mkv.db[p]
+		// Keys only the snapshot has are new to watchers so cached listings get refreshed
+		t := api.EventUpdate
+		if !exists {
+			f = &MemoryFileKV{path: p, kv: mkv}
+			t = api.EventCreate
+		}
+		f.mutex.Lock()
+		f.body = body
+		f.mutex.Unlock()
+		db[p] = f
+		events = append(events, api.Event{Type: t, Path: p})
+	}
+	mkv.db = db
+	mkv.attrs = snap.Attrs
+	if mkv.attrs == nil {
+		mkv.attrs = make(map[string]api.Attributes)
+	}
+	mkv.xattrs = snap.Xattrs
+	if mkv.xattrs == nil {
+		mkv.xattrs = make(map[string]map[string][]byte)
+	}
+	var err error
+	if mkv.config.Path != "" {
+		err = mkv.compact()
+	}
+	mkv.mutex.Unlock()
+	for _, e := range events {
+		mkv.events.Publish(e)
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package loopback
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/apitest"
+)
+
+func logConfig(p string, compactAfter int) []byte {
+	return []byte(fmt.Sprintf(`{"path": %q, "compact_after": %d}`, p, compactAfter))
+}
+
+func mountKV(t *testing.T, config []byte) *MemoryLoopbackKV {
+	d, err := NewMemoryLoopbackKV("/mnt/kv", config)
+	if err != nil {
+		t.Fatalf("Failed to build %s", err)
+	}
+	if err := d.Mount(config); err != nil {
+		t.Fatalf("Failed to mount %s", err)
+	}
+	return d.(*MemoryLoopbackKV)
+}
+
+func readKV(t *testing.T, d api.SimpleDevice, p string) string {
+	f, err := d.Open(p)
+	if err != nil {
+		t.Fatalf("Failed to open %s", err)
+	}
+	bits, _ := f.Read()
+	return string(bits)
+}
+
+func countLines(t *testing.T, p string) int {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestMemoryLoopbackKVPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "kv.log")
+	config := logConfig(logPath, DefaultCompactAfter)
+
+	d := mountKV(t, config)
+	f, _ := d.Open("/mnt/kv/a")
+	f.Write([]byte("first"))
+	f.Write([]byte("second"))
+	g, _ := d.Open("/mnt/kv/b")
+	g.Write([]byte("gone"))
+	d.Remove("/mnt/kv/b")
+	d.Open("/mnt/kv/empty")
+	d.SetAttr("/mnt/kv/a", api.Attributes{Mode: 0600, Uid: 1, Gid: 2})
+	d.SetXattr("/mnt/kv/a", "user.a", []byte("1"))
+	if err := d.Unmount(); err != nil {
+		t.Fatalf("Failed to unmount %s", err)
+	}
+	if err := f.Write([]byte("after unmount")); err == nil {
+		t.Errorf("Expected writes after unmount to fail")
+	}
+
+	// Crash in the middle of a record
+	lf, _ := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0600)
+	lf.Write([]byte(`{"op":"write","path":"/mnt/kv/torn","bo`))
+	lf.Close()
+
+	d = mountKV(t, config)
+	defer d.Unmount()
+	if body := readKV(t, d, "/mnt/kv/a"); body != "second" {
+		t.Errorf("Expected second however got %s", body)
+	}
+	names, _ := d.List("/mnt/kv")
+	if len(names) != 2 || names[0] != "/mnt/kv/a" || names[1] != "/mnt/kv/empty" {
+		t.Errorf("Expected a and empty to survive the remount however got %v", names)
+	}
+	if a, err := d.GetAttr("/mnt/kv/a"); err != nil || a.Mode != 0600 {
+		t.Errorf("Expected attributes to survive however got %v error %v", a, err)
+	}
+	if v, err := d.GetXattr("/mnt/kv/a", "user.a"); err != nil || string(v) != "1" {
+		t.Errorf("Expected xattr to survive however got %s error %v", string(v), err)
+	}
+	// Mount compacts the log down to the live keys and attributes
+	if lines := countLines(t, logPath); lines != 4 {
+		t.Errorf("Expected 4 records after compaction however got %d", lines)
+	}
+}
+
+func TestMemoryLoopbackKVCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "kv.log")
+	d := mountKV(t, logConfig(logPath, 10))
+	f, _ := d.Open("/mnt/kv/a")
+	for i := 0; i < 100; i++ {
+		f.Write([]byte(fmt.Sprintf("%d", i)))
+	}
+	if lines := countLines(t, logPath); lines > 10 {
+		t.Errorf("Expected the log to be compacted however it has %d records", lines)
+	}
+	d.Unmount()
+	d = mountKV(t, logConfig(logPath, 10))
+	defer d.Unmount()
+	if body := readKV(t, d, "/mnt/kv/a"); body != "99" {
+		t.Errorf("Expected 99 after compaction however got %s", body)
+	}
+}
+
+func TestMemoryLoopbackKVSnapshot(t *testing.T) {
+	d := mountKV(t, nil)
+	f, _ := d.Open("/mnt/kv/a")
+	f.Write([]byte("snapshot"))
+	d.SetXattr("/mnt/kv/a", "user.a", []byte("1"))
+	var snap bytes.Buffer
+	if err := d.Snapshot(&snap); err != nil {
+		t.Fatalf("Failed to snapshot %s", err)
+	}
+
+	f.Write([]byte("changed"))
+	d.Open("/mnt/kv/new")
+	if err := d.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatalf("Failed to restore %s", err)
+	}
+	if body := readKV(t, d, "/mnt/kv/a"); body != "snapshot" {
+		t.Errorf("Expected snapshot however got %s", body)
+	}
+	if body, _ := f.Read(); string(body) != "snapshot" {
+		t.Errorf("Expected an open file to see the restore however got %s", string(body))
+	}
+	names, _ := d.List("/mnt/kv")
+	if len(names) != 1 {
+		t.Errorf("Expected only the snapshot keys however got %v", names)
+	}
+	if v, _ := d.GetXattr("/mnt/kv/a", "user.a"); string(v) != "1" {
+		t.Errorf("Expected xattr from the snapshot however got %s", string(v))
+	}
+}
+
+func TestMemoryLoopbackKVRestoreWatch(t *testing.T) {
+	d := mountKV(t, nil)
+	d.Open("/mnt/kv/a")
+	d.Open("/mnt/kv/b")
+	var snap bytes.Buffer
+	if err := d.Snapshot(&snap); err != nil {
+		t.Fatalf("Failed to snapshot %s", err)
+	}
+	d.Remove("/mnt/kv/b")
+	d.Open("/mnt/kv/c")
+
+	events, err := d.Watch(context.Background(), "/mnt/kv/")
+	if err != nil {
+		t.Fatalf("Failed to watch %s", err)
+	}
+	if err := d.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatalf("Failed to restore %s", err)
+	}
+	expected := map[string]api.EventType{
+		"/mnt/kv/a": api.EventUpdate,
+		"/mnt/kv/b": api.EventCreate,
+		"/mnt/kv/c": api.EventDelete,
+	}
+	for range expected {
+		select {
+		case e := <-events:
+			if expected[e.Path] != e.Type {
+				t.Errorf("Expected %s of %s however got %s", expected[e.Path], e.Path, e.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for restore events")
+		}
+	}
+}
+
+func TestMemoryLoopbackKVConfig(t *testing.T) {
+	if _, err := api.MountSimpleDevice(FSMemoryLoopbacKV, "/mnt/kv", []byte(`{"path": 10}`)); err == nil {
+		t.Errorf("Expected a numeric path to fail validation")
+	}
+	if _, err := api.MountSimpleDevice(FSMemoryLoopbacKV, "/mnt/kv", []byte(`{"paht": "/tmp/kv.log"}`)); err == nil {
+		t.Errorf("Expected an unknown field to fail validation")
+	}
+}
+
+func TestMemoryLoopbackKVPersistConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	builds := 0
+	apitest.RunSimpleDevice(t, func(mountPoint string, config []byte) (api.SimpleDevice, error) {
+		builds++
+		// Every sub test gets its own log so they start out empty
+		return NewMemoryLoopbackKV(mountPoint, logConfig(filepath.Join(dir, fmt.Sprintf("%d.log", builds)), 8))
+	}, nil)
+}
@@ -3,70 +3,569 @@ package shylock
 import (
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
 	"github.com/lateefj/shylock/buse"
+	"github.com/lateefj/shylock/logger"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
 )
 
 const (
 	DOCKER = "DOCKER"
 	FUSE   = "FUSE"
+	CSI    = "CSI"
+
+	// StateMounted ... The file system is being served
+	StateMounted = "mounted"
+	// StateUnmounting ... Unmount has been asked for and hasn't finished
+	StateUnmounting = "unmounting"
+	// StateFailed ... Serving the file system stopped with an error
+	StateFailed = "failed"
+	// StateExited ... Serving stopped without shylock unmounting it, like a fusermount -u
+	StateExited = "exited"
 )
 
 var (
-	mountSystemNotSupported = errors.New("Mount System Not Supported")
-	mountedDevices          = make([]api.SimpleDevice, 0)
-	mountedFuse             = make([]*buse.FuseSimpleDevice, 0)
+	// ErrMountNotFound ... No mount with the id
+	ErrMountNotFound = errors.New("Mount not found")
+	// ErrMountPointInUse ... Something is already mounted at the mount point
+	ErrMountPointInUse = errors.New("Mount point is already in use")
+	// ErrQOSKeyInUse ... A QOS key of the mount already has limits from another mount or the QOS api
+	ErrQOSKeyInUse = errors.New("QOS key is already limited")
+	// ErrExited ... The error of a mount that stopped being served without shylock unmounting it
+	ErrExited = errors.New("Stopped serving without being unmounted by shylock")
+
+	mounted      = make(map[string]*mountEntry)
+	mountedCount int
+	mountedMutex sync.Mutex
+
+	// servers ... Volume plugins that are stopped on Exit
+	servers      = make([]io.Closer, 0)
+	serversMutex sync.Mutex
 )
 
+// ioMapper ... Native devices that take QOS limits, either applying them themselves or through buse
+type ioMapper interface {
+	SetIOMap(ioMap *qos.IOMap)
+}
+
+// middlewarer ... Native devices served by buse that take middleware
+type middlewarer interface {
+	SetMiddleware(mws []api.NativeMiddleware)
+}
+
+// kernelOptioner ... Native devices served by buse
+type kernelOptioner interface {
+	SetKernelOptions(ko buse.KernelOptions)
+}
+
+// readier ... Devices that know when the kernel finished mounting them
+type readier interface {
+	OnReady(f func(error))
+}
+
+// unmounter ... Both fuse devices and native devices
+type unmounter interface {
+	Unmount() error
+}
+
+// shutdowner ... Devices that can wait for requests in flight before unmounting
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// MountOptions ... The options mount(8) passes with -o
+type MountOptions struct {
+	ReadOnly           bool `json:"read_only,omitempty"`
+	AllowOther         bool `json:"allow_other,omitempty"`
+	DefaultPermissions bool `json:"default_permissions,omitempty"`
+	// UID, GID and Umask ... Owner and mode of keys without attributes, native file systems
+	// have their own attributes so these only apply to simple devices
+	UID   *uint32      `json:"uid,omitempty"`
+	GID   *uint32      `json:"gid,omitempty"`
+	Umask *os.FileMode `json:"umask,omitempty"`
+	// Ready ... Called once the kernel has mounted the file system or with why mounting failed
+	Ready func(info MountInfo, err error) `json:"-"`
+}
+
+// kernel ... The options the kernel enforces
+func (mo MountOptions) kernel(fsType string) buse.KernelOptions {
+	return buse.KernelOptions{FSName: fsType, ReadOnly: mo.ReadOnly, AllowOther: mo.AllowOther, DefaultPermissions: mo.DefaultPermissions}
+}
+
+// MountInfo ... What is mounted where and how it is doing
+type MountInfo struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	MountPoint string `json:"mount_point"`
+	State      string `json:"state"`
+	// Ready ... The kernel has mounted the file system and it is being served
+	Ready     bool      `json:"ready"`
+	Error     string    `json:"error,omitempty"`
+	MountedAt time.Time `json:"mounted_at"`
+	// Uptime ... Seconds since the mount was made
+	Uptime float64 `json:"uptime"`
+}
+
+// mountEntry ... A tracked mount, the fields are guarded by mountedMutex
+type mountEntry struct {
+	info    MountInfo
+	device  unmounter
+	qosKeys []string
+	ioMap   *qos.IOMap
+	// ready ... Closed once mounting finished, readyErr says how it went
+	ready    chan struct{}
+	readyErr error
+	onReady  func(MountInfo, error)
+}
+
+// stopped ... The mount is no longer served and is only kept so it shows up in the mount list
+func (me *mountEntry) stopped() bool {
+	return me.info.State == StateFailed || me.info.State == StateExited
+}
+
+// track ... Claim the mount point and give the mount an id. A mount that stopped being served
+// gives up its mount point
+func track(mountPath, fsType string) (*mountEntry, error) {
+	mountPath = path.Clean(mountPath)
+	mountedMutex.Lock()
+	defer mountedMutex.Unlock()
+	for id, me := range mounted {
+		if me.info.MountPoint != mountPath {
+			continue
+		}
+		if !me.stopped() {
+			return nil, ErrMountPointInUse
+		}
+		delete(mounted, id)
+	}
+	mountedCount++
+	me := &mountEntry{info: MountInfo{ID: strconv.Itoa(mountedCount), Type: fsType, MountPoint: mountPath, State: StateMounted, MountedAt: time.Now()}, ready: make(chan struct{})}
+	mounted[me.info.ID] = me
+	return me, nil
+}
+
+// untrack ... Free the mount point
+func untrack(me *mountEntry) {
+	mountedMutex.Lock()
+	defer mountedMutex.Unlock()
+	delete(mounted, me.info.ID)
+}
+
+// mountLogger ... Everything logged for a mount says which mount it was
+func mountLogger(me *mountEntry) *logger.Logger {
+	mountedMutex.Lock()
+	defer mountedMutex.Unlock()
+	return logger.Default().With("mount_id", me.info.ID, "mount_point", me.info.MountPoint, "type", me.info.Type)
+}
+
+// mountAuditor ... Entries from a mount say which mount they came from, nil when auditing is off
+func mountAuditor(me *mountEntry) *audit.Auditor {
+	mountedMutex.Lock()
+	defer mountedMutex.Unlock()
+	return audit.Default().With(me.info.ID, me.info.MountPoint, me.info.Type)
+}
+
+// releaseQOS ... Drop the QOS rules the mount added, only the first call does anything
+func releaseQOS(me *mountEntry) {
+	mountedMutex.Lock()
+	keys, ioMap := me.qosKeys, me.ioMap
+	me.qosKeys = nil
+	mountedMutex.Unlock()
+	for _, key := range keys {
+		if _, exists := ioMap.Get(key); exists {
+			ioMap.Remove(key)
+		}
+	}
+}
+
+// serve ... Run the blocking serve call. When it returns without being unmounted by shylock the mount
+// is kept in the mount list as failed or exited, its QOS rules are dropped and its mount point can
+// be mounted again
+func serve(me *mountEntry, serveFunc func() error) {
+	l := mountLogger(me)
+	go func() {
+		err := serveFunc()
+		mountedMutex.Lock()
+		unmounting := me.info.State == StateUnmounting
+		if !unmounting {
+			me.info.Ready = false
+			if err != nil {
+				me.info.State = StateFailed
+				me.info.Error = err.Error()
+			} else {
+				me.info.State = StateExited
+				me.info.Error = ErrExited.Error()
+			}
+		}
+		mountedMutex.Unlock()
+		switch {
+		case err != nil:
+			l.Error("Failed to mount", "error", err)
+		case !unmounting:
+			l.Warn("Unmounted outside of shylock")
+		}
+		readyErr := err
+		if readyErr == nil && !unmounting {
+			readyErr = ErrExited
+		}
+		markReady(me, readyErr)
+		if !unmounting {
+			releaseQOS(me)
+		}
+	}()
+}
+
+// watchReady ... Mark the mount ready once the device says the kernel mounted it
+func watchReady(me *mountEntry, device interface{}, callback func(MountInfo, error)) {
+	mountedMutex.Lock()
+	me.onReady = callback
+	mountedMutex.Unlock()
+	if r, ok := device.(readier); ok {
+		r.OnReady(func(err error) {
+			markReady(me, err)
+		})
+		return
+	}
+	markReady(me, nil)
+}
+
+// markReady ... Only the first call does anything
+func markReady(me *mountEntry, err error) {
+	mountedMutex.Lock()
+	select {
+	case <-me.ready:
+		mountedMutex.Unlock()
+		return
+	default:
+	}
+	me.readyErr = err
+	if err != nil {
+		if me.info.State != StateExited {
+			me.info.State = StateFailed
+		}
+		me.info.Error = err.Error()
+	} else {
+		me.info.Ready = me.info.State == StateMounted
+	}
+	close(me.ready)
+	info, callback := me.info, me.onReady
+	mountedMutex.Unlock()
+	if callback != nil {
+		callback(info, err)
+	}
+}
+
 // mountFuse ... binds together using fuse and whatever the custom interface
 // decoupling fuse and the custom systems
 func MountFuse(mountPath, fsType string, config []byte) error {
-	device, err := api.MountSimpleDevice(fsType, mountPath, config)
+	return MountFuseChain(mountPath, fsType, config, nil, nil)
+}
+
+// MountFuseChain ... Same as MountFuse with a middleware chain around the device, the
+// first wrapper in the chain sees every call first. Reads and writes are limited by ioMap when it isn't nil
+func MountFuseChain(mountPath, fsType string, config []byte, chain []api.WrapperConfig, ioMap *qos.IOMap) error {
+	return MountFuseOptions(mountPath, fsType, config, chain, ioMap, MountOptions{})
+}
+
+// MountFuseOptions ... Same as MountFuseChain with mount options
+func MountFuseOptions(mountPath, fsType string, config []byte, chain []api.WrapperConfig, ioMap *qos.IOMap, opts MountOptions) error {
+	_, err := mountFuseChain(mountPath, fsType, config, chain, ioMap, opts)
+	return err
+}
+
+// mountFuseChain ... Mount and return the id the mount is tracked with
+func mountFuseChain(mountPath, fsType string, config []byte, chain []api.WrapperConfig, ioMap *qos.IOMap, opts MountOptions) (*mountEntry, error) {
+	me, err := track(mountPath, fsType)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if api.IsNative(fsType) {
+		err = mountNative(me, mountPath, fsType, config, chain, ioMap, opts)
+	} else {
+		err = mountSimple(me, mountPath, fsType, config, chain, ioMap, opts)
+	}
+	if err != nil {
+		untrack(me)
+		return nil, err
 	}
+	return me, nil
+}
 
-	// Append to the list of devices
+// mountSimple ... Serve an api device through buse
+func mountSimple(me *mountEntry, mountPath, fsType string, config []byte, chain []api.WrapperConfig, ioMap *qos.IOMap, opts MountOptions) error {
+	device, err := api.MountWrappedSimpleDevice(fsType, mountPath, config, chain)
+	if err != nil {
+		return err
+	}
 	fuseDevice, err := buse.NewFuseSimpleDevice(mountPath, device)
 	if err != nil {
 		// Try to exit cleanly
 		device.Unmount()
 		return err
 	}
-	go func() {
-		err = fuseDevice.Mount(mountPath, nil)
+	fuseDevice.Kernel = opts.kernel(fsType)
+	if opts.UID != nil {
+		fuseDevice.Uid = *opts.UID
+	}
+	if opts.GID != nil {
+		fuseDevice.Gid = *opts.GID
+	}
+	if opts.Umask != nil {
+		fuseDevice.Umask = *opts.Umask
+	}
+	fuseDevice.SetLogger(mountLogger(me))
+	fuseDevice.SetAuditor(mountAuditor(me))
+	mountedMutex.Lock()
+	me.device = fuseDevice
+	mountedMutex.Unlock()
+	watchReady(me, fuseDevice, opts.Ready)
+	serve(me, func() error {
+		return fuseDevice.Mount(mountPath, ioMap)
+	})
+	return nil
+}
+
+// mountNative ... Serve a device that has its own file system, only wrappers with the native
+// capability can be applied to it
+func mountNative(me *mountEntry, mountPath, fsType string, config []byte, chain []api.WrapperConfig, ioMap *qos.IOMap, opts MountOptions) error {
+	if opts.UID != nil || opts.GID != nil || opts.Umask != nil {
+		return fmt.Errorf("uid, gid and umask can't be applied to native file system type %s", fsType)
+	}
+	if err := api.ValidateChain(fsType, chain); err != nil {
+		return err
+	}
+	device, err := api.NewNativeDevice(fsType, mountPath, config)
+	if err != nil {
+		return err
+	}
+	if len(chain) > 0 {
+		mw, ok := device.(middlewarer)
+		if !ok {
+			device.Unmount()
+			return fmt.Errorf("Wrappers can't be applied to native file system type %s", fsType)
+		}
+		mws, err := api.WrapNative(chain)
 		if err != nil {
-			log.Panicf("Failed to mount %s\n", mountPath)
+			device.Unmount()
+			return err
 		}
-		// Start tracking list of devices
-		mountedDevices = append(mountedDevices, device)
-		mountedFuse = append(mountedFuse, fuseDevice)
-
-	}()
+		mw.SetMiddleware(mws)
+	}
+	if im, ok := device.(ioMapper); ok && ioMap != nil {
+		im.SetIOMap(ioMap)
+	}
+	if ko, ok := device.(kernelOptioner); ok {
+		ko.SetKernelOptions(opts.kernel(fsType))
+	}
+	logger.Inject(device, mountLogger(me))
+	audit.Inject(device, mountAuditor(me))
+	mountedMutex.Lock()
+	me.device = device
+	mountedMutex.Unlock()
+	watchReady(me, device, opts.Ready)
+	serve(me, func() error {
+		return device.Serve(mountPath)
+	})
 	return nil
 }
 
-func Exit() {
-	for _, mf := range mountedFuse {
-		mf.Unmount()
+// Mounts ... Everything this process has mounted ordered by id
+func Mounts() []MountInfo {
+	mountedMutex.Lock()
+	infos := make([]MountInfo, 0, len(mounted))
+	for _, me := range mounted {
+		info := me.info
+		info.Uptime = time.Since(info.MountedAt).Seconds()
+		infos = append(infos, info)
 	}
+	mountedMutex.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		a, _ := strconv.Atoi(infos[i].ID)
+		b, _ := strconv.Atoi(infos[j].ID)
+		return a < b
+	})
+	return infos
 }
 
-// TODO: Probably would be good to implement someday.
+// LookupMount ... A single mount by id
+func LookupMount(id string) (MountInfo, bool) {
+	mountedMutex.Lock()
+	defer mountedMutex.Unlock()
+	me, exists := mounted[id]
+	if !exists {
+		return MountInfo{}, false
+	}
+	info := me.info
+	info.Uptime = time.Since(info.MountedAt).Seconds()
+	return info, true
+}
+
+// snapshotter ... The device of a mount when it can take snapshots
+func snapshotter(id string) (api.Snapshotter, error) {
+	mountedMutex.Lock()
+	me, exists := mounted[id]
+	var device unmounter
+	if exists {
+		device = me.device
+	}
+	mountedMutex.Unlock()
+	if !exists {
+		return nil, ErrMountNotFound
+	}
+	fd, ok := device.(*buse.FuseSimpleDevice)
+	if !ok {
+		return nil, api.ErrNotSupported
+	}
+	s, ok := api.AsSnapshotter(fd.SimpleDevice)
+	if !ok {
+		return nil, api.ErrNotSupported
+	}
+	return s, nil
+}
+
+// SnapshotMount ... Write the whole state of a mounted device, api.ErrNotSupported when it can't
+func SnapshotMount(id string, w io.Writer) error {
+	s, err := snapshotter(id)
+	if err != nil {
+		return err
+	}
+	return s.Snapshot(w)
+}
+
+// RestoreMount ... Replace the whole state of a mounted device with a snapshot, files that are
+// open see the new contents
+func RestoreMount(id string, r io.Reader) error {
+	s, err := snapshotter(id)
+	if err != nil {
+		return err
+	}
+	return s.Restore(r)
+}
+
+// Unmount ... Unmount a single mount and drop the QOS rules that came with it. Requests in flight
+// get buse.DefaultShutdownTimeout to finish
+func Unmount(id string) error {
+	mountedMutex.Lock()
+	me, exists := mounted[id]
+	if !exists || me.info.State == StateUnmounting {
+		mountedMutex.Unlock()
+		return ErrMountNotFound
+	}
+	me.info.State = StateUnmounting
+	me.info.Ready = false
+	mountedMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), buse.DefaultShutdownTimeout)
+	defer cancel()
+	return unmount(ctx, me)
+}
+
+// unmount ... Stop serving, the mount is forgotten even when unmounting fails
+func unmount(ctx context.Context, me *mountEntry) error {
+	defer untrack(me)
+	releaseQOS(me)
+	mountedMutex.Lock()
+	device := me.device
+	mountedMutex.Unlock()
+	if device == nil {
+		return nil
+	}
+	if sd, ok := device.(shutdowner); ok {
+		return sd.Shutdown(ctx)
+	}
+	return device.Unmount()
+}
+
+// trackServer ... Stop the server on Exit
+func trackServer(c io.Closer) {
+	serversMutex.Lock()
+	servers = append(servers, c)
+	serversMutex.Unlock()
+}
+
+// Shutdown ... Stop the volume plugins so no new volumes are mounted, then unmount everything at
+// once. Each mount stops taking new requests and waits for the ones in flight until ctx is done
+// before its backend is flushed. buse.ErrDrainTimeout is returned when any mount was still
+// answering requests, its backend is flushed once they finish, otherwise the first error
+func Shutdown(ctx context.Context) error {
+	serversMutex.Lock()
+	closers := servers
+	servers = make([]io.Closer, 0)
+	serversMutex.Unlock()
+	for _, c := range closers {
+		c.Close()
+	}
+	mountedMutex.Lock()
+	entries := make([]*mountEntry, 0, len(mounted))
+	for _, me := range mounted {
+		if me.info.State != StateUnmounting {
+			me.info.State = StateUnmounting
+			me.info.Ready = false
+			entries = append(entries, me)
+		}
+	}
+	mountedMutex.Unlock()
+
+	errs := make(chan error, len(entries))
+	for _, me := range entries {
+		go func(me *mountEntry) {
+			errs <- unmount(ctx, me)
+		}(me)
+	}
+	var err error
+	for range entries {
+		uErr := <-errs
+		if uErr == nil {
+			continue
+		}
+		logger.Default().Warn("Failed to unmount cleanly", "error", uErr)
+		if err == nil || uErr == buse.ErrDrainTimeout {
+			err = uErr
+		}
+	}
+	return err
+}
+
+// Exit ... Shutdown waiting buse.DefaultShutdownTimeout for requests in flight
+func Exit() error {
+	ctx, cancel := context.WithTimeout(context.Background(), buse.DefaultShutdownTimeout)
+	defer cancel()
+	return Shutdown(ctx)
+}
+
+// MountDocker ... Serve the Docker volume plugin protocol on the unix socket at mountPath. Volumes are
+// mounted under DockerVolumeRoot with fsType and config unless the volume options say otherwise
 func MountDocker(mountPath, fsType string, config []byte) error {
-	return mountSystemNotSupported
+	return MountDockerPlugin(NewDockerPlugin(DockerVolumeRoot, fsType, config, qos.NewIOMap()), mountPath)
+}
+
+// MountDockerPlugin ... Same as MountDocker for a plugin that has already been set up
+func MountDockerPlugin(dp *DockerPlugin, socketPath string) error {
+	if err := dp.Listen(socketPath); err != nil {
+		return err
+	}
+	trackServer(dp)
+	return nil
 }
 
 func Mount(mountPoint, mountType, fsType string, config []byte) error {
 	switch mountType {
 	case FUSE:
-		MountFuse(mountPoint, fsType, config)
+		return MountFuse(mountPoint, fsType, config)
 	case DOCKER:
-		MountDocker(mountPoint, fsType, config)
+		return MountDocker(mountPoint, fsType, config)
+	case CSI:
+		return MountCSI(mountPoint, fsType, config)
 	default:
 		return errors.New(fmt.Sprintf("%s mount system not supported", mountType))
 	}
-	return nil
 }
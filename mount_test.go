@@ -0,0 +1,102 @@
+package shylock
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lateefj/shylock/buse"
+	"github.com/lateefj/shylock/qos"
+	"golang.org/x/net/context"
+)
+
+// drainDevice ... Finishes its requests in flight when released or gives up when ctx is done
+type drainDevice struct {
+	release chan struct{}
+}
+
+func (dd *drainDevice) Unmount() error {
+	return nil
+}
+
+func (dd *drainDevice) Shutdown(ctx context.Context) error {
+	select {
+	case <-dd.release:
+		return nil
+	case <-ctx.Done():
+		return buse.ErrDrainTimeout
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	done := &drainDevice{release: make(chan struct{})}
+	close(done.release)
+	stuck := &drainDevice{release: make(chan struct{})}
+	for i, dd := range []*drainDevice{done, stuck} {
+		me, err := track(fmt.Sprintf("/mnt/shutdown/%d", i), "LOOPBACK_KV")
+		if err != nil {
+			t.Fatal(err)
+		}
+		me.device = dd
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); err != buse.ErrDrainTimeout {
+		t.Errorf("Expected the stuck mount to time out however got %v", err)
+	}
+	if len(Mounts()) != 0 {
+		t.Errorf("Expected every mount to be gone however got %+v", Mounts())
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected nothing left to shut down however got %s", err)
+	}
+}
+
+func TestServeStoppedFreesMountPoint(t *testing.T) {
+	ioMap := qos.NewIOMap()
+	for _, serveErr := range []error{nil, fmt.Errorf("connection reset")} {
+		me, err := track("/mnt/stopped", "LOOPBACK_KV")
+		if err != nil {
+			t.Fatalf("Expected the mount point to be free however got %s", err)
+		}
+		ioMap.Add("/mnt/stopped/tenant", time.Second, 10, 10)
+		me.ioMap, me.qosKeys = ioMap, []string{"/mnt/stopped/tenant"}
+		if _, err := track("/mnt/stopped", "LOOPBACK_KV"); err != ErrMountPointInUse {
+			t.Errorf("Expected a served mount to keep its mount point however got %v", err)
+		}
+		stop := make(chan struct{})
+		serve(me, func() error {
+			<-stop
+			return serveErr
+		})
+		close(stop)
+		WaitReady(context.Background(), me.info.ID)
+
+		info, exists := LookupMount(me.info.ID)
+		expected := StateExited
+		if serveErr != nil {
+			expected = StateFailed
+		}
+		if !exists || info.State != expected || info.Ready || info.Error == "" {
+			t.Errorf("Expected the mount to be %s however got %+v", expected, info)
+		}
+		// The rules are dropped after the mount is marked
+		for i := 0; i < 100; i++ {
+			if _, exists := ioMap.Get("/mnt/stopped/tenant"); !exists {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if _, exists := ioMap.Get("/mnt/stopped/tenant"); exists {
+			t.Errorf("Expected the QOS rules of a stopped mount to be dropped")
+		}
+	}
+	me, err := track("/mnt/stopped", "LOOPBACK_KV")
+	if err != nil {
+		t.Fatalf("Expected the stopped mount to give up its mount point however got %s", err)
+	}
+	untrack(me)
+	if len(Mounts()) != 0 {
+		t.Errorf("Expected the stopped mounts to be replaced however got %+v", Mounts())
+	}
+}
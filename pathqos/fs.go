@@ -1,20 +1,27 @@
 package pathqos
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"sync"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/buse"
+	"github.com/lateefj/shylock/inode"
+	"github.com/lateefj/shylock/logger"
 	"github.com/lateefj/shylock/qos"
 	"golang.org/x/net/context"
 )
 
-func fileAttr(fi os.FileInfo, a *fuse.Attr) {
+func (sfs *SFS) fileAttr(path string, fi os.FileInfo, a *fuse.Attr) {
 
+	a.Inode = sfs.inode(path, fi)
 	a.Size = uint64(fi.Size())
 	a.Mode = fi.Mode()
 	a.Mtime = fi.ModTime()
@@ -24,13 +31,70 @@ func fileAttr(fi os.FileInfo, a *fuse.Attr) {
 
 // SFS Shylock File System
 type SFS struct {
-	Path  string
-	IOMap *qos.IOMap
+	Path   string
+	IOMap  *qos.IOMap
+	Inodes *inode.Table
+	// open ... Files that haven't been released so they can be synced on unmount
+	open  map[*SFile]bool
+	mutex sync.Mutex
+	// Log ... Requests are logged at debug
+	Log *logger.Logger
+	// Audit ... Records creates, writes and removes, nil records nothing
+	Audit *audit.Auditor
 }
 
 func NewSFS(path string, iocMap *qos.IOMap) *SFS {
 	//TODO: Read from configuration file
-	return &SFS{Path: path, IOMap: iocMap}
+	return &SFS{Path: path, IOMap: iocMap, Inodes: inode.NewTable(path), open: make(map[*SFile]bool), Log: logger.Default().With("dir", path)}
+}
+
+// SetLogger ... Log with the mount fields
+func (sfs *SFS) SetLogger(l *logger.Logger) {
+	sfs.Log = l.With("dir", sfs.Path)
+}
+
+// SetAuditor ... Record the mutating requests of the mount
+func (sfs *SFS) SetAuditor(a *audit.Auditor) {
+	sfs.Audit = a
+}
+
+// Health ... The directory with the actual files is still there
+func (sfs *SFS) Health(ctx context.Context) error {
+	fi, err := os.Stat(sfs.Path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", sfs.Path)
+	}
+	return nil
+}
+
+// Close ... Sync and close every file still open, called after the last request on unmount
+func (sfs *SFS) Close() error {
+	sfs.mutex.Lock()
+	open := sfs.open
+	sfs.open = make(map[*SFile]bool)
+	sfs.mutex.Unlock()
+	var err error
+	for sf := range open {
+		if sf.file == nil {
+			continue
+		}
+		sf.file.Sync()
+		if cErr := sf.file.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// inode ... Hard links share an inode since the table is keyed by the real device and inode
+func (sfs *SFS) inode(path string, fi os.FileInfo) uint64 {
+	if path == sfs.Path {
+		return inode.RootInode
+	}
+	return sfs.Inodes.Inode(inode.FileKey(path, fi))
 }
 
 func (sfs *SFS) Root() (fs.Node, error) {
@@ -47,7 +111,7 @@ type SDir struct {
 func (sd *SDir) File() (*os.File, error) {
 	f, err := os.Open(sd.Path)
 	if err != nil {
-		log.Printf("Failed in SDir.File: %s\n", err)
+		sd.SFS.Log.Warn("Failed to open directory", "path", sd.Path, "error", err)
 	}
 	return f, err
 }
@@ -78,7 +142,7 @@ func (sd *SDir) Attr(ctx context.Context, a *fuse.Attr) error {
 	if err != nil {
 		return err
 	}
-	fileAttr(fi, a)
+	sd.SFS.fileAttr(sd.Path, fi, a)
 	return nil
 }
 
@@ -93,9 +157,9 @@ func (sd *SDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		if isDir(req.Name) {
-			return &SDir{Path: path, IOMap: sd.IOMap}, nil
+			return &SDir{SFS: sd.SFS, Path: path, IOMap: sd.IOMap}, nil
 		} else {
-			return &SFile{Path: path}, nil
+			return &SFile{SFS: sd.SFS, Path: path}, nil
 		}
 	}
 	f, err := os.Open(path)
@@ -107,10 +171,11 @@ func (sd *SDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 	if err != nil {
 		return nil, err
 	}
+	resp.Generation = sd.SFS.Inodes.Lookup(inode.FileKey(path, stat)).Generation
 	if stat.IsDir() {
-		return &SDir{Path: path, IOMap: sd.IOMap}, nil
+		return &SDir{SFS: sd.SFS, Path: path, IOMap: sd.IOMap}, nil
 	}
-	return &SFile{Path: path, IOMap: sd.IOMap}, nil
+	return &SFile{SFS: sd.SFS, Path: path, IOMap: sd.IOMap}, nil
 }
 
 // Register callback
@@ -132,6 +197,7 @@ func (sd *SDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			de.Type = fuse.DT_Dir
 		}
 		de.Name = name
+		de.Inode = sd.SFS.inode(sd.Path+"/"+name, fileInfo)
 		res = append(res, de)
 	}
 	return res, nil
@@ -140,30 +206,45 @@ func (sd *SDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 // Register callback
 var _ = fs.HandleReadDirAller(&SDir{})
 
-func (sd *SDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+func (sd *SDir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
 
 	path := sd.Path + "/" + req.Name
-	fmt.Printf("Removing file %s\n", req.Name)
+	sd.SFS.Log.Debug("Fuse request", "op", "remove", "path", path)
+	defer sd.SFS.Audit.Op(audit.Remove, req.Header, path, 0, &err)
+	fi, statErr := os.Lstat(path)
 	if req.Dir {
-		return os.RemoveAll(path)
+		err = os.RemoveAll(path)
 	} else {
-		return os.Remove(path)
+		err = os.Remove(path)
+	}
+	if err == nil && statErr == nil {
+		sd.SFS.Inodes.ForgetFile(path, fi)
 	}
+	return err
 }
 
 var _ = fs.NodeRemover(&SDir{})
 
-func (sd *SDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	fmt.Printf("Creating a file %s\n", req.Name)
+func (sd *SDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
 	path := sd.Path + "/" + req.Name
+	sd.SFS.Log.Debug("Fuse request", "op", "create", "path", path)
+	defer sd.SFS.Audit.Op(audit.Create, req.Header, path, 0, &err)
 
-	f := &SFile{Path: path, IOMap: sd.IOMap}
+	f := &SFile{SFS: sd.SFS, Path: path, IOMap: sd.IOMap, ioc: sd.IOMap.FindPath(path)}
+	f.file, err = os.OpenFile(path, int(req.Flags)|os.O_CREATE, req.Mode.Perm())
+	if err != nil {
+		return nil, nil, err
+	}
+	sd.SFS.mutex.Lock()
+	sd.SFS.open[f] = true
+	sd.SFS.mutex.Unlock()
 	return f, f, nil
 }
 
 var _ = fs.NodeCreater(&SDir{})
 
 type SFile struct {
+	SFS   *SFS
 	Path  string
 	IOMap *qos.IOMap
 	ioc   *qos.IOC
@@ -178,7 +259,7 @@ func (sf *SFile) openFile(flags fuse.OpenFlags) (bool, error) {
 	if sf.ioc == nil {
 		sf.ioc = sf.IOMap.FindPath(sf.Path)
 		if sf.ioc == nil {
-			fmt.Printf("Failed to find path %s\n", sf.Path)
+			sf.SFS.Log.Debug("No QOS limits for path", "path", sf.Path)
 		}
 	}
 	if sf.file == nil {
@@ -203,7 +284,7 @@ func (sf *SFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	if err != nil {
 		return err
 	}
-	fileAttr(info, a)
+	sf.SFS.fileAttr(sf.Path, info, a)
 	return nil
 }
 
@@ -216,15 +297,23 @@ func (sf *SFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Ope
 	}
 	// If new file set mods now and return
 	if !exists {
-		fmt.Println("Having to create file that doesn't exist")
+		sf.SFS.Log.Debug("Creating file that doesn't exist", "path", sf.Path)
 		sf.file, err = os.Create(sf.Path)
 	}
+	if err == nil {
+		sf.SFS.mutex.Lock()
+		sf.SFS.open[sf] = true
+		sf.SFS.mutex.Unlock()
+	}
 	return sf, err
 }
 
 var _ = fs.NodeOpener(&SFile{})
 
 func (sfh *SFile) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	sfh.SFS.mutex.Lock()
+	delete(sfh.SFS.open, sfh)
+	sfh.SFS.mutex.Unlock()
 	return sfh.file.Close()
 }
 
@@ -252,7 +341,8 @@ func (sfh *SFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.Re
 
 var _ = fs.HandleReader(&SFile{})
 
-func (sf *SFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+func (sf *SFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer sf.SFS.Audit.Op(audit.Write, req.Header, sf.Path, int64(len(req.Data)), &err)
 	if sf.ioc != nil {
 		size := len(req.Data)
 		stream := make(chan uint64, 1)
@@ -285,35 +375,52 @@ func (sfh *SFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 
 var _ = fs.HandleFlusher(&SFile{})
 
-var (
-	iocDir     string
-	configFile string
+const (
+	// FSPathQOS ... Registered type for a local directory with QOS limits
+	FSPathQOS = "PATHQOS"
 )
 
-func Mount(mountPoint string, ioMap *qos.IOMap) error {
-	iocDir = os.Getenv("PATHQOS_DIR")
-	if iocDir == "" {
-		log.Fatalf("PATHQOS_DIR (path to the actual files) is a required environment variable")
-	}
-	c, err := fuse.Mount(mountPoint)
-	if err != nil {
-		return err
+func init() {
+	api.RegisterNativeDeviceType(api.Registered{
+		FSType:      FSPathQOS,
+		Description: "Local directory with read and write limits for each path",
+		Schema: []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"required": ["dir"],
+	"properties": {
+		"dir": {"type": "string", "minLength": 1, "description": "Directory with the actual files"}
 	}
-	defer c.Close()
+}`),
+	}, NewDevice)
+}
 
-	filesys := NewSFS(iocDir, ioMap)
+type pathQOSConfig struct {
+	Dir string `json:"dir"`
+}
 
-	if err := fs.Serve(c, filesys); err != nil {
-		log.Printf("Failed to server because %s", err)
+// Device ... Serves the directory, limits come from the IO map which is keyed by the real paths
+type Device struct {
+	buse.Native
+	sfs *SFS
+}
 
-		return err
+// NewDevice ... Serve a local directory at the mount point
+func NewDevice(mountPoint string, config []byte) (api.NativeDevice, error) {
+	conf := &pathQOSConfig{}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, conf); err != nil {
+			return nil, err
+		}
 	}
-
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		log.Printf("Failed to mount because %s", err)
-		return err
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("%s needs the dir with the actual files", FSPathQOS)
 	}
-	return nil
+	sfs := NewSFS(conf.Dir, qos.NewIOMap())
+	return &Device{Native: buse.Native{FS: sfs}, sfs: sfs}, nil
+}
+
+// SetIOMap ... Limits to apply, must be called before Serve
+func (d *Device) SetIOMap(ioMap *qos.IOMap) {
+	d.sfs.IOMap = ioMap
 }
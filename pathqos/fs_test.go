@@ -1,11 +1,17 @@
 package pathqos
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 
-	//"golang.org/x/net/context"
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
 
+	"github.com/lateefj/shylock/audit"
 	"github.com/lateefj/shylock/qos"
 )
 
@@ -18,3 +24,71 @@ func TestSFSRoot(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSFSHardLinkInode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/orig", []byte("data"), 0600)
+	if err := os.Link(dir+"/orig", dir+"/link"); err != nil {
+		t.Skipf("Hard links not supported %s", err)
+	}
+	sfs := NewSFS(dir, qos.NewIOMap())
+	ctx := context.Background()
+	orig, link := &fuse.Attr{}, &fuse.Attr{}
+	(&SFile{SFS: sfs, Path: dir + "/orig"}).Attr(ctx, orig)
+	(&SFile{SFS: sfs, Path: dir + "/link"}).Attr(ctx, link)
+	if orig.Inode == 0 || orig.Inode != link.Inode {
+		t.Errorf("Expected hard links to share an inode however got %d and %d", orig.Inode, link.Inode)
+	}
+	root, _ := sfs.Root()
+	dirents, err := root.(*SDir).ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, de := range dirents {
+		if de.Inode != orig.Inode {
+			t.Errorf("Expected dirent %s to have inode %d however got %d", de.Name, orig.Inode, de.Inode)
+		}
+	}
+}
+
+// auditBuffer ... Audit entries in memory
+type auditBuffer struct {
+	bytes.Buffer
+}
+
+func (ab *auditBuffer) Close() error {
+	return nil
+}
+
+func TestSFSCreateAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sfs := NewSFS(dir, qos.NewIOMap())
+	buf := &auditBuffer{}
+	sfs.SetAuditor(audit.NewWriter(buf, nil, nil))
+	ctx := context.Background()
+	sd := &SDir{SFS: sfs, Path: dir, IOMap: sfs.IOMap}
+	_, h, err := sd.Create(ctx, &fuse.CreateRequest{Name: "new", Flags: fuse.OpenReadWrite, Mode: 0640}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Failed to create %s", err)
+	}
+	h.(*SFile).Release(ctx, &fuse.ReleaseRequest{})
+	if fi, err := os.Stat(dir + "/new"); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected the file to be created with its mode however got %v %v", fi, err)
+	}
+	missing := &SDir{SFS: sfs, Path: dir + "/missing", IOMap: sfs.IOMap}
+	if _, _, err := missing.Create(ctx, &fuse.CreateRequest{Name: "new", Flags: fuse.OpenReadWrite, Mode: 0640}, &fuse.CreateResponse{}); err == nil {
+		t.Errorf("Expected create in a missing directory to fail")
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"result":"ok"`) || !strings.Contains(lines[1], `"path":"`+dir+`/missing/new"`) || !strings.Contains(lines[1], `"result":"error"`) {
+		t.Errorf("Expected both creates to be audited with their result however got %s", buf.String())
+	}
+}
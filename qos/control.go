@@ -27,6 +27,13 @@ func (bl *ByteLimit) Reset() {
 	bl.Bytes = bl.Limit
 }
 
+// setLimit ... Reset reads the limit under the byte limit lock
+func (bl *ByteLimit) setLimit(limit uint64) {
+	bl.Mutex.Lock()
+	defer bl.Mutex.Unlock()
+	bl.Limit = limit
+}
+
 // Available ... Returns the amoutn of bytes that are still available
 func (bl *ByteLimit) Available() uint64 {
 	defer bl.Mutex.RUnlock()
@@ -96,8 +103,15 @@ func (ioc *IOC) Update(duration time.Duration, read, write uint64) {
 	ioc.Mutex.Lock()
 	defer ioc.Mutex.Unlock()
 	ioc.duration = duration
-	ioc.readLimit.Limit = read
-	ioc.writeLimit.Limit = write
+	ioc.readLimit.setLimit(read)
+	ioc.writeLimit.setLimit(write)
+}
+
+// Limits ... Bytes that can be read and written each duration
+func (ioc *IOC) Limits() (uint64, uint64) {
+	ioc.Mutex.RLock()
+	defer ioc.Mutex.RUnlock()
+	return ioc.readLimit.Limit, ioc.writeLimit.Limit
 }
 
 // Checkout ... quick way to get a stream of bytes
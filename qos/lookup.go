@@ -2,15 +2,18 @@ package qos
 
 import (
 	"encoding/csv"
-	"fmt"
 	"io"
-	"log"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/lateefj/shylock/logger"
 )
 
+// Log ... Where the qos package writes
+var Log = logger.Default()
+
 // LoadIOCConfig ... Takes an io.Reader expecting csv file and returns a *IOMap
 func LoadIOCConfig(f io.Reader) *IOMap {
 	reader := csv.NewReader(f)
@@ -22,12 +25,12 @@ func LoadIOCConfig(f io.Reader) *IOMap {
 			break
 		}
 		if err != nil {
-			log.Fatalf("Error parsing io.Reader with error: %s", err)
+			Log.Fatal("Error parsing qos config", "error", err)
 		}
 		if len(record) < 3 { // Skip empty or incomplete lines
 			continue
 		}
-		fmt.Printf("Record is %v\n", record)
+		Log.Debug("QoS record", "record", record)
 
 		path := strings.TrimSpace(record[0])
 		readConf := record[1]
@@ -35,15 +38,15 @@ func LoadIOCConfig(f io.Reader) *IOMap {
 
 		read, err := strconv.ParseUint(readConf, 10, 64)
 		if err != nil {
-			log.Fatalf("Error parsing read limit %s", readConf)
+			Log.Fatal("Error parsing read limit", "path", record[0], "read", readConf)
 		}
 		write, err := strconv.ParseUint(writeConf, 10, 64)
 		if err != nil {
-			log.Fatalf("Error parsing write limit %s", writeConf)
+			Log.Fatal("Error parsing write limit", "path", record[0], "write", writeConf)
 		}
 
 		mapping.Add(path, 1*time.Second, read, write)
-		fmt.Printf("Path %s read %d write %d\n", path, read, write)
+		Log.Debug("QoS limit", "path", path, "read", read, "write", write)
 	}
 	return mapping
 
@@ -70,6 +73,20 @@ func (iom *IOMap) Add(key string, duration time.Duration, read, write uint64) {
 	go c.Start()
 }
 
+// AddNew ... Add a IOC only when the key isn't in the map yet, false when it already was
+func (iom *IOMap) AddNew(key string, duration time.Duration, read, write uint64) bool {
+	iom.Mutex.Lock()
+	if _, exists := iom.Map[key]; exists {
+		iom.Mutex.Unlock()
+		return false
+	}
+	c := NewIOC(duration, read, write)
+	iom.Map[key] = c
+	iom.Mutex.Unlock()
+	go c.Start()
+	return true
+}
+
 // Remove ... Remove a key
 func (iom *IOMap) Remove(key string) {
 	// Locking only around map modification
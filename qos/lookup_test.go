@@ -55,6 +55,21 @@ func TestIOMapCrud(t *testing.T) {
 	}
 
 }
+func TestIOMapAddNew(t *testing.T) {
+	iom := NewIOMap()
+	if !iom.AddNew("foo", time.Second, 1, 1) {
+		t.Fatalf("Expected a missing key to be added")
+	}
+	defer iom.Remove("foo")
+	if iom.AddNew("foo", time.Second, 2, 2) {
+		t.Errorf("Expected an existing key to be left alone")
+	}
+	c, _ := iom.Get("foo")
+	if read, write := c.Limits(); read != 1 || write != 1 {
+		t.Errorf("Expected the first limits to stay however got %d %d", read, write)
+	}
+}
+
 func TestIOMapFindPath(t *testing.T) {
 
 	iom := IOMap{Map: make(map[string]*IOC), Mutex: sync.RWMutex{}}
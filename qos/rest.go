@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"time"
 )
 
@@ -36,7 +37,8 @@ func NewRest(m *IOMap) *Rest {
 }
 
 func (r *Rest) handleGet(key string, ioc *IOC, w http.ResponseWriter) {
-	jioc := &jsonIOC{Key: key, ReadLimit: ioc.readLimit.Limit, WriteLimit: ioc.writeLimit.Limit}
+	read, write := ioc.Limits()
+	jioc := &jsonIOC{Key: key, ReadLimit: read, WriteLimit: write}
 	bits, err := json.Marshal(jioc)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -52,6 +54,7 @@ func (r *Rest) updateIOC(key string, ioc *IOC, req *http.Request, w http.Respons
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Unmarshal error: %s", err.Error())
+		return
 	}
 	r.iom.Update(key, 1*time.Second, tmp.ReadLimit, tmp.WriteLimit)
 	w.WriteHeader(http.StatusOK)
@@ -61,22 +64,65 @@ func (r *Rest) addIOC(key string, req *http.Request, w http.ResponseWriter) {
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Unmarshal error: %s", err.Error())
+		return
+	}
+	// Paths keep their leading slash in the body
+	if tmp.Key != "" {
+		key = tmp.Key
 	}
 	r.iom.Add(key, 1*time.Second, tmp.ReadLimit, tmp.WriteLimit)
 	w.WriteHeader(http.StatusOK)
 }
 
-// Default ... Default handler for a mounted system
+// handleList ... Every key in the map
+func (r *Rest) handleList(w http.ResponseWriter) {
+	r.iom.Mutex.RLock()
+	keys := make([]string, 0, len(r.iom.Map))
+	for k := range r.iom.Map {
+		keys = append(keys, k)
+	}
+	r.iom.Mutex.RUnlock()
+	sort.Strings(keys)
+	list := make([]*jsonIOC, 0, len(keys))
+	for _, k := range keys {
+		if ioc, exists := r.iom.Get(k); exists {
+			read, write := ioc.Limits()
+			list = append(list, &jsonIOC{Key: k, ReadLimit: read, WriteLimit: write})
+		}
+	}
+	bits, err := json.Marshal(list)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error %s", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bits)
+}
+
+// Default ... Default handler for a mounted system, a GET without a key lists every key
 func (r *Rest) Default(w http.ResponseWriter, req *http.Request) {
 
 	key := req.URL.Path[len("/key/"):]
+	if key == "" && req.Method == http.MethodGet {
+		r.handleList(w)
+		return
+	}
 	var ioc *IOC
 	exists := false
 	if req.Method != http.MethodPost {
 		ioc, exists = r.iom.Get(key)
+		if !exists {
+			// Path keys have a leading slash that can't be in the url
+			ioc, exists = r.iom.Get("/" + key)
+			if exists {
+				key = "/" + key
+			}
+		}
 		if !exists {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintf(w, "could not find key %s", key)
+			return
 		}
 	}
 
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/lateefj/mctest"
 )
@@ -59,3 +60,60 @@ func TestHandleGetDeletePutPost(t *testing.T) {
 	}
 
 }
+
+func TestListAndPathKeys(t *testing.T) {
+	iom := NewIOMap()
+	rest := NewRest(iom)
+	bits, _ := json.Marshal(&jsonIOC{Key: "/mnt/kv/", ReadLimit: 2, WriteLimit: 3})
+	req, _ := http.NewRequest(http.MethodPost, "/key/mnt/kv/", ioutil.NopCloser(bytes.NewReader(bits)))
+	rest.Default(mctest.NewMockTestResponse(t), req)
+	if _, exists := iom.Get("/mnt/kv/"); !exists {
+		t.Fatalf("Expected the key from the body to keep its leading slash")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/key/", nil)
+	resp := mctest.NewMockTestResponse(t)
+	rest.Default(resp, req)
+	if !resp.AssertCode(http.StatusOK) {
+		t.Fatal("Status code was not OK")
+	}
+	if !resp.AssertJson(&[]*jsonIOC{}, &[]*jsonIOC{{Key: "/mnt/kv/", ReadLimit: 2, WriteLimit: 3}}) {
+		t.Fatalf("Expected a list of keys however got %s", resp.String())
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, "/key/mnt/kv/", nil)
+	rest.Default(mctest.NewMockTestResponse(t), req)
+	if _, exists := iom.Get("/mnt/kv/"); exists {
+		t.Fatalf("Expected the key to be removed without the leading slash in the url")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/key/mnt/kv/", nil)
+	resp = mctest.NewMockTestResponse(t)
+	rest.Default(resp, req)
+	if !resp.AssertCode(http.StatusNotFound) {
+		t.Fatal("Expected a removed key to be not found")
+	}
+}
+
+func TestListWhileUpdating(t *testing.T) {
+	iom := NewIOMap()
+	iom.Add("/mnt/kv/", time.Second, 1, 1)
+	ioc, _ := iom.Get("/mnt/kv/")
+	done := make(chan bool)
+	go func() {
+		for i := uint64(0); i < 100; i++ {
+			ioc.Update(time.Second, i, i)
+			ioc.reset()
+		}
+		close(done)
+	}()
+	rest := NewRest(iom)
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/key/", nil)
+		rest.Default(mctest.NewMockTestResponse(t), req)
+	}
+	<-done
+	if read, write := ioc.Limits(); read != 99 || write != 99 {
+		t.Errorf("Expected the last update however got %d %d", read, write)
+	}
+}
@@ -3,17 +3,19 @@ package redisfs
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
-	"strconv"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/go-redis/redis"
-	"github.com/lateefj/shylock/qos"
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/audit"
+	"github.com/lateefj/shylock/buse"
 	"golang.org/x/net/context"
 )
 
@@ -24,7 +26,6 @@ const (
 
 var (
 	redisPathRegex = regexp.MustCompile("/(?P<operation>.*)/(?P<topic>.*)/(?P<name>.*)")
-	fuseConn       *fuse.Conn
 )
 
 func parsePath(path string) (string, string, string, error) {
@@ -47,6 +48,8 @@ type RFS struct {
 	Path string
 	Host string
 	Opts *redis.Options
+	// Audit ... Records writes and refused removes and mkdirs, nil records nothing
+	Audit *audit.Auditor
 }
 
 // NewRFS ... create a RFS
@@ -54,6 +57,18 @@ func NewRFS(path string, opts *redis.Options) *RFS {
 	return &RFS{Path: path, Opts: opts}
 }
 
+// SetAuditor ... Record the mutating requests of the mount
+func (rfs *RFS) SetAuditor(a *audit.Auditor) {
+	rfs.Audit = a
+}
+
+// Health ... Ping the server
+func (rfs *RFS) Health(ctx context.Context) error {
+	c := redis.NewClient(rfs.Opts).WithContext(ctx)
+	defer c.Close()
+	return c.Ping().Err()
+}
+
 // Root ... root for filesystem
 func (rfs *RFS) Root() (fs.Node, error) {
 	return &RDir{RFS: rfs, Path: rfs.Path}, nil
@@ -112,7 +127,7 @@ func (rd *RDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 		operation, topic, name, _ := parsePath(path[len(rd.RFS.Path):])
 		switch operation {
 		case "pubsub":
-			return &RedisPipe{Topic: topic, FileName: name, Opts: rd.RFS.Opts}, nil
+			return &RedisPipe{Path: path, Topic: topic, FileName: name, Opts: rd.RFS.Opts, Audit: rd.RFS.Audit}, nil
 		}
 
 	}
@@ -122,14 +137,32 @@ func (rd *RDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 // Register callback
 var _ fs.NodeRequestLookuper = (*RDir)(nil)
 
+// Remove ... Channels can't be removed through the mount, the attempt is still audited
+func (rd *RDir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer rd.RFS.Audit.Op(audit.Remove, req.Header, rd.Path+"/"+req.Name, 0, &err)
+	return fuse.Errno(syscall.ENOTSUP)
+}
+
+var _ fs.NodeRemover = (*RDir)(nil)
+
+// Mkdir ... Every path already looks like a directory, the attempt is still audited
+func (rd *RDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	defer rd.RFS.Audit.Op(audit.Mkdir, req.Header, rd.Path+"/"+req.Name, 0, &err)
+	return nil, fuse.Errno(syscall.ENOTSUP)
+}
+
+var _ fs.NodeMkdirer = (*RDir)(nil)
+
 // RedisPipe ... redis pipe like file
 type RedisPipe struct {
+	Path     string
 	FileName string
 	DB       string
 	Topic    string
 	Opts     *redis.Options
 	Client   *redis.Client
 	PubSub   *redis.PubSub
+	Audit    *audit.Auditor
 }
 
 // Attr ... hmmm
@@ -199,8 +232,8 @@ func (rp *RedisPipe) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse
 var _ = fs.HandleReader(&RedisPipe{})
 
 // Write ... Write a message to the PubSub
-func (rp *RedisPipe) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	var err error
+func (rp *RedisPipe) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer rp.Audit.Op(audit.Write, req.Header, rp.Path, int64(len(req.Data)), &err)
 	if rp.Client == nil {
 		rp.subscribe()
 	}
@@ -231,50 +264,46 @@ func (rp *RedisPipe) Write(ctx context.Context, req *fuse.WriteRequest, resp *fu
 
 var _ = fs.HandleWriter(&RedisPipe{})
 
-// Mount ... Place to mount etcd
-func Mount(mountPoint string, ioMap *qos.IOMap) error {
-
-	host := os.Getenv("REDIS_HOST")
-	if host == "" {
-		host = "localhost:6379"
-	}
-	password := os.Getenv("REDIS_PASSWORD")
-	var err error
-	db := 0
-	dbEnv := os.Getenv("REDIS_DB")
-	if dbEnv != "" {
-		db, err = strconv.Atoi(dbEnv)
-		if err != nil {
-			log.Fatalf("Unable to parse REDIS_DB %s\n", dbEnv)
-		}
-	}
-	opts := &redis.Options{
-		Addr:     host,
-		Password: password,
-		DB:       db,
-	}
+const (
+	// FSRedis ... Registered type for redis pub / sub
+	FSRedis = "REDIS"
+)
 
-	fuseConn, err = fuse.Mount(mountPoint)
-	if err != nil {
-		return err
+func init() {
+	api.RegisterNativeDeviceType(api.Registered{
+		FSType:      FSRedis,
+		Description: "Redis pub / sub channels as files at /operation/topic/name",
+		Schema: []byte(`{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"host": {"type": "string", "description": "Redis server, defaults to localhost:6379"},
+		"password": {"type": "string"},
+		"db": {"type": "integer", "minimum": 0}
 	}
-	defer fuseConn.Close()
+}`),
+		Capabilities: []api.Capability{api.CapStreaming},
+	}, NewDevice)
+}
 
-	filesys := NewRFS(mountPoint, opts)
+type redisConfig struct {
+	Host     string `json:"host"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+}
 
-	err = fs.Serve(fuseConn, filesys)
-	if err != nil {
-		return err
+// NewDevice ... Serve redis at the mount point
+func NewDevice(mountPoint string, config []byte) (api.NativeDevice, error) {
+	conf := &redisConfig{Host: "localhost:6379"}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, conf); err != nil {
+			return nil, err
+		}
 	}
-	// check if the mount process has an error to report
-	<-fuseConn.Ready
-	if err := fuseConn.MountError; err != nil {
-		log.Printf("Failed to mount because %s", err)
+	opts := &redis.Options{
+		Addr:     conf.Host,
+		Password: conf.Password,
+		DB:       conf.DB,
 	}
-	return err
-}
-
-// Exit ... Exit hook
-func Exit() error {
-	return fuseConn.Close()
+	return &buse.Native{FS: NewRFS(mountPoint, opts)}, nil
 }
@@ -0,0 +1,170 @@
+package shylock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/qos"
+)
+
+const (
+	snapshotSuffix = "/snapshot"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bits, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bits)
+}
+
+// MountsRest ... Mount and unmount backends while the process is running
+type MountsRest struct {
+	IOMap *qos.IOMap
+}
+
+// NewMountsRest ... QOS rules posted with a mount are added to iom
+func NewMountsRest(iom *qos.IOMap) *MountsRest {
+	return &MountsRest{IOMap: iom}
+}
+
+// Default ... GET /mounts lists every mount, POST /mounts mounts the MountConfig in the body,
+// GET /mounts/{id} shows one mount and DELETE /mounts/{id} unmounts it. GET /mounts/{id}/snapshot
+// saves the state of the device and PUT /mounts/{id}/snapshot restores it
+func (mr *MountsRest) Default(w http.ResponseWriter, req *http.Request) {
+	id := ""
+	if len(req.URL.Path) > len("/mounts/") {
+		id = req.URL.Path[len("/mounts/"):]
+	}
+	if strings.HasSuffix(id, snapshotSuffix) {
+		mr.snapshot(w, req, strings.TrimSuffix(id, snapshotSuffix))
+		return
+	}
+	if id == "" {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, Mounts())
+		case http.MethodPost:
+			mr.mount(w, req)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		info, exists := LookupMount(id)
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "could not find mount %s", id)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case http.MethodDelete:
+		err := Unmount(id)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrMountNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "could not find mount %s", id)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error %s", err.Error())
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// snapshot ... Snapshots are buffered so a failure still gets an error status
+func (mr *MountsRest) snapshot(w http.ResponseWriter, req *http.Request, id string) {
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		buf := &bytes.Buffer{}
+		if err = SnapshotMount(id, buf); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf.Bytes())
+			return
+		}
+	case http.MethodPut:
+		var bits []byte
+		if bits, err = ioutil.ReadAll(req.Body); err == nil && !json.Valid(bits) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error snapshot is not json")
+			return
+		}
+		if err == nil {
+			if err = RestoreMount(id, bytes.NewReader(bits)); err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch err {
+	case ErrMountNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "could not find mount %s", id)
+	case api.ErrNotSupported:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Error mount %s can't take snapshots", id)
+	case api.ErrReadOnly:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Error %s", err.Error())
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error %s", err.Error())
+	}
+}
+
+func (mr *MountsRest) mount(w http.ResponseWriter, req *http.Request) {
+	mc := MountConfig{}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error %s", err.Error())
+		return
+	}
+	if mc.MountPoint == "" || mc.Type == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error type and mount_point are required")
+		return
+	}
+	info, err := MountWithConfig(mc, mr.IOMap)
+	if err == ErrMountPointInUse || err == ErrQOSKeyInUse {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error %s", err.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error %s", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// Setup ... Associates the mounts and health endpoints with the default http server
+func Setup(iom *qos.IOMap) {
+	rest := NewMountsRest(iom)
+	http.HandleFunc("/mounts", rest.Default)
+	http.HandleFunc("/mounts/", rest.Default)
+	http.HandleFunc("/healthz", Healthz)
+	http.HandleFunc("/readyz", Readyz)
+}
@@ -0,0 +1,201 @@
+package shylock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lateefj/shylock/api"
+	"github.com/lateefj/shylock/buse"
+	"github.com/lateefj/shylock/qos"
+)
+
+func TestMountsRest(t *testing.T) {
+	rest := NewMountsRest(qos.NewIOMap())
+
+	w := httptest.NewRecorder()
+	rest.Default(w, httptest.NewRequest(http.MethodGet, "/mounts", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected list to be ok however got %d", w.Code)
+	}
+	infos := make([]MountInfo, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("Expected a json list however got %s", err)
+	}
+
+	bad := map[string]string{
+		"not json":       `{`,
+		"unknown field":  `{"type": "LOOPBACK_KV", "mount_point": "/mnt/kv", "extra": 1}`,
+		"no mount point": `{"type": "LOOPBACK_KV"}`,
+		"unknown type":   `{"type": "DOES_NOT_EXIST", "mount_point": "/mnt/kv"}`,
+		"qos no key":     `{"type": "LOOPBACK_KV", "mount_point": "/mnt/kv", "qos": [{"read_limit": 1}]}`,
+	}
+	for name, body := range bad {
+		w = httptest.NewRecorder()
+		rest.Default(w, httptest.NewRequest(http.MethodPost, "/mounts", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be a bad request however got %d", name, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	rest.Default(w, httptest.NewRequest(http.MethodDelete, "/mounts/does-not-exist", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown id to be not found however got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	rest.Default(w, httptest.NewRequest(http.MethodGet, "/mounts/does-not-exist", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown id to be not found however got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	rest.Default(w, httptest.NewRequest(http.MethodPut, "/mounts", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected put to not be allowed however got %d", w.Code)
+	}
+}
+
+func TestUnmountRemovesQOS(t *testing.T) {
+	iom := qos.NewIOMap()
+	iom.Add("/mnt/test/", 1*time.Second, 10, 10)
+	me, err := track("/mnt/test/", "LOOPBACK_KV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	me.qosKeys = []string{"/mnt/test/"}
+	me.ioMap = iom
+	if _, err := track("/mnt/test", "LOOPBACK_MQ"); err != ErrMountPointInUse {
+		t.Errorf("Expected mount point to be in use however got %v", err)
+	}
+	info, exists := LookupMount(me.info.ID)
+	if !exists || info.State != StateMounted || info.MountPoint != "/mnt/test" {
+		t.Fatalf("Expected mount to be tracked however got %+v", info)
+	}
+	if err := Unmount(me.info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := iom.Get("/mnt/test/"); exists {
+		t.Errorf("Expected qos rule to be removed with the mount")
+	}
+	if _, exists := LookupMount(me.info.ID); exists {
+		t.Errorf("Expected mount to be gone")
+	}
+	if err := Unmount(me.info.ID); err != ErrMountNotFound {
+		t.Errorf("Expected second unmount to be not found however got %v", err)
+	}
+}
+
+func TestMountsRestQOSKeyInUse(t *testing.T) {
+	iom := qos.NewIOMap()
+	iom.Add("/mnt/other/", time.Second, 10, 10)
+	defer iom.Remove("/mnt/other/")
+	rest := NewMountsRest(iom)
+	body := `{"type": "LOOPBACK_KV", "mount_point": "/mnt/kv", "qos": [
+		{"key": "/mnt/kv/tenant/", "read_limit": 1, "write_limit": 1},
+		{"key": "/mnt/other/", "read_limit": 1, "write_limit": 1}]}`
+	w := httptest.NewRecorder()
+	rest.Default(w, httptest.NewRequest(http.MethodPost, "/mounts", strings.NewReader(body)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected a limited key to conflict however got %d", w.Code)
+	}
+	c, _ := iom.Get("/mnt/other/")
+	if read, write := c.Limits(); read != 10 || write != 10 {
+		t.Errorf("Expected the other limits to be left alone however got %d %d", read, write)
+	}
+	if _, exists := iom.Get("/mnt/kv/tenant/"); exists {
+		t.Errorf("Expected the keys added before the conflict to be removed")
+	}
+	if len(Mounts()) != 0 {
+		t.Errorf("Expected nothing to be mounted however got %+v", Mounts())
+	}
+}
+
+// trackDevice ... Track a mount of the device without serving it through fuse
+func trackDevice(t *testing.T, mountPoint, fsType string, chain []api.WrapperConfig) (*mountEntry, api.SimpleDevice) {
+	device, err := api.MountWrappedSimpleDevice(fsType, mountPoint, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := buse.NewFuseSimpleDevice(mountPoint, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	me, err := track(mountPoint, fsType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	me.device = fd
+	return me, device
+}
+
+func TestMountsRestSnapshot(t *testing.T) {
+	me, device := trackDevice(t, "/mnt/snap", "LOOPBACK_KV", nil)
+	defer Unmount(me.info.ID)
+	ro, _ := trackDevice(t, "/mnt/snap-ro", "LOOPBACK_KV", []api.WrapperConfig{{Type: api.WrapperReadOnly}})
+	defer Unmount(ro.info.ID)
+	mq, _ := trackDevice(t, "/mnt/snap-mq", "LOOPBACK_MQ", nil)
+	defer Unmount(mq.info.ID)
+	srv := httptest.NewServer(http.HandlerFunc(NewMountsRest(qos.NewIOMap()).Default))
+	defer srv.Close()
+	call := func(method, id string, body []byte) (int, []byte) {
+		req, _ := http.NewRequest(method, srv.URL+"/mounts/"+id+"/snapshot", bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		bits, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, bits
+	}
+	write := func(p, body string) {
+		f, _ := device.Open(p)
+		defer f.Close()
+		if err := f.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("/mnt/snap/a", "before")
+	code, snap := call(http.MethodGet, me.info.ID, nil)
+	if code != http.StatusOK || !bytes.Contains(snap, []byte("/mnt/snap/a")) {
+		t.Fatalf("Expected a snapshot with the file however got %d %s", code, snap)
+	}
+	write("/mnt/snap/a", "after")
+	write("/mnt/snap/b", "new")
+	if code, bits := call(http.MethodPut, me.info.ID, snap); code != http.StatusNoContent {
+		t.Fatalf("Expected restore to work however got %d %s", code, bits)
+	}
+	f, _ := device.Open("/mnt/snap/a")
+	body, _ := f.Read()
+	f.Close()
+	if string(body) != "before" {
+		t.Errorf("Expected the restored file to be before however got %s", body)
+	}
+	if names, _ := device.List("/mnt/snap"); len(names) != 1 {
+		t.Errorf("Expected the file made after the snapshot to be gone however got %v", names)
+	}
+
+	if code, _ := call(http.MethodPut, me.info.ID, []byte("{")); code != http.StatusBadRequest {
+		t.Errorf("Expected a broken snapshot to be a bad request however got %d", code)
+	}
+	if code, _ := call(http.MethodGet, ro.info.ID, nil); code != http.StatusOK {
+		t.Errorf("Expected a read only mount to snapshot however got %d", code)
+	}
+	if code, _ := call(http.MethodPut, ro.info.ID, snap); code != http.StatusForbidden {
+		t.Errorf("Expected a read only mount to refuse a restore however got %d", code)
+	}
+	if code, _ := call(http.MethodGet, mq.info.ID, nil); code != http.StatusNotImplemented {
+		t.Errorf("Expected a device without snapshots to not implement them however got %d", code)
+	}
+	if code, _ := call(http.MethodGet, "does-not-exist", nil); code != http.StatusNotFound {
+		t.Errorf("Expected unknown id to be not found however got %d", code)
+	}
+	if code, _ := call(http.MethodPost, me.info.ID, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected post to not be allowed however got %d", code)
+	}
+}